@@ -1,52 +1,168 @@
 package main
 
 import (
+	"context"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hdhauk/TTK4145-Lift/driver"
+	"github.com/hdhauk/TTK4145-Lift/globalstate"
+	"github.com/hdhauk/TTK4145-Lift/statetools"
 )
 
+// hallButtons mirrors the hall buttons of the global state, and is kept up to
+// date by syncBtnLEDs. Pickup detection use it rather than copying the whole
+// global state on every status update from the driver.
+var hallButtons = &buttonMirror{state: *globalstate.NewState(0)}
+
+type buttonMirror struct {
+	mu    sync.Mutex
+	state globalstate.State
+}
+
+// reset replaces the buttons with those of the state. The maps of the state
+// are copied, as the state of an event is shared with other subscribers.
+func (m *buttonMirror) reset(s globalstate.State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.HallUpButtons = copyButtons(s.HallUpButtons)
+	m.state.HallDownButtons = copyButtons(s.HallDownButtons)
+}
+
+func copyButtons(buttons map[string]globalstate.Status) map[string]globalstate.Status {
+	c := make(map[string]globalstate.Status, len(buttons))
+	for floor, status := range buttons {
+		c[floor] = status
+	}
+	return c
+}
+
+func (m *buttonMirror) set(floor uint, dir string, status globalstate.Status) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dir == "up" {
+		m.state.HallUpButtons[strconv.Itoa(int(floor))] = status
+	} else {
+		m.state.HallDownButtons[strconv.Itoa(int(floor))] = status
+	}
+}
+
+func (m *buttonMirror) copy() globalstate.State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.DeepCopy()
+}
+
+// version returns the version of the hall button.
+func (m *buttonMirror) version(floor int, dir string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dir == "up" {
+		return m.state.HallUpButtons[strconv.Itoa(floor)].Version
+	}
+	return m.state.HallDownButtons[strconv.Itoa(floor)].Version
+}
+
+// orderVersions holds the version of every hall button the lift is on its way
+// to serve, as it was when the lift took the order on. The order is reported
+// done with it, such that a late report can't clear the button once it is
+// given to another lift, or pressed again.
+var orderVersions = &versionTable{versions: make(map[driver.Btn]uint64)}
+
+type versionTable struct {
+	mu       sync.Mutex
+	versions map[driver.Btn]uint64
+}
+
+func (t *versionTable) set(b driver.Btn, version uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.versions[b] = version
+}
+
+// take returns the version of the order, and forgets it.
+func (t *versionTable) take(b driver.Btn) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v := t.versions[b]
+	delete(t.versions, b)
+	return v
+}
+
+func (m *buttonMirror) shouldStopAndPickup(floor int, dir string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return statetools.ShouldStopAndPickup(m.state, floor, dir)
+}
+
+// syncBtnLEDs keeps the hall button LEDs in line with the global state, as it
+// changes. The LEDs are only touched while there are consensus.
 func syncBtnLEDs() {
 	consensus := false
 
 	for {
-		// For incoming changes in the consensus status.
-		select {
-		case b := <-haveConsensusBtnSyncCh:
-			consensus = b
-		case <-time.After(1 * time.Microsecond):
-
-		}
-		if !consensus {
-			continue
-		}
-		// Only do sync every half second.
-		time.Sleep(500 * time.Millisecond)
-
-		state, err := stateGlobal.GetState()
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := stateGlobal.Watch(ctx)
 		if err != nil {
+			// Not connected to any cluster yet.
+			cancel()
+			select {
+			case consensus = <-haveConsensusBtnSyncCh:
+			case <-time.After(1 * time.Second):
+			}
 			continue
 		}
 
-		// Check all hall buttons.
-		for floorStr, status := range state.HallUpButtons {
-			f, _ := strconv.Atoi(floorStr)
-			if status.LastStatus == "done" {
-				driver.BtnLEDClear(driver.Btn{Floor: f, Type: driver.HallUp})
-			} else {
-				driver.BtnLEDSet(driver.Btn{Floor: f, Type: driver.HallUp})
-			}
-
-		}
-		for floorStr, status := range state.HallDownButtons {
-			f, _ := strconv.Atoi(floorStr)
-			if status.LastStatus == "done" {
-				driver.BtnLEDClear(driver.Btn{Floor: f, Type: driver.HallDown})
-			} else {
-				driver.BtnLEDSet(driver.Btn{Floor: f, Type: driver.HallDown})
+		for events != nil {
+			select {
+			// For incoming changes in the consensus status.
+			case consensus = <-haveConsensusBtnSyncCh:
+				if consensus {
+					setHallLEDs(hallButtons.copy())
+				}
+			case e, ok := <-events:
+				if !ok {
+					events = nil
+					break
+				}
+				switch e.Type {
+				case globalstate.EventReset:
+					hallButtons.reset(e.State)
+					if consensus {
+						setHallLEDs(e.State)
+					}
+				case globalstate.EventButton:
+					hallButtons.set(e.Floor, e.Dir, e.Button)
+					if consensus {
+						setHallLED(int(e.Floor), e.Dir, e.Button)
+					}
+				}
 			}
 		}
+		cancel()
+	}
+}
 
+func setHallLEDs(s globalstate.State) {
+	for floorStr, status := range s.HallUpButtons {
+		f, _ := strconv.Atoi(floorStr)
+		setHallLED(f, "up", status)
+	}
+	for floorStr, status := range s.HallDownButtons {
+		f, _ := strconv.Atoi(floorStr)
+		setHallLED(f, "down", status)
+	}
+}
+
+func setHallLED(f int, dir string, status globalstate.Status) {
+	b := driver.Btn{Floor: f, Type: driver.HallUp}
+	if dir == "down" {
+		b.Type = driver.HallDown
+	}
+	if status.LastStatus == globalstate.BtnStateDone {
+		driver.BtnLEDClear(b)
+	} else {
+		driver.BtnLEDSet(b)
 	}
 }
@@ -1,22 +1,23 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/hdhauk/TTK4145-Lift/driver"
 	"github.com/hdhauk/TTK4145-Lift/globalstate"
 	"github.com/hdhauk/TTK4145-Lift/peerdiscovery"
-	"github.com/hdhauk/TTK4145-Lift/statetools"
 )
 
 // Globalstate callbacks
 // =============================================================================
-func onIncomingCommand(f int, dir string) {
+func onIncomingCommand(f int, dir string, version uint64) {
 	switch dir {
 	case "up":
+		orderVersions.set(driver.Btn{Floor: f, Type: driver.HallUp}, version)
 		goToCh <- driver.Btn{Floor: f, Type: driver.HallUp}
 	case "down":
+		orderVersions.set(driver.Btn{Floor: f, Type: driver.HallDown}, version)
 		goToCh <- driver.Btn{Floor: f, Type: driver.HallDown}
+	case globalstate.CallTypeCab:
+		driver.PressCabButton(f)
 	}
 }
 
@@ -88,11 +89,16 @@ func onNewStatus(f int, dir string, dstFloor int, dstDir string) {
 	if dstFloor < 0 {
 		dstFloor = dstFloor * -1
 	}
+	doorOpen, cabCalls := driver.Cabin()
 	lsu := globalstate.LiftStatusUpdate{
 		CurrentFloor: uint(f),
 		CurrentDir:   dir,
 		DstFloor:     uint(dstFloor),
 		DstBtnDir:    dstDir,
+		DoorOpen:     doorOpen,
+	}
+	for _, c := range cabCalls {
+		lsu.CabCalls = append(lsu.CabCalls, uint(c))
 	}
 	if err := stateGlobal.UpdateLiftStatus(lsu); err != nil {
 		mainlogger.Println("[WARN] Failed to send liftupdate.")
@@ -100,8 +106,12 @@ func onNewStatus(f int, dir string, dstFloor int, dstDir string) {
 	}
 
 	// Check if there are anyone to pick up.
-	state, _ := stateGlobal.GetState()
-	if statetools.ShouldStopAndPickup(state, f, dir) {
+	if hallButtons.shouldStopAndPickup(f, dir) {
+		b := driver.Btn{Floor: f, Type: driver.HallUp}
+		if dir == "down" {
+			b.Type = driver.HallDown
+		}
+		orderVersions.set(b, hallButtons.version(f, dir))
 		driver.StopForPickup(f, dir)
 		mainlogger.Printf("[INFO] Pickup was available in Floor=%d Dir=%s. Stopping!\n", f, dir)
 	}
@@ -110,9 +120,10 @@ func onNewStatus(f int, dir string, dstFloor int, dstDir string) {
 
 func onDstReached(b driver.Btn, pickup bool) {
 	bsu := globalstate.ButtonStatusUpdate{
-		Floor:  uint(b.Floor),
-		Dir:    b.Type.String(),
-		Status: globalstate.BtnStateDone,
+		Floor:   uint(b.Floor),
+		Dir:     b.Type.String(),
+		Status:  globalstate.BtnStateDone,
+		Version: orderVersions.take(b),
 	}
 	if err := stateGlobal.UpdateButtonStatus(bsu); err != nil {
 		mainlogger.Printf("[WARN] Unable to send order complete: %s\n", err.Error())
@@ -131,9 +142,9 @@ func onDstReached(b driver.Btn, pickup bool) {
 // Peer discovery callbacks
 // =============================================================================
 func onNewPeer(p peerdiscovery.Peer) {
-
+	mainlogger.Printf("[INFO] Discovered peer %s at %s:%s\n", p.Nick, p.IP, p.RaftPort)
 }
 
 func onLostPeer(p peerdiscovery.Peer) {
-	fmt.Printf("Lost peer: %+v\n", p)
+	mainlogger.Printf("[WARN] Lost peer %s at %s:%s. Last seen %s\n", p.Nick, p.IP, p.RaftPort, p.LastSeen.Format("15:04:05.000"))
 }
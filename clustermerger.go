@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// staticPeers hold the communication addresses provided with -peers and -peers-file.
+var staticPeers []string
+
+// clusterMerger continuously checks that every discovered and statically
+// configured peer is part of the same raft as this node. Nodes started
+// simultaneously will often bootstrap separate clusters, which are merged here
+// as soon as they discover each other.
+func clusterMerger() {
+	for {
+		time.Sleep(2 * time.Second)
+		for _, p := range discoveredPeers.Peers() {
+			// Unreachable peers yield an error every round, and are of no interest.
+			stateGlobal.Reconcile(p.CommAddr)
+		}
+		for _, addr := range staticPeers {
+			stateGlobal.Reconcile(addr)
+		}
+	}
+}
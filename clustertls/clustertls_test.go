@@ -0,0 +1,71 @@
+package clustertls
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func nodeConfig(t *testing.T, caCert, caKey []byte, name string) *tls.Config {
+	certPEM, keyPEM, err := NewNodeCert(caCert, caKey, name, []string{"127.0.0.1", "localhost"}, time.Hour)
+	if err != nil {
+		t.Fatalf("NewNodeCert() = %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair() = %v", err)
+	}
+	config, err := NewConfig(caCert, cert)
+	if err != nil {
+		t.Fatalf("NewConfig() = %v", err)
+	}
+	return config
+}
+
+// handshake performs a TLS handshake between a client and a server, and
+// returns the error seen by the server.
+func handshake(client, server *tls.Config) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		conf := client.Clone()
+		conf.ServerName = "127.0.0.1"
+		tls.Client(c, conf).Handshake()
+		c.Close()
+	}()
+	return tls.Server(s, server).Handshake()
+}
+
+func TestMutualTLS(t *testing.T) {
+	caCert, caKey, err := NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatalf("NewCA() = %v", err)
+	}
+	node1 := nodeConfig(t, caCert, caKey, "lift1")
+	node2 := nodeConfig(t, caCert, caKey, "lift2")
+	if err := handshake(node1, node2); err != nil {
+		t.Errorf("handshake between nodes of the same cluster failed: %v", err)
+	}
+
+	otherCert, otherKey, _ := NewCA("other CA", time.Hour)
+	stranger := nodeConfig(t, otherCert, otherKey, "lift3")
+	if err := handshake(stranger, node1); err == nil {
+		t.Errorf("accepted client with certificate from another CA")
+	}
+
+	noCert := node1.Clone()
+	noCert.Certificates = nil
+	if err := handshake(noCert, node1); err == nil {
+		t.Errorf("accepted client without certificate")
+	}
+}
+
+func TestNodeCertRequireCA(t *testing.T) {
+	caCert, caKey, _ := NewCA("test CA", time.Hour)
+	certPEM, keyPEM, _ := NewNodeCert(caCert, caKey, "lift1", []string{"127.0.0.1"}, time.Hour)
+	if _, _, err := NewNodeCert(certPEM, keyPEM, "lift2", []string{"127.0.0.1"}, time.Hour); err == nil {
+		t.Errorf("NewNodeCert() signed by a node certificate")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Command liftcert creates the certificates needed to run a cluster with mutual
+TLS. It works completely offline. First create a certificate authority for the
+cluster:
+
+	liftcert -ca
+
+which writes ca.crt and ca.key. Then create a certificate for each node,
+listing every IP-address the node may use:
+
+	liftcert -node lift1 -hosts 10.100.23.151,127.0.0.1
+
+which writes lift1.crt and lift1.key. Copy ca.crt along with the certificate
+and key of the node to each node, and keep ca.key somewhere safe.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/clustertls"
+)
+
+func main() {
+	var createCA bool
+	var node, hosts, dir string
+	var days int
+	flag.BoolVar(&createCA, "ca", false, "Create a new certificate authority for the cluster")
+	flag.StringVar(&node, "node", "", "Create a certificate for the node with this name")
+	flag.StringVar(&hosts, "hosts", "", "Comma separated IP-addresses and host names of the node")
+	flag.StringVar(&dir, "dir", ".", "Directory to read the CA from, and write certificates to")
+	flag.IntVar(&days, "days", 365, "Number of days the certificate is valid")
+	flag.Parse()
+
+	validFor := time.Duration(days) * 24 * time.Hour
+	caCrt, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	switch {
+	case createCA:
+		if _, err := os.Stat(caKey); err == nil {
+			fail(fmt.Errorf("%s already exists. Remove it to create a new CA", caKey))
+		}
+		cert, key, err := clustertls.NewCA("TTK4145-Lift cluster CA", validFor)
+		if err != nil {
+			fail(err)
+		}
+		write(caCrt, caKey, cert, key)
+
+	case node != "":
+		if hosts == "" {
+			fail(fmt.Errorf("provide the addresses of the node with -hosts"))
+		}
+		caCert, err := ioutil.ReadFile(caCrt)
+		if err != nil {
+			fail(err)
+		}
+		caKeyPEM, err := ioutil.ReadFile(caKey)
+		if err != nil {
+			fail(err)
+		}
+		cert, key, err := clustertls.NewNodeCert(caCert, caKeyPEM, node, strings.Split(hosts, ","), validFor)
+		if err != nil {
+			fail(err)
+		}
+		write(filepath.Join(dir, node+".crt"), filepath.Join(dir, node+".key"), cert, key)
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func write(certFile, keyFile string, cert, key []byte) {
+	if err := ioutil.WriteFile(certFile, cert, 0644); err != nil {
+		fail(err)
+	}
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Wrote %s and %s\n", certFile, keyFile)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "liftcert: %s\n", err.Error())
+	os.Exit(1)
+}
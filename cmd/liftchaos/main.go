@@ -0,0 +1,800 @@
+/*
+Command liftchaos tests a local cluster against the failures of the TTK4145
+acceptance test. It starts a cluster of controllers on this machine, each with
+a simulated lift of its own, and presses hall buttons at random while it:
+
+  - crashes controllers, and restarts them
+  - cuts controllers off from the others, and heals the network
+  - disconnects lifts from their controllers, and reconnects them
+
+Build the controller first, and point liftchaos to it:
+
+	go build . && go build ./cmd/liftchaos
+	./liftchaos -lift ./TTK4145-Lift -nodes 3 -duration 5m
+
+Once the time is up the network is healed, and all controllers restarted and
+reconnected. When every hall call accepted is served, or the -settle timeout
+passes, it checks that:
+
+  - no hall call is lost. Every call whose lamp lit up is served.
+  - no hall call is served twice. No more than one lift opens its door for it.
+
+and exits with status 1 if either is broken. At most -max-down controllers are
+disrupted at any time. The network is cut and degraded through the fault
+injection of the controllers, so no root privileges are needed. The lifts
+speak the same protocol as the simulator in driver/simulators, with which the
+runner sees every lamp and door. Controller logs and data are kept in -dir.
+
+The door openings of the whole run are matched to the hall calls through the
+history of the cluster, /v1/history, which tells which lifts every call was
+assigned to, and when it was done. A door opening serves the calls at the
+floor assigned to the lift and not yet done. An opening serving none of them
+is put down to the call at the floor last assigned to the lift, which was
+taken from it or done already, and so is served twice.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/globalstate"
+)
+
+// Node states
+const (
+	nodeUp           = "up"
+	nodeCrashed      = "crashed"
+	nodeDisconnected = "disconnected"
+)
+
+// settleTime is how long the traffic leaves a floor alone once a door opened
+// there, and how long lifts still on their way are waited for once every hall
+// call is served.
+const settleTime = 5 * time.Second
+
+// node is a controller of the cluster along with its lift.
+type node struct {
+	id       int
+	raftAddr string
+	commAddr string
+	simPort  int
+	dataDir  string
+	sim      *simLift
+	cmd      *exec.Cmd
+	exited   chan struct{} // Closed once the controller has exited
+	state    string
+}
+
+// press is a hall button pressed by the runner.
+type press struct {
+	floor    int
+	btn      int
+	lift     int // Lift the button was pressed on
+	pressed  time.Time
+	accepted bool      // The lamp lit up
+	opened   time.Time // First door opening at the floor since, if any
+}
+
+func (p *press) String() string {
+	return callName(p.floor, p.dir())
+}
+
+// dir returns the direction of the call, as named by the API.
+func (p *press) dir() string {
+	if p.btn == hallDown {
+		return "down"
+	}
+	return "up"
+}
+
+// doorOpening is a lift opening its door at a floor.
+type doorOpening struct {
+	lift  int
+	floor int
+	at    time.Time
+}
+
+func callName(floor int, dir string) string {
+	return fmt.Sprintf("hall call %s at floor %d", dir, floor)
+}
+
+type runner struct {
+	lift     string
+	floors   int
+	dir      string
+	cluster  string
+	drop     float64
+	latency  time.Duration
+	maxDown  int
+	interval time.Duration
+	rate     float64
+	start    time.Time
+	rand     *rand.Rand
+
+	mu       sync.Mutex
+	nodes    []*node
+	presses  []*press
+	doors    []doorOpening
+	isolated int // Node cut off from the others, or -1
+	actions  map[string]int
+	history  []globalstate.HallCallRecordV1 // History of the hall calls, as the cluster saw it at the end
+}
+
+func main() {
+	r := &runner{isolated: -1, actions: make(map[string]int)}
+	var n, basePort int
+	var duration, settle, travel time.Duration
+	var seed int64
+	flag.StringVar(&r.lift, "lift", "./TTK4145-Lift", "Controller binary")
+	flag.IntVar(&n, "nodes", 3, "Number of controllers")
+	flag.IntVar(&r.floors, "floors", 4, "Number of floors")
+	flag.IntVar(&basePort, "port", 54000, "First port used. The lifts, raft and communication services use the ports from here on")
+	flag.StringVar(&r.dir, "dir", "", "Directory for controller logs and data. Default is a new temporary directory")
+	flag.DurationVar(&duration, "duration", 2*time.Minute, "How long to cause chaos")
+	flag.DurationVar(&settle, "settle", time.Minute, "How long to wait for outstanding hall calls once the chaos is over")
+	flag.DurationVar(&r.interval, "interval", 10*time.Second, "Average time between failures and recoveries")
+	flag.Float64Var(&r.rate, "rate", 0.5, "Hall calls pressed per second")
+	flag.IntVar(&r.maxDown, "max-down", 1, "Most controllers disrupted at the same time")
+	flag.Float64Var(&r.drop, "drop", 0, "Share of packets dropped between the controllers throughout, from 0 to 1")
+	flag.DurationVar(&r.latency, "latency", 0, "Latency between the controllers throughout")
+	flag.DurationVar(&travel, "travel", 2*time.Second, "Time for a lift to travel between two floors")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "Seed of the random failures and hall calls")
+	flag.Parse()
+	if n < 2 || r.floors < 2 {
+		fail(fmt.Errorf("at least 2 controllers and 2 floors are needed"))
+	}
+	if _, err := os.Stat(r.lift); err != nil {
+		fail(fmt.Errorf("controller binary not found. Build it with go build, or point to it with -lift: %v", err))
+	}
+	if r.dir == "" {
+		var err error
+		if r.dir, err = ioutil.TempDir("", "liftchaos"); err != nil {
+			fail(err)
+		}
+	} else if err := os.MkdirAll(r.dir, 0755); err != nil {
+		fail(err)
+	}
+	r.cluster = fmt.Sprintf("chaos-%d", os.Getpid())
+	r.rand = rand.New(rand.NewSource(seed))
+	fmt.Printf("Seed %d. Logs and data in %s\n", seed, r.dir)
+
+	for i := 0; i < n; i++ {
+		nd := &node{
+			id:       i,
+			raftAddr: fmt.Sprintf("127.0.0.1:%d", basePort+100+i),
+			commAddr: fmt.Sprintf("127.0.0.1:%d", basePort+200+i),
+			simPort:  basePort + i,
+			dataDir:  filepath.Join(r.dir, fmt.Sprintf("node%d", i)),
+		}
+		sim, err := newSimLift(i, r.floors, nd.simPort, travel, r.onLamp, r.onDoor)
+		if err != nil {
+			fail(err)
+		}
+		nd.sim = sim
+		r.nodes = append(r.nodes, nd)
+	}
+
+	// Stop the controllers on Ctrl+C, such that none are left behind.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		r.stopAll()
+		os.Exit(2)
+	}()
+
+	// The first controller bootstraps the cluster, and the others join it.
+	r.start = time.Now()
+	for i := range r.nodes {
+		if err := r.startNode(i); err != nil {
+			r.stopAll()
+			fail(err)
+		}
+	}
+	if err := r.waitForMembers(n, 30*time.Second); err != nil {
+		r.stopAll()
+		fail(err)
+	}
+	r.applyFaults()
+	r.log("Cluster of %d controllers is up", n)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); r.traffic(done) }()
+	go func() { defer wg.Done(); r.chaos(done) }()
+	time.Sleep(duration)
+	close(done)
+	wg.Wait()
+
+	r.recover()
+	r.log("Chaos is over. Waiting for outstanding hall calls")
+	for deadline := time.Now().Add(settle); time.Now().Before(deadline) && r.outstanding() > 0; {
+		time.Sleep(500 * time.Millisecond)
+	}
+	time.Sleep(settleTime)
+	err := r.fetchHistory()
+	r.stopAll()
+	if err != nil {
+		fail(fmt.Errorf("unable to get the history of the hall calls from the cluster: %v", err))
+	}
+	if !r.report() {
+		os.Exit(1)
+	}
+}
+
+// Controllers
+// =============================================================================
+
+// startNode starts the controller, and waits for it to be part of a cluster
+// with a leader. Controllers join the others through their communication
+// services, and keep their data between restarts.
+func (r *runner) startNode(i int) error {
+	nd := r.nodes[i]
+	var peers []string
+	for _, other := range r.nodes {
+		if other != nd {
+			peers = append(peers, other.commAddr)
+		}
+	}
+	args := []string{
+		"-sim", strconv.Itoa(nd.simPort),
+		"-nick", fmt.Sprintf("chaos%d", i),
+		"-cluster", r.cluster,
+		"-ip", "127.0.0.1",
+		"-raft", strings.Split(nd.raftAddr, ":")[1],
+		"-comm", strings.Split(nd.commAddr, ":")[1],
+		"-floors", strconv.Itoa(r.floors),
+		"-data", nd.dataDir,
+		"-faults",
+	}
+	r.mu.Lock()
+	restart := nd.cmd != nil
+	r.mu.Unlock()
+	if i > 0 || restart {
+		args = append(args, "-peers", strings.Join(peers, ","))
+	}
+	logFile, err := os.OpenFile(filepath.Join(r.dir, fmt.Sprintf("node%d.log", i)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(r.lift, args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("unable to start controller %d: %v", i, err)
+	}
+	exited := make(chan struct{})
+	r.mu.Lock()
+	nd.cmd = cmd
+	nd.exited = exited
+	nd.state = nodeUp
+	r.mu.Unlock()
+
+	// Controllers exiting by themselves are taken as crashed.
+	go func() {
+		cmd.Wait()
+		logFile.Close()
+		close(exited)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if nd.cmd == cmd && nd.state != nodeCrashed {
+			nd.state = nodeCrashed
+			r.logLocked("Controller %d exited by itself", i)
+		}
+	}()
+
+	client := globalstate.NewAPIClient(nd.commAddr, "", nil)
+	client.Timeout = time.Second
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+		var m struct {
+			Leader string `json:"leader"`
+		}
+		if err := client.Get("/v1/membership", &m); err == nil && m.Leader != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("controller %d found no leader within 30s. See its log in %s", i, r.dir)
+}
+
+// killNode crashes the controller, and waits for it to exit, such that its
+// ports are free.
+func (r *runner) killNode(i int) {
+	r.mu.Lock()
+	nd := r.nodes[i]
+	nd.state = nodeCrashed
+	cmd, exited := nd.cmd, nd.exited
+	r.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	cmd.Process.Kill()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// stopAll crashes all controllers.
+func (r *runner) stopAll() {
+	for i := range r.nodes {
+		r.killNode(i)
+	}
+}
+
+// waitForMembers waits for the raft to have n members.
+func (r *runner) waitForMembers(n int, timeout time.Duration) error {
+	client := globalstate.NewAPIClient(r.nodes[0].commAddr, "", nil)
+	client.Timeout = time.Second
+	var m struct {
+		Peers []string `json:"peers"`
+	}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+		if err := client.Get("/v1/membership", &m); err == nil && len(m.Peers) == n {
+			return nil
+		}
+	}
+	return fmt.Errorf("only %d of %d controllers joined the raft within %v", len(m.Peers), n, timeout)
+}
+
+// applyFaults sets the faults of every running controller: the background
+// packet loss and latency, and the partition if a controller is cut off.
+func (r *runner) applyFaults() {
+	r.mu.Lock()
+	faults := map[string]interface{}{
+		"dropRate":  r.drop,
+		"latencyMs": int64(r.latency / time.Millisecond),
+	}
+	if r.isolated >= 0 {
+		var rest []string
+		for _, nd := range r.nodes {
+			if nd.id != r.isolated {
+				rest = append(rest, nd.raftAddr)
+			}
+		}
+		faults["partitions"] = map[string][]string{
+			"isolated": {r.nodes[r.isolated].raftAddr},
+			"rest":     rest,
+		}
+	}
+	var comms []string
+	for _, nd := range r.nodes {
+		if nd.state != nodeCrashed {
+			comms = append(comms, nd.commAddr)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, comm := range comms {
+		client := globalstate.NewAPIClient(comm, "", nil)
+		client.Timeout = time.Second
+		if err := client.Do("PUT", "/v1/faults", faults, nil); err != nil {
+			r.log("Unable to set faults of %s: %v", comm, err)
+		}
+	}
+}
+
+// fetchHistory records the history of the hall calls, as the cluster sees it,
+// which the door openings are matched against.
+func (r *runner) fetchHistory() error {
+	client := globalstate.NewAPIClient(r.nodes[0].commAddr, "", nil)
+	client.Timeout = 5 * time.Second
+	var history []globalstate.HallCallRecordV1
+	if err := client.Get("/v1/history", &history); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.history = history
+	r.mu.Unlock()
+	return nil
+}
+
+// Chaos
+// =============================================================================
+
+// action is a failure or a recovery of a node.
+type action struct {
+	name string
+	node int
+}
+
+// chaos causes failures, and recovers from them, at random until done.
+func (r *runner) chaos(done <-chan struct{}) {
+	for {
+		wait := time.Duration(float64(r.interval) * (0.5 + r.rand.Float64()))
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		actions := r.possibleActions()
+		if len(actions) > 0 {
+			r.do(actions[r.rand.Intn(len(actions))])
+		}
+	}
+}
+
+// possibleActions returns the failures that keep the number of disrupted
+// controllers within the limit, and all possible recoveries.
+func (r *runner) possibleActions() []action {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	disrupted := 0
+	for _, nd := range r.nodes {
+		if nd.state != nodeUp || nd.id == r.isolated {
+			disrupted++
+		}
+	}
+	var actions []action
+	for _, nd := range r.nodes {
+		switch {
+		case nd.state == nodeCrashed:
+			actions = append(actions, action{"restart", nd.id})
+		case nd.state == nodeDisconnected:
+			actions = append(actions, action{"reconnect", nd.id})
+		case nd.id == r.isolated:
+			actions = append(actions, action{"heal", nd.id})
+		case disrupted < r.maxDown:
+			actions = append(actions, action{"crash", nd.id}, action{"disconnect", nd.id})
+			if r.isolated < 0 {
+				actions = append(actions, action{"isolate", nd.id})
+			}
+		}
+	}
+	return actions
+}
+
+func (r *runner) do(a action) {
+	r.mu.Lock()
+	r.actions[a.name]++
+	r.mu.Unlock()
+	nd := r.nodes[a.node]
+	switch a.name {
+	case "crash":
+		r.log("Crashing controller %d", a.node)
+		r.killNode(a.node)
+	case "restart":
+		r.log("Restarting controller %d", a.node)
+		r.restartNode(a.node)
+	case "disconnect":
+		r.log("Disconnecting lift %d from its controller", a.node)
+		nd.sim.disconnect()
+		r.mu.Lock()
+		nd.state = nodeDisconnected
+		r.mu.Unlock()
+	case "reconnect":
+		r.log("Reconnecting lift %d, and restarting its controller", a.node)
+		r.killNode(a.node)
+		nd.sim.reconnect()
+		r.restartNode(a.node)
+	case "isolate":
+		r.log("Cutting controller %d off from the others", a.node)
+		r.mu.Lock()
+		r.isolated = a.node
+		r.mu.Unlock()
+		r.applyFaults()
+	case "heal":
+		r.log("Healing the network")
+		r.mu.Lock()
+		r.isolated = -1
+		r.mu.Unlock()
+		r.applyFaults()
+	}
+}
+
+// restartNode starts the crashed controller again, with the faults of the
+// others.
+func (r *runner) restartNode(i int) {
+	if err := r.startNode(i); err != nil {
+		r.log("%v", err)
+	}
+	r.applyFaults()
+}
+
+// recover heals the network, and brings every controller and lift back.
+func (r *runner) recover() {
+	r.mu.Lock()
+	r.isolated = -1
+	r.drop, r.latency = 0, 0
+	r.mu.Unlock()
+	r.applyFaults()
+	for i, nd := range r.nodes {
+		switch nd.state {
+		case nodeCrashed:
+			r.do(action{"restart", i})
+		case nodeDisconnected:
+			r.do(action{"reconnect", i})
+		}
+	}
+}
+
+// Traffic
+// =============================================================================
+
+// traffic presses hall buttons at random on lifts with a running controller
+// until done. Only one hall button is pressed per floor at the time.
+func (r *runner) traffic(done <-chan struct{}) {
+	for {
+		wait := time.Duration(float64(time.Second) / r.rate * (0.5 + r.rand.Float64()))
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+
+		r.mu.Lock()
+		var floors, lifts []int
+		for f := 0; f < r.floors; f++ {
+			if p := r.latestLocked(f); p == nil || r.settledLocked(p) {
+				floors = append(floors, f)
+			}
+		}
+		for _, nd := range r.nodes {
+			if nd.state == nodeUp && nd.sim.connected() {
+				lifts = append(lifts, nd.id)
+			}
+		}
+		if len(floors) == 0 || len(lifts) == 0 {
+			r.mu.Unlock()
+			continue
+		}
+		p := &press{floor: floors[r.rand.Intn(len(floors))], lift: lifts[r.rand.Intn(len(lifts))], pressed: time.Now()}
+		switch {
+		case p.floor == 0:
+			p.btn = hallUp
+		case p.floor == r.floors-1:
+			p.btn = hallDown
+		default:
+			p.btn = r.rand.Intn(2)
+		}
+		r.presses = append(r.presses, p)
+		r.mu.Unlock()
+		r.nodes[p.lift].sim.press(p.floor, p.btn)
+	}
+}
+
+// latestLocked returns the hall call last pressed at the floor, if any.
+func (r *runner) latestLocked(floor int) *press {
+	for i := len(r.presses) - 1; i >= 0; i-- {
+		if r.presses[i].floor == floor {
+			return r.presses[i]
+		}
+	}
+	return nil
+}
+
+// settledLocked returns true once a door opened at the floor of the hall call
+// a while ago, or the call was never accepted. Which lifts served the call is
+// only known once matched against the history of the cluster.
+func (r *runner) settledLocked(p *press) bool {
+	if !p.opened.IsZero() {
+		return time.Since(p.opened) > settleTime
+	}
+	return !p.accepted && time.Since(p.pressed) > settleTime
+}
+
+// onLamp accepts the hall call last pressed at the floor once its lamp lights
+// up on any lift.
+func (r *runner) onLamp(lift, floor, btn int, on bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p := r.latestLocked(floor); on && p != nil && p.btn == btn {
+		p.accepted = true
+	}
+}
+
+// onDoor records the door opening, to be matched against the history of the
+// cluster at the end. Until then the hall calls pressed at the floor are taken
+// as served by it.
+func (r *runner) onDoor(lift, floor int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.doors = append(r.doors, doorOpening{lift: lift, floor: floor, at: now})
+	for _, p := range r.presses {
+		if p.floor == floor && p.opened.IsZero() {
+			p.opened = now
+		}
+	}
+}
+
+// outstanding returns the number of accepted hall calls with no door opened
+// at their floor since.
+func (r *runner) outstanding() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, p := range r.presses {
+		if p.accepted && p.opened.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// Matching
+// =============================================================================
+
+// callOfLocked returns the index of the call in the history that the press is
+// part of, or -1 if the cluster never knew of it. That is the call already
+// outstanding for the button when pressed, or else the first call of the
+// button pressed after it, and before the next press of the button.
+func (r *runner) callOfLocked(i int) int {
+	p := r.presses[i]
+	var next time.Time
+	for _, q := range r.presses[i+1:] {
+		if q.floor == p.floor && q.btn == p.btn {
+			next = q.pressed
+			break
+		}
+	}
+	call := -1
+	for j, c := range r.history {
+		if int(c.Floor) != p.floor || c.Direction != p.dir() {
+			continue
+		}
+		if c.Pressed.Before(p.pressed) {
+			if c.Done == nil || c.Done.After(p.pressed) {
+				call = j
+			}
+			continue
+		}
+		if call < 0 && (next.IsZero() || c.Pressed.Before(next)) {
+			call = j
+		}
+		break
+	}
+	return call
+}
+
+// servedByLocked returns the lifts that opened their door for each call in
+// the history. A door opening serves the calls at the floor assigned to the
+// lift at the time, and not yet done. An opening serving none of them is put
+// down to the call at the floor last assigned to the lift before it.
+func (r *runner) servedByLocked() [][]int {
+	servedBy := make([][]int, len(r.history))
+	for _, d := range r.doors {
+		id := r.nodes[d.lift].raftAddr
+		var served []int
+		last, lastAt := -1, time.Time{}
+		for j, c := range r.history {
+			if int(c.Floor) != d.floor {
+				continue
+			}
+			assignee := ""
+			for _, a := range c.Assignments {
+				if a.At.After(d.at) {
+					break
+				}
+				assignee = a.Lift
+				if a.Lift == id && a.At.After(lastAt) {
+					last, lastAt = j, a.At
+				}
+			}
+			if assignee == id && (c.Done == nil || !c.Done.Before(d.at)) {
+				served = append(served, j)
+			}
+		}
+		if len(served) == 0 && last >= 0 {
+			served = []int{last}
+		}
+		for _, j := range served {
+			if !intInSlice(d.lift, servedBy[j]) {
+				servedBy[j] = append(servedBy[j], d.lift)
+			}
+		}
+	}
+	return servedBy
+}
+
+// Report
+// =============================================================================
+
+// report prints a summary of the run, and returns true if no hall call was
+// lost or served twice.
+func (r *runner) report() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	servedBy := r.servedByLocked()
+	var accepted, served int
+	var lost, twice []*press
+	calls := make(map[*press]int)
+	reported := make(map[int]bool) // Calls served twice already reported
+	for i, p := range r.presses {
+		call := r.callOfLocked(i)
+		calls[p] = call
+		if p.accepted {
+			accepted++
+		}
+		if call >= 0 && len(servedBy[call]) > 0 {
+			served++
+		} else if p.accepted {
+			lost = append(lost, p)
+		}
+		if call >= 0 && len(servedBy[call]) > 1 && !reported[call] {
+			reported[call] = true
+			twice = append(twice, p)
+		}
+	}
+	var names []string
+	for name, count := range r.actions {
+		names = append(names, fmt.Sprintf("%s %d", name, count))
+	}
+	sort.Strings(names)
+
+	fmt.Println()
+	fmt.Printf("Hall calls:  %d pressed, %d accepted, %d served\n", len(r.presses), accepted, served)
+	fmt.Printf("Actions:     %s\n", strings.Join(names, ", "))
+	for _, p := range lost {
+		fmt.Printf("LOST:        %s, pressed on lift %d at %s, %s\n", p, p.lift, r.elapsed(p.pressed), r.callStatusLocked(calls[p]))
+	}
+	for _, p := range twice {
+		fmt.Printf("SERVED TWICE: %s, pressed on lift %d at %s, served by lifts %v\n", p, p.lift, r.elapsed(p.pressed), servedBy[calls[p]])
+	}
+	if len(lost) == 0 && len(twice) == 0 {
+		fmt.Println("No hall call lost, and none served twice")
+		return true
+	}
+	return false
+}
+
+// callStatusLocked tells how the call in the history is doing, which tells
+// where a lost call got stuck.
+func (r *runner) callStatusLocked(call int) string {
+	if call < 0 {
+		return "unknown to the cluster"
+	}
+	c := r.history[call]
+	switch {
+	case c.Done != nil:
+		return "done in the cluster"
+	case len(c.Assignments) > 0:
+		return "assigned to " + c.Assignments[len(c.Assignments)-1].Lift + " in the cluster"
+	}
+	return "unassigned in the cluster"
+}
+
+// Helpers
+// =============================================================================
+
+func (r *runner) log(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logLocked(format, args...)
+}
+
+func (r *runner) logLocked(format string, args ...interface{}) {
+	fmt.Printf("%8s  %s\n", r.elapsed(time.Now()), fmt.Sprintf(format, args...))
+}
+
+// elapsed returns the time since the start of the run, in tenths of seconds.
+func (r *runner) elapsed(t time.Time) string {
+	return fmt.Sprintf("%.1fs", t.Sub(r.start).Seconds())
+}
+
+func intInSlice(a int, list []int) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "liftchaos: %v\n", err)
+	os.Exit(1)
+}
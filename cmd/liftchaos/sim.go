@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Button types, as numbered by the simulator protocol.
+const (
+	hallUp   = 0
+	hallDown = 1
+	cab      = 2
+)
+
+// sensorZone is how far from a floor, in floors, the floor sensor still
+// detects it. Like in the simulator, the sensor is lit for a quarter of the
+// travel time when passing a floor.
+const sensorZone = 0.125
+
+// simLift simulates a lift the same way as the simulator in driver/simulators,
+// and speaks the same protocol, such that controllers started with -sim
+// connect to it. Commands are 4 bytes: the type of the command followed by
+// its arguments. Lamps and doors are reported through the callbacks, which
+// lets the runner observe what the lift does.
+//
+// Unlike the real simulator the motor stops whenever the controller
+// disconnects, as it would on a lift losing its controller, and the lift
+// never moves beyond the top or bottom floor.
+type simLift struct {
+	id     int
+	floors int
+	travel time.Duration // Time to travel between two floors
+	ln     net.Listener
+
+	mu           sync.Mutex
+	pos          float64 // Position of the car, in floors
+	motor        int     // Direction of the motor: -1, 0 or 1
+	buttons      [][3]bool
+	door         bool
+	conn         net.Conn
+	disconnected bool
+
+	onLamp func(lift, floor, btn int, on bool)
+	onDoor func(lift, floor int)
+}
+
+// newSimLift starts a simulated lift, standing at the ground floor, listening
+// for a controller at the port. The callbacks are called whenever the
+// controller turns a hall lamp on or off, and opens the door.
+func newSimLift(id, floors, port int, travel time.Duration,
+	onLamp func(lift, floor, btn int, on bool), onDoor func(lift, floor int)) (*simLift, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	s := &simLift{
+		id:      id,
+		floors:  floors,
+		travel:  travel,
+		ln:      ln,
+		buttons: make([][3]bool, floors),
+		onLamp:  onLamp,
+		onDoor:  onDoor,
+	}
+	go s.accept()
+	go s.run()
+	return s, nil
+}
+
+// accept serves one controller at the time. Controllers connecting while the
+// lift is disconnected are hung up on.
+func (s *simLift) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.disconnected {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve handles the commands of the controller until it disconnects.
+func (s *simLift) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+			s.motor = 0
+		}
+		s.mu.Unlock()
+	}()
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return
+		}
+		resp, ok := s.handle(buf)
+		if ok {
+			if _, err := conn.Write(resp[:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle carries out a command, and returns the response, if any. Anything
+// not a command, such as the "GET " the driver sends ahead of every command,
+// is ignored.
+func (s *simLift) handle(cmd [4]byte) (resp [4]byte, ok bool) {
+	s.mu.Lock()
+	resp = [4]byte{cmd[0], 0, 0, 0}
+	var lamp, door bool
+	floor := s.floorLocked()
+	switch cmd[0] {
+	case 1:
+		switch {
+		case cmd[1] == 0:
+			s.motor = 0
+		case cmd[1] < 128:
+			s.motor = 1
+		default:
+			s.motor = -1
+		}
+	case 2:
+		lamp = int(cmd[2]) < s.floors && cmd[1] < cab
+	case 4:
+		door = cmd[1] == 1 && !s.door && floor >= 0
+		s.door = cmd[1] == 1
+	case 6:
+		if f, b := int(cmd[2]), int(cmd[1]); f < s.floors && b <= cab && s.buttons[f][b] {
+			resp[1] = 1
+		}
+		ok = true
+	case 7:
+		if floor >= 0 {
+			resp[1], resp[2] = 1, byte(floor)
+		}
+		ok = true
+	case 8, 9:
+		ok = true
+	}
+	s.mu.Unlock()
+
+	if lamp {
+		s.onLamp(s.id, int(cmd[2]), int(cmd[1]), cmd[3] == 1)
+	}
+	if door {
+		s.onDoor(s.id, floor)
+	}
+	return resp, ok
+}
+
+// run moves the car according to the motor.
+func (s *simLift) run() {
+	const tick = 10 * time.Millisecond
+	for range time.Tick(tick) {
+		s.mu.Lock()
+		s.pos += float64(s.motor) * float64(tick) / float64(s.travel)
+		if s.pos < 0 || s.pos > float64(s.floors-1) {
+			s.pos = math.Max(0, math.Min(s.pos, float64(s.floors-1)))
+			s.motor = 0
+		}
+		s.mu.Unlock()
+	}
+}
+
+// floorLocked returns the floor the car is at, or -1 if between floors.
+func (s *simLift) floorLocked() int {
+	f := math.Floor(s.pos + 0.5)
+	if math.Abs(s.pos-f) > sensorZone {
+		return -1
+	}
+	return int(f)
+}
+
+// press holds the button down long enough for the controller to notice.
+func (s *simLift) press(floor, btn int) {
+	s.mu.Lock()
+	s.buttons[floor][btn] = true
+	s.mu.Unlock()
+	time.AfterFunc(200*time.Millisecond, func() {
+		s.mu.Lock()
+		s.buttons[floor][btn] = false
+		s.mu.Unlock()
+	})
+}
+
+// disconnect hangs up on the controller, and refuses it until reconnected.
+// The driver of the controller never connects again by itself, so it must be
+// restarted once reconnected.
+func (s *simLift) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnected = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// reconnect lets the controller connect again.
+func (s *simLift) reconnect() {
+	s.mu.Lock()
+	s.disconnected = false
+	s.mu.Unlock()
+}
+
+// connected returns true if a controller is connected.
+func (s *simLift) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
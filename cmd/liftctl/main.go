@@ -0,0 +1,535 @@
+/*
+Command liftctl administers a cluster through the communication service of any
+of its nodes:
+
+	liftctl -addr 10.100.23.151:8001 status
+
+Commands:
+
+	status                       Lifts with their raft role, position and service mode
+	members                      Members of the raft and its leader
+	calls                        Outstanding hall calls, and calls placed through the API
+	call hall <floor> <up|down>  Place a hall call
+	call cab <lift> <floor>      Place a cab call in the lift
+	cancel <call id>             Cancel a call placed through the API
+	reassign <floor> <up|down>   Hand a hall call stuck with a lift back for assignment
+	kick <node>                  Remove a node from the raft
+	transfer-leader              Make the leader hand the leadership over to another node
+	drain [-undo] <lift>         Take a lift out of service, or put it back in with -undo
+	snapshot                     Make the node take a snapshot of the raft
+	faults                       Network faults injected into the traffic of the node
+	faults set [flags]           Replace the faults, see liftctl faults set -h
+	faults clear                 Stop injecting faults
+
+Faults are only injected by nodes started with -faults, and only into what the
+node itself sends, so a partition must be set on every node in it:
+
+	liftctl -addr 127.0.0.1:9000 faults set -drop 0.2 -latency 50ms -jitter 10ms
+	liftctl -addr 127.0.0.1:9000 faults set -partition a=127.0.0.1:8000,127.0.0.1:8002
+
+Lifts and nodes are given by their raft address (ip:port). Output is tables,
+or with -json, the JSON served by the API. Clusters with a secret or TLS need
+the same -secret-file or -tls-* flags as the nodes, and calls may only be
+placed or cancelled in such clusters.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/globalstate"
+)
+
+// ctl runs the commands against a node.
+type ctl struct {
+	client *globalstate.APIClient
+	json   bool
+}
+
+var commands = []struct {
+	name  string
+	usage string
+	run   func(c *ctl, args []string) error
+}{
+	{"status", "status", (*ctl).status},
+	{"members", "members", (*ctl).members},
+	{"calls", "calls", (*ctl).calls},
+	{"call", "call hall <floor> <up|down> | call cab <lift> <floor>", (*ctl).call},
+	{"cancel", "cancel <call id>", (*ctl).cancel},
+	{"reassign", "reassign <floor> <up|down>", (*ctl).reassign},
+	{"kick", "kick <node>", (*ctl).kick},
+	{"transfer-leader", "transfer-leader", (*ctl).transferLeader},
+	{"drain", "drain [-undo] <lift>", (*ctl).drain},
+	{"snapshot", "snapshot", (*ctl).snapshot},
+	{"faults", "faults [set [-drop <rate>] [-latency <duration>] [-jitter <duration>] [-partition <name>=<node>,...]... | clear]", (*ctl).faults},
+}
+
+func main() {
+	var addr, secretFile, tlsCA, tlsCert, tlsKey string
+	var timeout time.Duration
+	c := &ctl{}
+	flag.StringVar(&addr, "addr", "", "Address (ip:port) of the communication service of any node")
+	flag.StringVar(&secretFile, "secret-file", "", "File holding the secret of the cluster")
+	flag.StringVar(&tlsCA, "tls-ca", "", "Certificate of the cluster CA, for clusters with mutual TLS")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate signed by the cluster CA")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key of the certificate")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "Timeout of each request. Transferring the leadership takes a few seconds")
+	flag.BoolVar(&c.json, "json", false, "Print the JSON served by the API instead of tables")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if addr == "" {
+		fail(fmt.Errorf("provide the address of a node with -addr"))
+	}
+
+	client, err := globalstate.LoadAPIClient(addr, secretFile, tlsCA, tlsCert, tlsKey)
+	if err != nil {
+		fail(err)
+	}
+	c.client = client
+	c.client.Timeout = timeout
+
+	name, args := flag.Arg(0), flag.Args()[1:]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(c, args); err != nil {
+				fail(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "liftctl: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: liftctl -addr <ip:port> [flags] <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// Commands
+// =============================================================================
+
+func (c *ctl) status(args []string) error {
+	var rawState, rawMembers json.RawMessage
+	if err := c.client.Get("/v1/state", &rawState); err != nil {
+		return err
+	}
+	if err := c.client.Get("/v1/membership", &rawMembers); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(map[string]json.RawMessage{"state": rawState, "membership": rawMembers})
+	}
+	var s globalstate.StateV1
+	var m globalstate.MembershipV1
+	if err := json.Unmarshal(rawState, &s); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rawMembers, &m); err != nil {
+		return err
+	}
+
+	unassigned := 0
+	for _, h := range s.HallCalls {
+		if h.Status == globalstate.BtnStateUnassigned {
+			unassigned++
+		}
+	}
+	w := newTable()
+	fmt.Fprintf(w, "Node:\t%s\n", m.Self)
+	fmt.Fprintf(w, "Leader:\t%s\n", orNone(m.Leader))
+	fmt.Fprintf(w, "Raft index:\t%d\n", s.Index)
+	fmt.Fprintf(w, "Floors:\t%d\n", s.Floors)
+	fmt.Fprintf(w, "Hall calls:\t%d, %d unassigned\n", len(s.HallCalls), unassigned)
+	w.Flush()
+	fmt.Println()
+
+	w = newTable()
+	fmt.Fprintln(w, "LIFT\tROLE\tMODE\tFLOOR\tDIRECTION\tDOOR\tCAB CALLS\tLAST UPDATE")
+	for _, n := range s.Nodes {
+		door := "closed"
+		if n.DoorOpen {
+			door = "open"
+		}
+		var cab []string
+		for _, f := range n.CabCalls {
+			cab = append(cab, strconv.Itoa(int(f)))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", n.ID, role(n.ID, m), n.Mode, n.LastFloor,
+			strings.ToLower(n.Direction), door, orNone(strings.Join(cab, ",")), ago(n.LastUpdate))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) members(args []string) error {
+	var raw json.RawMessage
+	if err := c.client.Get("/v1/membership", &raw); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	var m globalstate.MembershipV1
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return err
+	}
+	sort.Strings(m.Peers)
+	w := newTable()
+	fmt.Fprintln(w, "NODE\tROLE\t")
+	for _, p := range m.Peers {
+		self := ""
+		if p == m.Self {
+			self = "(this node)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p, role(p, m), self)
+	}
+	return w.Flush()
+}
+
+func (c *ctl) calls(args []string) error {
+	var rawHall, rawCalls json.RawMessage
+	if err := c.client.Get("/v1/hall-calls", &rawHall); err != nil {
+		return err
+	}
+	if err := c.client.Get("/v1/calls", &rawCalls); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(map[string]json.RawMessage{"hallCalls": rawHall, "calls": rawCalls})
+	}
+	var hall []globalstate.HallCallV1
+	var calls []globalstate.CallV1
+	if err := json.Unmarshal(rawHall, &hall); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rawCalls, &calls); err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "FLOOR\tDIRECTION\tSTATUS\tASSIGNED TO\tSINCE")
+	for _, h := range hall {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", h.Floor, h.Direction, h.Status, orNone(h.AssignedTo), ago(h.LastChange))
+	}
+	w.Flush()
+	if len(calls) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w = newTable()
+	fmt.Fprintln(w, "CALL\tTYPE\tFLOOR\tDIRECTION\tLIFT\tSTATUS\tCREATED")
+	for _, cl := range calls {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", cl.ID, cl.Type, cl.Floor, orNone(cl.Direction), orNone(cl.Lift), cl.Status, ago(cl.Created))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) call(args []string) error {
+	var req map[string]interface{}
+	switch {
+	case len(args) == 3 && args[0] == "hall":
+		floor, err := parseFloor(args[1])
+		if err != nil {
+			return err
+		}
+		req = map[string]interface{}{"type": "hall", "floor": floor, "direction": args[2]}
+	case len(args) == 3 && args[0] == "cab":
+		floor, err := parseFloor(args[2])
+		if err != nil {
+			return err
+		}
+		req = map[string]interface{}{"type": "cab", "floor": floor, "lift": args[1]}
+	default:
+		return fmt.Errorf("usage: call hall <floor> <up|down> | call cab <lift> <floor>")
+	}
+	var raw json.RawMessage
+	if err := c.client.Do("POST", "/v1/calls", req, &raw); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	var cl globalstate.CallV1
+	if err := json.Unmarshal(raw, &cl); err != nil {
+		return err
+	}
+	fmt.Printf("Placed %s call %s\n", cl.Type, cl.ID)
+	return nil
+}
+
+func (c *ctl) cancel(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: cancel <call id>")
+	}
+	var raw json.RawMessage
+	if err := c.client.Do("DELETE", "/v1/calls/"+args[0], nil, &raw); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	fmt.Printf("Cancelled call %s\n", args[0])
+	return nil
+}
+
+func (c *ctl) reassign(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: reassign <floor> <up|down>")
+	}
+	if _, err := parseFloor(args[0]); err != nil {
+		return err
+	}
+	if err := c.client.Do("POST", "/v1/hall-calls/"+args[0]+"/"+args[1]+"/reassign", nil, nil); err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Printf("Handed hall call %s at floor %s back for assignment\n", args[1], args[0])
+	}
+	return nil
+}
+
+func (c *ctl) kick(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: kick <node>")
+	}
+	if err := c.client.Do("DELETE", "/v1/membership/"+args[0], nil, nil); err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Printf("Removed %s from the raft\n", args[0])
+	}
+	return nil
+}
+
+func (c *ctl) transferLeader(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: transfer-leader")
+	}
+	var raw json.RawMessage
+	if err := c.client.Do("POST", "/v1/leadership/transfer", nil, &raw); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	var l globalstate.LeaderV1
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return err
+	}
+	fmt.Printf("Leadership transferred to %s\n", l.Leader)
+	return nil
+}
+
+func (c *ctl) drain(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ContinueOnError)
+	undo := fs.Bool("undo", false, "Put the lift back in service")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: drain [-undo] <lift>")
+	}
+	lift := fs.Arg(0)
+	mode := globalstate.ServiceModeDrain
+	if *undo {
+		mode = globalstate.ServiceModeNormal
+	}
+	var raw json.RawMessage
+	if err := c.client.Do("PUT", "/v1/nodes/"+lift+"/mode", map[string]string{"mode": mode}, &raw); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	if *undo {
+		fmt.Printf("%s is back in service\n", lift)
+	} else {
+		fmt.Printf("%s is out of service. Its hall calls are handed over to the other lifts\n", lift)
+	}
+	return nil
+}
+
+func (c *ctl) snapshot(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: snapshot")
+	}
+	var raw json.RawMessage
+	if err := c.client.Do("POST", "/v1/snapshot", nil, &raw); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	var s globalstate.SnapshotV1
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	fmt.Printf("Took snapshot of the raft at index %d\n", s.Index)
+	return nil
+}
+
+func (c *ctl) faults(args []string) error {
+	var req *globalstate.FaultsV1
+	switch {
+	case len(args) == 0:
+	case args[0] == "clear" && len(args) == 1:
+		req = &globalstate.FaultsV1{}
+	case args[0] == "set":
+		fs := flag.NewFlagSet("faults set", flag.ContinueOnError)
+		drop := fs.Float64("drop", 0, "Share of packets and requests dropped, from 0 to 1")
+		latency := fs.Duration("latency", 0, "Latency added to every packet and request")
+		jitter := fs.Duration("jitter", 0, "Random variation of the latency, in either direction")
+		partitions := partitionFlag{}
+		fs.Var(partitions, "partition", "Partition on the form <name>=<node>,<node>. May be repeated")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 0 {
+			return fmt.Errorf("usage: faults set [-drop <rate>] [-latency <duration>] [-jitter <duration>] [-partition <name>=<node>,...]...")
+		}
+		req = &globalstate.FaultsV1{
+			DropRate:   *drop,
+			LatencyMs:  int64(*latency / time.Millisecond),
+			JitterMs:   int64(*jitter / time.Millisecond),
+			Partitions: partitions,
+		}
+	default:
+		return fmt.Errorf("usage: faults [set [flags] | clear]")
+	}
+
+	var raw json.RawMessage
+	var err error
+	if req == nil {
+		err = c.client.Get("/v1/faults", &raw)
+	} else {
+		err = c.client.Do("PUT", "/v1/faults", req, &raw)
+	}
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(raw)
+	}
+	var f globalstate.FaultsV1
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return err
+	}
+	w := newTable()
+	fmt.Fprintf(w, "Drop rate:\t%.2f\n", f.DropRate)
+	fmt.Fprintf(w, "Latency:\t%v\n", time.Duration(f.LatencyMs)*time.Millisecond)
+	fmt.Fprintf(w, "Jitter:\t%v\n", time.Duration(f.JitterMs)*time.Millisecond)
+	var names []string
+	for name := range f.Partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Fprintf(w, "Partitions:\t-\n")
+	}
+	for i, name := range names {
+		label := ""
+		if i == 0 {
+			label = "Partitions:"
+		}
+		fmt.Fprintf(w, "%s\t%s: %s\n", label, name, strings.Join(f.Partitions[name], ", "))
+	}
+	return w.Flush()
+}
+
+// Helpers
+// =============================================================================
+
+// partitionFlag collects partitions given on the form <name>=<node>,<node>.
+type partitionFlag map[string][]string
+
+func (p partitionFlag) String() string {
+	return ""
+}
+
+func (p partitionFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("partitions are given as <name>=<node>,<node>")
+	}
+	for _, node := range strings.Split(s[i+1:], ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			p[s[:i]] = append(p[s[:i]], node)
+		}
+	}
+	return nil
+}
+
+// role returns the raft role of the node, as seen by the node serving the
+// membership.
+func role(id string, m globalstate.MembershipV1) string {
+	switch {
+	case id == m.Leader:
+		return "leader"
+	case id == m.Self:
+		return "follower"
+	}
+	for _, p := range m.Peers {
+		if p == id {
+			return "follower"
+		}
+	}
+	return "not a member"
+}
+
+func parseFloor(s string) (int, error) {
+	floor, err := strconv.Atoi(s)
+	if err != nil || floor < 0 {
+		return 0, fmt.Errorf("invalid floor: %s", s)
+	}
+	return floor, nil
+}
+
+// ago returns the time passed since t in whole seconds.
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return (time.Since(t) / time.Second * time.Second).String() + " ago"
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "liftctl: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,344 @@
+/*
+Command lifttop shows the state of a cluster in the terminal, live, much like
+top does for processes. It connects to the communication service of any node
+of the cluster:
+
+	lifttop -addr 10.100.23.151:8001
+
+and draws the shaft of every lift, with the position and direction of the car,
+whether its door is open, its cab calls and the raft role of the node, along
+with all hall calls. Clusters with a secret or TLS need the same -secret-file
+or -tls-* flags as the nodes.
+
+Keys:
+
+	up/k, down/j  Select a floor
+	u, d          Place a hall call up or down at the selected floor
+	q             Quit
+
+Hall calls may only be placed in clusters with a secret or TLS.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hdhauk/TTK4145-Lift/globalstate"
+)
+
+// staleAfter is how long a lift may go without reporting before it is shown
+// as stale.
+const staleAfter = 10 * time.Second
+
+// Terminal escape sequences
+const (
+	altScreen  = "\x1b[?1049h\x1b[?25l"
+	mainScreen = "\x1b[?25h\x1b[?1049l"
+	home       = "\x1b[H"
+	clearLine  = "\x1b[K"
+	clearBelow = "\x1b[J"
+	bold       = "\x1b[1m"
+	dim        = "\x1b[2m"
+	reverse    = "\x1b[7m"
+	yellow     = "\x1b[33m"
+	green      = "\x1b[32m"
+	red        = "\x1b[31m"
+	reset      = "\x1b[0m"
+)
+
+// snapshot is the state of the cluster as seen by the node.
+type snapshot struct {
+	globalstate.StateV1
+	Members globalstate.MembershipV1 `json:"-"`
+	Err     error                    `json:"-"`
+	Taken   time.Time                `json:"-"`
+}
+
+func main() {
+	var addr, secretFile, tlsCA, tlsCert, tlsKey string
+	var interval time.Duration
+	flag.StringVar(&addr, "addr", "", "Address (ip:port) of the communication service of any node")
+	flag.StringVar(&secretFile, "secret-file", "", "File holding the secret of the cluster")
+	flag.StringVar(&tlsCA, "tls-ca", "", "Certificate of the cluster CA, for clusters with mutual TLS")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate signed by the cluster CA")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key of the certificate")
+	flag.DurationVar(&interval, "interval", 500*time.Millisecond, "Time between updates")
+	flag.Parse()
+	if addr == "" {
+		fail(fmt.Errorf("provide the address of a node with -addr"))
+	}
+
+	client, err := globalstate.LoadAPIClient(addr, secretFile, tlsCA, tlsCert, tlsKey)
+	if err != nil {
+		fail(err)
+	}
+	client.Timeout = 2 * time.Second
+
+	restore, err := rawTerminal()
+	if err != nil {
+		fail(fmt.Errorf("unable to set up the terminal: %v", err))
+	}
+	fmt.Print(altScreen)
+	quit := func(code int) {
+		fmt.Print(mainScreen)
+		restore()
+		os.Exit(code)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	snapshots := make(chan snapshot)
+	go poll(client, interval, snapshots)
+	keys := make(chan string)
+	go readKeys(keys)
+
+	var s snapshot
+	cursor := 0
+	message := ""
+	for {
+		select {
+		case s = <-snapshots:
+			if cursor >= int(s.Floors) {
+				cursor = int(s.Floors) - 1
+			}
+			if cursor < 0 {
+				cursor = 0
+			}
+		case k := <-keys:
+			switch k {
+			case "q":
+				quit(0)
+			case "up", "k":
+				if cursor < int(s.Floors)-1 {
+					cursor++
+				}
+			case "down", "j":
+				if cursor > 0 {
+					cursor--
+				}
+			case "u", "d":
+				message = placeHallCall(client, cursor, map[string]string{"u": "up", "d": "down"}[k])
+			}
+		case <-signals:
+			quit(0)
+		}
+		fmt.Print(render(s, cursor, message))
+	}
+}
+
+// poll sends a new snapshot of the cluster every interval.
+func poll(client *globalstate.APIClient, interval time.Duration, snapshots chan<- snapshot) {
+	for {
+		var s snapshot
+		s.Err = client.Get("/v1/state", &s)
+		if s.Err == nil {
+			s.Err = client.Get("/v1/membership", &s.Members)
+		}
+		s.Taken = time.Now()
+		snapshots <- s
+		time.Sleep(interval)
+	}
+}
+
+func placeHallCall(client *globalstate.APIClient, floor int, dir string) string {
+	var call globalstate.CallV1
+	req := map[string]interface{}{"type": "hall", "floor": floor, "direction": dir}
+	if err := client.Do("POST", "/v1/calls", req, &call); err != nil {
+		return red + "Unable to place call: " + err.Error() + reset
+	}
+	return fmt.Sprintf("Placed hall call %s at floor %d, id %s", dir, floor, call.ID)
+}
+
+// render draws the whole screen.
+func render(s snapshot, cursor int, message string) string {
+	var b bytes.Buffer
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format, a...)
+		b.WriteString(clearLine + "\n")
+	}
+	b.WriteString(home)
+
+	leader := s.Members.Leader
+	if leader == "" {
+		leader = red + "none" + reset
+	}
+	line("%slifttop%s  %s  leader %s  %s", bold, reset, s.Members.Self, leader, s.Taken.Format("15:04:05"))
+	if s.Err != nil {
+		line("%s%s%s", red, s.Err.Error(), reset)
+	} else {
+		line("")
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].ID < s.Nodes[j].ID })
+	calls := map[string]globalstate.HallCallV1{}
+	for _, c := range s.HallCalls {
+		calls[fmt.Sprintf("%d%s", c.Floor, c.Direction)] = c
+	}
+
+	// Header with the id and role of every lift
+	const cell = 17
+	header, roles := pad("Floor  Hall", 13), pad("       up dn", 13)
+	for _, n := range s.Nodes {
+		header += pad(n.ID, cell)
+		roles += colorRole(n, s.Members, cell)
+	}
+	line("%s%s%s", bold, header, reset)
+	line("%s", roles)
+
+	for f := int(s.Floors) - 1; f >= 0; f-- {
+		row := fmt.Sprintf("%5d  ", f)
+		if f == cursor {
+			row = reverse + row + reset
+		}
+		for _, dir := range []string{"up", "down"} {
+			row += " " + hallMark(calls[fmt.Sprintf("%d%s", f, dir)], dir) + " "
+		}
+		for _, n := range s.Nodes {
+			row += shaftCell(n, uint(f), cell)
+		}
+		line("%s", row)
+	}
+	line("")
+
+	// Hall calls and their assignees
+	line("%sHall calls%s", bold, reset)
+	sort.Slice(s.HallCalls, func(i, j int) bool { return s.HallCalls[i].Floor > s.HallCalls[j].Floor })
+	for _, c := range s.HallCalls {
+		assignee := c.AssignedTo
+		if assignee == "" {
+			assignee = "-"
+		}
+		line("  %d %-4s  %-10s  %s", c.Floor, c.Direction, c.Status, assignee)
+	}
+	if len(s.HallCalls) == 0 {
+		line("  %snone%s", dim, reset)
+	}
+	line("")
+	line("%s[▲] car  ]▲[ door open  • cab call  %s▲%s%s unassigned  %s▲%s%s assigned%s", dim, yellow, reset, dim, green, reset, dim, reset)
+	line("%s↑/k ↓/j select floor   u/d hall call up/down   q quit%s", dim, reset)
+	line("%s", message)
+	b.WriteString(clearBelow)
+	return b.String()
+}
+
+// shaftCell draws the floor of the shaft of a lift.
+func shaftCell(n globalstate.NodeV1, floor uint, width int) string {
+	cab := " "
+	for _, c := range n.CabCalls {
+		if c == floor {
+			cab = "•"
+		}
+	}
+	car := "   "
+	if n.LastFloor == floor {
+		arrow := map[string]string{"up": "▲", "down": "▼"}[strings.ToLower(n.Direction)]
+		if arrow == "" {
+			arrow = "■"
+		}
+		if n.DoorOpen {
+			car = "]" + arrow + "["
+		} else {
+			car = "[" + arrow + "]"
+		}
+	}
+	text := pad("|"+car+" "+cab+"|", width)
+	if time.Since(n.LastUpdate) > staleAfter {
+		return dim + text + reset
+	}
+	return text
+}
+
+func hallMark(c globalstate.HallCallV1, dir string) string {
+	arrow := map[string]string{"up": "▲", "down": "▼"}[dir]
+	switch c.Status {
+	case "unassigned":
+		return yellow + arrow + reset
+	case "assigned":
+		return green + arrow + reset
+	}
+	return dim + "." + reset
+}
+
+// colorRole returns the raft role of the lift, as seen by the node.
+func colorRole(n globalstate.NodeV1, m globalstate.MembershipV1, width int) string {
+	role := "follower"
+	member := n.ID == m.Self
+	for _, p := range m.Peers {
+		member = member || p == n.ID
+	}
+	color := ""
+	switch {
+	case n.ID == m.Leader:
+		role, color = "leader", bold+green
+	case !member:
+		role, color = "not a member", red
+	}
+	if time.Since(n.LastUpdate) > staleAfter {
+		role, color = role+", stale", dim
+	}
+	return color + pad(role, width) + reset
+}
+
+// pad pads s with spaces to width characters.
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// readKeys sends every key pressed. Arrow keys are sent as "up" and "down".
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		switch in := string(buf[:n]); in {
+		case "\x1b[A":
+			keys <- "up"
+		case "\x1b[B":
+			keys <- "down"
+		default:
+			for _, r := range in {
+				keys <- string(r)
+			}
+		}
+	}
+}
+
+// rawTerminal makes the terminal pass on every key at once, without echoing
+// it, and returns a function restoring it.
+func rawTerminal() (restore func(), err error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "lifttop: %v\n", err)
+	os.Exit(1)
+}
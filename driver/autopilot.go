@@ -2,6 +2,7 @@ package driver
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -91,7 +92,7 @@ func autoPilot(apFloorCh <-chan int, driverInitDone chan error) {
 			// Otherwise do the pickup and carry on
 			driverHandle.setMotorDir(stop)
 			go cfg.OnDstReached(newBtn(p.floor, p.dir), true)
-			go cfg.OnNewStatus(lastFloor, stop, currentOutsideDst.floor, currentOutsideDst.dir)
+			reportStatus(lastFloor, stop, currentOutsideDst, insideBtns)
 			if insideBtns[f] {
 				driverHandle.setBtnLED(Btn{f, Cab}, false)
 				insideBtns[f] = false
@@ -102,7 +103,7 @@ func autoPilot(apFloorCh <-chan int, driverInitDone chan error) {
 		case b := <-insideBtnPressCh:
 			insideBtns[b.Floor] = true
 		case <-time.After(4 * time.Second):
-			go cfg.OnNewStatus(lastFloor, currentDir, currentOutsideDst.floor, currentOutsideDst.dir)
+			reportStatus(lastFloor, currentDir, currentOutsideDst, insideBtns)
 
 		}
 		// Determine what to do next:
@@ -142,10 +143,111 @@ func autoPilot(apFloorCh <-chan int, driverInitDone chan error) {
 			currentDir = up
 		}
 		driverHandle.setMotorDir(currentDir)
-		go cfg.OnNewStatus(lastFloor, currentDir, currentOutsideDst.floor, currentOutsideDst.dir)
+		reportStatus(lastFloor, currentDir, currentOutsideDst, insideBtns)
 	}
 }
 
+// cabin is the state inside the lift, along with the status last reported,
+// such that the status may be reported again when the door opens or closes.
+var cabin = struct {
+	sync.Mutex
+	doorOpen   bool
+	cabCalls   []int
+	floor      int
+	dir        string
+	outsideDst dst
+	reported   status // The status being, or last, passed to OnNewStatus
+}{}
+
+// status is a status of the lift, as passed to OnNewStatus.
+type status struct {
+	floor      int
+	dir        string
+	outsideDst dst
+	doorOpen   bool
+	cabCalls   []int
+}
+
+// statusQueue holds the latest status yet to be passed to OnNewStatus. Any
+// status not yet passed on when a newer one occurs is outdated, and replaced.
+// Queueing never blocks, as OnNewStatus may in turn wait for the autopilot
+// through StopForPickup.
+var statusQueue = struct {
+	sync.Mutex
+	latest  status
+	pending bool
+	ready   chan struct{}
+}{ready: make(chan struct{}, 1)}
+
+// reportStatus reports the status of the lift through the OnNewStatus callback.
+func reportStatus(floor int, dir string, outsideDst dst, insideBtns []bool) {
+	cabin.Lock()
+	cabin.floor, cabin.dir, cabin.outsideDst = floor, dir, outsideDst
+	cabin.cabCalls = cabin.cabCalls[:0]
+	for f, pressed := range insideBtns {
+		if pressed {
+			cabin.cabCalls = append(cabin.cabCalls, f)
+		}
+	}
+	queueStatusLocked(dir)
+	cabin.Unlock()
+}
+
+// setDoor opens or closes the door, and reports the lift as stopped.
+func setDoor(open bool) {
+	driverHandle.setDoorLED(open)
+	cabin.Lock()
+	cabin.doorOpen = open
+	queueStatusLocked(stop)
+	cabin.Unlock()
+}
+
+// queueStatusLocked queues the status of the cabin, moving in the direction,
+// to be reported. The caller must hold the lock of the cabin.
+func queueStatusLocked(dir string) {
+	s := status{
+		floor:      cabin.floor,
+		dir:        dir,
+		outsideDst: cabin.outsideDst,
+		doorOpen:   cabin.doorOpen,
+		cabCalls:   append([]int(nil), cabin.cabCalls...),
+	}
+	statusQueue.Lock()
+	statusQueue.latest, statusQueue.pending = s, true
+	statusQueue.Unlock()
+	select {
+	case statusQueue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// statusReporter passes the queued statuses to OnNewStatus one at a time, such
+// that a status is never overtaken by an earlier one.
+func statusReporter() {
+	for range statusQueue.ready {
+		statusQueue.Lock()
+		s, pending := statusQueue.latest, statusQueue.pending
+		statusQueue.pending = false
+		statusQueue.Unlock()
+		if !pending {
+			continue
+		}
+		cabin.Lock()
+		cabin.reported = s
+		cabin.Unlock()
+		cfg.OnNewStatus(s.floor, s.dir, s.outsideDst.floor, s.outsideDst.dir)
+	}
+}
+
+// Cabin returns whether the door of the lift is open, and the floors of the
+// cab calls it has yet to serve, as of the status being reported. It is thus
+// consistent with the status passed to OnNewStatus when called from it.
+func Cabin() (doorOpen bool, cabCalls []int) {
+	cabin.Lock()
+	defer cabin.Unlock()
+	return cabin.reported.doorOpen, append([]int(nil), cabin.reported.cabCalls...)
+}
+
 func getFurthestAway(btns []bool, currentFloor int) int {
 	min := 1000
 	max := -1
@@ -185,9 +287,9 @@ func stopAndOpenDoor() error {
 		return fmt.Errorf("cannot stop and open door between floors")
 	}
 	driverHandle.setMotorDir(stop)
-	driverHandle.setDoorLED(true)
+	setDoor(true)
 	time.Sleep(3 * time.Second)
-	driverHandle.setDoorLED(false)
+	setDoor(false)
 	return nil
 }
 
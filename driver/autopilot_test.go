@@ -1,6 +1,10 @@
 package driver
 
-import "testing"
+import (
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestDirToDst(t *testing.T) {
 	var tests = []struct {
@@ -19,3 +23,55 @@ func TestDirToDst(t *testing.T) {
 		}
 	}
 }
+
+var startReporter sync.Once
+
+func TestLatestStatusReported(t *testing.T) {
+	type report struct {
+		dir      string
+		doorOpen bool
+	}
+	reports := make(chan report, 10)
+	onNewStatus := cfg.OnNewStatus
+	defer func() { cfg.OnNewStatus = onNewStatus }()
+	cfg.OnNewStatus = func(floor int, dir string, dstFloor int, dstDir string) {
+		// The first report is slow, such as when the leader is far away
+		if len(reports) == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		doorOpen, _ := Cabin()
+		reports <- report{dir, doorOpen}
+	}
+	setDoorLED := driverHandle.setDoorLED
+	defer func() { driverHandle.setDoorLED = setDoorLED }()
+	driverHandle.setDoorLED = func(bool) {}
+	// A single reporter keeps the order, also when the test is repeated
+	startReporter.Do(func() { go statusReporter() })
+
+	reportStatus(1, up, dst{floor: 2, dir: up}, []bool{false, false, false, false})
+	reportStatus(2, stop, dst{floor: 2, dir: up}, []bool{false, false, false, false})
+	setDoor(true)
+	setDoor(false)
+	reportStatus(2, down, dst{floor: 0, dir: down}, []bool{true, false, false, false})
+
+	// The statuses occurring during the slow report are outdated by the last
+	// one, and skipped
+	latest := report{down, false}
+	var got []report
+	for len(got) == 0 || got[len(got)-1] != latest {
+		select {
+		case r := <-reports:
+			got = append(got, r)
+		case <-time.After(time.Second):
+			t.Fatalf("latest status never reported, got %+v", got)
+		}
+	}
+	if len(got) > 2 {
+		t.Errorf("outdated statuses reported: %+v", got)
+	}
+	select {
+	case r := <-reports:
+		t.Errorf("status %+v reported after the latest", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
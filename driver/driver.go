@@ -20,6 +20,18 @@ func GoToFloor(floor int, dir string) {
 	}
 }
 
+// PressCabButton acts as if the cab button of the floor was pressed, and let
+// other systems place orders from inside the lift.
+func PressCabButton(floor int) {
+	b := Btn{Floor: floor, Type: Cab}
+	if err := validateButton(b); err != nil {
+		cfg.Logger.Printf("%s[ERROR] Invalid button: %s%s", yellow, err.Error(), white)
+		return
+	}
+	driverHandle.setBtnLED(b, true)
+	insideBtnPressCh <- b
+}
+
 // StopForPickup can be called if the lift should stop in the next floor,
 // to pick someone up.
 func StopForPickup(f int, d string) {
@@ -57,6 +57,7 @@ func Init(c Config, done chan error) {
 	go btnPressHandler(btnPressCh)
 	go floorDetectHandler(floorDetectCh, apFloorCh)
 	go autoPilot(apFloorCh, done)
+	go statusReporter()
 	go driverHandle.init(cfg.SimPort)
 
 	// Block until stack unwind
@@ -0,0 +1,236 @@
+/*
+Package faultnet injects network faults into the traffic of a node, such that
+resilience tests may be run by an ordinary user, without tc and netem. The
+faults are changed at runtime, and apply to all traffic the node sends:
+
+  - A share of the packets and requests are dropped.
+  - Packets and requests are delayed by a latency, varied at random by a jitter.
+  - Nodes are split into named partitions. Nodes in different partitions are
+    cut off from each other. Nodes left out of every partition reach each
+    other, but none of the nodes in a partition.
+
+Nodes are identified by their raft address (ip:port). As the faults only apply
+to what the node itself sends, a partition is only complete once it is set on
+every node.
+*/
+package faultnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDropped is returned for packets and requests dropped at random.
+var ErrDropped = errors.New("dropped by fault injection")
+
+// ErrCut is returned for packets and requests to nodes in other partitions.
+var ErrCut = errors.New("cut off by fault injection")
+
+// Settings are the faults injected into the traffic of a node.
+type Settings struct {
+	// DropRate is the share of packets and requests dropped, from 0 to 1.
+	DropRate float64
+	// Latency is added to every packet and request sent.
+	Latency time.Duration
+	// Jitter varies the latency of every packet and request at random, by up
+	// to as much in either direction.
+	Jitter time.Duration
+	// Partitions hold the raft addresses of the nodes in every partition, by
+	// the name of the partition.
+	Partitions map[string][]string
+}
+
+// String describes the settings, for logging.
+func (s Settings) String() string {
+	var names []string
+	for name := range s.Partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var partitions []string
+	for _, name := range names {
+		partitions = append(partitions, fmt.Sprintf("%s=%s", name, strings.Join(s.Partitions[name], ",")))
+	}
+	if len(partitions) == 0 {
+		partitions = []string{"none"}
+	}
+	return fmt.Sprintf("drop rate %.2f, latency %v ±%v, partitions %s",
+		s.DropRate, s.Latency, s.Jitter, strings.Join(partitions, " "))
+}
+
+// Faults holds the faults injected into the traffic of a node, and is safe
+// for concurrent use.
+type Faults struct {
+	self     string
+	mu       sync.Mutex
+	settings Settings
+	rand     *rand.Rand
+}
+
+// New returns the faults of the node with the raft address self. No faults
+// are injected until they are set.
+func New(self string) *Faults {
+	return &Faults{
+		self: self,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Set replaces the faults injected. A node may only be in one partition.
+func (f *Faults) Set(s Settings) error {
+	if s.DropRate < 0 || s.DropRate > 1 {
+		return fmt.Errorf("drop rate must be between 0 and 1, not %v", s.DropRate)
+	}
+	if s.Latency < 0 || s.Jitter < 0 {
+		return fmt.Errorf("latency and jitter may not be negative")
+	}
+	partitions := make(map[string][]string)
+	member := make(map[string]string)
+	for name, nodes := range s.Partitions {
+		if name == "" {
+			return fmt.Errorf("partitions must be named")
+		}
+		for _, n := range nodes {
+			if other, ok := member[n]; ok && other != name {
+				return fmt.Errorf("%s is in both partition %s and %s", n, other, name)
+			}
+			member[n] = name
+		}
+		partitions[name] = append([]string(nil), nodes...)
+	}
+	s.Partitions = partitions
+
+	f.mu.Lock()
+	f.settings = s
+	f.mu.Unlock()
+	return nil
+}
+
+// Settings returns a copy of the faults injected.
+func (f *Faults) Settings() Settings {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.settings
+	s.Partitions = make(map[string][]string)
+	for name, nodes := range f.settings.Partitions {
+		s.Partitions[name] = append([]string(nil), nodes...)
+	}
+	return s
+}
+
+// Cut returns true if the node at the raft address peer is in another
+// partition than the node itself.
+func (f *Faults) Cut(peer string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.partitionLocked(f.self) != f.partitionLocked(peer)
+}
+
+// partitionLocked returns the name of the partition of the node, or an empty
+// string if it is in none.
+func (f *Faults) partitionLocked(node string) string {
+	for name, nodes := range f.settings.Partitions {
+		for _, n := range nodes {
+			if n == node {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Inject applies the faults to a packet or request sent to the node at the
+// raft address peer. An empty peer is never cut off. It returns ErrCut or
+// ErrDropped if the packet is lost, and otherwise holds it back for the
+// latency.
+func (f *Faults) Inject(peer string) error {
+	if peer != "" && f.Cut(peer) {
+		return ErrCut
+	}
+	if f.drop() {
+		return ErrDropped
+	}
+	time.Sleep(f.delay())
+	return nil
+}
+
+// drop returns true if a packet should be dropped.
+func (f *Faults) drop() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.settings.DropRate > 0 && f.rand.Float64() < f.settings.DropRate
+}
+
+// delay returns the latency of a packet, varied by the jitter.
+func (f *Faults) delay() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.settings.Latency
+	if j := int64(f.settings.Jitter); j > 0 {
+		d += time.Duration(f.rand.Int63n(2*j+1) - j)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Wrappers
+// =============================================================================
+
+// RoundTripper returns a round tripper injecting the faults into the requests
+// sent through rt. The peer function returns the raft address of the node
+// serving the host (ip:port) of a request. The host itself is used if it is
+// nil.
+func RoundTripper(rt http.RoundTripper, f *Faults, peer func(host string) string) http.RoundTripper {
+	return &roundTripper{next: rt, faults: f, peer: peer}
+}
+
+type roundTripper struct {
+	next   http.RoundTripper
+	faults *Faults
+	peer   func(host string) string
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	peer := req.URL.Host
+	if rt.peer != nil {
+		peer = rt.peer(peer)
+	}
+	if err := rt.faults.Inject(peer); err != nil {
+		return nil, fmt.Errorf("request to %s %s", req.URL.Host, err.Error())
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// PacketConn returns a connection dropping and delaying the packets written
+// to conn. Delayed packets are sent in the background, so writes never block.
+// Packets are broadcasted, so partitions are left to the receiver.
+func PacketConn(conn net.PacketConn, f *Faults) net.PacketConn {
+	return &packetConn{PacketConn: conn, faults: f}
+}
+
+type packetConn struct {
+	net.PacketConn
+	faults *Faults
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.faults.drop() {
+		return len(b), nil
+	}
+	d := c.faults.delay()
+	if d == 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	packet := append([]byte(nil), b...)
+	time.AfterFunc(d, func() { c.PacketConn.WriteTo(packet, addr) })
+	return len(b), nil
+}
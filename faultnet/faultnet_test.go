@@ -0,0 +1,137 @@
+package faultnet
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetValidates(t *testing.T) {
+	f := New("10.0.0.1:8000")
+	invalid := []Settings{
+		{DropRate: -0.1},
+		{DropRate: 1.5},
+		{Latency: -time.Second},
+		{Jitter: -time.Second},
+		{Partitions: map[string][]string{"": {"10.0.0.1:8000"}}},
+		{Partitions: map[string][]string{"a": {"10.0.0.1:8000"}, "b": {"10.0.0.1:8000"}}},
+	}
+	for _, s := range invalid {
+		if err := f.Set(s); err == nil {
+			t.Errorf("Set(%+v) succeeded", s)
+		}
+	}
+
+	partitions := map[string][]string{"a": {"10.0.0.1:8000"}}
+	if err := f.Set(Settings{DropRate: 0.5, Latency: time.Second, Partitions: partitions}); err != nil {
+		t.Fatalf("Set() = %v", err)
+	}
+	partitions["a"][0] = "10.0.0.9:8000"
+	if got := f.Settings(); got.DropRate != 0.5 || got.Latency != time.Second || got.Partitions["a"][0] != "10.0.0.1:8000" {
+		t.Errorf("Settings() = %+v", got)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	f := New("10.0.0.1:8000")
+	if f.Cut("10.0.0.2:8000") {
+		t.Errorf("cut off without partitions")
+	}
+	f.Set(Settings{Partitions: map[string][]string{
+		"a": {"10.0.0.1:8000", "10.0.0.2:8000"},
+		"b": {"10.0.0.3:8000"},
+	}})
+	cases := map[string]bool{
+		"10.0.0.2:8000": false, // Same partition
+		"10.0.0.3:8000": true,  // Other partition
+		"10.0.0.4:8000": true,  // In no partition
+	}
+	for peer, cut := range cases {
+		if f.Cut(peer) != cut {
+			t.Errorf("Cut(%s) = %v, want %v", peer, !cut, cut)
+		}
+	}
+	if err := f.Inject("10.0.0.3:8000"); err != ErrCut {
+		t.Errorf("Inject() = %v, want %v", err, ErrCut)
+	}
+
+	// Nodes left out of every partition only reach each other.
+	outside := New("10.0.0.4:8000")
+	outside.Set(f.Settings())
+	if !outside.Cut("10.0.0.1:8000") || outside.Cut("10.0.0.5:8000") {
+		t.Errorf("node left out of the partitions reach the wrong nodes")
+	}
+}
+
+func TestDropAndDelay(t *testing.T) {
+	f := New("10.0.0.1:8000")
+	f.Set(Settings{DropRate: 1})
+	if err := f.Inject("10.0.0.2:8000"); err != ErrDropped {
+		t.Errorf("Inject() = %v, want %v", err, ErrDropped)
+	}
+
+	f.Set(Settings{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	for i := 0; i < 100; i++ {
+		if d := f.delay(); d < 10*time.Millisecond || d > 30*time.Millisecond {
+			t.Fatalf("delay() = %v, want between 10ms and 30ms", d)
+		}
+	}
+	start := time.Now()
+	if err := f.Inject("10.0.0.2:8000"); err != nil || time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Inject() = %v after %v, want no error after at least 10ms", err, time.Since(start))
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	f := New("10.0.0.1:8000")
+	client := &http.Client{Transport: RoundTripper(http.DefaultTransport, f, func(host string) string { return "10.0.0.2:8000" })}
+	if _, err := client.Get(srv.URL); err != nil {
+		t.Fatalf("request failed without faults: %v", err)
+	}
+	f.Set(Settings{Partitions: map[string][]string{"a": {"10.0.0.2:8000"}}})
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Errorf("request to node in another partition succeeded")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	send, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New("10.0.0.1:8000")
+	conn := PacketConn(send, f)
+	defer conn.Close()
+	buf := make([]byte, 16)
+
+	// Dropped packets are never sent.
+	f.Set(Settings{DropRate: 1})
+	conn.WriteTo([]byte("dropped"), recv.LocalAddr())
+	recv.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, _ := recv.ReadFrom(buf); n != 0 {
+		t.Errorf("received dropped packet %q", buf[:n])
+	}
+
+	// Delayed packets are sent without blocking the writer.
+	f.Set(Settings{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	conn.WriteTo([]byte("delayed"), recv.LocalAddr())
+	if time.Since(start) > 10*time.Millisecond {
+		t.Errorf("write blocked for %v", time.Since(start))
+	}
+	recv.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, _ := recv.ReadFrom(buf)
+	if string(buf[:n]) != "delayed" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("received %q after %v, want \"delayed\" after at least 50ms", buf[:n], time.Since(start))
+	}
+}
@@ -0,0 +1,288 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+/*
+Administration of a running cluster, beyond joining and kicking nodes. All of
+it is available through the /v1 API, and thereby the liftctl command:
+
+  - A lift may be drained, which takes it out of service. Its hall calls are
+    handed back for assignment to the other lifts, and it is given no new ones,
+    while it still serves its cab calls.
+  - A hall call stuck with a lift may be handed back for assignment.
+  - The leader may hand the leadership over to another node.
+  - A node may be asked to take a snapshot of the raft, compacting its log.
+*/
+
+const (
+	// ServiceModeNormal is a lift in service, which is assigned hall calls.
+	ServiceModeNormal = "normal"
+	// ServiceModeDrain is a lift taken out of service. It is not assigned any
+	// hall calls, but still serves its cab calls.
+	ServiceModeDrain = "drain"
+)
+
+// serviceMode is a change of the service mode of a lift.
+type serviceMode struct {
+	Mode string
+	At   time.Time
+}
+
+// buttonRelease hands an assigned hall button back as unassigned. A release
+// based on a version of the button is rejected if the button have changed
+// since, the same way as button updates.
+type buttonRelease struct {
+	Dir     string
+	At      time.Time
+	Version uint64
+}
+
+// SetServiceMode changes the service mode of the lift. Draining a lift hands
+// the hall calls assigned to it back for assignment to the other lifts.
+func (rw *raftwrapper) SetServiceMode(id, mode string) error {
+	if rw.getRaft().State() != raft.Leader {
+		return fmt.Errorf("not leader")
+	}
+	if mode != ServiceModeNormal && mode != ServiceModeDrain {
+		return fmt.Errorf("invalid service mode: %s", mode)
+	}
+	v, _ := json.Marshal(serviceMode{Mode: mode, At: rw.config.Clock()})
+	return rw.applyCommand("nodeMode", id, v)
+}
+
+// ReassignHallCall hands an assigned hall call back as unassigned, such that
+// it is assigned again, to whichever lift is the cheapest at the time.
+func (rw *raftwrapper) ReassignHallCall(floor uint, dir string) error {
+	return rw.releaseButton(floor, dir, 0)
+}
+
+// releaseButton hands the hall button back as unassigned, unless it have
+// changed since the version given. A version of 0 releases it as it is.
+func (rw *raftwrapper) releaseButton(floor uint, dir string, version uint64) error {
+	if rw.getRaft().State() != raft.Leader {
+		return fmt.Errorf("not leader")
+	}
+	v, _ := json.Marshal(buttonRelease{Dir: dir, At: rw.config.Clock(), Version: version})
+	return rw.applyCommand("btnRelease", strconv.Itoa(int(floor)), v)
+}
+
+// releaseHallCalls hands all hall calls assigned to the lift back for
+// assignment, the same way as ReassignHallCall.
+func (rw *raftwrapper) releaseHallCalls(lift string) error {
+	state := rw.GetState()
+	for dir, buttons := range map[string]map[string]Status{"up": state.HallUpButtons, "down": state.HallDownButtons} {
+		for floor, status := range buttons {
+			if status.AssignedTo != lift || status.LastStatus != BtnStateAssigned {
+				continue
+			}
+			// Buttons served or reassigned since are left as they are
+			f, _ := strconv.Atoi(floor)
+			switch err := rw.releaseButton(uint(f), dir, status.Version); err.(type) {
+			case nil, *TransitionError, *StaleUpdateError:
+			default:
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rw *raftwrapper) applyNodeMode(nodeID string, b []byte) interface{} {
+	var m serviceMode
+	if err := json.Unmarshal(b, &m); err != nil {
+		rw.logger.Printf("[ERROR] Unable to unmarshal service mode: %s\n", err.Error())
+		return fmt.Errorf("unable to unmarshal service mode: %s", err.Error())
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	lift, ok := rw.state.Nodes[nodeID]
+	if !ok {
+		return fmt.Errorf("no such lift: %s", nodeID)
+	}
+	lift.Mode = m.Mode
+	rw.state.Nodes[nodeID] = lift
+	rw.emitLocked(Event{Type: EventLift, Lift: lift})
+	if m.Mode == ServiceModeDrain {
+		rw.releaseHallButtonsLocked(nodeID, m.At)
+	}
+	return nil
+}
+
+// applyBtnRelease hands the hall button back as unassigned. Only assigned
+// buttons may be handed back.
+func (rw *raftwrapper) applyBtnRelease(floor string, b []byte) interface{} {
+	var release buttonRelease
+	if err := json.Unmarshal(b, &release); err != nil {
+		rw.logger.Printf("[ERROR] Unable to unmarshal button release: %s\n", err.Error())
+		return fmt.Errorf("unable to unmarshal button release: %s", err.Error())
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if err := validateButton(floor, release.Dir, rw.state.Floors); err != nil {
+		return err
+	}
+	button := rw.hallButtons(release.Dir)[floor]
+	if release.Version != 0 && release.Version != button.Version {
+		return &StaleUpdateError{Floor: floor, Dir: release.Dir, Version: release.Version, Current: button.Version}
+	}
+	if current := button.LastStatus; current != BtnStateAssigned {
+		if current == "" {
+			current = BtnStateDone
+		}
+		return &TransitionError{Floor: floor, Dir: release.Dir, From: current, To: BtnStateUnassigned}
+	}
+	rw.setButtonLocked(floor, release.Dir, Status{LastStatus: BtnStateUnassigned, LastChange: release.At})
+	return nil
+}
+
+// releaseHallButtonsLocked hands all hall buttons assigned to the lift back as
+// unassigned.
+func (rw *raftwrapper) releaseHallButtonsLocked(lift string, when time.Time) {
+	for _, dir := range []string{"up", "down"} {
+		buttons := rw.hallButtons(dir)
+		for _, floor := range sortedFloors(buttons) {
+			if status := buttons[floor]; status.AssignedTo == lift && status.LastStatus == BtnStateAssigned {
+				rw.setButtonLocked(floor, dir, Status{LastStatus: BtnStateUnassigned, LastChange: when})
+			}
+		}
+	}
+}
+
+// inService returns the state without the lifts taken out of service, such
+// that the cost function never picks any of them.
+func inService(s State) State {
+	for id, lift := range s.Nodes {
+		if lift.Mode == ServiceModeDrain {
+			delete(s.Nodes, id)
+		}
+	}
+	return s
+}
+
+// countAlive returns the number of members of the raft, except the one left
+// out, that have published a lift status within the grace period. The node
+// itself is always alive.
+func (rw *raftwrapper) countAlive(peers []string, except string) int {
+	state := rw.GetState()
+	dead := getDeadNodes(state, rw.ownID, rw.config.Clock(), rw.config.DeadNodeGracePeriod)
+	alive := 0
+	for _, p := range peers {
+		_, known := state.Nodes[p]
+		if p != except && (p == rw.ownID || known && !stringInSlice(p, dead)) {
+			alive++
+		}
+	}
+	return alive
+}
+
+// TransferLeadership hands the leadership of the raft over to another node,
+// and returns the raft address of the new leader. The raft library is unable
+// to transfer leadership as such, so the leader removes itself from the raft,
+// waits for the others to elect a new leader among themselves, and joins the
+// raft again as a follower. Which node wins the election is up to raft. At
+// least two other members must be alive, as a single node never elects itself.
+//
+// The node restarts its raft right after leaving, as a node bootstrapping the
+// cluster would otherwise elect itself leader of a raft of its own. The state
+// is restored from a snapshot taken before leaving, such that the node keeps
+// knowing the cluster. Should it fail to join again, the RemovalMonitor asks
+// to be added once it finds the new leader. The node is of no use without a
+// raft, so it exits if unable to restart it.
+func (f *FSM) TransferLeadership() (string, error) {
+	if !f.ready() {
+		return "", fmt.Errorf("globalstate not yet initialized")
+	}
+	f.mergeMu.Lock()
+	defer f.mergeMu.Unlock()
+	rw := f.wrapper
+	if rw.getRaft().State() != raft.Leader {
+		return "", fmt.Errorf("not leader")
+	}
+
+	peers, err := rw.peers()
+	if err != nil {
+		return "", err
+	}
+	remaining := len(peers) - 1
+	if alive := rw.countAlive(peers, rw.ownID); remaining < 2 || alive <= remaining/2 {
+		return "", fmt.Errorf("only %d of %d other nodes alive. At least two are needed to elect another leader", alive, remaining)
+	}
+	var others []string
+	for _, p := range peers {
+		if addr, err := rw.commAddr(p); err == nil && p != rw.ownID {
+			others = append(others, addr)
+		}
+	}
+	if err := rw.getRaft().Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
+		return "", fmt.Errorf("unable to take snapshot: %s", err.Error())
+	}
+
+	// Stop the workers before leaving, such that the removal isn't taken for
+	// the node being kicked.
+	f.logger.Printf("[INFO] Transferring leadership. Leaving the raft.\n")
+	rw.stopWorkers()
+	if err := rw.getRaft().RemovePeer(rw.ownID).Error(); err != nil {
+		rw.raftMu.Lock()
+		rw.shutdown = make(chan interface{})
+		rw.raftMu.Unlock()
+		f.startWorkers()
+		return "", fmt.Errorf("unable to leave the raft: %s", err.Error())
+	}
+	if err := rw.Stop(); err != nil {
+		f.logger.Fatalf("[ERROR] Unable to stop the raft left: %s\n", err.Error())
+	}
+
+	// The log is applied again from the snapshot as the node catches up, so
+	// the state is reset first.
+	rw.resetState()
+	if err := rw.Start(false); err != nil {
+		f.logger.Fatalf("[ERROR] Unable to restart the raft: %s\n", err.Error())
+	}
+	defer f.startWorkers()
+	left := rw.getRaft().LastIndex()
+
+	leader, err := waitForLeader(others, rw.ownID, rw.client, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	if err := joinPeerToRaft(leader.LeaderComm, rw.RaftPort, rw.config.CommAddr, rw.client, f.logger); err != nil {
+		return "", err
+	}
+
+	// Give the node a moment to catch up, such that it knows where the leader
+	// is once it is back. Applying its own removal again makes raft forget the
+	// leader until the next heartbeat, so the node is only back once it have
+	// applied entries appended after it left.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if rw.getRaft().AppliedIndex() > left && rw.GetLeader() == leader.Leader {
+			break
+		}
+	}
+	f.logger.Printf("[INFO] Leadership transferred to %s\n", leader.Leader)
+	return leader.Leader, nil
+}
+
+// waitForLeader polls the nodes at the communication addresses until one of
+// them knows of a leader other than the node left out.
+func waitForLeader(comms []string, except string, client *commClient, timeout time.Duration) (clusterStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, comm := range comms {
+			cs, err := getClusterStatus(comm, client)
+			if err == nil && cs.Leader != "" && cs.Leader != except && cs.LeaderComm != "" {
+				return cs, nil
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return clusterStatus{}, fmt.Errorf("no leader elected within %v", timeout)
+}
@@ -0,0 +1,113 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ServiceMode(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.logger = log.New(ioutil.Discard, "", 0)
+	now := time.Now()
+	status := func(v interface{}) []byte { b, _ := json.Marshal(v); return b }
+
+	rw.applyNodeUpdate("lift1", status(LiftStatus{ID: "lift1", LastUpdate: now}))
+	rw.applyNodeUpdate("lift2", status(LiftStatus{ID: "lift2", LastUpdate: now}))
+	rw.applyBtnUpUpdate("1", status(Status{LastStatus: BtnStateUnassigned, LastChange: now}))
+	rw.applyBtnUpUpdate("1", status(Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1", LastChange: now}))
+
+	// Draining a lift hands its hall calls back, and keeps it away from the
+	// cost function, even as it keeps reporting.
+	assert.Nil(t, rw.applyNodeMode("lift1", status(serviceMode{Mode: ServiceModeDrain, At: now})))
+	assert.Equal(t, BtnStateUnassigned, rw.GetState().HallUpButtons["1"].LastStatus)
+	rw.applyNodeUpdate("lift1", status(LiftStatus{ID: "lift1", LastFloor: 2, LastUpdate: now}))
+	assert.Equal(t, ServiceModeDrain, rw.GetState().Nodes["lift1"].Mode)
+	nodes := inService(rw.GetState()).Nodes
+	assert.NotContains(t, nodes, "lift1")
+	assert.Contains(t, nodes, "lift2")
+	assert.Equal(t, ServiceModeDrain, nodeToV1("lift1", rw.GetState().Nodes["lift1"]).Mode)
+	assert.Equal(t, ServiceModeNormal, nodeToV1("lift2", rw.GetState().Nodes["lift2"]).Mode)
+
+	assert.Nil(t, rw.applyNodeMode("lift1", status(serviceMode{Mode: ServiceModeNormal, At: now})))
+	assert.Contains(t, inService(rw.GetState()).Nodes, "lift1")
+	assert.Error(t, rw.applyNodeMode("lift3", status(serviceMode{Mode: ServiceModeDrain, At: now})).(error))
+}
+
+func Test_ReassignHallCall(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.logger = log.New(ioutil.Discard, "", 0)
+	now := time.Now()
+	status := func(v interface{}) []byte { b, _ := json.Marshal(v); return b }
+
+	rw.applyBtnDownUpdate("2", status(Status{LastStatus: BtnStateUnassigned, LastChange: now}))
+	_, ok := rw.applyBtnRelease("2", status(buttonRelease{Dir: "down", At: now})).(*TransitionError)
+	assert.True(t, ok, "unassigned call handed back")
+
+	rw.applyBtnDownUpdate("2", status(Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1", LastChange: now}))
+	assert.Nil(t, rw.applyBtnRelease("2", status(buttonRelease{Dir: "down", At: now})))
+	assert.Equal(t, BtnStateUnassigned, rw.GetState().HallDownButtons["2"].LastStatus)
+	rw.applyBtnDownUpdate("2", status(Status{LastStatus: BtnStateAssigned, AssignedTo: "lift2", LastChange: now}))
+	assert.Equal(t, 1, rw.History()[0].Reassignments())
+
+	_, ok = rw.applyBtnRelease("0", status(buttonRelease{Dir: "down", At: now})).(*InvalidButtonError)
+	assert.True(t, ok, "down call at ground floor handed back")
+}
+
+func Test_AdminThroughAPI(t *testing.T) {
+	var nodes []*FSM
+	for i, port := range []int{9054, 9056, 9058} {
+		config := Config{
+			RaftPort:           port,
+			Floors:             4,
+			CostFunction:       func(s State, f int, d string) string { return "" },
+			Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+			DisableRaftLogging: true,
+		}
+		if i > 0 {
+			config.InitalPeer = nodes[0].CommAddr()
+		}
+		node := &FSM{}
+		if err := node.Init(config); err != nil {
+			t.Fatalf("failed to initialize FSM: %v", err)
+		}
+		defer node.Shutdown()
+		nodes = append(nodes, node)
+	}
+	leader, follower := nodes[0].wrapper.ownID, nodes[1].wrapper.ownID
+	if !assert.Equal(t, leader, nodes[1].Leader()) {
+		return
+	}
+
+	// Requests are sent to a follower, and redirected to the leader.
+	client := NewAPIClient(nodes[1].CommAddr(), "", nil)
+	client.Timeout = 30 * time.Second
+	var node NodeV1
+	assert.NoError(t, client.Do("PUT", "/v1/nodes/"+follower+"/mode", ServiceModeV1{Mode: ServiceModeDrain}, &node))
+	assert.Equal(t, ServiceModeDrain, node.Mode)
+	assert.Error(t, client.Do("PUT", "/v1/nodes/"+follower+"/mode", ServiceModeV1{Mode: "sleep"}, nil))
+	assert.Error(t, client.Do("POST", "/v1/hall-calls/1/up/reassign", nil, nil), "call not assigned")
+
+	var snapshot SnapshotV1
+	assert.NoError(t, client.Do("POST", "/v1/snapshot", nil, &snapshot))
+	assert.NotZero(t, snapshot.Index)
+
+	// The old leader is back as a follower of the new one.
+	var l LeaderV1
+	assert.NoError(t, client.Do("POST", "/v1/leadership/transfer", nil, &l))
+	assert.NotEqual(t, leader, l.Leader)
+	assert.NotEmpty(t, l.LeaderCommAddr)
+	assert.Equal(t, l.Leader, nodes[0].Leader())
+	assert.NotEqual(t, raft.Leader, nodes[0].wrapper.getRaft().State(), "old leader elected itself")
+	var m MembershipV1
+	assert.NoError(t, NewAPIClient(l.LeaderCommAddr, "", nil).Get("/v1/membership", &m))
+	assert.Contains(t, m.Peers, leader)
+	assert.NoError(t, nodes[0].UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: BtnStateUnassigned}))
+	state, _ := nodes[0].GetState()
+	assert.Equal(t, ServiceModeDrain, state.Nodes[follower].Mode)
+}
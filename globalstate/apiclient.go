@@ -0,0 +1,103 @@
+package globalstate
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/clustertls"
+)
+
+// APIClient is a client of the /v1 API of the communication service of a
+// node, for tools monitoring or administering a cluster. Requests are signed
+// with the cluster secret and sent over mutual TLS the same way as between the
+// nodes, and requests only the leader may serve are redirected to it.
+type APIClient struct {
+	// Addr is the address (ip:port) of the communication service.
+	Addr string
+	// Timeout of each request. Zero means no timeout.
+	Timeout time.Duration
+
+	client *commClient
+}
+
+// NewAPIClient returns a client of the node with the communication service at
+// addr. The secret and TLS configuration must be the ones of the cluster, or
+// empty and nil if it has none.
+func NewAPIClient(addr, secret string, tlsConfig *tls.Config) *APIClient {
+	return &APIClient{
+		Addr:    addr,
+		Timeout: 10 * time.Second,
+		client:  newCommClient(newAuthenticator(secret), tlsConfig),
+	}
+}
+
+// LoadAPIClient returns a client of the node with the communication service at
+// addr, set up from the files of the cluster: the file holding the secret, and
+// the certificate of the CA, the certificate and the key for mutual TLS. Files
+// left empty are not used, but the TLS files must be given all or none.
+func LoadAPIClient(addr, secretFile, tlsCA, tlsCert, tlsKey string) (*APIClient, error) {
+	var secret string
+	if secretFile != "" {
+		var err error
+		if secret, err = ReadSecretFile(secretFile); err != nil {
+			return nil, err
+		}
+	}
+	var tlsConfig *tls.Config
+	if tlsCA != "" || tlsCert != "" || tlsKey != "" {
+		if tlsCA == "" || tlsCert == "" || tlsKey == "" {
+			return nil, fmt.Errorf("TLS requires all of the CA, the certificate and the key")
+		}
+		var err error
+		if tlsConfig, err = clustertls.LoadConfig(tlsCA, tlsCert, tlsKey); err != nil {
+			return nil, err
+		}
+	}
+	return NewAPIClient(addr, secret, tlsConfig), nil
+}
+
+// ReadSecretFile returns the secret of the cluster held by the file, without
+// surrounding whitespace. Empty files are rejected, as an empty secret turns
+// signing off.
+func ReadSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// Do sends a request to the path, with the body, if any, encoded as JSON.
+// The response is decoded into v, unless v is nil. Errors reported by the
+// service are returned as errors.
+func (c *APIClient) Do(method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	res, err := c.client.do(method, c.Addr, path, b, c.Timeout)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 || v == nil {
+		return checkResponse(res)
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Get decodes the response to a GET request for the path into v.
+func (c *APIClient) Get(path string, v interface{}) error {
+	return c.Do("GET", path, nil, v)
+}
@@ -0,0 +1,63 @@
+package globalstate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_APIClient(t *testing.T) {
+	const secret = "correct horse battery staple"
+	rw := newRaftWrapper("0", 4)
+	rw.auth = newAuthenticator(secret)
+	srv := httptest.NewServer(newCommService("127.0.0.1:0", rw))
+	defer srv.Close()
+
+	// Requests only the leader may serve are followed to it, still signed.
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", srv.URL+r.URL.RequestURI())
+		writeError(w, http.StatusTemporaryRedirect, "only the leader may serve the request")
+	}))
+	defer follower.Close()
+
+	client := NewAPIClient(strings.TrimPrefix(follower.URL, "http://"), secret, nil)
+	var state StateV1
+	assert.NoError(t, client.Get("/v1/state", &state))
+	assert.Equal(t, uint(4), state.Floors)
+
+	err := client.Get("/v1/nodes/10.0.0.1:8000", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no such node")
+	}
+
+	client = NewAPIClient(strings.TrimPrefix(srv.URL, "http://"), "wrong", nil)
+	assert.Error(t, client.Get("/v1/state", &state))
+}
+
+func Test_LoadAPIClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty, secret := filepath.Join(dir, "empty"), filepath.Join(dir, "secret")
+	ioutil.WriteFile(empty, []byte(" \n"), 0600)
+	ioutil.WriteFile(secret, []byte("correct horse battery staple\n"), 0600)
+
+	// An empty secret would turn signing off
+	_, err = LoadAPIClient("127.0.0.1:1", empty, "", "", "")
+	assert.Error(t, err)
+	_, err = LoadAPIClient("127.0.0.1:1", secret, "ca.crt", "", "")
+	assert.Error(t, err)
+
+	client, err := LoadAPIClient("127.0.0.1:1", secret, "", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("correct horse battery staple"), client.client.auth.secret)
+	}
+}
@@ -0,0 +1,750 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
+)
+
+/*
+Version 1 of the public API of the communication service. The API is described
+by the OpenAPI document served at /v1/openapi.json, and changes to it must be
+backwards compatible. All errors are returned as JSON on the form
+	{"error": {"code": 404, "message": "..."}}
+If a cluster secret is configured, all requests must be signed the same way as
+requests between the nodes are. The types of the API are exported, such that
+tools may decode the responses through an APIClient.
+*/
+
+// NodeV1 is a lift as presented by the API.
+type NodeV1 struct {
+	ID                         string    `json:"id"`
+	CommAddr                   string    `json:"commAddr"`
+	LastFloor                  uint      `json:"lastFloor"`
+	Direction                  string    `json:"direction"`
+	DestinationFloor           uint      `json:"destinationFloor"`
+	DestinationButtonDirection string    `json:"destinationButtonDirection"`
+	LastUpdate                 time.Time `json:"lastUpdate"`
+	DoorOpen                   bool      `json:"doorOpen"`
+	CabCalls                   []uint    `json:"cabCalls"`
+	Mode                       string    `json:"mode"`
+}
+
+// ServiceModeV1 is the service mode of a lift, either normal or drain.
+type ServiceModeV1 struct {
+	Mode string `json:"mode"`
+}
+
+// HallCallV1 is a hall call as presented by the API.
+type HallCallV1 struct {
+	Floor      uint      `json:"floor"`
+	Direction  string    `json:"direction"`
+	Status     string    `json:"status"`
+	AssignedTo string    `json:"assignedTo,omitempty"`
+	LastChange time.Time `json:"lastChange"`
+	Version    uint64    `json:"version"`
+}
+
+// StateV1 is the full cluster state as presented by the API.
+type StateV1 struct {
+	Index     uint64       `json:"index"`
+	Floors    uint         `json:"floors"`
+	Nodes     []NodeV1     `json:"nodes"`
+	HallCalls []HallCallV1 `json:"hallCalls"`
+}
+
+// CallV1 is a call placed through the API.
+type CallV1 struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Floor      uint      `json:"floor"`
+	Direction  string    `json:"direction,omitempty"`
+	Lift       string    `json:"lift,omitempty"`
+	Status     string    `json:"status"`
+	Created    time.Time `json:"created"`
+	LastChange time.Time `json:"lastChange"`
+}
+
+// MemberV1 is a node joining or leaving the cluster.
+type MemberV1 struct {
+	ID     string `json:"id"`
+	Joined bool   `json:"joined"`
+}
+
+// LeaderV1 is the leader of the cluster, as seen by the node.
+type LeaderV1 struct {
+	Leader         string `json:"leader"`
+	LeaderCommAddr string `json:"leaderCommAddr"`
+}
+
+// HallCallRecordV1 is the lifecycle of a hall call as presented by the API.
+type HallCallRecordV1 struct {
+	Floor         uint           `json:"floor"`
+	Direction     string         `json:"direction"`
+	Pressed       time.Time      `json:"pressed"`
+	Assignments   []AssignmentV1 `json:"assignments"`
+	Reassignments int            `json:"reassignments"`
+	Done          *time.Time     `json:"done,omitempty"`
+	ServedBy      string         `json:"servedBy,omitempty"`
+	WaitingTime   *float64       `json:"waitingTime,omitempty"`
+}
+
+// AssignmentV1 is the assignment of a hall call to a lift.
+type AssignmentV1 struct {
+	Lift string    `json:"lift"`
+	At   time.Time `json:"at"`
+}
+
+// HistoryStatsV1 summarizes the history of hall calls. Waiting times are in
+// seconds, and keyed by percentile, such as "p95", and "max".
+type HistoryStatsV1 struct {
+	Calls         int                `json:"calls"`
+	Served        int                `json:"served"`
+	Outstanding   int                `json:"outstanding"`
+	Reassignments int                `json:"reassignments"`
+	WaitingTime   map[string]float64 `json:"waitingTime"`
+}
+
+// SnapshotV1 is a snapshot of the raft taken by a node.
+type SnapshotV1 struct {
+	Index uint64 `json:"index"`
+}
+
+// FaultsV1 are the faults injected into the traffic of a node. Latency and
+// jitter are in milliseconds, and partitions hold the raft addresses of the
+// nodes in them, by name.
+type FaultsV1 struct {
+	DropRate   float64             `json:"dropRate"`
+	LatencyMs  int64               `json:"latencyMs"`
+	JitterMs   int64               `json:"jitterMs"`
+	Partitions map[string][]string `json:"partitions"`
+}
+
+// eventKeepAlive is the interval of comments sent on idle event streams, such
+// that proxies and clients don't give up on them.
+const eventKeepAlive = 15 * time.Second
+
+// maxCallWait limits how long a request may wait for a call to change.
+const maxCallWait = time.Minute
+
+// MembershipV1 describe the members of the raft, as seen by the node.
+type MembershipV1 struct {
+	Self           string   `json:"self"`
+	Leader         string   `json:"leader"`
+	LeaderCommAddr string   `json:"leaderCommAddr"`
+	Peers          []string `json:"peers"`
+}
+
+func (s *commService) routesV1(rt *router) {
+	rt.handleFunc("GET", "/v1/openapi.json", s.handleOpenAPI)
+	rt.handleFunc("GET", "/v1/state", s.handleGetState)
+	rt.handleFunc("GET", "/v1/nodes", s.handleGetNodes)
+	rt.handle("GET", "/v1/nodes/{id}", s.handleGetNode)
+	rt.handle("PUT", "/v1/nodes/{id}/mode", s.handleSetServiceMode)
+	rt.handleFunc("GET", "/v1/hall-calls", s.handleGetHallCalls)
+	rt.handle("POST", "/v1/hall-calls/{floor}/{direction}/reassign", s.handleReassignHallCall)
+	rt.handleFunc("GET", "/v1/membership", s.handleGetMembership)
+	rt.handle("DELETE", "/v1/membership/{id}", s.handleDeleteMember)
+	rt.handleFunc("POST", "/v1/leadership/transfer", s.handleTransferLeadership)
+	rt.handleFunc("POST", "/v1/snapshot", s.handleSnapshot)
+	rt.handleFunc("GET", "/v1/faults", s.handleGetFaults)
+	rt.handleFunc("PUT", "/v1/faults", s.handleSetFaults)
+	rt.handleFunc("GET", "/v1/calls", s.handleGetCalls)
+	rt.handleFunc("POST", "/v1/calls", s.handlePlaceCall)
+	rt.handle("GET", "/v1/calls/{id}", s.handleGetCall)
+	rt.handle("DELETE", "/v1/calls/{id}", s.handleCancelCall)
+	rt.handleFunc("GET", "/v1/events", s.handleEvents)
+	rt.handleFunc("GET", "/v1/history", s.handleGetHistory)
+	rt.handleFunc("GET", "/v1/history/stats", s.handleGetHistoryStats)
+}
+
+func (s *commService) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write([]byte(openAPIv1))
+}
+
+func (s *commService) handleGetState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, stateToV1(s.store.GetState()))
+}
+
+func (s *commService) handleGetNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, nodesV1(s.store.GetState()))
+}
+
+func (s *commService) handleGetNode(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	ls, ok := s.store.GetState().Nodes[params["id"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such node: %s", params["id"])
+		return
+	}
+	writeJSON(w, http.StatusOK, nodeToV1(params["id"], ls))
+}
+
+// handleSetServiceMode takes a lift out of service, or puts it back in. Only
+// the leader is able to do so, and other nodes redirect the request to it.
+func (s *commService) handleSetServiceMode(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !s.redirectToLeader(w, r) {
+		return
+	}
+	var req ServiceModeV1
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed service mode: %s", err.Error())
+		return
+	}
+	if req.Mode != ServiceModeNormal && req.Mode != ServiceModeDrain {
+		writeError(w, http.StatusBadRequest, "invalid service mode: %s", req.Mode)
+		return
+	}
+	if _, ok := s.store.GetState().Nodes[params["id"]]; !ok {
+		writeError(w, http.StatusNotFound, "no such node: %s", params["id"])
+		return
+	}
+	if err := s.store.SetServiceMode(params["id"], req.Mode); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "unable to set service mode: %s", err.Error())
+		return
+	}
+	s.logger.Printf("[INFO] Service mode of %s set to %s\n", params["id"], req.Mode)
+	writeJSON(w, http.StatusOK, nodeToV1(params["id"], s.store.GetState().Nodes[params["id"]]))
+}
+
+func (s *commService) handleGetHallCalls(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hallCallsV1(s.store.GetState()))
+}
+
+// handleReassignHallCall hands an assigned hall call back for assignment,
+// such as when the lift it is assigned to is stuck. Only the leader is able
+// to do so, and other nodes redirect the request to it.
+func (s *commService) handleReassignHallCall(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !s.redirectToLeader(w, r) {
+		return
+	}
+	floor, dir := params["floor"], params["direction"]
+	if err := validateButton(floor, dir, s.store.GetState().Floors); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	f, _ := strconv.Atoi(floor)
+	err := s.store.ReassignHallCall(uint(f), dir)
+	switch err.(type) {
+	case nil:
+	case *TransitionError:
+		writeError(w, http.StatusConflict, "only assigned hall calls may be reassigned: %s", err.Error())
+		return
+	default:
+		writeError(w, http.StatusServiceUnavailable, "unable to reassign hall call: %s", err.Error())
+		return
+	}
+	s.logger.Printf("[INFO] Hall call %s %s handed back for reassignment\n", dir, floor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *commService) handleGetMembership(w http.ResponseWriter, r *http.Request) {
+	status, err := s.store.clusterStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	sort.Strings(status.Peers)
+	writeJSON(w, http.StatusOK, MembershipV1{
+		Self:           status.ID,
+		Leader:         status.Leader,
+		LeaderCommAddr: status.LeaderComm,
+		Peers:          status.Peers,
+	})
+}
+
+// handleDeleteMember removes a node from the raft. Only the leader is able to
+// do so, and other nodes redirect the request to it.
+func (s *commService) handleDeleteMember(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !s.redirectToLeader(w, r) {
+		return
+	}
+	id := params["id"]
+	peers, err := s.store.peers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	if !stringInSlice(id, peers) {
+		writeError(w, http.StatusNotFound, "%s is not a member of the raft", id)
+		return
+	}
+	if err := s.store.Kick(id); err != nil {
+		s.logger.Printf("[WARN] Refused to kick %s: %s\n", id, err.Error())
+		writeError(w, http.StatusConflict, "%s", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTransferLeadership makes the leader hand the leadership over to
+// another node, and responds with the new leader once the node is back in the
+// raft as a follower. Other nodes redirect the request to the leader.
+func (s *commService) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	if s.transferLeadership == nil {
+		writeError(w, http.StatusNotImplemented, "leadership transfer not available on the node")
+		return
+	}
+	if !s.redirectToLeader(w, r) {
+		return
+	}
+	leader, err := s.transferLeadership()
+	if err != nil {
+		s.logger.Printf("[WARN] Unable to transfer leadership: %s\n", err.Error())
+		writeError(w, http.StatusConflict, "unable to transfer leadership: %s", err.Error())
+		return
+	}
+	comm, _ := s.store.commAddr(leader)
+	writeJSON(w, http.StatusOK, LeaderV1{Leader: leader, LeaderCommAddr: comm})
+}
+
+// handleSnapshot makes the node take a snapshot of the raft, compacting its
+// log. Every node takes its own snapshots, so the request is never redirected.
+func (s *commService) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.getRaft().Snapshot().Error(); err != nil {
+		writeError(w, http.StatusConflict, "unable to take snapshot: %s", err.Error())
+		return
+	}
+	index, _ := strconv.ParseUint(s.store.getRaft().Stats()["last_snapshot_index"], 10, 64)
+	s.logger.Printf("[INFO] Took snapshot of the raft at index %d\n", index)
+	writeJSON(w, http.StatusOK, SnapshotV1{Index: index})
+}
+
+// handleGetFaults responds with the faults injected into the traffic of the
+// node. Every node has its own faults, so requests are never redirected.
+func (s *commService) handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	if s.store.config.Faults == nil {
+		writeError(w, http.StatusNotImplemented, "fault injection not enabled on the node")
+		return
+	}
+	writeJSON(w, http.StatusOK, faultsToV1(s.store.config.Faults.Settings()))
+}
+
+// handleSetFaults replaces the faults injected into the traffic of the node.
+func (s *commService) handleSetFaults(w http.ResponseWriter, r *http.Request) {
+	if s.store.config.Faults == nil {
+		writeError(w, http.StatusNotImplemented, "fault injection not enabled on the node")
+		return
+	}
+	var req FaultsV1
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed faults: %s", err.Error())
+		return
+	}
+	settings := faultnet.Settings{
+		DropRate:   req.DropRate,
+		Latency:    time.Duration(req.LatencyMs) * time.Millisecond,
+		Jitter:     time.Duration(req.JitterMs) * time.Millisecond,
+		Partitions: req.Partitions,
+	}
+	if err := s.store.config.Faults.Set(settings); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	s.logger.Printf("[WARN] Injecting network faults: %s\n", settings)
+	writeJSON(w, http.StatusOK, faultsToV1(s.store.config.Faults.Settings()))
+}
+
+func (s *commService) handleGetCalls(w http.ResponseWriter, r *http.Request) {
+	calls := []CallV1{}
+	for _, c := range s.store.GetState().Calls {
+		calls = append(calls, callToV1(c))
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Created.Before(calls[j].Created) })
+	writeJSON(w, http.StatusOK, calls)
+}
+
+// handlePlaceCall places a hall or cab call, and responds with the call and
+// its location.
+func (s *commService) handlePlaceCall(w http.ResponseWriter, r *http.Request) {
+	if !s.callsAllowed(w) || !s.redirectToLeader(w, r) {
+		return
+	}
+	var req CallV1
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed call: %s", err.Error())
+		return
+	}
+	c := Call{Type: req.Type, Floor: req.Floor, Dir: req.Direction, Lift: req.Lift}
+	if err := validateCall(c, s.store.GetState()); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	c, err := s.store.PlaceCall(c)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "unable to place call: %s", err.Error())
+		return
+	}
+	w.Header().Set("Location", "/v1/calls/"+c.ID)
+	writeJSON(w, http.StatusCreated, callToV1(c))
+}
+
+// handleGetCall responds with the call. If wait is given, such as
+// ?wait=30s, the response is held back until the status of the call change
+// or the duration has passed, which let clients follow a call without
+// polling it continuously.
+func (s *commService) handleGetCall(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	c, ok := s.store.GetState().Calls[params["id"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such call: %s", params["id"])
+		return
+	}
+	if wait := r.URL.Query().Get("wait"); wait != "" && c.Open() {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid wait: %s", wait)
+			return
+		}
+		if d > maxCallWait {
+			d = maxCallWait
+		}
+		c, _ = s.store.waitForCall(c.ID, c.Status, d)
+	}
+	writeJSON(w, http.StatusOK, callToV1(c))
+}
+
+func (s *commService) handleCancelCall(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if !s.callsAllowed(w) || !s.redirectToLeader(w, r) {
+		return
+	}
+	if _, ok := s.store.GetState().Calls[params["id"]]; !ok {
+		writeError(w, http.StatusNotFound, "no such call: %s", params["id"])
+		return
+	}
+	c, err := s.store.CancelCall(params["id"])
+	if err == ErrCallClosed {
+		writeError(w, http.StatusConflict, "call %s is already %s", c.ID, c.Status)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "unable to cancel call: %s", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, callToV1(c))
+}
+
+// handleGetHistory responds with the history of hall calls, in the order they
+// were pressed. See queryHistory for the filters available.
+func (s *commService) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := queryHistory(s.store.History(), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	records := []HallCallRecordV1{}
+	for _, h := range history {
+		records = append(records, historyRecordToV1(h))
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// handleGetHistoryStats responds with the number of hall calls and the
+// percentiles of their waiting times, for the same filters as the history.
+func (s *commService) handleGetHistoryStats(w http.ResponseWriter, r *http.Request) {
+	history, err := queryHistory(s.store.History(), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+	stats := historyStats(history)
+	res := HistoryStatsV1{
+		Calls:         stats.Calls,
+		Served:        stats.Served,
+		Outstanding:   stats.Calls - stats.Served,
+		Reassignments: stats.Reassignments,
+		WaitingTime:   map[string]float64{},
+	}
+	for _, p := range stats.WaitingTime {
+		res.WaitingTime["p"+strconv.FormatFloat(p.P, 'f', -1, 64)] = p.Wait.Seconds()
+	}
+	if stats.Served > 0 {
+		res.WaitingTime["max"] = stats.MaxWaitTime.Seconds()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// queryHistory returns the hall calls of the history matching the query of
+// the request:
+//
+//	floor=<floor>          Only calls at the floor
+//	direction=<up|down>    Only calls in the direction
+//	since=<RFC 3339 time>  Only calls pressed at or after the time
+//	limit=<n>              Only the n most recent of the calls
+func queryHistory(history []HallCallRecord, r *http.Request) ([]HallCallRecord, error) {
+	q := r.URL.Query()
+	floor := -1
+	if v := q.Get("floor"); v != "" {
+		f, err := strconv.Atoi(v)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid floor: %s", v)
+		}
+		floor = f
+	}
+	dir := q.Get("direction")
+	if dir != "" && dir != "up" && dir != "down" {
+		return nil, fmt.Errorf("invalid direction: %s", dir)
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since: %s", v)
+		}
+		since = t
+	}
+	limit := -1
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit: %s", v)
+		}
+		limit = n
+	}
+
+	var matching []HallCallRecord
+	for _, h := range history {
+		if (floor >= 0 && h.Floor != uint(floor)) || (dir != "" && h.Dir != dir) || h.Pressed.Before(since) {
+			continue
+		}
+		matching = append(matching, h)
+	}
+	if limit >= 0 && len(matching) > limit {
+		matching = matching[len(matching)-limit:]
+	}
+	return matching, nil
+}
+
+// handleEvents streams changes of the state as Server-Sent Events. The id of
+// every event is the raft index it stems from and its position among the
+// events of that index, as <index>.<position>. A client may resume after an
+// event with either the Last-Event-ID header or ?since=<id>, where a bare
+// index resumes after all events of the index. The stream starts with a reset
+// event holding the full state whenever the client don't resume, or resume
+// from further back than the node remember.
+func (s *commService) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if q := r.URL.Query().Get("since"); q != "" {
+		since = q
+	}
+	var sinceID eventID
+	if since != "" {
+		var err error
+		if sinceID, err = parseEventID(since); err != nil {
+			writeError(w, http.StatusBadRequest, "%s", err.Error())
+			return
+		}
+	}
+
+	events, ch := s.store.subscribe(sinceID)
+	defer s.store.events.unsubscribe(ch)
+	shutdown := s.store.done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	last := sinceID
+	for _, e := range events {
+		s.writeEvent(w, e)
+		last = e.id()
+	}
+	// Leader changes are not replayed reliably, so always tell where it is
+	s.writeEvent(w, Event{Index: last.Index, Sub: last.Sub, Type: EventLeader, Leader: s.store.GetLeader()})
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				// Unable to keep up. The client should resume from the last id.
+				return
+			}
+			s.writeEvent(w, e)
+		case <-time.After(eventKeepAlive):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-shutdown:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *commService) writeEvent(w http.ResponseWriter, e Event) {
+	var data interface{}
+	switch e.Type {
+	case EventReset:
+		data = stateToV1(e.State)
+	case EventButton:
+		data = HallCallV1{
+			Floor:      e.Floor,
+			Direction:  e.Dir,
+			Status:     e.Button.LastStatus,
+			AssignedTo: e.Button.AssignedTo,
+			LastChange: e.Button.LastChange,
+			Version:    e.Button.Version,
+		}
+	case EventLift:
+		data = nodeToV1(e.Lift.ID, e.Lift)
+	case EventMembership:
+		data = MemberV1{ID: e.Node, Joined: e.Joined}
+	case EventLeader:
+		comm, _ := s.store.commAddr(e.Leader)
+		data = LeaderV1{Leader: e.Leader, LeaderCommAddr: comm}
+	case EventCall:
+		data = callToV1(e.Call)
+	}
+	b, _ := json.Marshal(data)
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.id(), e.Type, b)
+}
+
+// callsAllowed returns true if requests are authenticated, either by the
+// cluster secret or mutual TLS. Otherwise calls may not be placed or
+// cancelled, and the request is refused.
+func (s *commService) callsAllowed(w http.ResponseWriter) bool {
+	if s.store.auth != nil || s.store.config.TLS != nil {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "calls may only be placed in clusters with a secret or TLS")
+	return false
+}
+
+// redirectToLeader returns true if the node is the leader. Otherwise the
+// request is redirected to the same path at the leader, and false returned.
+func (s *commService) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if s.store.GetStatus() == 2 {
+		return true
+	}
+	leader, err := s.store.leaderComEndpoint()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "no leader available: %s", err.Error())
+		return false
+	}
+	w.Header().Set("X-Raft-Leader", leader)
+	w.Header().Set("Location", s.store.client.url(leader, r.URL.RequestURI()))
+	writeError(w, http.StatusTemporaryRedirect, "only the leader at %s may serve the request", leader)
+	return false
+}
+
+func nodesV1(s State) []NodeV1 {
+	nodes := []NodeV1{}
+	for id, ls := range s.Nodes {
+		nodes = append(nodes, nodeToV1(id, ls))
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+func nodeToV1(id string, ls LiftStatus) NodeV1 {
+	return NodeV1{
+		ID:                         id,
+		CommAddr:                   ls.CommAddr,
+		LastFloor:                  ls.LastFloor,
+		Direction:                  ls.Direction,
+		DestinationFloor:           ls.DestinationFloor,
+		DestinationButtonDirection: ls.DestinationButtonDirection,
+		LastUpdate:                 ls.LastUpdate,
+		DoorOpen:                   ls.DoorOpen,
+		CabCalls:                   append([]uint{}, ls.CabCalls...),
+		Mode:                       serviceModeOf(ls),
+	}
+}
+
+// serviceModeOf returns the service mode of the lift. Lifts never drained are
+// in normal service.
+func serviceModeOf(ls LiftStatus) string {
+	if ls.Mode == "" {
+		return ServiceModeNormal
+	}
+	return ls.Mode
+}
+
+// hallCallsV1 returns all hall calls that are not done, ordered by floor.
+func hallCallsV1(s State) []HallCallV1 {
+	calls := []HallCallV1{}
+	add := func(buttons map[string]Status, dir string) {
+		for floorStr, st := range buttons {
+			if st.LastStatus == BtnStateDone {
+				continue
+			}
+			floor, _ := strconv.Atoi(floorStr)
+			calls = append(calls, HallCallV1{
+				Floor:      uint(floor),
+				Direction:  dir,
+				Status:     st.LastStatus,
+				AssignedTo: st.AssignedTo,
+				LastChange: st.LastChange,
+				Version:    st.Version,
+			})
+		}
+	}
+	add(s.HallUpButtons, "up")
+	add(s.HallDownButtons, "down")
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].Floor != calls[j].Floor {
+			return calls[i].Floor < calls[j].Floor
+		}
+		return calls[i].Direction < calls[j].Direction
+	})
+	return calls
+}
+
+func historyRecordToV1(h HallCallRecord) HallCallRecordV1 {
+	record := HallCallRecordV1{
+		Floor:         h.Floor,
+		Direction:     h.Dir,
+		Pressed:       h.Pressed,
+		Assignments:   []AssignmentV1{},
+		Reassignments: h.Reassignments(),
+		ServedBy:      h.ServedBy,
+	}
+	for _, a := range h.Assignments {
+		record.Assignments = append(record.Assignments, AssignmentV1{Lift: a.Lift, At: a.At})
+	}
+	if wait, ok := h.WaitingTime(); ok {
+		done, seconds := h.Done, wait.Seconds()
+		record.Done = &done
+		record.WaitingTime = &seconds
+	}
+	return record
+}
+
+func callToV1(c Call) CallV1 {
+	return CallV1{
+		ID:         c.ID,
+		Type:       c.Type,
+		Floor:      c.Floor,
+		Direction:  c.Dir,
+		Lift:       c.Lift,
+		Status:     c.Status,
+		Created:    c.Created,
+		LastChange: c.LastChange,
+	}
+}
+
+func faultsToV1(f faultnet.Settings) FaultsV1 {
+	return FaultsV1{
+		DropRate:   f.DropRate,
+		LatencyMs:  int64(f.Latency / time.Millisecond),
+		JitterMs:   int64(f.Jitter / time.Millisecond),
+		Partitions: f.Partitions,
+	}
+}
+
+func stateToV1(s State) StateV1 {
+	return StateV1{
+		Index:     s.Index,
+		Floors:    s.Floors,
+		Nodes:     nodesV1(s),
+		HallCalls: hallCallsV1(s),
+	}
+}
@@ -0,0 +1,141 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// apiServer returns a server for the routes of a comm service backed by a
+// raftwrapper holding the state, without any raft behind it.
+func apiServer(state State) *httptest.Server {
+	rw := newRaftWrapper("0", int(state.Floors))
+	rw.state = state
+	return httptest.NewServer(newCommService("127.0.0.1:0", rw))
+}
+
+func Test_OpenAPIDocumentCoversRoutes(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal([]byte(openAPIv1), &doc); err != nil {
+		t.Fatalf("OpenAPI document is not valid JSON: %s", err.Error())
+	}
+
+	rt := &router{}
+	(&commService{}).routesV1(rt)
+	for _, r := range rt.routes {
+		path := "/" + strings.Join(r.segments, "/")
+		ops, ok := doc.Paths[path]
+		if !assert.True(t, ok, "%s is not documented", path) {
+			continue
+		}
+		_, ok = ops[strings.ToLower(r.method)]
+		assert.True(t, ok, "%s %s is not documented", r.method, path)
+	}
+}
+
+func Test_APIErrors(t *testing.T) {
+	srv := apiServer(State{Floors: 4, Nodes: map[string]LiftStatus{}})
+	defer srv.Close()
+
+	// Unknown path
+	res, err := http.Get(srv.URL + "/v1/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Error(t, checkResponse(res))
+
+	// Wrong method on a known path
+	req, _ := http.NewRequest("PUT", srv.URL+"/v1/nodes", nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e apiError
+	json.NewDecoder(res.Body).Decode(&e)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, "GET", res.Header.Get("Allow"))
+	assert.Equal(t, http.StatusMethodNotAllowed, e.Error.Code)
+	assert.NotEmpty(t, e.Error.Message)
+
+	// Unknown node
+	res, err = http.Get(srv.URL + "/v1/nodes/10.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Contains(t, checkResponse(res).Error(), "10.0.0.1:8000")
+}
+
+func Test_APIState(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	srv := apiServer(State{
+		Floors: 4,
+		Nodes: map[string]LiftStatus{
+			"10.0.0.2:8000": {ID: "10.0.0.2:8000", CommAddr: "10.0.0.2:8001", LastFloor: 2, Direction: "up", LastUpdate: now},
+			"10.0.0.1:8000": {ID: "10.0.0.1:8000", CommAddr: "10.0.0.1:8001", LastFloor: 0, Direction: "stop", LastUpdate: now},
+		},
+		HallUpButtons: map[string]Status{
+			"1": {LastStatus: BtnStateAssigned, AssignedTo: "10.0.0.2:8000", LastChange: now},
+			"0": {LastStatus: BtnStateDone, LastChange: now},
+		},
+		HallDownButtons: map[string]Status{
+			"3": {LastStatus: BtnStateUnassigned, LastChange: now},
+		},
+	})
+	defer srv.Close()
+
+	var nodes []NodeV1
+	res, err := http.Get(srv.URL + "/v1/nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&nodes))
+	res.Body.Close()
+	if assert.Len(t, nodes, 2) {
+		assert.Equal(t, "10.0.0.1:8000", nodes[0].ID)
+		assert.Equal(t, "10.0.0.2:8001", nodes[1].CommAddr)
+		assert.Equal(t, uint(2), nodes[1].LastFloor)
+	}
+
+	var node NodeV1
+	res, err = http.Get(srv.URL + "/v1/nodes/10.0.0.2:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&node))
+	res.Body.Close()
+	assert.Equal(t, "up", node.Direction)
+	assert.True(t, now.Equal(node.LastUpdate))
+
+	var calls []HallCallV1
+	res, err = http.Get(srv.URL + "/v1/hall-calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&calls))
+	res.Body.Close()
+	assert.Equal(t, []HallCallV1{
+		{Floor: 1, Direction: "up", Status: BtnStateAssigned, AssignedTo: "10.0.0.2:8000", LastChange: calls[0].LastChange},
+		{Floor: 3, Direction: "down", Status: BtnStateUnassigned, LastChange: calls[1].LastChange},
+	}, calls)
+
+	var state StateV1
+	res, err = http.Get(srv.URL + "/v1/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&state))
+	res.Body.Close()
+	assert.Equal(t, uint(4), state.Floors)
+	assert.Len(t, state.Nodes, 2)
+	assert.Len(t, state.HallCalls, 2)
+}
@@ -0,0 +1,129 @@
+package globalstate
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Every request sent between the communication services is signed with a
+HMAC-SHA256 of the method, request URI, a timestamp, a random nonce and the
+body, keyed with the secret shared by all members of the cluster. Requests
+that are unsigned, wrongly signed, older than maxAuthSkew or seen before are
+rejected. The clocks of the nodes must thus be reasonably synchronized.
+*/
+
+const (
+	headerTimestamp = "X-Lift-Timestamp"
+	headerNonce     = "X-Lift-Nonce"
+	headerSignature = "X-Lift-Signature"
+
+	// maxAuthSkew is the largest accepted difference between the timestamp of a
+	// request and the local clock.
+	maxAuthSkew = 30 * time.Second
+
+	// maxSignedBody limits how much of a request body is read before verifying it.
+	maxSignedBody = 1 << 20
+)
+
+// authenticator signs outgoing and verifies incoming requests. A nil
+// authenticator sends unsigned requests and accepts anything, which is the
+// behavior when no secret is configured.
+type authenticator struct {
+	secret []byte
+	mu     sync.Mutex
+	seen   map[string]time.Time // Nonces seen within maxAuthSkew
+}
+
+// newAuthenticator returns an authenticator for the secret, or nil if the
+// secret is empty.
+func newAuthenticator(secret string) *authenticator {
+	if secret == "" {
+		return nil
+	}
+	return &authenticator{
+		secret: []byte(secret),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// sign signs an outgoing request with the shared secret. The body must be the
+// same as the one sent with the request.
+func (a *authenticator) sign(req *http.Request, body []byte) error {
+	if a == nil {
+		return nil
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+	n := hex.EncodeToString(nonce)
+	req.Header.Set(headerTimestamp, ts)
+	req.Header.Set(headerNonce, n)
+	req.Header.Set(headerSignature, a.signature(req.Method, req.URL.RequestURI(), ts, n, body))
+	return nil
+}
+
+// verify checks the signature of an incoming request. The body is read in
+// order to verify it, and replaced such that handlers may read it as usual.
+func (a *authenticator) verify(r *http.Request) error {
+	if a == nil {
+		return nil
+	}
+	ts, nonce, sig := r.Header.Get(headerTimestamp), r.Header.Get(headerNonce), r.Header.Get(headerSignature)
+	if ts == "" || nonce == "" || sig == "" {
+		return fmt.Errorf("request not signed")
+	}
+	nanos, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp: %s", err.Error())
+	}
+	if skew := time.Since(time.Unix(0, nanos)); skew > maxAuthSkew || skew < -maxAuthSkew {
+		return fmt.Errorf("timestamp off by %v", skew)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := a.signature(r.Method, r.URL.RequestURI(), ts, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return fmt.Errorf("bad signature")
+	}
+
+	// Only check for replays once the request is known to be authentic, such
+	// that nobody are able to fill up the nonce cache.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for n, t := range a.seen {
+		if time.Since(t) > 2*maxAuthSkew {
+			delete(a.seen, n)
+		}
+	}
+	if _, replayed := a.seen[nonce]; replayed {
+		return fmt.Errorf("replayed request")
+	}
+	a.seen[nonce] = time.Now()
+	return nil
+}
+
+func (a *authenticator) signature(method, uri, ts, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, uri, ts, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
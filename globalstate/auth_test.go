@@ -0,0 +1,71 @@
+package globalstate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// authServer returns a server answering 200 to requests verified by auth, and
+// 401 to all others.
+func authServer(auth *authenticator) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.verify(r); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+}
+
+func Test_SignedRequests(t *testing.T) {
+	auth := newAuthenticator("correct horse battery staple")
+	srv := authServer(auth)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	// Correctly signed, with the body still readable by the handler
+	res, err := newCommClient(auth, nil).post(addr, "/update/button", []byte(`{"Floor":1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, `{"Floor":1}`, string(body))
+
+	// Unsigned
+	res, err = newCommClient(nil, nil).post(addr, "/join", []byte(`{"addr":"8000"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// Other secret
+	res, err = newCommClient(newAuthenticator("wrong"), nil).post(addr, "/join", []byte(`{"addr":"8000"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func Test_RejectTamperedAndReplayedRequests(t *testing.T) {
+	auth := newAuthenticator("correct horse battery staple")
+	signed := func(body string, ts time.Time) *http.Request {
+		r := httptest.NewRequest("POST", "/cmd", nil)
+		stamp := strconv.FormatInt(ts.UnixNano(), 10)
+		r.Header.Set(headerTimestamp, stamp)
+		r.Header.Set(headerNonce, "0123")
+		r.Header.Set(headerSignature, auth.signature("POST", "/cmd", stamp, "0123", []byte(body)))
+		return r
+	}
+	withBody := func(r *http.Request, body string) *http.Request {
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+		return r
+	}
+
+	assert.Error(t, auth.verify(withBody(signed(`{"Floor":1}`, time.Now()), `{"Floor":3}`)), "tampered body")
+	assert.Error(t, auth.verify(withBody(signed(`{"Floor":1}`, time.Now().Add(-time.Hour)), `{"Floor":1}`)), "stale request")
+	assert.NoError(t, auth.verify(withBody(signed(`{"Floor":1}`, time.Now()), `{"Floor":1}`)))
+	assert.Error(t, auth.verify(withBody(signed(`{"Floor":1}`, time.Now()), `{"Floor":1}`)), "replayed nonce")
+}
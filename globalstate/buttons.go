@@ -0,0 +1,119 @@
+package globalstate
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+Hall buttons follow a strict lifecycle, which is enforced as the raft log is
+applied:
+
+	done ──press──> unassigned ──assign──> assigned ──serve──> done
+	                     │                    │ ▲
+	                     └───────serve────────┼─┘ reassign
+	                                          └──> done
+
+A button that was never pressed is considered done. Pressing a button that
+is already lit, or serving one that is already done, is accepted but leaves
+the button as it is. Handing an order back as unassigned only happens when
+the lift it was assigned to leaves the cluster or is drained, or when the
+order is reassigned by hand.
+
+Every change increments the version of the button. An update may carry the
+version it was based on, and is then rejected if the button have changed
+since, such that decisions taken on an old state can't override newer ones.
+Assignments and releases carry the version they were decided on, and lifts
+report orders done with the version the button had when they took the order
+on. A late report from a lift the order was taken from is thereby rejected.
+Presses carry no version, as a press is news from the floor which no
+decision can make stale.
+*/
+
+// InvalidButtonError is returned for updates of buttons that don't exist.
+type InvalidButtonError struct {
+	Floor  string
+	Dir    string
+	Reason string
+}
+
+func (e *InvalidButtonError) Error() string {
+	return fmt.Sprintf("invalid button %s %s: %s", e.Dir, e.Floor, e.Reason)
+}
+
+// TransitionError is returned for updates not allowed by the lifecycle of
+// the button.
+type TransitionError struct {
+	Floor string
+	Dir   string
+	From  string
+	To    string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("button %s %s cannot go from %s to %s", e.Dir, e.Floor, e.From, e.To)
+}
+
+// StaleUpdateError is returned for updates based on an older version of the
+// button than the current one.
+type StaleUpdateError struct {
+	Floor   string
+	Dir     string
+	Version uint64 // The version the update was based on
+	Current uint64
+}
+
+func (e *StaleUpdateError) Error() string {
+	return fmt.Sprintf("stale update of button %s %s: based on version %d, but it is at %d", e.Dir, e.Floor, e.Version, e.Current)
+}
+
+// validateButton returns an InvalidButtonError unless the button exist on
+// lifts with the number of floors. If the number of floors is unknown, only
+// the direction is checked.
+func validateButton(floor, dir string, floors uint) error {
+	if dir != "up" && dir != "down" {
+		return &InvalidButtonError{Floor: floor, Dir: dir, Reason: "direction must be up or down"}
+	}
+	f, err := strconv.Atoi(floor)
+	if err != nil || f < 0 {
+		return &InvalidButtonError{Floor: floor, Dir: dir, Reason: "floor must be a non-negative integer"}
+	}
+	if floors == 0 {
+		return nil
+	}
+	switch {
+	case uint(f) >= floors:
+		return &InvalidButtonError{Floor: floor, Dir: dir, Reason: fmt.Sprintf("floor not in range [ 0 - %d ]", floors-1)}
+	case dir == "down" && f == 0:
+		return &InvalidButtonError{Floor: floor, Dir: dir, Reason: "no down button at ground floor"}
+	case dir == "up" && uint(f) == floors-1:
+		return &InvalidButtonError{Floor: floor, Dir: dir, Reason: "no up button at top floor"}
+	}
+	return nil
+}
+
+// transition checks the update of a button against its lifecycle. It returns
+// true if the update should be stored, false if it leaves the button as it
+// is, or an error if it is not allowed.
+func transition(floor, dir string, from, to Status) (bool, error) {
+	if to.Version != 0 && to.Version != from.Version {
+		return false, &StaleUpdateError{Floor: floor, Dir: dir, Version: to.Version, Current: from.Version}
+	}
+	current := from.LastStatus
+	if current == "" {
+		current = BtnStateDone
+	}
+	switch to.LastStatus {
+	case BtnStateUnassigned:
+		// Pressing a lit button changes nothing
+		return current == BtnStateDone, nil
+	case BtnStateAssigned:
+		if current == BtnStateDone {
+			return false, &TransitionError{Floor: floor, Dir: dir, From: current, To: to.LastStatus}
+		}
+		return true, nil
+	case BtnStateDone:
+		return current != BtnStateDone, nil
+	}
+	return false, &TransitionError{Floor: floor, Dir: dir, From: current, To: to.LastStatus}
+}
@@ -0,0 +1,90 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ButtonLifecycle(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.logger = log.New(ioutil.Discard, "", 0)
+	rw.state.Floors = 4
+	t0 := time.Now()
+	update := func(floor string, s Status) interface{} {
+		b, _ := json.Marshal(s)
+		return rw.applyBtnUpUpdate(floor, b)
+	}
+	button := func() Status { return rw.GetState().HallUpButtons["1"] }
+
+	// Buttons must be pressed before they are assigned
+	assert.IsType(t, &TransitionError{}, update("1", Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1"}))
+	assert.Nil(t, update("1", Status{LastStatus: BtnStateUnassigned, LastChange: t0}))
+	assert.Equal(t, uint64(1), button().Version)
+
+	// Pressing it again changes nothing
+	assert.Nil(t, update("1", Status{LastStatus: BtnStateUnassigned, LastChange: t0.Add(time.Second)}))
+	assert.Equal(t, t0.Unix(), button().LastChange.Unix())
+	assert.Equal(t, uint64(1), button().Version)
+
+	// Assignments based on an old version are rejected
+	assert.Nil(t, update("1", Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1", Version: 1}))
+	err := update("1", Status{LastStatus: BtnStateAssigned, AssignedTo: "lift2", Version: 1})
+	assert.Equal(t, &StaleUpdateError{Floor: "1", Dir: "up", Version: 1, Current: 2}, err)
+	assert.Equal(t, "lift1", button().AssignedTo)
+
+	// Reassignment and serving
+	assert.Nil(t, update("1", Status{LastStatus: BtnStateAssigned, AssignedTo: "lift2", Version: 2}))
+	assert.Equal(t, "lift2", button().AssignedTo)
+	assert.Nil(t, update("1", Status{LastStatus: BtnStateDone}))
+	assert.Equal(t, BtnStateDone, button().LastStatus)
+	assert.Equal(t, uint64(4), button().Version)
+
+	// Unknown statuses and buttons that don't exist
+	assert.IsType(t, &TransitionError{}, update("1", Status{LastStatus: "pressed"}))
+	assert.IsType(t, &InvalidButtonError{}, update("3", Status{LastStatus: BtnStateUnassigned}))
+	assert.IsType(t, &InvalidButtonError{}, update("4", Status{LastStatus: BtnStateUnassigned}))
+	assert.IsType(t, &InvalidButtonError{}, update("-1", Status{LastStatus: BtnStateUnassigned}))
+	assert.IsType(t, &InvalidButtonError{}, update("one", Status{LastStatus: BtnStateUnassigned}))
+	b, _ := json.Marshal(Status{LastStatus: BtnStateUnassigned})
+	assert.IsType(t, &InvalidButtonError{}, rw.applyBtnDownUpdate("0", b))
+}
+
+func Test_LateDoneAfterReassignment(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.logger = log.New(ioutil.Discard, "", 0)
+	apply := func(bsu ButtonStatusUpdate) error {
+		b, _ := json.Marshal(Status{LastStatus: bsu.Status, AssignedTo: bsu.AssignedTo, Version: bsu.Version})
+		err, _ := rw.applyBtnUpUpdate("1", b).(error)
+		return err
+	}
+	release := func(version uint64) interface{} {
+		b, _ := json.Marshal(buttonRelease{Dir: "up", At: time.Now(), Version: version})
+		return rw.applyBtnRelease("1", b)
+	}
+	button := func() Status { return rw.GetState().HallUpButtons["1"] }
+
+	// The lift is ordered with the version the button got when assigned to it
+	assert.Nil(t, apply(ButtonStatusUpdate{Floor: 1, Dir: "up", Status: BtnStateUnassigned}))
+	ordered, err := updateToAssigned(btn{Floor: 1, Dir: "up"}, rw.GetState(), "lift1", apply)
+	assert.NoError(t, err)
+	assert.Equal(t, button().Version, ordered)
+
+	// The order is reassigned while the lift is out of reach
+	assert.Nil(t, release(ordered))
+	assert.IsType(t, &StaleUpdateError{}, release(ordered))
+	_, err = updateToAssigned(btn{Floor: 1, Dir: "up"}, rw.GetState(), "lift2", apply)
+	assert.NoError(t, err)
+
+	// The late report of the first lift leaves the button with the second one
+	err = apply(ButtonStatusUpdate{Floor: 1, Dir: "up", Status: BtnStateDone, Version: ordered})
+	assert.IsType(t, &StaleUpdateError{}, err)
+	assert.Equal(t, BtnStateAssigned, button().LastStatus)
+	assert.Equal(t, "lift2", button().AssignedTo)
+	assert.Nil(t, apply(ButtonStatusUpdate{Floor: 1, Dir: "up", Status: BtnStateDone, Version: button().Version}))
+	assert.Equal(t, BtnStateDone, button().LastStatus)
+}
@@ -0,0 +1,415 @@
+package globalstate
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+/*
+Calls let external systems summon lifts without anyone pressing a button. A
+hall call lights the hall button and is assigned by the leader like any other
+hall order, while a cab call is passed straight to the lift it is placed on.
+Every call is kept in the replicated state under a random id, such that any
+node is able to tell whether the call have been served yet.
+
+A hall call is served when its button is done, and a cab call when the lift
+reports standing still at the floor of the call, or already does when the call
+is placed. Calls follow the order of the log rather than any timestamps, which
+are set by whichever node was leader at the time. Closed calls are kept for
+callRetention before they are forgotten.
+*/
+
+const (
+	// CallTypeHall is a call from outside the lifts, in a direction.
+	CallTypeHall = "hall"
+	// CallTypeCab is a call from inside a given lift.
+	CallTypeCab = "cab"
+
+	// CallPending is a call waiting for a lift.
+	CallPending = "pending"
+	// CallAssigned is a hall call that a lift have been dispatched to.
+	CallAssigned = "assigned"
+	// CallServed is a call that a lift have arrived at.
+	CallServed = "served"
+	// CallCancelled is a call that was cancelled, or whose lift left the cluster.
+	CallCancelled = "cancelled"
+
+	// callRetention is how long served and cancelled calls are kept.
+	callRetention = time.Hour
+)
+
+// ErrCallClosed is returned when cancelling a call that is already served or
+// cancelled.
+var ErrCallClosed = fmt.Errorf("call is already closed")
+
+// PlaceCall places a hall or cab call, and returns it with its id set. Only
+// the leader may place calls. Cab calls are passed on to the lift at once.
+func (rw *raftwrapper) PlaceCall(c Call) (Call, error) {
+	if rw.getRaft().State() != raft.Leader {
+		return Call{}, fmt.Errorf("not leader")
+	}
+	state := rw.GetState()
+	if err := validateCall(c, state); err != nil {
+		return Call{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Call{}, err
+	}
+	c.ID = hex.EncodeToString(id)
+	c.Status = CallPending
+	c.Created = rw.config.Clock()
+	c.LastChange = c.Created
+	if c.Type == CallTypeHall {
+		c.Lift = ""
+	}
+
+	v, _ := json.Marshal(c)
+	if err := rw.applyCommand("callPlace", c.ID, v); err != nil {
+		return Call{}, err
+	}
+	rw.logger.Printf("[INFO] Placed %s call %s to floor %d.\n", c.Type, c.ID, c.Floor)
+
+	if c.Type == CallTypeCab {
+		if err := rw.sendCmd(btn{Floor: int(c.Floor), Dir: CallTypeCab}, 0, c.Lift); err != nil {
+			rw.logger.Printf("[WARN] Unable to pass cab call %s on to %s: %s\n", c.ID, c.Lift, err.Error())
+			rw.CancelCall(c.ID)
+			return Call{}, fmt.Errorf("unable to reach lift %s: %s", c.Lift, err.Error())
+		}
+	}
+	return rw.GetState().Calls[c.ID], nil
+}
+
+// CancelCall cancels an open call. A hall call that no lift is dispatched to
+// yet turns the button off, unless other calls are waiting for it. Lifts
+// already on their way are not stopped.
+func (rw *raftwrapper) CancelCall(id string) (Call, error) {
+	if rw.getRaft().State() != raft.Leader {
+		return Call{}, fmt.Errorf("not leader")
+	}
+	c, ok := rw.GetState().Calls[id]
+	if !ok {
+		return Call{}, fmt.Errorf("no such call: %s", id)
+	}
+	if !c.Open() {
+		return c, ErrCallClosed
+	}
+
+	v, _ := json.Marshal(rw.config.Clock())
+	if err := rw.applyCommand("callCancel", id, v); err != nil {
+		return Call{}, err
+	}
+	rw.logger.Printf("[INFO] Cancelled call %s.\n", id)
+	return rw.GetState().Calls[id], nil
+}
+
+// adoptCall places an open call handed over from another cluster merging into
+// this one, keeping its id, such that clients waiting for it find it here. A
+// cab call is kept on its lift, which is about to join, and already has the
+// call in its queue. Calls already known are left as they are.
+func (rw *raftwrapper) adoptCall(c Call) error {
+	if rw.getRaft().State() != raft.Leader {
+		return fmt.Errorf("not leader")
+	}
+	if !c.Open() {
+		return ErrCallClosed
+	}
+	if c.ID == "" {
+		return fmt.Errorf("no call id provided")
+	}
+	state := rw.GetState()
+	if c.Type == CallTypeCab {
+		// The lift is about to join, and is taken for a member already
+		state.Nodes[c.Lift] = LiftStatus{}
+	}
+	if err := validateCall(c, state); err != nil {
+		return err
+	}
+	c.Status = CallPending
+	c.LastChange = rw.config.Clock()
+	if c.Type == CallTypeHall {
+		c.Lift = ""
+	}
+
+	v, _ := json.Marshal(c)
+	if err := rw.applyCommand("callPlace", c.ID, v); err != nil {
+		return err
+	}
+	rw.logger.Printf("[INFO] Adopted %s call %s to floor %d.\n", c.Type, c.ID, c.Floor)
+	return nil
+}
+
+// waitForCall blocks until the call change from the provided status, or the
+// timeout expire, and returns the call as it then stands.
+func (rw *raftwrapper) waitForCall(id, status string, timeout time.Duration) (Call, bool) {
+	deadline := time.After(timeout)
+	shutdown := rw.done()
+	for {
+		rw.mu.Lock()
+		c, ok := rw.state.Calls[id]
+		_, ch, _ := rw.events.subscribe(rw.lastEvent)
+		rw.mu.Unlock()
+
+		dropped := false
+		for ok && c.Status == status && !dropped {
+			select {
+			case e, open := <-ch:
+				if !open {
+					dropped = true
+				} else if e.Type == EventCall && e.Call.ID == id {
+					c = e.Call
+				} else if e.Type == EventReset {
+					c, ok = e.State.Calls[id]
+				}
+			case <-deadline:
+				rw.events.unsubscribe(ch)
+				return c, ok
+			case <-shutdown:
+				rw.events.unsubscribe(ch)
+				return c, ok
+			}
+		}
+		rw.events.unsubscribe(ch)
+		if !dropped {
+			return c, ok
+		}
+		// Dropped for being too slow. Start over from the current state, within
+		// the same deadline.
+	}
+}
+
+func (rw *raftwrapper) applyCommand(t, key string, v []byte) error {
+	b, err := json.Marshal(&command{Type: t, Key: key, Value: v, Time: rw.config.Clock()})
+	if err != nil {
+		rw.logger.Printf("[ERROR] Failed to marshal raft log command: %s\n", err.Error())
+		return err
+	}
+	start := time.Now()
+	future := rw.getRaft().Apply(b, 5*time.Second)
+	err = future.Error()
+	rw.metrics.observeApply(time.Since(start))
+	if err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func validateCall(c Call, s State) error {
+	if c.Floor >= s.Floors {
+		return fmt.Errorf("floor %d not in range [ 0 - %d ]", c.Floor, int(s.Floors)-1)
+	}
+	switch c.Type {
+	case CallTypeHall:
+		switch {
+		case c.Dir != "up" && c.Dir != "down":
+			return fmt.Errorf("direction must be up or down, not %q", c.Dir)
+		case c.Dir == "down" && c.Floor == 0:
+			return fmt.Errorf("no down button at ground floor")
+		case c.Dir == "up" && c.Floor == s.Floors-1:
+			return fmt.Errorf("no up button at top floor")
+		}
+	case CallTypeCab:
+		if _, ok := s.Nodes[c.Lift]; !ok {
+			return fmt.Errorf("no such lift: %q", c.Lift)
+		}
+	default:
+		return fmt.Errorf("call type must be %s or %s, not %q", CallTypeHall, CallTypeCab, c.Type)
+	}
+	return nil
+}
+
+// Internal fsm-functions for calls. The mutex is held by the caller of all
+// functions with names not starting with apply.
+// =============================================================================
+
+func (rw *raftwrapper) applyCallPlace(id string, b []byte) interface{} {
+	var c Call
+	if err := json.Unmarshal(b, &c); err != nil {
+		rw.logger.Printf("[ERROR] Unable to unmarshal call: %s\n", err.Error())
+		return fmt.Errorf("unable to unmarshal call: %s", err.Error())
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.state.Calls == nil {
+		rw.state.Calls = make(map[string]Call)
+	}
+	// A call handed over by several nodes of a merging cluster is kept once
+	if _, known := rw.state.Calls[c.ID]; known {
+		return nil
+	}
+	rw.pruneCalls(c.Created)
+	rw.setCallLocked(c)
+
+	// A lift already standing still at the floor opens its door at once
+	if lift, ok := rw.state.Nodes[c.Lift]; ok && c.Type == CallTypeCab {
+		rw.serveCabCalls(lift, c.Created)
+	}
+
+	// Light the hall button, unless it already is
+	if c.Type == CallTypeHall {
+		floor := strconv.Itoa(int(c.Floor))
+		if st := rw.hallButtons(c.Dir)[floor]; st.LastStatus == "" || st.LastStatus == BtnStateDone {
+			rw.setButtonLocked(floor, c.Dir, Status{LastStatus: BtnStateUnassigned, LastChange: c.Created})
+		} else {
+			rw.updateHallCalls(floor, c.Dir, st)
+		}
+	}
+	return nil
+}
+
+func (rw *raftwrapper) applyCallCancel(id string, b []byte) interface{} {
+	var when time.Time
+	if err := json.Unmarshal(b, &when); err != nil {
+		rw.logger.Printf("[ERROR] Unable to unmarshal cancel time: %s\n", err.Error())
+		return fmt.Errorf("unable to unmarshal cancel time: %s", err.Error())
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	c, ok := rw.state.Calls[id]
+	if !ok || !c.Open() {
+		return ErrCallClosed
+	}
+	c.Status = CallCancelled
+	c.LastChange = when
+	rw.setCallLocked(c)
+
+	// Turn the hall button off if nobody is dispatched to it, and no other
+	// calls are waiting for it.
+	if c.Type == CallTypeHall {
+		for _, other := range rw.state.Calls {
+			if other.Open() && other.Type == CallTypeHall && other.Floor == c.Floor && other.Dir == c.Dir {
+				return nil
+			}
+		}
+		floor := strconv.Itoa(int(c.Floor))
+		if rw.hallButtons(c.Dir)[floor].LastStatus == BtnStateUnassigned {
+			rw.setButtonLocked(floor, c.Dir, Status{LastStatus: BtnStateDone, LastChange: when})
+		}
+	}
+	return nil
+}
+
+// updateHallCalls brings the open hall calls on the button in line with the
+// new status of it. Any status applied after a call is placed is newer than
+// the call.
+func (rw *raftwrapper) updateHallCalls(floor, dir string, st Status) {
+	f, _ := strconv.Atoi(floor)
+	for _, c := range sortedCalls(rw.state.Calls) {
+		if !c.Open() || c.Type != CallTypeHall || c.Floor != uint(f) || c.Dir != dir {
+			continue
+		}
+		status, lift := c.Status, c.Lift
+		switch st.LastStatus {
+		case BtnStateDone:
+			status = CallServed
+		case BtnStateAssigned:
+			status, lift = CallAssigned, st.AssignedTo
+		case BtnStateUnassigned:
+			status, lift = CallPending, ""
+		}
+		if status != c.Status || lift != c.Lift {
+			c.Status, c.Lift, c.LastChange = status, lift, st.LastChange
+			rw.setCallLocked(c)
+		}
+	}
+}
+
+// serveCabCalls marks the cab calls of the lift as served, at the given time,
+// if it is standing still at their floor.
+func (rw *raftwrapper) serveCabCalls(lift LiftStatus, when time.Time) {
+	if !strings.EqualFold(lift.Direction, "stop") {
+		return
+	}
+	for _, c := range sortedCalls(rw.state.Calls) {
+		if c.Open() && c.Type == CallTypeCab && c.Lift == lift.ID && c.Floor == lift.LastFloor {
+			c.Status = CallServed
+			c.LastChange = when
+			rw.setCallLocked(c)
+		}
+	}
+}
+
+// releaseCalls hands hall calls served by a removed lift back as pending, and
+// cancels any cab calls placed on it.
+func (rw *raftwrapper) releaseCalls(lift string, when time.Time) {
+	for _, c := range sortedCalls(rw.state.Calls) {
+		if !c.Open() || c.Lift != lift {
+			continue
+		}
+		if c.Type == CallTypeCab {
+			c.Status = CallCancelled
+		} else {
+			c.Status, c.Lift = CallPending, ""
+		}
+		c.LastChange = when
+		rw.setCallLocked(c)
+	}
+}
+
+// pruneCalls forgets calls closed more than callRetention before now. The
+// time is taken from the log, such that all nodes prune the same calls.
+func (rw *raftwrapper) pruneCalls(now time.Time) {
+	for id, c := range rw.state.Calls {
+		if !c.Open() && now.Sub(c.LastChange) > callRetention {
+			delete(rw.state.Calls, id)
+		}
+	}
+}
+
+// sortedCalls returns the calls ordered by floor, then by id. Events emitted
+// while iterating over them then get the same ids on all nodes, which a map
+// would not give.
+func sortedCalls(calls map[string]Call) []Call {
+	sorted := make([]Call, 0, len(calls))
+	for _, c := range calls {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Floor != sorted[j].Floor {
+			return sorted[i].Floor < sorted[j].Floor
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// sortedFloors returns the floors of the buttons in ascending order, for the
+// same reason as sortedCalls.
+func sortedFloors(buttons map[string]Status) []string {
+	floors := make([]string, 0, len(buttons))
+	for floor := range buttons {
+		floors = append(floors, floor)
+	}
+	sort.Slice(floors, func(i, j int) bool {
+		fi, _ := strconv.Atoi(floors[i])
+		fj, _ := strconv.Atoi(floors[j])
+		return fi < fj
+	})
+	return floors
+}
+
+func (rw *raftwrapper) hallButtons(dir string) map[string]Status {
+	if dir == "up" {
+		return rw.state.HallUpButtons
+	}
+	return rw.state.HallDownButtons
+}
+
+func (rw *raftwrapper) setCallLocked(c Call) {
+	rw.state.Calls[c.ID] = c
+	rw.emitLocked(Event{Type: EventCall, Call: c})
+}
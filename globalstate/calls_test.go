@@ -0,0 +1,173 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func placeCall(rw *raftwrapper, c Call) {
+	c.Status = CallPending
+	c.LastChange = c.Created
+	b, _ := json.Marshal(c)
+	rw.applyCallPlace(c.ID, b)
+}
+
+func Test_CallLifecycle(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.logger = log.New(ioutil.Discard, "", 0)
+	t0 := time.Now()
+	at := func(s int) time.Time { return t0.Add(time.Duration(s) * time.Second) }
+	status := func(v interface{}) []byte { b, _ := json.Marshal(v); return b }
+
+	// A hall call lights the button, and follows it until it is done.
+	placeCall(rw, Call{ID: "hall", Type: CallTypeHall, Floor: 2, Dir: "up", Created: at(0)})
+	assert.Equal(t, BtnStateUnassigned, rw.GetState().HallUpButtons["2"].LastStatus)
+	rw.applyBtnUpUpdate("2", status(Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1", LastChange: at(1)}))
+	assert.Equal(t, CallAssigned, rw.GetState().Calls["hall"].Status)
+	assert.Equal(t, "lift1", rw.GetState().Calls["hall"].Lift)
+	rw.applyBtnUpUpdate("2", status(Status{LastStatus: BtnStateDone, LastChange: at(-1)}))
+	assert.Equal(t, CallServed, rw.GetState().Calls["hall"].Status)
+
+	// A cab call is served once the lift stands still at the floor, whatever
+	// the clocks of the nodes stamping the updates say.
+	rw.applyNodeUpdate("lift1", status(LiftStatus{ID: "lift1", LastFloor: 1, Direction: "UP", LastUpdate: at(2)}))
+	placeCall(rw, Call{ID: "cab", Type: CallTypeCab, Floor: 3, Lift: "lift1", Created: at(3)})
+	assert.Equal(t, CallPending, rw.GetState().Calls["cab"].Status)
+	rw.applyNodeUpdate("lift1", status(LiftStatus{ID: "lift1", LastFloor: 3, Direction: "UP", LastUpdate: at(4)}))
+	assert.Equal(t, CallPending, rw.GetState().Calls["cab"].Status)
+	rw.applyNodeUpdate("lift1", status(LiftStatus{ID: "lift1", LastFloor: 3, Direction: "STOP", LastUpdate: at(1)}))
+	assert.Equal(t, CallServed, rw.GetState().Calls["cab"].Status)
+
+	// A cab call on the floor where the lift already stands still is served
+	// at once.
+	placeCall(rw, Call{ID: "here", Type: CallTypeCab, Floor: 3, Lift: "lift1", Created: at(5)})
+	assert.Equal(t, CallServed, rw.GetState().Calls["here"].Status)
+
+	// Cancelling the only call on an unassigned button turns it off, but
+	// closed calls cannot be cancelled.
+	placeCall(rw, Call{ID: "cancel", Type: CallTypeHall, Floor: 1, Dir: "down", Created: at(6)})
+	assert.Nil(t, rw.applyCallCancel("cancel", status(at(7))))
+	assert.Equal(t, CallCancelled, rw.GetState().Calls["cancel"].Status)
+	assert.Equal(t, BtnStateDone, rw.GetState().HallDownButtons["1"].LastStatus)
+	assert.Equal(t, ErrCallClosed, rw.applyCallCancel("cancel", status(at(8))))
+
+	// Calls on a removed lift are handed back or cancelled.
+	placeCall(rw, Call{ID: "orphan", Type: CallTypeCab, Floor: 0, Lift: "lift1", Created: at(9)})
+	placeCall(rw, Call{ID: "moved", Type: CallTypeHall, Floor: 0, Dir: "up", Created: at(9)})
+	rw.applyBtnUpUpdate("0", status(Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1", LastChange: at(10)}))
+	rw.applyNodeRemove("lift1", status(at(11)))
+	assert.Equal(t, CallCancelled, rw.GetState().Calls["orphan"].Status)
+	assert.Equal(t, CallPending, rw.GetState().Calls["moved"].Status)
+	assert.Empty(t, rw.GetState().Calls["moved"].Lift)
+
+	// Closed calls are forgotten after a while.
+	placeCall(rw, Call{ID: "late", Type: CallTypeHall, Floor: 1, Dir: "up", Created: at(12).Add(callRetention)})
+	_, kept := rw.GetState().Calls["hall"]
+	assert.False(t, kept, "closed call not pruned")
+	_, kept = rw.GetState().Calls["moved"]
+	assert.True(t, kept, "open call pruned")
+}
+
+func Test_CallsRequireAuthentication(t *testing.T) {
+	srv := apiServer(State{Floors: 4})
+	defer srv.Close()
+	res, err := http.Post(srv.URL+"/v1/calls", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+func Test_PlaceCallsThroughAPI(t *testing.T) {
+	cmds := make(chan btn, 10)
+	config := Config{
+		RaftPort:           9046,
+		Secret:             "correct horse battery staple",
+		Floors:             4,
+		OnIncomingCommand:  func(f int, d string, v uint64) { cmds <- btn{Floor: f, Dir: d} },
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+	client := raft1.wrapper.client
+
+	// Unsigned requests are rejected
+	res, err := http.Post("http://"+raft1.CommAddr()+"/v1/calls", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	place := func(body string) (CallV1, int) {
+		var c CallV1
+		res, err := client.post(raft1.CommAddr(), "/v1/calls", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		json.NewDecoder(res.Body).Decode(&c)
+		return c, res.StatusCode
+	}
+	get := func(path string) CallV1 {
+		var c CallV1
+		res, err := client.get(raft1.CommAddr(), path, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		json.NewDecoder(res.Body).Decode(&c)
+		return c
+	}
+
+	_, code := place(`{"type": "hall", "floor": 3, "direction": "up"}`)
+	assert.Equal(t, http.StatusBadRequest, code, "up call at top floor")
+
+	hall, code := place(`{"type": "hall", "floor": 1, "direction": "up"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, CallPending, hall.Status)
+	assert.NotEqual(t, BtnStateDone, raft1.wrapper.GetState().HallUpButtons["1"].LastStatus)
+
+	// Cab calls are passed on to the lift, and served when it stops there.
+	self := raft1.wrapper.ownID
+	cab, code := place(`{"type": "cab", "floor": 2, "lift": "` + self + `"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	select {
+	case b := <-cmds:
+		assert.Equal(t, btn{Floor: 2, Dir: CallTypeCab}, b)
+	case <-time.After(5 * time.Second):
+		t.Errorf("cab call not passed on to the lift")
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		raft1.UpdateLiftStatus(LiftStatusUpdate{CurrentFloor: 2, CurrentDir: "STOP"})
+	}()
+	assert.Equal(t, CallServed, get("/v1/calls/"+cab.ID+"?wait=5s").Status)
+
+	// Cancelling is only possible once
+	res, err = client.do("DELETE", raft1.CommAddr(), "/v1/calls/"+hall.ID, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, CallCancelled, get("/v1/calls/"+hall.ID).Status)
+	res, err = client.do("DELETE", raft1.CommAddr(), "/v1/calls/"+hall.ID, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+}
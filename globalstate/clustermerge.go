@@ -0,0 +1,325 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// clusterStatus is what a node tells others about the raft it is part of.
+type clusterStatus struct {
+	ID         string
+	Leader     string
+	LeaderComm string // Communication address of the leader, if known
+	Peers      []string
+}
+
+// memberCheckInterval is how often Reconcile asks a node that is known to be an
+// active member of our raft which cluster it is part of. Other nodes are asked
+// on every call.
+const memberCheckInterval = 30 * time.Second
+
+// Reconcile makes sure this node and the node with the provided communication
+// address end up in the same raft. Whenever the two nodes belong to different clusters
+// the clusters are compared, and the nodes in the losing cluster hand over
+// their outstanding hall calls to the winning leader before leaving their own
+// raft and joining the winning one. The outcome is the same no matter which
+// side calls Reconcile, so it is safe to call it from both sides at once.
+// Hall calls and the open calls placed through the API are handed over, and
+// the node leaves its raft, such that it isn't left behind there as a dead
+// voter.
+func (f *FSM) Reconcile(peerComm string) error {
+	if !f.ready() {
+		return fmt.Errorf("globalstate not yet initialized")
+	}
+	f.mergeMu.Lock()
+	defer f.mergeMu.Unlock()
+
+	ours, err := f.wrapper.clusterStatus()
+	if err != nil {
+		return err
+	}
+	if peerComm == f.wrapper.config.CommAddr {
+		return nil
+	}
+
+	// Members publishing their status are in our cluster, and are only asked
+	// once in a while, in case they have been split off.
+	if f.wrapper.activeMember(peerComm, ours.Peers) {
+		if time.Since(f.memberChecked[peerComm]) < memberCheckInterval {
+			return nil
+		}
+		if f.memberChecked == nil {
+			f.memberChecked = make(map[string]time.Time)
+		}
+		f.memberChecked[peerComm] = time.Now()
+	}
+
+	theirs, err := getClusterStatus(peerComm, f.wrapper.client)
+	if err != nil {
+		return err
+	}
+	if theirs.ID == ours.ID || stringInSlice(theirs.ID, ours.Peers) {
+		return nil
+	}
+
+	// Nodes in the middle of joining or electing a leader are left alone, as
+	// are nodes that already consider us part of their cluster.
+	if theirs.Leader == "" || theirs.LeaderComm == "" || theirs.Leader == ours.Leader ||
+		stringInSlice(ours.ID, theirs.Peers) || stringInSlice(theirs.Leader, ours.Peers) {
+		return nil
+	}
+	if winsMerge(ours, theirs) {
+		return nil
+	}
+
+	f.logger.Printf("[WARN] Found another cluster led by %s (%d nodes). Merging into it.\n", theirs.Leader, len(theirs.Peers))
+	if err := f.handOverCalls(theirs.LeaderComm); err != nil {
+		f.logger.Printf("[ERROR] Unable to hand over calls to %s: %s\n", theirs.Leader, err.Error())
+		return err
+	}
+	if err := f.leaveCluster(); err != nil {
+		f.logger.Printf("[WARN] Unable to leave the raft before merging: %s\n", err.Error())
+	}
+	return f.rejoin(theirs.LeaderComm)
+}
+
+// winsMerge decides deterministically which of two clusters survive a merge.
+// A cluster with a leader beats one without, the larger cluster beats the
+// smaller one, and ties are broken by the lowest leader address.
+func winsMerge(ours, theirs clusterStatus) bool {
+	if (ours.Leader == "") != (theirs.Leader == "") {
+		return ours.Leader != ""
+	}
+	if len(ours.Peers) != len(theirs.Peers) {
+		return len(ours.Peers) > len(theirs.Peers)
+	}
+	return ours.Leader < theirs.Leader
+}
+
+// handOverCalls sends all outstanding hall calls known to this node, which the
+// leader at leaderComm doesn't already know of, as unassigned orders. The open
+// calls placed through the API are sent along with their ids.
+func (f *FSM) handOverCalls(leaderComm string) error {
+	res, err := f.wrapper.client.get(leaderComm, "/debug/dump-state", 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var theirs State
+	if err := json.NewDecoder(res.Body).Decode(&theirs); err != nil {
+		return err
+	}
+
+	ours := f.wrapper.GetState()
+	for _, bsu := range missingHallCalls(ours, theirs) {
+		b, _ := json.Marshal(bsu)
+		res, err := f.wrapper.client.post(leaderComm, "/update/button", b)
+		if err != nil {
+			return err
+		}
+		if err := checkResponse(res); err != nil {
+			return err
+		}
+		f.logger.Printf("[INFO] Handed over hall call at floor %d going %s\n", bsu.Floor, bsu.Dir)
+	}
+	for _, c := range missingCalls(ours, theirs) {
+		b, _ := json.Marshal(c)
+		res, err := f.wrapper.client.post(leaderComm, "/update/call", b)
+		if err != nil {
+			return err
+		}
+		if err := checkResponse(res); err != nil {
+			return err
+		}
+		f.logger.Printf("[INFO] Handed over %s call %s\n", c.Type, c.ID)
+	}
+	return nil
+}
+
+// missingCalls returns the open calls in ours that theirs doesn't know of, in
+// the order they were placed.
+func missingCalls(ours, theirs State) []Call {
+	var missing []Call
+	for id, c := range ours.Calls {
+		if _, known := theirs.Calls[id]; !known && c.Open() {
+			missing = append(missing, c)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if !missing[i].Created.Equal(missing[j].Created) {
+			return missing[i].Created.Before(missing[j].Created)
+		}
+		return missing[i].ID < missing[j].ID
+	})
+	return missing
+}
+
+// leaveCluster removes the node from its raft before it joins another one. A
+// leader removes itself, and a follower asks its leader. The node is going
+// away regardless, so the removal is made even if the others are left unable
+// to elect a leader, until they merge as well.
+func (f *FSM) leaveCluster() error {
+	rw := f.wrapper
+	peers, err := rw.peers()
+	if err != nil || len(peers) <= 1 {
+		return err
+	}
+	rw.stopWorkers()
+	if rw.getRaft().State() == raft.Leader {
+		return rw.Leave(rw.ownID)
+	}
+	return leaveRaft(rw)
+}
+
+// missingHallCalls returns all hall calls that are outstanding in ours, but
+// not in theirs, as unassigned button status updates.
+func missingHallCalls(ours, theirs State) []ButtonStatusUpdate {
+	var missing []ButtonStatusUpdate
+	scan := func(our, their map[string]Status, dir string) {
+		for floorStr, s := range our {
+			if s.LastStatus == BtnStateDone {
+				continue
+			}
+			if t, ok := their[floorStr]; ok && t.LastStatus != BtnStateDone {
+				continue
+			}
+			floor, _ := strconv.Atoi(floorStr)
+			missing = append(missing, ButtonStatusUpdate{
+				Floor:  uint(floor),
+				Dir:    dir,
+				Status: BtnStateUnassigned,
+			})
+		}
+	}
+	scan(ours.HallUpButtons, theirs.HallUpButtons, "up")
+	scan(ours.HallDownButtons, theirs.HallDownButtons, "down")
+	return missing
+}
+
+// raftFiles are the files and folders in the raft folder holding the raft
+// state of the node. Anything else in the folder belongs to the user.
+var raftFiles = []string{"raft.db", "snapshots", "peers.json"}
+
+// rejoin leaves the current raft, discards all raft state and joins the raft
+// that the node at peerComm is part of. The old raft state is kept aside until
+// the node has joined, and is restored if unable to join.
+func (f *FSM) rejoin(peerComm string) error {
+	rw := f.wrapper
+	if err := rw.Stop(); err != nil {
+		return err
+	}
+
+	// Our log is incompatible with the one of the new cluster, so start over.
+	backup := filepath.Join(rw.RaftDir, "merge-backup")
+	if err := os.RemoveAll(backup); err != nil {
+		return f.rollback(backup, err)
+	}
+	if err := moveRaftFiles(rw.RaftDir, backup); err != nil {
+		return f.rollback(backup, err)
+	}
+	rw.resetState()
+
+	if err := rw.Start(false); err != nil {
+		return f.rollback(backup, err)
+	}
+	if err := joinPeerToRaft(peerComm, rw.RaftPort, rw.config.CommAddr, rw.client, f.logger); err != nil {
+		return f.rollback(backup, err)
+	}
+	if err := os.RemoveAll(backup); err != nil {
+		f.logger.Printf("[WARN] Unable to remove old raft state: %s\n", err.Error())
+	}
+	f.startWorkers()
+	return nil
+}
+
+// rollback brings the node back into the raft it left in rejoin, with the raft
+// state kept in backup, and returns the error that made the rejoin fail. The
+// node is of no use without a raft, so it exits if unable to roll back.
+func (f *FSM) rollback(backup string, cause error) error {
+	rw := f.wrapper
+	f.logger.Printf("[ERROR] Unable to join the other cluster: %s. Restoring the old raft.\n", cause.Error())
+	err := rw.Stop()
+	if err == nil {
+		err = removeRaftFiles(rw.RaftDir)
+	}
+	if err == nil {
+		err = moveRaftFiles(backup, rw.RaftDir)
+	}
+	if err == nil {
+		rw.resetState()
+		err = rw.Start(true)
+	}
+	if err != nil {
+		f.logger.Fatalf("[ERROR] Unable to restore the old raft: %s\n", err.Error())
+	}
+	os.RemoveAll(backup)
+	f.startWorkers()
+	return cause
+}
+
+// moveRaftFiles moves the raft state of the node from one folder to another.
+func moveRaftFiles(from, to string) error {
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+	for _, name := range raftFiles {
+		err := os.Rename(filepath.Join(from, name), filepath.Join(to, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRaftFiles removes the raft state of the node from the folder.
+func removeRaftFiles(dir string) error {
+	for _, name := range raftFiles {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rw *raftwrapper) clusterStatus() (clusterStatus, error) {
+	peers, err := rw.peers()
+	if err != nil {
+		return clusterStatus{}, err
+	}
+	if !stringInSlice(rw.ownID, peers) {
+		peers = append(peers, rw.ownID)
+	}
+	leader := rw.GetLeader()
+	leaderComm, _ := rw.commAddr(leader)
+	return clusterStatus{ID: rw.ownID, Leader: leader, LeaderComm: leaderComm, Peers: peers}, nil
+}
+
+// activeMember returns whether the node at the communication address is one of
+// the peers, and has published its status within the dead node grace period.
+func (rw *raftwrapper) activeMember(commAddr string, peers []string) bool {
+	state := rw.GetState()
+	for id, ls := range state.Nodes {
+		if ls.CommAddr == commAddr && stringInSlice(id, peers) {
+			return rw.config.Clock().Sub(ls.LastUpdate) <= rw.config.DeadNodeGracePeriod
+		}
+	}
+	return false
+}
+
+func getClusterStatus(commAddr string, client *commClient) (clusterStatus, error) {
+	res, err := client.get(commAddr, "/status", 2*time.Second)
+	if err != nil {
+		return clusterStatus{}, err
+	}
+	defer res.Body.Close()
+	var cs clusterStatus
+	err = json.NewDecoder(res.Body).Decode(&cs)
+	return cs, err
+}
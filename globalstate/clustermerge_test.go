@@ -0,0 +1,185 @@
+package globalstate
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WinsMerge(t *testing.T) {
+	var tests = []struct {
+		ours, theirs clusterStatus
+		want         bool
+	}{
+		{clusterStatus{Leader: "a:1", Peers: []string{"a:1"}}, clusterStatus{Leader: "", Peers: []string{"b:1", "c:1"}}, true},
+		{clusterStatus{Leader: "", Peers: []string{"a:1"}}, clusterStatus{Leader: "b:1", Peers: []string{"b:1"}}, false},
+		{clusterStatus{Leader: "b:1", Peers: []string{"b:1", "c:1"}}, clusterStatus{Leader: "a:1", Peers: []string{"a:1"}}, true},
+		{clusterStatus{Leader: "b:1", Peers: []string{"b:1"}}, clusterStatus{Leader: "a:1", Peers: []string{"a:1"}}, false},
+		{clusterStatus{Leader: "a:1", Peers: []string{"a:1"}}, clusterStatus{Leader: "b:1", Peers: []string{"b:1"}}, true},
+	}
+	for _, test := range tests {
+		// Exactly one of the sides should win
+		if got := winsMerge(test.ours, test.theirs); got != test.want {
+			t.Errorf("winsMerge(%+v, %+v) = %v", test.ours, test.theirs, got)
+		}
+		if winsMerge(test.theirs, test.ours) == test.want {
+			t.Errorf("winsMerge(%+v, %+v) is not symmetric", test.ours, test.theirs)
+		}
+	}
+}
+
+func Test_MissingHallCalls(t *testing.T) {
+	ours := NewState(4)
+	ours.HallUpButtons["0"] = Status{LastStatus: BtnStateAssigned}
+	ours.HallUpButtons["1"] = Status{LastStatus: BtnStateUnassigned}
+	ours.HallDownButtons["2"] = Status{LastStatus: BtnStateDone}
+	ours.HallDownButtons["3"] = Status{LastStatus: BtnStateUnassigned}
+
+	theirs := NewState(4)
+	theirs.HallUpButtons["1"] = Status{LastStatus: BtnStateAssigned}
+	theirs.HallDownButtons["3"] = Status{LastStatus: BtnStateDone}
+
+	got := missingHallCalls(*ours, *theirs)
+	want := []ButtonStatusUpdate{
+		{Floor: 0, Dir: "up", Status: BtnStateUnassigned},
+		{Floor: 3, Dir: "down", Status: BtnStateUnassigned},
+	}
+	assert.Equal(t, want, got)
+}
+
+func Test_MissingCalls(t *testing.T) {
+	now := time.Now()
+	ours := NewState(4)
+	ours.Calls["a"] = Call{ID: "a", Type: CallTypeHall, Status: CallAssigned, Created: now.Add(time.Second)}
+	ours.Calls["b"] = Call{ID: "b", Type: CallTypeCab, Status: CallPending, Created: now}
+	ours.Calls["c"] = Call{ID: "c", Type: CallTypeHall, Status: CallServed, Created: now}
+	ours.Calls["d"] = Call{ID: "d", Type: CallTypeHall, Status: CallPending, Created: now}
+
+	theirs := NewState(4)
+	theirs.Calls["d"] = ours.Calls["d"]
+
+	got := missingCalls(*ours, *theirs)
+	assert.Equal(t, []Call{ours.Calls["b"], ours.Calls["a"]}, got)
+}
+
+func Test_ActiveMember(t *testing.T) {
+	rw := newRaftWrapper("9000", 4)
+	rw.config.DeadNodeGracePeriod = time.Minute
+	rw.state.Nodes["a:1"] = LiftStatus{CommAddr: "a:2", LastUpdate: time.Now()}
+	rw.state.Nodes["b:1"] = LiftStatus{CommAddr: "b:2", LastUpdate: time.Now().Add(-2 * time.Minute)}
+	rw.state.Nodes["c:1"] = LiftStatus{CommAddr: "c:2", LastUpdate: time.Now()}
+	peers := []string{"a:1", "b:1"}
+
+	assert.True(t, rw.activeMember("a:2", peers))
+	assert.False(t, rw.activeMember("b:2", peers), "stale member taken as active")
+	assert.False(t, rw.activeMember("c:2", peers), "node outside the raft taken as member")
+	assert.False(t, rw.activeMember("d:2", peers), "unknown node taken as member")
+}
+
+func Test_MergeTwoSingleNodeClusters(t *testing.T) {
+	config1 := Config{
+		RaftPort:           9024,
+		Floors:             4,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	config2 := config1
+	config2.RaftPort = 9026
+
+	// The losing node keeps its raft state in a folder of its own, which may
+	// hold other files as well.
+	dataDir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	userFile := filepath.Join(dataDir, "notes.txt")
+	if err := ioutil.WriteFile(userFile, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config2.DataDir = dataDir
+
+	// Both nodes bootstrap their own cluster
+	raft1, raft2 := FSM{}, FSM{}
+	if err := raft1.Init(config1); err != nil {
+		t.Fatalf("Init() of node 1 failed: %v", err)
+	}
+	defer raft1.Shutdown()
+	if err := raft2.Init(config2); err != nil {
+		t.Fatalf("Init() of node 2 failed: %v", err)
+	}
+	defer raft2.Shutdown()
+	if err := raft2.UpdateButtonStatus(ButtonStatusUpdate{Floor: 1, Dir: "up", Status: BtnStateUnassigned}); err != nil {
+		t.Fatalf("UpdateButtonStatus() failed: %v", err)
+	}
+	call, err := raft2.wrapper.PlaceCall(Call{Type: CallTypeHall, Floor: 2, Dir: "down"})
+	if err != nil {
+		t.Fatalf("PlaceCall() failed: %v", err)
+	}
+	time.Sleep(1 * time.Second)
+
+	// The cluster with the lowest leader address survives, and the other one
+	// should bring along its hall calls, and the calls placed through the API.
+	if err := raft1.Reconcile(raft2.CommAddr()); err != nil {
+		t.Fatalf("Reconcile() from the winning side failed: %v", err)
+	}
+	if err := raft2.Reconcile(raft1.CommAddr()); err != nil {
+		t.Fatalf("Reconcile() from the losing side failed: %v", err)
+	}
+	time.Sleep(4 * time.Second)
+
+	state1, _ := raft1.GetState()
+	state2, _ := raft2.GetState()
+	assert.Equal(t, BtnStateUnassigned, state1.HallUpButtons["1"].LastStatus)
+	assert.Equal(t, BtnStateUnassigned, state1.HallDownButtons["2"].LastStatus)
+	if c, ok := state1.Calls[call.ID]; assert.True(t, ok, "call placed on the losing cluster lost") {
+		assert.Equal(t, CallPending, c.Status)
+		assert.Equal(t, call.Created, c.Created)
+	}
+	assert.Equal(t, state1, state2)
+	_, err = os.Stat(userFile)
+	assert.NoError(t, err, "merging removed other files in the data folder")
+}
+
+func Test_RejoinRollsBackOnFailure(t *testing.T) {
+	config := Config{
+		RaftPort:           9066,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	node := FSM{}
+	if err := node.Init(config); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	defer node.Shutdown()
+	if err := node.UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "down", Status: BtnStateUnassigned}); err != nil {
+		t.Fatalf("UpdateButtonStatus() failed: %v", err)
+	}
+
+	// Nobody listens at the address, so the node should end up back in its
+	// own raft, with its state intact.
+	node.mergeMu.Lock()
+	err := node.rejoin("127.0.0.1:1")
+	node.mergeMu.Unlock()
+	if err == nil {
+		t.Fatal("rejoin() of an unreachable cluster succeeded")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for node.wrapper.getRaft().State() != raft.Leader && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, raft.Leader, node.wrapper.getRaft().State())
+	state, _ := node.GetState()
+	assert.Equal(t, BtnStateUnassigned, state.HallDownButtons["2"].LastStatus)
+	if err := node.UpdateButtonStatus(ButtonStatusUpdate{Floor: 0, Dir: "up", Status: BtnStateUnassigned}); err != nil {
+		t.Errorf("UpdateButtonStatus() after rollback failed: %v", err)
+	}
+}
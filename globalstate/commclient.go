@@ -0,0 +1,87 @@
+package globalstate
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// postTimeout bounds POST requests, which wait for their change to be
+// committed. A join commits two log entries, adding the node to the raft and
+// registering its communication service, each of which may take up to the
+// apply timeout of 5 seconds.
+const postTimeout = 15 * time.Second
+
+// commClient sends requests to the communication services of other nodes.
+// Requests are signed if a cluster secret is configured, and sent over mutual
+// TLS if a TLS configuration is provided.
+type commClient struct {
+	auth      *authenticator
+	scheme    string
+	transport http.RoundTripper
+}
+
+func newCommClient(auth *authenticator, tlsConfig *tls.Config) *commClient {
+	c := &commClient{auth: auth, scheme: "http", transport: http.DefaultTransport}
+	if tlsConfig != nil {
+		c.scheme = "https"
+		c.transport = &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 5 * time.Second,
+		}
+	}
+	return c
+}
+
+// url returns the URL of the path at the communication endpoint addr.
+func (c *commClient) url(addr, path string) string {
+	return fmt.Sprintf("%s://%s%s", c.scheme, addr, path)
+}
+
+// do sends a request to the communication endpoint addr. A zero timeout
+// means no timeout.
+func (c *commClient) do(method, addr, path string, body []byte, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(addr, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if err := c.auth.sign(req, body); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: c.transport, Timeout: timeout}
+	return client.Do(req)
+}
+
+// get sends a GET request to the communication endpoint addr.
+func (c *commClient) get(addr, path string, timeout time.Duration) (*http.Response, error) {
+	return c.do("GET", addr, path, nil, timeout)
+}
+
+// post sends a POST request with a JSON body to the communication endpoint
+// addr, giving up after postTimeout.
+func (c *commClient) post(addr, path string, body []byte) (*http.Response, error) {
+	return c.do("POST", addr, path, body, postTimeout)
+}
+
+// checkResponse closes the body of the response, and returns the error
+// reported by the service if the request failed.
+func checkResponse(res *http.Response) error {
+	defer res.Body.Close()
+	if res.StatusCode < 300 {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+	var e apiError
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error.Message == "" {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return fmt.Errorf("%s: %s", res.Status, e.Error.Message)
+}
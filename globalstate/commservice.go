@@ -1,13 +1,13 @@
 package globalstate
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"sync/atomic"
 )
 
 // commService provides HTTP communication services for admitting new peers and command messages.
@@ -15,16 +15,50 @@ type commService struct {
 	addr       string
 	leaderAddr string
 	ln         net.Listener
+	metricsLn  net.Listener // Plain listener serving nothing but the metrics, if enabled
+	port       int
+	closed     int32 // Set to 1 once closed. Accessed atomically
 	store      *raftwrapper
+	router     *router
 	logger     *log.Logger
+
+	// transferLeadership hands the leadership over to another node, and
+	// returns the new leader. Set by the FSM.
+	transferLeadership func() (string, error)
 }
 
 func newCommService(addr string, store *raftwrapper) *commService {
-	return &commService{
+	s := &commService{
 		addr:   addr,
 		store:  store,
 		logger: store.logger,
 	}
+	s.router = s.routes()
+	return s
+}
+
+// Listen binds the listener of the service, such that the address of the
+// service is known before it is started. The listener of the metrics is bound
+// as well, if enabled.
+func (s *commService) Listen() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if addr := s.store.config.MetricsAddr; addr != "" {
+		ml, err := net.Listen("tcp", addr)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("unable to bind metrics listener: %s", err.Error())
+		}
+		s.metricsLn = ml
+	}
+	s.port = l.Addr().(*net.TCPAddr).Port
+	if s.store.config.TLS != nil {
+		l = tls.NewListener(l, s.store.config.TLS)
+	}
+	s.ln = l
+	return nil
 }
 
 // Start starts the communication service and start listening.
@@ -33,55 +67,82 @@ func (s *commService) Start() error {
 		Handler: s,
 	}
 
-	// Create listener
-	l, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return err
+	// Create listener, unless already done
+	if s.ln == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
 	}
-	s.ln = l
-
-	// Handle request to the root
-	http.ListenAndServe(s.addr, s)
 
 	// Start accepting incoming connections on the listener
 	go func() {
 		err := server.Serve(s.ln)
-		if err != nil {
+		if err != nil && atomic.LoadInt32(&s.closed) == 0 {
 			log.Fatalf("HTTP serve: %s", err)
 		}
 	}()
+
+	// The metrics listener is neither encrypted nor authenticated, such that
+	// Prometheus is able to scrape it.
+	if s.metricsLn != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", s.HandleMetrics)
+		go func() {
+			err := http.Serve(s.metricsLn, mux)
+			if err != nil && atomic.LoadInt32(&s.closed) == 0 {
+				log.Fatalf("HTTP serve metrics: %s", err)
+			}
+		}()
+	}
 	return nil
 }
 
 // Close closes the service.
 func (s *commService) Close() {
+	atomic.StoreInt32(&s.closed, 1)
 	s.ln.Close()
+	if s.metricsLn != nil {
+		s.metricsLn.Close()
+	}
 	return
 }
 
 // ServeHTTP defines the behavior when receiving a request
 func (s *commService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p := r.URL.Path
-	// Mux different endpoints
-	if strings.HasPrefix(p, "/join") {
-		// Join requests
-		s.HandleJoin(w, r)
-	} else if strings.HasPrefix(p, "/update/lift") {
-		// Incoming lift status updates
-		s.HandleLiftUpdate(w, r)
-	} else if strings.HasPrefix(p, "/update/button") {
-		// Incoming button status updates
-		s.HandleButtonUpdate(w, r)
-	} else if strings.HasPrefix(p, "/cmd") {
-		// Incoming commands/assignments from leader
-		s.HandleCmd(w, r)
-	} else if strings.HasPrefix(p, "/debug/dump-state") {
-		// For debugging purposes
-		s.HandleDebugDumpState(w, r)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
-		s.logger.Printf("not found: someone tried to access %v", p)
+	// Reject anything not signed with the cluster secret. Browsers are unable
+	// to sign their requests, so the dashboard page is open to anyone, and the
+	// page may read the rest given the dashboard token. Prometheus may scrape
+	// the metrics on a listener of their own instead.
+	if r.Method == "GET" && r.URL.Path == "/dashboard" || s.dashboardViewer(r) {
+		s.router.ServeHTTP(w, r)
+		return
+	}
+	if err := s.store.auth.verify(r); err != nil {
+		s.logger.Printf("[WARN] Rejected request for %s from %s: %s\n", r.URL.Path, r.RemoteAddr, err.Error())
+		writeError(w, http.StatusUnauthorized, "unauthorized: %s", err.Error())
+		return
 	}
+	s.router.ServeHTTP(w, r)
+}
+
+// routes sets up the endpoints of the service. The unversioned endpoints are
+// used between the nodes themselves, while the /v1 API is meant for others.
+// The metrics and the dashboard are meant for Prometheus and people.
+func (s *commService) routes() *router {
+	rt := &router{}
+	rt.handleFunc("POST", "/join", s.HandleJoin)                      // Join requests
+	rt.handleFunc("POST", "/update/lift", s.HandleLiftUpdate)         // Incoming lift status updates
+	rt.handleFunc("POST", "/update/button", s.HandleButtonUpdate)     // Incoming button status updates
+	rt.handleFunc("POST", "/update/call", s.HandleCallUpdate)         // Open calls handed over by merging clusters
+	rt.handleFunc("POST", "/cmd", s.HandleCmd)                        // Incoming commands/assignments from leader
+	rt.handleFunc("POST", "/kick", s.HandleKick)                      // Requests to remove a node from the raft
+	rt.handleFunc("POST", "/leave", s.HandleLeave)                    // Requests from nodes shutting down to leave the raft
+	rt.handleFunc("GET", "/status", s.HandleStatus)                   // Information about the raft this node is part of
+	rt.handleFunc("GET", "/debug/dump-state", s.HandleDebugDumpState) // For debugging purposes
+	rt.handleFunc("GET", "/metrics", s.HandleMetrics)                 // Metrics in the Prometheus text format
+	rt.handleFunc("GET", "/dashboard", s.HandleDashboard)             // Overview of the cluster for browsers
+	s.routesV1(rt)
+	return rt
 }
 
 // Endpoint handlers
@@ -89,48 +150,44 @@ func (s *commService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *commService) HandleJoin(w http.ResponseWriter, r *http.Request) {
 	// Redirect if not currently leader
 	if s.store.GetStatus() != 2 {
-		// Infer commPort from the raft-port. The communication port should always
-		// be one above the raft port.
-		leader := s.store.GetLeader()
-		if leader == "" {
-			s.logger.Println("[WARN] No current leader. Cannot redirect")
-			w.WriteHeader(http.StatusGone)
+		leader, err := s.store.leaderComEndpoint()
+		if err != nil {
+			s.logger.Printf("[WARN] Cannot redirect: %s\n", err.Error())
+			writeError(w, http.StatusServiceUnavailable, "cannot redirect to leader: %s", err.Error())
 			return
 		}
-		parts := strings.Split(leader, ":")
-		raftPortInt, _ := strconv.Atoi(parts[1])
-		portStr := strconv.Itoa(raftPortInt + 1)
 
 		// Return leader address to requester
-		w.Header().Add("X-Raft-Leader", parts[0]+":"+portStr)
+		w.Header().Add("X-Raft-Leader", leader)
 		return
 	}
 
 	// Decode incoming json object. Discard if unable to decode
 	m := map[string]string{}
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		log.Printf("Unable to decode request: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		s.logger.Printf("[WARN] Unable to decode join request: %v\n", err)
+		writeError(w, http.StatusBadRequest, "malformed join request: %s", err.Error())
 		return
 	}
 
-	// Simple and naive test to prevent injection of more than one peer
-	if len(m) != 1 {
-		w.WriteHeader(http.StatusBadRequest)
+	// Simple and naive test to prevent injection of more than one peer. The
+	// request holds the raft port, and the address of the communication service.
+	if len(m) > 2 {
+		writeError(w, http.StatusBadRequest, "unexpected fields in join request")
 		return
 	}
 
 	// Pull port off request
 	peerAddr, ok := m["addr"]
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "no addr provided")
 		return
 	}
-	parts := strings.Split(r.RemoteAddr, ":")
-	peerAddr = parts[0] + ":" + peerAddr
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	peerAddr = net.JoinHostPort(host, peerAddr)
 
-	if err := s.store.Join(peerAddr); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := s.store.Join(peerAddr, m["comm"]); err != nil {
+		writeError(w, http.StatusInternalServerError, "unable to join %s: %s", peerAddr, err.Error())
 		return
 	}
 	// Return empty X-Raft-Leader tag to indicate success
@@ -141,29 +198,24 @@ func (s *commService) HandleJoin(w http.ResponseWriter, r *http.Request) {
 func (s *commService) HandleCmd(w http.ResponseWriter, r *http.Request) {
 	// Check for empty request
 	if r.Body == nil {
-		http.Error(w, "No request body provided", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "no request body provided")
 		return
 	}
 
-	// Unmarshal json object (identical to btn-struct in LeaderMonitor
-	// but redeclared here for your convenience.
-	var btn = struct {
-		Floor int
-		Dir   string
-	}{}
-
-	err := json.NewDecoder(r.Body).Decode(&btn)
+	// Unmarshal json object
+	var o order
+	err := json.NewDecoder(r.Body).Decode(&o)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "malformed request: %s", err.Error())
 		return
 	}
-	s.store.config.OnIncomingCommand(btn.Floor, btn.Dir)
+	s.store.config.OnIncomingCommand(o.Floor, o.Dir, o.Version)
 }
 
 func (s *commService) HandleLiftUpdate(w http.ResponseWriter, r *http.Request) {
 	// Check for empty request
 	if r.Body == nil {
-		http.Error(w, "No request body provided", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "no request body provided")
 		return
 	}
 
@@ -171,12 +223,13 @@ func (s *commService) HandleLiftUpdate(w http.ResponseWriter, r *http.Request) {
 	var status LiftStatus
 	err := json.NewDecoder(r.Body).Decode(&status)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "malformed request: %s", err.Error())
 		return
 	}
 
 	if err := s.store.UpdateLiftStatus(status); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "unable to update lift status: %s", err.Error())
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -185,7 +238,7 @@ func (s *commService) HandleButtonUpdate(w http.ResponseWriter, r *http.Request)
 	// Check for empty request
 	if r.Body == nil {
 		s.logger.Printf("[WARN] Received empty button status update.\n")
-		http.Error(w, "No request body provided", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "no request body provided")
 		return
 	}
 
@@ -194,12 +247,37 @@ func (s *commService) HandleButtonUpdate(w http.ResponseWriter, r *http.Request)
 	err := json.NewDecoder(r.Body).Decode(&status)
 	if err != nil {
 		s.logger.Println("[WARN] Unable to unmarshal incoming status update")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "malformed request: %s", err.Error())
+		return
+	}
+
+	err = s.store.UpdateButtonStatus(status)
+	switch err.(type) {
+	case nil:
+	case *InvalidButtonError:
+		writeError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	case *TransitionError, *StaleUpdateError:
+		writeError(w, http.StatusConflict, "%s", err.Error())
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, "unable to update button status: %s", err.Error())
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	if err := s.store.UpdateButtonStatus(status); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+// HandleCallUpdate places an open call handed over by a node of another cluster
+// merging into this one, keeping its id.
+func (s *commService) HandleCallUpdate(w http.ResponseWriter, r *http.Request) {
+	var c Call
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		s.logger.Println("[WARN] Unable to unmarshal incoming call")
+		writeError(w, http.StatusBadRequest, "malformed request: %s", err.Error())
+		return
+	}
+	if err := s.store.adoptCall(c); err != nil {
+		writeError(w, http.StatusConflict, "unable to place call: %s", err.Error())
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -212,6 +290,91 @@ func (s *commService) HandleDebugDumpState(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(state)
 }
 
+func (s *commService) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.store.clusterStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
 func (s *commService) HandleKick(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("HandlerKick is not yet implemented")
+	// Redirect if not currently leader
+	if s.store.GetStatus() != 2 {
+		leader, err := s.store.leaderComEndpoint()
+		if err != nil {
+			s.logger.Printf("[WARN] Cannot redirect: %s\n", err.Error())
+			writeError(w, http.StatusServiceUnavailable, "cannot redirect to leader: %s", err.Error())
+			return
+		}
+
+		// Return leader address to requester
+		w.Header().Add("X-Raft-Leader", leader)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Decode incoming json object on the form {"addr": "ip:raftport"}
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request: %s", err.Error())
+		return
+	}
+	addr, ok := m["addr"]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "no addr provided")
+		return
+	}
+
+	if err := s.store.Kick(addr); err != nil {
+		s.logger.Printf("[WARN] Refused to kick %s: %s\n", addr, err.Error())
+		writeError(w, http.StatusConflict, "%s", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleLeave removes the node making the request from the raft. The request
+// holds the id of the node, which is its raft address, on the form
+// {"id": "ip:raftport"}. It is not taken from the address the request came
+// from, which may differ behind NAT or with several addresses.
+func (s *commService) HandleLeave(w http.ResponseWriter, r *http.Request) {
+	// Redirect if not currently leader
+	if s.store.GetStatus() != 2 {
+		leader, err := s.store.leaderComEndpoint()
+		if err != nil {
+			s.logger.Printf("[WARN] Cannot redirect: %s\n", err.Error())
+			writeError(w, http.StatusServiceUnavailable, "cannot redirect to leader: %s", err.Error())
+			return
+		}
+		w.Header().Add("X-Raft-Leader", leader)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+
+	// The id must be in the configuration of the raft, see Leave.
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request: %s", err.Error())
+		return
+	}
+	addr, ok := m["id"]
+	if !ok || addr == "" {
+		writeError(w, http.StatusBadRequest, "no id provided")
+		return
+	}
+	if addr == s.store.ownID {
+		writeError(w, http.StatusConflict, "the leader leaves on its own")
+		return
+	}
+
+	if err := s.store.Leave(addr); err != nil {
+		s.logger.Printf("[WARN] Unable to let %s leave: %s\n", addr, err.Error())
+		writeError(w, http.StatusConflict, "%s", err.Error())
+		return
+	}
+	s.logger.Printf("[INFO] %s left the raft\n", addr)
+	w.WriteHeader(http.StatusOK)
 }
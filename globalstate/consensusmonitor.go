@@ -7,6 +7,7 @@ import (
 )
 
 func (rw *raftwrapper) ConsensusMonitor() {
+	shutdown := rw.done()
 	lastStatus := raft.Candidate
 	connected := false
 	setConn := func(b bool) { connected = b }
@@ -14,23 +15,31 @@ func (rw *raftwrapper) ConsensusMonitor() {
 		select {
 		// Sleep slightly longer than the half the raft election timeout.
 		case <-time.After(550 * time.Millisecond):
-			newStatus := rw.raft.State()
+			newStatus := rw.getRaft().State()
+			if newStatus == raft.Follower && rw.getRaft().Leader() == "" {
+				// A node removed from the raft never becomes candidate, but is
+				// left as a follower without any leader.
+				newStatus = raft.Candidate
+			}
 			switch newStatus {
 			case raft.Candidate:
 				if lastStatus == raft.Candidate && connected {
+					rw.metrics.inc(&rw.metrics.consensusLost)
 					rw.config.OnLostConsensus()
 					setConn(false)
 				}
 			case raft.Shutdown:
-				rw.logger.Fatalf("[ERROR] Raft in shutdown!")
+				// Raft is only shut down when the node is stopped.
+				return
 			default:
 				if lastStatus == raft.Candidate {
+					rw.metrics.inc(&rw.metrics.consensusAcquired)
 					rw.config.OnAquiredConsensus()
 				}
 				setConn(true)
 			}
 			lastStatus = newStatus
-		case <-rw.shutdown:
+		case <-shutdown:
 			return
 		}
 	}
@@ -24,7 +24,7 @@ func Test_LoosingConsensus(t *testing.T) {
 	time.Sleep(3 * time.Second)
 	config2 := Config{
 		RaftPort:           9018,
-		InitalPeer:         getOutboundIP() + ":9016",
+		InitalPeer:         raft1.CommAddr(),
 		CostFunction:       func(s State, f int, d string) string { return "localhost:8005" },
 		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
 		DisableRaftLogging: true,
@@ -35,7 +35,7 @@ func Test_LoosingConsensus(t *testing.T) {
 	time.Sleep(3 * time.Second)
 	config3 := Config{
 		RaftPort:           9020,
-		InitalPeer:         getOutboundIP() + ":9016",
+		InitalPeer:         raft1.CommAddr(),
 		CostFunction:       func(s State, f int, d string) string { return "localhost:8005" },
 		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
 		DisableRaftLogging: true,
@@ -43,8 +43,9 @@ func Test_LoosingConsensus(t *testing.T) {
 	raft3 := FSM{}
 	raft3.Init(config3)
 	time.Sleep(3 * time.Second)
-	raft2.Shutdown()
-	raft3.Shutdown()
+	// Crash them, as nodes shut down properly leave the raft in good order.
+	raft2.stop()
+	raft3.stop()
 
 	select {
 	case <-consensusLost:
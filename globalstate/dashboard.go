@@ -0,0 +1,283 @@
+package globalstate
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+/*
+The dashboard gives an overview of the cluster in a browser, without reading
+any logs. It is a single static page, without any external dependencies, that
+follows the state through the event stream of the /v1 API. As browsers are
+unable to sign their requests, the page itself is served to anyone, but in
+clusters with a secret the state is only available to it given the dashboard
+token. The token is handed to the page once, as /dashboard?token=<token>, and
+kept by the browser in a cookie sent along with the requests of the page.
+The token only grants GET requests, and thereby nothing but reading.
+*/
+
+// dashboardCookie is the name of the cookie holding the dashboard token.
+const dashboardCookie = "lift-dashboard"
+
+// HandleDashboard serves the dashboard. A token given in the query is stored
+// in a cookie, and the browser sent back to the page without it, such that
+// the token is kept out of the history of the browser.
+func (s *commService) HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		if !s.dashboardToken(token) {
+			writeError(w, http.StatusUnauthorized, "unauthorized: wrong dashboard token")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     dashboardCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   s.store.config.TLS != nil,
+		})
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// dashboardViewer returns true for requests from a browser holding the
+// dashboard token, which are allowed to read but nothing else.
+func (s *commService) dashboardViewer(r *http.Request) bool {
+	if r.Method != "GET" {
+		return false
+	}
+	c, err := r.Cookie(dashboardCookie)
+	return err == nil && s.dashboardToken(c.Value)
+}
+
+// dashboardToken returns true if the token is the dashboard token of the
+// node. No token is accepted if none is configured.
+func (s *commService) dashboardToken(token string) bool {
+	expected := s.store.config.DashboardToken
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// dashboardHTML is the dashboard page. It must not load anything but the /v1
+// API of the node serving it.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Lifts</title>
+<style>
+  body { font-family: sans-serif; margin: 1em 2em; color: #222; background: #fafafa; }
+  h1 { font-size: 1.4em; margin-bottom: 0.2em; }
+  h2 { font-size: 1.1em; margin-top: 1.5em; }
+  table { border-collapse: collapse; }
+  th, td { border: 1px solid #ccc; padding: 0.3em 0.7em; text-align: center; }
+  th { background: #eee; }
+  td.lift { min-width: 4em; }
+  .car { display: inline-block; padding: 0.1em 0.5em; border-radius: 3px; background: #2a6; color: #fff; font-weight: bold; }
+  .stale .car { background: #999; }
+  .call { font-weight: bold; }
+  .unassigned { color: #c60; }
+  .assigned { color: #26a; }
+  .leader { font-weight: bold; }
+  #status { font-size: 0.9em; color: #666; }
+  #status.error { color: #c00; }
+  .panels { display: flex; flex-wrap: wrap; gap: 3em; }
+</style>
+</head>
+<body>
+<h1>Lifts</h1>
+<div id="status">Connecting...</div>
+
+<h2>Shaft</h2>
+<table id="shaft"></table>
+
+<div class="panels">
+  <div>
+    <h2>Hall calls</h2>
+    <table>
+      <thead><tr><th>Floor</th><th>Direction</th><th>Status</th><th>Assigned to</th><th>Since</th></tr></thead>
+      <tbody id="calls"></tbody>
+    </table>
+  </div>
+  <div>
+    <h2>Raft</h2>
+    <table>
+      <thead><tr><th>Member</th><th>Role</th></tr></thead>
+      <tbody id="members"></tbody>
+    </table>
+  </div>
+</div>
+
+<script>
+"use strict";
+
+// A lift is shown as stale when it have not reported for this long.
+var staleAfter = 10000;
+
+var state = { floors: 0, nodes: {}, calls: {}, leader: "", peers: [], self: "" };
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined) { e.textContent = text; }
+  if (cls) { e.className = cls; }
+  return e;
+}
+
+function arrow(dir) {
+  dir = (dir || "").toLowerCase();
+  if (dir === "up") { return "▲"; }
+  if (dir === "down") { return "▼"; }
+  return "■";
+}
+
+function since(t) {
+  var s = Math.max(0, Math.round((Date.now() - Date.parse(t)) / 1000));
+  return s < 60 ? s + " s" : Math.floor(s / 60) + " min";
+}
+
+function setStatus(text, error) {
+  var e = document.getElementById("status");
+  e.textContent = text;
+  e.className = error ? "error" : "";
+}
+
+function renderShaft() {
+  var table = document.getElementById("shaft");
+  table.textContent = "";
+  var ids = Object.keys(state.nodes).sort();
+  var head = el("tr");
+  head.appendChild(el("th", "Floor"));
+  head.appendChild(el("th", "Up"));
+  head.appendChild(el("th", "Down"));
+  ids.forEach(function (id) { head.appendChild(el("th", id, id === state.leader ? "leader" : "")); });
+  table.appendChild(head);
+
+  for (var f = state.floors - 1; f >= 0; f--) {
+    var row = el("tr");
+    row.appendChild(el("th", String(f)));
+    ["up", "down"].forEach(function (dir) {
+      var c = state.calls[f + dir];
+      row.appendChild(c ? el("td", arrow(dir), "call " + c.status) : el("td"));
+    });
+    ids.forEach(function (id) {
+      var n = state.nodes[id];
+      var stale = Date.now() - Date.parse(n.lastUpdate) > staleAfter;
+      var td = el("td", undefined, "lift" + (stale ? " stale" : ""));
+      if (n.lastFloor === f) {
+        td.appendChild(el("span", arrow(n.direction), "car"));
+        td.title = "Last update " + since(n.lastUpdate) + " ago";
+      }
+      row.appendChild(td);
+    });
+    table.appendChild(row);
+  }
+}
+
+function renderCalls() {
+  var body = document.getElementById("calls");
+  body.textContent = "";
+  Object.keys(state.calls).map(function (k) { return state.calls[k]; })
+    .sort(function (a, b) { return a.floor - b.floor || (a.direction < b.direction ? -1 : 1); })
+    .forEach(function (c) {
+      var row = el("tr");
+      row.appendChild(el("td", String(c.floor)));
+      row.appendChild(el("td", arrow(c.direction) + " " + c.direction));
+      row.appendChild(el("td", c.status, c.status));
+      row.appendChild(el("td", c.assignedTo || "-"));
+      row.appendChild(el("td", since(c.lastChange)));
+      body.appendChild(row);
+    });
+}
+
+function renderMembers() {
+  var body = document.getElementById("members");
+  body.textContent = "";
+  var members = state.peers.slice();
+  if (state.self && members.indexOf(state.self) < 0) { members.push(state.self); }
+  members.sort().forEach(function (id) {
+    var row = el("tr");
+    var name = id + (id === state.self ? " (this node)" : "");
+    row.appendChild(el("td", name, id === state.leader ? "leader" : ""));
+    row.appendChild(el("td", id === state.leader ? "leader" : "follower"));
+    body.appendChild(row);
+  });
+}
+
+function render() {
+  renderShaft();
+  renderCalls();
+  renderMembers();
+}
+
+function setCall(c) {
+  if (c.status === "done") {
+    delete state.calls[c.floor + c.direction];
+  } else {
+    state.calls[c.floor + c.direction] = c;
+  }
+}
+
+function refreshMembership() {
+  fetch("/v1/membership").then(function (res) {
+    if (!res.ok) { throw new Error("membership: " + res.status); }
+    return res.json();
+  }).then(function (m) {
+    state.self = m.self;
+    state.peers = m.peers || [];
+    state.leader = m.leader;
+    render();
+  }).catch(function () {});
+}
+
+var handlers = {
+  reset: function (s) {
+    state.floors = s.floors;
+    state.nodes = {};
+    state.calls = {};
+    (s.nodes || []).forEach(function (n) { state.nodes[n.id] = n; });
+    (s.hallCalls || []).forEach(setCall);
+    refreshMembership();
+  },
+  button: setCall,
+  lift: function (n) { state.nodes[n.id] = n; },
+  membership: function (m) {
+    if (!m.joined) { delete state.nodes[m.id]; }
+    refreshMembership();
+  },
+  leader: function (l) {
+    state.leader = l.leader;
+    refreshMembership();
+  }
+};
+
+function connect() {
+  var events = new EventSource("/v1/events");
+  events.onopen = function () { setStatus("Live"); };
+  events.onerror = function () {
+    // The stream is resumed by the browser, unless the request is refused.
+    fetch("/v1/state").then(function (res) {
+      if (res.status === 401) {
+        events.close();
+        setStatus("The cluster has a secret. Open the dashboard as /dashboard?token=<dashboard token> to see the state.", true);
+      } else {
+        setStatus("Connection lost. Reconnecting...", true);
+      }
+    }).catch(function () { setStatus("Connection lost. Reconnecting...", true); });
+  };
+  Object.keys(handlers).forEach(function (type) {
+    events.addEventListener(type, function (e) {
+      handlers[type](JSON.parse(e.data));
+      render();
+    });
+  });
+}
+
+connect();
+// Keep ages and stale lifts up to date between events.
+setInterval(render, 1000);
+</script>
+</body>
+</html>
+`
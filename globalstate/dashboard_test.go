@@ -0,0 +1,75 @@
+package globalstate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Dashboard(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.auth = newAuthenticator("correct horse battery staple")
+	srv := httptest.NewServer(newCommService("127.0.0.1:0", rw))
+	defer srv.Close()
+
+	// Browsers are unable to sign their requests
+	res, err := http.Get(srv.URL + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "text/html")
+	assert.Equal(t, dashboardHTML, string(b))
+
+	// Nothing is loaded from elsewhere, and only existing endpoints are used.
+	assert.NotContains(t, dashboardHTML, "http://")
+	assert.NotContains(t, dashboardHTML, "https://")
+	rt := &router{}
+	(&commService{}).routesV1(rt)
+	for _, path := range regexp.MustCompile(`"(/v1/[^"]*)"`).FindAllStringSubmatch(dashboardHTML, -1) {
+		found := false
+		for _, r := range rt.routes {
+			found = found || r.method == "GET" && "/"+strings.Join(r.segments, "/") == path[1]
+		}
+		assert.True(t, found, "%s is not an endpoint", path[1])
+	}
+}
+
+func Test_DashboardToken(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.auth = newAuthenticator("correct horse battery staple")
+	rw.config.DashboardToken = "open sesame"
+	srv := httptest.NewServer(newCommService("127.0.0.1:0", rw))
+	defer srv.Close()
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+	status := func(method, path string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader("{}"))
+		res, err := browser.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/state"))
+	assert.Equal(t, http.StatusUnauthorized, status("GET", "/dashboard?token=guess"))
+	assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/state"))
+
+	// The browser is sent on to the dashboard with the token in a cookie
+	assert.Equal(t, http.StatusOK, status("GET", "/dashboard?token="+url.QueryEscape("open sesame")))
+	assert.Equal(t, http.StatusOK, status("GET", "/v1/state"))
+
+	// The token grants nothing but reading
+	assert.Equal(t, http.StatusUnauthorized, status("POST", "/v1/calls"))
+}
@@ -0,0 +1,275 @@
+package globalstate
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Every change to the state is published as an event while the raft log is
+applied. Events carry the index of the log entry that caused them, and their
+position among the events of that entry. Both are the same on all nodes, such
+that a subscriber may resume from where it left off at any node of the cluster. The most recent events are kept in memory for
+that purpose. A subscriber resuming from further back is told to start over
+from the full state with an EventReset.
+*/
+
+// Event types
+const (
+	// EventReset replaces the state as a whole, such as when restoring a
+	// snapshot. State holds the new state.
+	EventReset = "reset"
+	// EventButton is a change of a hall button. Floor, Dir and Button are set.
+	EventButton = "button"
+	// EventLift is a status update from a lift. Lift is set.
+	EventLift = "lift"
+	// EventMembership is a node joining or leaving the cluster. Node and
+	// Joined are set.
+	EventMembership = "membership"
+	// EventLeader is a change of leader, as seen by the node. Leader is set,
+	// and is empty while there are no leader.
+	EventLeader = "leader"
+	// EventCall is a change of a call placed through the API. Call is set.
+	EventCall = "call"
+)
+
+const (
+	// eventHistory is the number of events kept for subscribers to resume from.
+	eventHistory = 1024
+	// eventBuffer is the number of events a subscriber may lag behind before it
+	// is dropped.
+	eventBuffer = 256
+)
+
+// Event is a change of the state.
+type Event struct {
+	Index  uint64 // Raft index of the log entry causing the event
+	Sub    uint64 // Position among the events of the log entry, from 0
+	Type   string
+	Floor  uint
+	Dir    string
+	Button Status
+	Lift   LiftStatus
+	Node   string
+	Joined bool
+	Leader string
+	Call   Call
+	State  State
+}
+
+func (e Event) id() eventID {
+	return eventID{Index: e.Index, Sub: e.Sub}
+}
+
+// eventID identifies an event by the log entry causing it, and its position
+// among the events of the entry.
+type eventID struct {
+	Index uint64
+	Sub   uint64
+}
+
+func (id eventID) before(other eventID) bool {
+	return id.Index < other.Index || id.Index == other.Index && id.Sub < other.Sub
+}
+
+func (id eventID) String() string {
+	return fmt.Sprintf("%d.%d", id.Index, id.Sub)
+}
+
+// parseEventID parses an event id on the form <index>.<sub>. A bare index is
+// taken as the last of the events of that index.
+func parseEventID(s string) (eventID, error) {
+	parts := strings.SplitN(s, ".", 2)
+	index, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return eventID{}, fmt.Errorf("invalid event id: %s", s)
+	}
+	id := eventID{Index: index, Sub: math.MaxUint64}
+	if len(parts) == 2 {
+		if id.Sub, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return eventID{}, fmt.Errorf("invalid event id: %s", s)
+		}
+	}
+	return id, nil
+}
+
+// eventBus keeps recent events, and passes new ones on to subscribers.
+// Subscribers unable to keep up are dropped by closing their channel.
+type eventBus struct {
+	mu       sync.Mutex
+	history  []Event
+	complete eventID // All events after it are in history
+	subs     map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan Event]struct{})}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e.Type == EventReset {
+		b.history = nil
+		b.complete = e.id()
+	} else {
+		b.history = append(b.history, e)
+		if len(b.history) > eventHistory {
+			b.complete = b.history[0].id()
+			b.history = b.history[1:]
+		}
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events after the one with id since, along with a
+// channel of the events to come. If some of the events since are forgotten, ok
+// is false and no events are returned.
+func (b *eventBus) subscribe(since eventID) (events []Event, ch chan Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch = make(chan Event, eventBuffer)
+	b.subs[ch] = struct{}{}
+	if since.before(b.complete) {
+		return nil, ch, false
+	}
+	for _, e := range b.history {
+		if since.before(e.id()) {
+			events = append(events, e)
+		}
+	}
+	return events, ch, true
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// emitLocked publishes an event caused by the log entry being applied. The
+// caller must hold the mutex. Leader events are not caused by the log, and
+// share the id of the event before them, such that the ids of the others are
+// the same on all nodes. Events emitted while iterating over the state must
+// therefore be emitted in a fixed order, see sortedCalls and sortedFloors.
+func (rw *raftwrapper) emitLocked(e Event) {
+	if e.Type != EventLeader {
+		if rw.lastEvent.Index != rw.state.Index {
+			rw.lastEvent = eventID{Index: rw.state.Index}
+		} else {
+			rw.lastEvent.Sub++
+		}
+	}
+	e.Index, e.Sub = rw.lastEvent.Index, rw.lastEvent.Sub
+	rw.events.publish(e)
+}
+
+// subscribe returns the events since the one with id since, along with a
+// channel of the events to come. If they are not all available, or since is
+// zero, an EventReset holding the current state is returned instead. The
+// state and events are consistent, as no log entries are applied in between.
+func (rw *raftwrapper) subscribe(since eventID) (events []Event, ch chan Event) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if since.Index > rw.state.Index {
+		since = eventID{}
+	}
+	events, ch, ok := rw.events.subscribe(since)
+	if since == (eventID{}) || !ok {
+		reset := Event{Index: rw.lastEvent.Index, Sub: rw.lastEvent.Sub, Type: EventReset, State: rw.state.DeepCopy()}
+		return []Event{reset}, ch
+	}
+	return events, ch
+}
+
+// watch returns a channel of all events, starting with an EventReset holding
+// the current state. Unlike subscribing, the consumer is never dropped. If it
+// falls behind it is instead caught up again, either by repeating some events
+// or with a new EventReset. The channel is closed once done is closed, or the
+// raftwrapper is stopped.
+func (rw *raftwrapper) watch(done <-chan struct{}) <-chan Event {
+	out := make(chan Event)
+	shutdown := rw.done()
+	send := func(e Event) bool {
+		select {
+		case out <- e:
+			return true
+		case <-done:
+		case <-shutdown:
+		}
+		return false
+	}
+
+	go func() {
+		defer close(out)
+		var since eventID
+		for {
+			events, ch := rw.subscribe(since)
+			for _, e := range events {
+				if !send(e) {
+					rw.events.unsubscribe(ch)
+					return
+				}
+				since = e.id()
+			}
+			for dropped := false; !dropped; {
+				select {
+				case e, ok := <-ch:
+					if !ok {
+						dropped = true
+						break
+					}
+					if !send(e) {
+						rw.events.unsubscribe(ch)
+						return
+					}
+					since = e.id()
+				case <-done:
+					rw.events.unsubscribe(ch)
+					return
+				case <-shutdown:
+					rw.events.unsubscribe(ch)
+					return
+				}
+			}
+			// Dropped for being too slow. Resume from the last event sent.
+		}
+	}()
+	return out
+}
+
+// LeaderMonitor publishes an event whenever the leader, as seen by the node,
+// changes. Leadership is not part of the raft log, so the events are given
+// the id of the last event.
+func (rw *raftwrapper) LeaderMonitor() {
+	shutdown := rw.done()
+	leader := ""
+	for {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-shutdown:
+			return
+		}
+		if l := rw.getRaft().Leader(); l != leader {
+			leader = l
+			rw.metrics.inc(&rw.metrics.leaderChanges)
+			rw.mu.Lock()
+			rw.emitLocked(Event{Type: EventLeader, Leader: leader})
+			rw.mu.Unlock()
+		}
+	}
+}
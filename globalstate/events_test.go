@@ -0,0 +1,310 @@
+package globalstate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EventBusResume(t *testing.T) {
+	b := newEventBus()
+	for i := uint64(1); i <= eventHistory+10; i++ {
+		b.publish(Event{Index: i, Type: EventLift})
+	}
+
+	events, ch, ok := b.subscribe(eventID{Index: eventHistory + 5})
+	assert.True(t, ok)
+	assert.Len(t, events, 5)
+	assert.Equal(t, uint64(eventHistory+6), events[0].Index)
+	b.unsubscribe(ch)
+
+	// Events from too far back are forgotten
+	_, ch, ok = b.subscribe(eventID{Index: 5})
+	assert.False(t, ok)
+	b.unsubscribe(ch)
+
+	// A reset forgets everything before it
+	b.publish(Event{Index: 2000, Type: EventReset})
+	_, ch, ok = b.subscribe(eventID{Index: eventHistory + 5})
+	assert.False(t, ok)
+	b.unsubscribe(ch)
+}
+
+func Test_EventsSharingAnIndex(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.mu.Lock()
+	rw.state.Index = 7
+	for i := 0; i < 3; i++ {
+		rw.emitLocked(Event{Type: EventButton})
+	}
+	rw.emitLocked(Event{Type: EventLeader})
+	rw.state.Index = 8
+	rw.emitLocked(Event{Type: EventLift})
+	rw.mu.Unlock()
+
+	// Resuming in the middle of an index keeps the rest of it
+	events, ch := rw.subscribe(eventID{Index: 7, Sub: 0})
+	defer rw.events.unsubscribe(ch)
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.id().String())
+	}
+	assert.Equal(t, []string{"7.1", "7.2", "7.2", "8.0"}, ids)
+	assert.Equal(t, EventLeader, events[2].Type)
+
+	// A bare index resumes after all of its events
+	id, err := parseEventID("7")
+	assert.NoError(t, err)
+	events, ch2 := rw.subscribe(id)
+	defer rw.events.unsubscribe(ch2)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, eventID{Index: 8}, events[0].id())
+	}
+
+	for _, bad := range []string{"", "x", "7.", "7.x", "-1"} {
+		if _, err := parseEventID(bad); err == nil {
+			t.Errorf("parseEventID(%q) accepted an invalid id", bad)
+		}
+	}
+}
+
+// mixedLog returns log entries where a lift is given several hall buttons and
+// calls before it is removed, such that the removal changes many of them. One
+// of its hall calls is then served by another lift.
+func mixedLog(t0 time.Time) []*raft.Log {
+	var entries []*raft.Log
+	add := func(t, key string, value interface{}) {
+		v, _ := json.Marshal(value)
+		b, _ := json.Marshal(command{Type: t, Key: key, Value: v, Time: t0.Add(time.Duration(len(entries)) * time.Second)})
+		entries = append(entries, &raft.Log{Index: uint64(len(entries) + 1), Data: b})
+	}
+
+	add("nodeUpdate", "lift1", LiftStatus{ID: "lift1", Direction: "up"})
+	for _, floor := range []uint{2, 1} {
+		for _, dir := range []string{"up", "down"} {
+			id := fmt.Sprintf("hall-%d-%s", floor, dir)
+			add("callPlace", id, Call{ID: id, Type: CallTypeHall, Floor: floor, Dir: dir, Status: CallPending, Created: t0})
+			add("btn"+strings.Title(dir)+"Update", fmt.Sprint(floor), Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1", Version: 1})
+		}
+	}
+	for _, floor := range []uint{3, 1, 2} {
+		id := fmt.Sprintf("cab-%d", floor)
+		add("callPlace", id, Call{ID: id, Type: CallTypeCab, Floor: floor, Lift: "lift1", Status: CallPending, Created: t0})
+	}
+	add("nodeRemove", "lift1", t0.Add(time.Minute))
+	add("nodeUpdate", "lift2", LiftStatus{ID: "lift2", Direction: "stop"})
+	add("btnUpUpdate", "2", Status{LastStatus: BtnStateAssigned, AssignedTo: "lift2", Version: 3})
+	add("btnUpUpdate", "2", Status{LastStatus: BtnStateDone, AssignedTo: "lift2", Version: 4})
+	return entries
+}
+
+func Test_EventIDsEqualOnAllNodes(t *testing.T) {
+	entries := mixedLog(time.Now())
+	replay := func() []Event {
+		rw := newRaftWrapper("0", 4)
+		rw.logger = log.New(ioutil.Discard, "", 0)
+		for _, l := range entries {
+			assert.Nil(t, rw.Apply(l))
+		}
+		events, ch, _ := rw.events.subscribe(eventID{})
+		rw.events.unsubscribe(ch)
+		return events
+	}
+
+	// Map order differs from run to run, so a few replays would tell them apart
+	first := replay()
+	for i := 0; i < 5; i++ {
+		if !assert.Equal(t, first, replay()) {
+			return
+		}
+	}
+}
+
+func Test_EventBusDropsSlowSubscribers(t *testing.T) {
+	b := newEventBus()
+	_, ch, _ := b.subscribe(eventID{})
+	for i := uint64(1); i <= eventBuffer+1; i++ {
+		b.publish(Event{Index: i, Type: EventLift})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, eventBuffer, n, "slow subscriber not dropped")
+	b.unsubscribe(ch)
+}
+
+type sseEvent struct {
+	id    eventID
+	event string
+	data  string
+}
+
+// readEvents reads events off the stream until the one wanted turn up, and
+// returns all of them.
+func readEvents(t *testing.T, r *bufio.Reader, until func(e sseEvent) bool) []sseEvent {
+	var events []sseEvent
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event stream ended: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			e.id, _ = parseEventID(line[4:])
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		case line == "" && e.event != "":
+			events = append(events, e)
+			if until(e) {
+				return events
+			}
+			e = sseEvent{}
+		}
+	}
+}
+
+func Test_EventStream(t *testing.T) {
+	config := Config{
+		RaftPort:           9048,
+		Floors:             4,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+	client := raft1.wrapper.client
+
+	// A fresh stream starts with the full state and the leader
+	res, err := client.get(raft1.CommAddr(), "/v1/events", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	stream := bufio.NewReader(res.Body)
+	events := readEvents(t, stream, func(e sseEvent) bool { return e.event == EventLeader })
+	assert.Equal(t, EventReset, events[0].event)
+	var state StateV1
+	assert.NoError(t, json.Unmarshal([]byte(events[0].data), &state))
+	assert.True(t, events[0].id.Index <= state.Index, "reset event after the state")
+	assert.Contains(t, events[len(events)-1].data, raft1.wrapper.ownID)
+
+	// Changes are pushed as they are applied
+	raft1.UpdateLiftStatus(LiftStatusUpdate{CurrentFloor: 3, CurrentDir: "STOP"})
+	events = readEvents(t, stream, func(e sseEvent) bool {
+		var lift NodeV1
+		json.Unmarshal([]byte(e.data), &lift)
+		return e.event == EventLift && lift.LastFloor == 3
+	})
+	resumeFrom := events[len(events)-1].id
+	res.Body.Close()
+
+	// Resuming replays what was missed, without starting over
+	raft1.UpdateButtonStatus(ButtonStatusUpdate{Floor: 1, Dir: "down", Status: BtnStateUnassigned})
+	time.Sleep(100 * time.Millisecond)
+	res, err = client.do("GET", raft1.CommAddr(), "/v1/events?since="+resumeFrom.String(), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	events = readEvents(t, bufio.NewReader(res.Body), func(e sseEvent) bool { return e.event == EventLeader })
+	if assert.True(t, len(events) >= 2) {
+		assert.Equal(t, EventButton, events[0].event)
+		assert.True(t, resumeFrom.before(events[0].id))
+		assert.Contains(t, events[0].data, `"direction":"down"`)
+	}
+	for _, e := range events {
+		assert.NotEqual(t, EventReset, e.event)
+	}
+}
+
+func Test_WatchCatchesUpSlowConsumers(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	done := make(chan struct{})
+	defer close(done)
+	events := rw.watch(done)
+	assert.Equal(t, EventReset, (<-events).Type)
+
+	// Publish far more than the consumer is able to buffer
+	last := uint64(3 * eventBuffer)
+	for i := uint64(1); i <= last; i++ {
+		rw.mu.Lock()
+		rw.state.Index = i
+		rw.emitLocked(Event{Type: EventLift})
+		rw.mu.Unlock()
+	}
+
+	var seen uint64
+	for seen < last {
+		select {
+		case e := <-events:
+			if e.Index > seen+1 {
+				t.Fatalf("missed events between %d and %d", seen, e.Index)
+			}
+			if e.Index > seen {
+				seen = e.Index
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only got events up to %d of %d", seen, last)
+		}
+	}
+}
+
+func Test_Watch(t *testing.T) {
+	config := Config{
+		RaftPort:           9052,
+		Floors:             4,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if _, err := raft1.Watch(context.Background()); err == nil {
+		t.Errorf("watching before initialization")
+	}
+	if err := raft1.Init(config); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := raft1.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-events
+	assert.Equal(t, EventReset, first.Type)
+	assert.Equal(t, uint(4), first.State.Floors)
+
+	raft1.UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: BtnStateUnassigned})
+	timeout := time.After(5 * time.Second)
+	for found := false; !found; {
+		select {
+		case e := <-events:
+			found = e.Type == EventButton && e.Floor == 2 && e.Dir == "up"
+		case <-timeout:
+			t.Fatalf("no event for the button")
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
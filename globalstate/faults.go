@@ -0,0 +1,75 @@
+package globalstate
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/hashicorp/raft"
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
+)
+
+// faultTransport injects the faults of the node into the RPCs raft sends.
+// Pipelining is refused, such that raft sends every AppendEntries on its own,
+// and every one of them is subject to the faults.
+type faultTransport struct {
+	raft.Transport
+	faults *faultnet.Faults
+}
+
+func (t *faultTransport) AppendEntriesPipeline(target string) (raft.AppendPipeline, error) {
+	return nil, raft.ErrPipelineReplicationNotSupported
+}
+
+func (t *faultTransport) AppendEntries(target string, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	if err := t.faults.Inject(target); err != nil {
+		return err
+	}
+	return t.Transport.AppendEntries(target, args, resp)
+}
+
+func (t *faultTransport) RequestVote(target string, args *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
+	if err := t.faults.Inject(target); err != nil {
+		return err
+	}
+	return t.Transport.RequestVote(target, args, resp)
+}
+
+func (t *faultTransport) InstallSnapshot(target string, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	if err := t.faults.Inject(target); err != nil {
+		return err
+	}
+	return t.Transport.InstallSnapshot(target, args, resp, data)
+}
+
+// Close closes the underlying transport, if it may be closed.
+func (t *faultTransport) Close() error {
+	if trans, ok := t.Transport.(raft.WithClose); ok {
+		return trans.Close()
+	}
+	return nil
+}
+
+// withFaults returns the round tripper with the faults of the node injected
+// into the requests sent through it, if fault injection is enabled.
+func (rw *raftwrapper) withFaults(rt http.RoundTripper) http.RoundTripper {
+	if rw.config.Faults == nil {
+		return rt
+	}
+	return faultnet.RoundTripper(rt, rw.config.Faults, rw.raftAddrOf)
+}
+
+// raftAddrOf returns the raft address of the node with the communication
+// service at comm, or comm itself if no such node is known.
+func (rw *raftwrapper) raftAddrOf(comm string) string {
+	if comm == rw.config.CommAddr {
+		return rw.ownID
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	for id, ls := range rw.state.Nodes {
+		if ls.CommAddr == comm {
+			return id
+		}
+	}
+	return comm
+}
@@ -0,0 +1,76 @@
+package globalstate
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FaultsThroughAPI(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	srv := httptest.NewServer(newCommService("127.0.0.1:0", rw))
+	defer srv.Close()
+	client := NewAPIClient(srv.Listener.Addr().String(), "", nil)
+
+	// Refused unless fault injection is enabled.
+	assert.Error(t, client.Get("/v1/faults", &FaultsV1{}))
+
+	rw.config.Faults = faultnet.New("10.0.0.1:8000")
+	var f FaultsV1
+	assert.NoError(t, client.Get("/v1/faults", &f))
+	assert.Zero(t, f.DropRate)
+	assert.Empty(t, f.Partitions)
+
+	set := FaultsV1{DropRate: 0.25, LatencyMs: 40, JitterMs: 10, Partitions: map[string][]string{"a": {"10.0.0.1:8000"}}}
+	assert.NoError(t, client.Do("PUT", "/v1/faults", set, &f))
+	assert.Equal(t, set, f)
+	settings := rw.config.Faults.Settings()
+	assert.Equal(t, 40*time.Millisecond, settings.Latency)
+	assert.True(t, rw.config.Faults.Cut("10.0.0.2:8000"))
+
+	assert.Error(t, client.Do("PUT", "/v1/faults", FaultsV1{DropRate: 2}, nil))
+	var cleared FaultsV1
+	assert.NoError(t, client.Do("PUT", "/v1/faults", FaultsV1{}, &cleared))
+	assert.Empty(t, cleared.Partitions)
+	assert.False(t, rw.config.Faults.Cut("10.0.0.2:8000"))
+}
+
+func Test_ClusterWithFaults(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.leader()
+	setFaults := func(f FaultsV1) {
+		for _, n := range c.nodes {
+			assert.NoError(t, NewAPIClient(n.CommAddr(), "", nil).Do("PUT", "/v1/faults", f, nil))
+		}
+	}
+
+	// Calls are served exactly once through lossy and slow links, once the
+	// calls lost on the way to the lifts time out.
+	setFaults(FaultsV1{DropRate: 0.1, LatencyMs: 20, JitterMs: 10})
+	c.pressHallCall(1, 1, "up")
+	c.pressHallCall(2, 2, "down")
+	c.retryLost()
+	c.assertServedExactlyOnce()
+
+	// The majority elects a new leader when partitioned from the old one.
+	c.elect(1)
+	c.quiet(func() {
+		setFaults(FaultsV1{Partitions: map[string][]string{
+			"minority": {c.nodes[0].id},
+			"majority": {c.nodes[1].id, c.nodes[2].id},
+		}})
+	})
+	assert.Equal(t, c.nodes[1].id, c.leader(1, 2).id)
+	c.advance(3*time.Second, 1, 2)
+	c.pressHallCall(1, 3, "down")
+	c.assertServedExactlyOnce()
+
+	setFaults(FaultsV1{})
+	assert.Equal(t, c.nodes[1].id, c.leader().id)
+	c.pressHallCall(0, 0, "up")
+	c.assertServedExactlyOnce()
+}
@@ -1,16 +1,18 @@
 package globalstate
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/hashicorp/raft"
 )
 
 // FSM hold all logic and essentially IS the globalstate handle. You may
@@ -19,7 +21,13 @@ type FSM struct {
 	wrapper  *raftwrapper
 	comm     *commService
 	logger   *log.Logger
+	initMu   sync.RWMutex // Guards initDone, which is read by other goroutines
 	initDone bool
+	mergeMu  sync.Mutex
+
+	// When Reconcile last asked each member of the raft, by communication
+	// address. Guarded by mergeMu.
+	memberChecked map[string]time.Time
 }
 
 // Init sets up and start the FSM.
@@ -27,8 +35,6 @@ func (f *FSM) Init(config Config) error {
 	// Parse ports
 	rPort := config.RaftPort
 	rPortStr := strconv.Itoa(rPort)
-	cPort := rPort + 1
-	cPortStr := strconv.Itoa(cPort)
 
 	// Creating new FSM
 	f.wrapper = newRaftWrapper(rPortStr, config.Floors)
@@ -39,63 +45,213 @@ func (f *FSM) Init(config Config) error {
 	}
 	f.wrapper.config = config
 
+	// Bind the communication service, such that the address advertised to the
+	// other nodes is known before joining any of them.
+	f.comm = newCommService("0.0.0.0:"+strconv.Itoa(config.CommPort), f.wrapper)
+	if err := f.comm.Listen(); err != nil {
+		config.Logger.Printf("[ERROR] Unable to bind communication service: %v\n", err.Error())
+		return err
+	}
+	if config.CommAddr == "" {
+		config.CommAddr = net.JoinHostPort(config.OwnIP, strconv.Itoa(f.comm.port))
+	}
+	f.wrapper.config = config
+	f.wrapper.auth = newAuthenticator(config.Secret)
+	f.wrapper.client = newCommClient(f.wrapper.auth, config.TLS)
+	f.wrapper.client.transport = f.wrapper.withFaults(f.wrapper.client.transport)
+	f.comm.transferLeadership = f.TransferLeadership
+
 	// Set basic properties of the fsm
-	f.wrapper.ownID = config.OwnIP + ":" + rPortStr
+	f.wrapper.ownID = net.JoinHostPort(config.OwnIP, rPortStr)
 	f.wrapper.logger = config.Logger
 	f.logger = config.Logger
 
-	// Set up storage for FSM
-	tmpDir, err1 := ioutil.TempDir("", "raft-fsm-store")
-	if err1 != nil {
-		f.wrapper.logger.Printf("[ERROR] Unable to create temporary folder for raft: %v\n", err1.Error())
-		return fmt.Errorf("failed to instantiate temp folder: %v", err1)
+	if err := f.start(config); err != nil {
+		// Release the ports and the raft state, such that Init may be retried.
+		if err := f.wrapper.Stop(); err != nil {
+			f.logger.Printf("[ERROR] Unable to stop raft: %s\n", err.Error())
+		}
+		f.comm.Close()
+		if f.wrapper.ephemeral {
+			os.RemoveAll(f.wrapper.RaftDir)
+		}
+		return err
+	}
+
+	f.startWorkers()
+	f.setReady(true)
+	return nil
+}
+
+// start sets up the raft storage, starts raft and the communication service,
+// and joins the cluster of the seeds, if any.
+func (f *FSM) start(config Config) error {
+	// Set up storage for FSM. Use a temporary folder if no data directory is
+	// provided. It is then removed when the FSM is shut down.
+	if config.DataDir == "" {
+		tmpDir, err := ioutil.TempDir("", "raft-fsm-store")
+		if err != nil {
+			f.wrapper.logger.Printf("[ERROR] Unable to create temporary folder for raft: %v\n", err.Error())
+			return fmt.Errorf("failed to instantiate temp folder: %v", err)
+		}
+		f.wrapper.RaftDir = tmpDir
+		f.wrapper.ephemeral = true
+	} else {
+		if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+			f.wrapper.logger.Printf("[ERROR] Unable to create data directory for raft: %v\n", err.Error())
+			return fmt.Errorf("failed to create data directory: %v", err)
+		}
+		f.wrapper.RaftDir = config.DataDir
+	}
+
+	// Gather every known address of a possible cluster member.
+	var seeds []string
+	if config.InitalPeer != "" {
+		seeds = append(seeds, config.InitalPeer)
+	}
+	for _, seed := range config.Seeds {
+		if seed != config.CommAddr && !stringInSlice(seed, seeds) {
+			seeds = append(seeds, seed)
+		}
 	}
-	defer os.RemoveAll(tmpDir)
-	f.wrapper.RaftDir = tmpDir
 
 	// Start the FSM
-	if err := f.wrapper.Start(config.InitalPeer == ""); err != nil {
+	if err := f.wrapper.Start(len(seeds) == 0); err != nil {
 		f.logger.Printf("[ERROR] Unable to start FSM: %v\n", err.Error())
 		return err
 	}
 
+	// A node restarted on top of an existing raft state already knows its peers,
+	// and will be brought up to date by the leader as soon as it is reachable.
+	rejoining := f.wrapper.hasExistingState()
+	if rejoining {
+		f.logger.Printf("[INFO] Found existing raft state in %s. Rejoining as %s\n", f.wrapper.RaftDir, f.wrapper.ownID)
+	}
+
 	// Start the communication service, to handle join requests.
-	f.comm = newCommService("0.0.0.0:"+cPortStr, f.wrapper)
 	if err := f.comm.Start(); err != nil {
 		f.logger.Printf("[ERROR] Unable to start communication service: %v\n", err.Error())
 		return err
 	}
-	f.logger.Printf("[INFO] Communication service started on on port %v\n", cPort)
+	f.logger.Printf("[INFO] Communication service started on %v\n", config.CommAddr)
 
-	// Join supplied peer.
-	if config.InitalPeer != "" {
-		err := joinPeerToRaft(config.InitalPeer, rPortStr, config.OwnIP, f.logger)
-		if err != nil {
-			f.logger.Printf("[ERROR] Unable to join node at %s: %s\n", config.InitalPeer, err.Error())
-			return err
+	// Join any of the supplied seeds. Nodes started at the same time with only
+	// each other as seeds would wait for each other forever, so one of them
+	// bootstraps a new cluster if none of the seeds answers.
+	if len(seeds) > 0 && !rejoining {
+		for i, seed := range seeds {
+			seeds[i] = seedCommAddr(seed, f.wrapper.client, f.logger)
+		}
+		if err := joinAnySeed(seeds, f.wrapper.RaftPort, config, f.wrapper.client, f.logger); err != nil {
+			if anySeedAnswers(seeds) || !bootstrapsSeeds(config.CommAddr, seeds) {
+				f.logger.Printf("[ERROR] Unable to join any of the seeds %v: %s\n", seeds, err.Error())
+				return err
+			}
+			f.logger.Printf("[WARN] None of the seeds %v answered. Bootstrapping a new cluster, as the node has the lowest address\n", seeds)
+			if err := f.wrapper.Stop(); err != nil {
+				return err
+			}
+			if err := f.wrapper.Start(true); err != nil {
+				return err
+			}
 		}
 	}
 
 	// Wait for raft to either join or create a new raft. This usually takes 2-3 seconds
 	time.Sleep(4 * time.Second)
+	return nil
+}
 
-	// Start workers
-	go f.wrapper.ConsensusOrderAssigner(f.UpdateButtonStatus)
-	go f.wrapper.ConsensusMonitor()
+// Shutdown leaves the raft and shuts down the FSM. The node has the leader
+// remove it from the raft, or removes itself if it is the leader, which hands
+// the hall calls assigned to it back for assignment to the other lifts. The
+// others are thereby spared a dead voter. A node unable to leave, such as the
+// leader of a cluster too small to elect another one, is shut down all the
+// same, and kicked once found dead.
+func (f *FSM) Shutdown() {
+	if f.ready() {
+		if err := f.leave(); err != nil {
+			f.logger.Printf("[WARN] Unable to leave the raft: %s\n", err.Error())
+		}
+	}
+	f.stop()
+}
+
+// leave leaves the raft, such that the others carry on without waiting for the
+// node to come back. Its hall calls are handed back as it is removed from the
+// state, before it is removed from the raft, such that they are never left
+// with a node that is gone. A leader removes itself, and the others elect a
+// new leader among themselves. It only does so if they are enough to, and
+// otherwise just hands its hall calls back.
+func (f *FSM) leave() error {
+	rw := f.wrapper
+	peers, err := rw.peers()
+	if err != nil {
+		return err
+	}
+	if len(peers) <= 1 {
+		return nil
+	}
+
+	// Stop the workers before leaving, such that the removal isn't taken for
+	// the node being kicked.
+	f.mergeMu.Lock()
+	defer f.mergeMu.Unlock()
+	f.setReady(false)
+	rw.stopWorkers()
+	if rw.getRaft().State() != raft.Leader {
+		if err := leaveRaft(rw); err != nil {
+			return err
+		}
+		f.logger.Printf("[INFO] Left the raft\n")
+		return nil
+	}
 
-	f.initDone = true
+	remaining := len(peers) - 1
+	if alive := rw.countAlive(peers, rw.ownID); remaining < 2 || alive <= remaining/2 {
+		f.logger.Printf("[WARN] Only %d of %d other nodes alive, which are unable to elect a new leader. Handing back the hall calls without leaving the raft\n", alive, remaining)
+		return rw.releaseHallCalls(rw.ownID)
+	}
+	if err := rw.Leave(rw.ownID); err != nil {
+		return err
+	}
+	f.logger.Printf("[INFO] Left the raft as leader\n")
 	return nil
 }
 
-// Shutdown shuts down the FSM in a safe manner.
-func (f *FSM) Shutdown() {
-	close(f.wrapper.shutdown)
+// stop shuts down the FSM without leaving the raft, the same way as if the
+// node crashed.
+func (f *FSM) stop() {
 	f.logger.Println("[INFO] Shutting down raft")
-	future := f.wrapper.raft.Shutdown()
-	if future.Error() != nil {
-		f.logger.Fatalf("[ERROR] Failed to close FSM: %v", future.Error())
+	if err := f.wrapper.Stop(); err != nil {
+		f.logger.Fatalf("[ERROR] Failed to close FSM: %v", err)
 	}
-	//f.comm.Close()
+	if f.wrapper.ephemeral {
+		os.RemoveAll(f.wrapper.RaftDir)
+	}
+	f.comm.Close()
+	f.setReady(false)
+}
+
+// ready returns whether the FSM is initialized and not yet shut down.
+func (f *FSM) ready() bool {
+	f.initMu.RLock()
+	defer f.initMu.RUnlock()
+	return f.initDone
+}
+
+func (f *FSM) setReady(ready bool) {
+	f.initMu.Lock()
+	f.initDone = ready
+	f.initMu.Unlock()
+}
+
+func (f *FSM) startWorkers() {
+	go f.wrapper.ConsensusOrderAssigner(f.UpdateButtonStatus)
+	go f.wrapper.ConsensusMonitor()
+	go f.wrapper.DeadNodeRemover()
+	go f.wrapper.RemovalMonitor()
+	go f.wrapper.LeaderMonitor()
 }
 
 func validateConfig(c *Config) error {
@@ -105,6 +261,15 @@ func validateConfig(c *Config) error {
 	if c.OwnIP == "" {
 		c.OwnIP = getOutboundIP()
 	}
+	if c.JoinAttempts == 0 {
+		c.JoinAttempts = 3
+	}
+	if c.DeadNodeGracePeriod == 0 {
+		c.DeadNodeGracePeriod = 30 * time.Second
+	}
+	if c.Clock == nil {
+		c.Clock = time.Now
+	}
 	if c.OnPromotion == nil {
 		c.OnPromotion = func() {}
 	}
@@ -118,7 +283,7 @@ func validateConfig(c *Config) error {
 		c.OnLostConsensus = func() {}
 	}
 	if c.OnIncomingCommand == nil {
-		c.OnIncomingCommand = func(f int, d string) {}
+		c.OnIncomingCommand = func(f int, d string, v uint64) {}
 	}
 	if c.CostFunction == nil {
 		c.CostFunction = func(s State, f int, d string) string { return "localhost:8000" }
@@ -129,24 +294,107 @@ func validateConfig(c *Config) error {
 	return nil
 }
 
-func joinPeerToRaft(initialPeer, raftAddr, ownIP string, logger *log.Logger) error {
-	// Marshal join request
-	b, err := json.Marshal(map[string]string{"addr": raftAddr})
+// joinAnySeed tries to join the seeds one by one, and starts over from the first
+// seed after a short pause if none of them admitted the node.
+func joinAnySeed(seeds []string, raftAddr string, c Config, client *commClient, logger *log.Logger) error {
+	var err error
+	for attempt := 1; attempt <= c.JoinAttempts; attempt++ {
+		for _, seed := range seeds {
+			if err = joinPeerToRaft(seed, raftAddr, c.CommAddr, client, logger); err == nil {
+				return nil
+			}
+			logger.Printf("[WARN] Unable to join seed %s (attempt %d/%d): %s\n", seed, attempt, c.JoinAttempts, err.Error())
+		}
+		if attempt < c.JoinAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+// seedCommAddr returns the address of the communication service of the seed.
+// A seed not answering as a communication service, while the raft port + 1
+// does, is taken for the raft address of a node with the default
+// communication port.
+func seedCommAddr(seed string, client *commClient, logger *log.Logger) string {
+	if _, err := getClusterStatus(seed, client); err == nil {
+		return seed
+	}
+	host, port, err := net.SplitHostPort(seed)
+	p, convErr := strconv.Atoi(port)
+	if err != nil || convErr != nil {
+		return seed
+	}
+	comm := net.JoinHostPort(host, strconv.Itoa(p+1))
+	if _, err := getClusterStatus(comm, client); err != nil {
+		return seed
+	}
+	logger.Printf("[WARN] %s is a raft address. Joining through the communication service at %s instead\n", seed, comm)
+	return comm
+}
+
+// bootstrapsSeeds returns whether the node at commAddr is the one to bootstrap a
+// new cluster when none of the seeds answers. All nodes started with the same
+// seeds agree on the node, which is the one with the lowest address.
+func bootstrapsSeeds(commAddr string, seeds []string) bool {
+	for _, seed := range seeds {
+		if seed < commAddr {
+			return false
+		}
+	}
+	return true
+}
+
+// anySeedAnswers returns whether any of the seeds accepts connections, such as
+// a seed refusing to admit the node.
+func anySeedAnswers(seeds []string) bool {
+	for _, seed := range seeds {
+		if conn, err := net.DialTimeout("tcp", seed, time.Second); err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// leaveRaft asks the leader to remove the node from the raft. The leader is
+// looked up again on every attempt, in case it changes on the way.
+func leaveRaft(rw *raftwrapper) error {
+	b, err := json.Marshal(map[string]string{"id": rw.ownID})
 	if err != nil {
 		return err
 	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		var leader string
+		var res *http.Response
+		if leader, err = rw.leaderComEndpoint(); err == nil {
+			if res, err = rw.client.do("POST", leader, "/leave", b, 5*time.Second); err == nil {
+				if err = checkResponse(res); err == nil {
+					return nil
+				}
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return err
+}
 
-	// Infer communication port from RaftPort (comport is always one above!)
-	parts := strings.Split(initialPeer, ":")
-	port, _ := strconv.Atoi(parts[1])
-	initialPeer = fmt.Sprintf("%s:%d", parts[0], port+1)
+func joinPeerToRaft(peerComm, raftAddr, commAddr string, client *commClient, logger *log.Logger) error {
+	// Marshal join request
+	b, err := json.Marshal(map[string]string{"addr": raftAddr, "comm": commAddr})
+	if err != nil {
+		return err
+	}
 
-	url := fmt.Sprintf("http://%s/join", initialPeer)
-	logger.Printf("[INFO] Attempting to join %v", url)
-	resp, err := http.Post(url, "application-type/json", bytes.NewReader(b))
+	logger.Printf("[INFO] Attempting to join %v", client.url(peerComm, "/join"))
+	resp, err := client.post(peerComm, "/join", b)
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("join refused by %s: %s", peerComm, resp.Status)
+	}
 
 	// Peer admitted on first try (ie. luckily tried the leader on first try)
 	if resp.Header.Get("X-Raft-Leader") == "" {
@@ -159,13 +407,15 @@ func joinPeerToRaft(initialPeer, raftAddr, ownIP string, logger *log.Logger) err
 	resp.Body.Close()
 
 	// Request the leader
-	url = fmt.Sprintf("http://%s/join", leaderAddr)
-	logger.Printf("[INFO] Redirected! Attempting to join: %v\n", url)
-	resp2, err := http.Post(url, "application-type/json", bytes.NewReader(b))
+	logger.Printf("[INFO] Redirected! Attempting to join: %v\n", client.url(leaderAddr, "/join"))
+	resp2, err := client.post(leaderAddr, "/join", b)
 	if err != nil {
 		return err
 	}
 	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK {
+		return fmt.Errorf("join refused by leader at %s: %s", leaderAddr, resp2.Status)
+	}
 	logger.Printf("[INFO] Successfully joined raft\n")
 	return nil
 }
@@ -1,11 +1,16 @@
 package globalstate
 
 import (
+	"crypto/tls"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/hdhauk/TTK4145-Lift/clustertls"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -46,7 +51,7 @@ func Test_TwoNodeSimpleConsensus(t *testing.T) {
 	time.Sleep(7 * time.Second)
 	config2 := Config{
 		RaftPort:           9004,
-		InitalPeer:         getOutboundIP() + ":9002",
+		InitalPeer:         raft1.CommAddr(),
 		OnAquiredConsensus: func() { consensus <- true },
 		OnLostConsensus:    func() { consensus <- false },
 		CostFunction:       func(s State, f int, d string) string { return "localhost:8005" },
@@ -81,7 +86,7 @@ func Test_TwoNodeConsensusWithTraffic(t *testing.T) {
 	time.Sleep(5 * time.Second)
 	config2 := Config{
 		RaftPort:           9008,
-		InitalPeer:         getOutboundIP() + ":9006",
+		InitalPeer:         raft1.CommAddr(),
 		CostFunction:       func(s State, f int, d string) string { return "localhost:8005" },
 		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
 		DisableRaftLogging: true,
@@ -89,10 +94,10 @@ func Test_TwoNodeConsensusWithTraffic(t *testing.T) {
 	raft2 := FSM{}
 	raft2.Init(config2)
 
-	raft1.UpdateButtonStatus(ButtonStatusUpdate{2, "up", "done", ""})
-	raft2.UpdateButtonStatus(ButtonStatusUpdate{1, "down", "assigned", "localhost:90"})
-	raft1.UpdateLiftStatus(LiftStatusUpdate{1, "stop", 2, ""})
-	raft2.UpdateLiftStatus(LiftStatusUpdate{3, "down", 1, "up"})
+	raft1.UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: "done"})
+	raft2.UpdateButtonStatus(ButtonStatusUpdate{Floor: 1, Dir: "down", Status: "unassigned"})
+	raft1.UpdateLiftStatus(LiftStatusUpdate{CurrentFloor: 1, CurrentDir: "stop", DstFloor: 2})
+	raft2.UpdateLiftStatus(LiftStatusUpdate{CurrentFloor: 3, CurrentDir: "down", DstFloor: 1, DstBtnDir: "up"})
 
 	time.Sleep(1 * time.Second)
 	state1, _ := raft1.GetState()
@@ -113,7 +118,7 @@ func Test_ThreeNodeClusterWithRedirect(t *testing.T) {
 	time.Sleep(5 * time.Second)
 	config2 := Config{
 		RaftPort:           9012,
-		InitalPeer:         getOutboundIP() + ":9010",
+		InitalPeer:         raft1.CommAddr(),
 		CostFunction:       func(s State, f int, d string) string { return "localhost:8005" },
 		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
 		DisableRaftLogging: true,
@@ -124,7 +129,7 @@ func Test_ThreeNodeClusterWithRedirect(t *testing.T) {
 	time.Sleep(5 * time.Second)
 	config3 := Config{
 		RaftPort:           9014,
-		InitalPeer:         getOutboundIP() + ":9012",
+		InitalPeer:         raft2.CommAddr(),
 		CostFunction:       func(s State, f int, d string) string { return "localhost:8005" },
 		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
 		DisableRaftLogging: true,
@@ -133,7 +138,7 @@ func Test_ThreeNodeClusterWithRedirect(t *testing.T) {
 	raft3.Init(config3)
 
 	blankState, _ := raft1.GetState()
-	raft1.UpdateButtonStatus(ButtonStatusUpdate{2, "up", "done", ""})
+	raft1.UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: "unassigned"})
 	time.Sleep(1 * time.Second)
 	state1, _ := raft1.GetState()
 	state2, _ := raft2.GetState()
@@ -143,3 +148,357 @@ func Test_ThreeNodeClusterWithRedirect(t *testing.T) {
 	assert.Equal(t, state2, state3)
 
 }
+
+func Test_RestartWithPersistentState(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "raft-persist-test")
+	if err != nil {
+		t.Fatalf("unable to create data directory: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	config := Config{
+		RaftPort:           9022,
+		DataDir:            dataDir,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	raft1.UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: "unassigned"})
+	time.Sleep(1 * time.Second)
+	before, _ := raft1.GetState()
+	raft1.Shutdown()
+
+	// Restart on top of the same data directory
+	raft2 := FSM{}
+	if err := raft2.Init(config); err != nil {
+		t.Fatalf("failed to restart FSM: %v", err)
+	}
+	after, _ := raft2.GetState()
+	assert.NotEmpty(t, before.HallUpButtons)
+	assert.Equal(t, before.HallUpButtons, after.HallUpButtons)
+	raft2.Shutdown()
+}
+
+func Test_JoinSkipsUnreachableSeeds(t *testing.T) {
+	config1 := Config{
+		RaftPort:           9028,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config1); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+
+	config2 := Config{
+		RaftPort:           9030,
+		Seeds:              []string{"127.0.0.1:1", raft1.CommAddr()},
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft2 := FSM{}
+	if err := raft2.Init(config2); err != nil {
+		t.Fatalf("failed to join through the second seed: %v", err)
+	}
+	defer raft2.Shutdown()
+
+	status, err := raft1.wrapper.clusterStatus()
+	assert.NoError(t, err)
+	assert.Contains(t, status.Peers, getOutboundIP()+":9030")
+}
+
+func Test_JoinThroughRaftAddressSeed(t *testing.T) {
+	config1 := Config{
+		RaftPort:           9084,
+		CommPort:           9085,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config1); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+
+	config2 := Config{
+		RaftPort:           9086,
+		InitalPeer:         getOutboundIP() + ":9084",
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft2 := FSM{}
+	if err := raft2.Init(config2); err != nil {
+		t.Fatalf("failed to join through the raft address of the peer: %v", err)
+	}
+	defer raft2.Shutdown()
+
+	status, err := raft1.wrapper.clusterStatus()
+	assert.NoError(t, err)
+	assert.Contains(t, status.Peers, getOutboundIP()+":9086")
+}
+
+func Test_StaticSeedsBootstrapLowestAddress(t *testing.T) {
+	low := getOutboundIP() + ":9068"
+	high := getOutboundIP() + ":9070"
+	config := Config{
+		RaftPort:           9072,
+		CommPort:           9070,
+		Seeds:              []string{low, high},
+		JoinAttempts:       1,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+
+	// None of the seeds answers, and another node has the lowest address.
+	// The node should give up, and leave its ports free for another try.
+	node2 := FSM{}
+	if err := node2.Init(config); err == nil {
+		node2.Shutdown()
+		t.Fatal("node without the lowest address bootstrapped a cluster")
+	}
+	for _, addr := range []string{":9070", ":9072"} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("port %s not released after failed Init: %v", addr, err)
+		}
+		l.Close()
+	}
+
+	// The node with the lowest address bootstraps a cluster instead.
+	config1 := config
+	config1.RaftPort = 9074
+	config1.CommPort = 9068
+	node1 := FSM{}
+	if err := node1.Init(config1); err != nil {
+		t.Fatalf("node with the lowest address failed to bootstrap: %v", err)
+	}
+	defer node1.Shutdown()
+	assert.Equal(t, node1.wrapper.ownID, node1.Leader())
+
+	if err := node2.Init(config); err != nil {
+		t.Fatalf("failed to join the bootstrapped cluster: %v", err)
+	}
+	defer node2.Shutdown()
+	assert.Equal(t, node1.wrapper.ownID, node2.Leader())
+}
+
+func Test_RejectUnsignedJoin(t *testing.T) {
+	config1 := Config{
+		RaftPort:           9032,
+		Secret:             "correct horse battery staple",
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config1); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+
+	intruder := Config{
+		RaftPort:           9034,
+		InitalPeer:         raft1.CommAddr(),
+		JoinAttempts:       1,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft2 := FSM{}
+	assert.Error(t, raft2.Init(intruder), "joined without the secret")
+	raft2.Shutdown()
+
+	member := intruder
+	member.RaftPort = 9036
+	member.Secret = config1.Secret
+	raft3 := FSM{}
+	if err := raft3.Init(member); err != nil {
+		t.Fatalf("failed to join with the secret: %v", err)
+	}
+	defer raft3.Shutdown()
+
+	status, err := raft1.wrapper.clusterStatus()
+	assert.NoError(t, err)
+	assert.NotContains(t, status.Peers, getOutboundIP()+":9034")
+	assert.Contains(t, status.Peers, getOutboundIP()+":9036")
+}
+
+func Test_TwoNodeClusterOverTLS(t *testing.T) {
+	caCert, caKey, err := clustertls.NewCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatalf("unable to create CA: %v", err)
+	}
+	tlsConfig := func(name string) *tls.Config {
+		certPEM, keyPEM, _ := clustertls.NewNodeCert(caCert, caKey, name, []string{getOutboundIP()}, time.Hour)
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		config, err := clustertls.NewConfig(caCert, cert)
+		if err != nil {
+			t.Fatalf("unable to create TLS config: %v", err)
+		}
+		return config
+	}
+
+	config1 := Config{
+		RaftPort:           9038,
+		TLS:                tlsConfig("lift1"),
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config1); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+
+	config2 := Config{
+		RaftPort:           9040,
+		InitalPeer:         raft1.CommAddr(),
+		TLS:                tlsConfig("lift2"),
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft2 := FSM{}
+	if err := raft2.Init(config2); err != nil {
+		t.Fatalf("failed to join over TLS: %v", err)
+	}
+	defer raft2.Shutdown()
+
+	// The update is replicated over the TLS raft transport
+	assert.NoError(t, raft2.UpdateButtonStatus(ButtonStatusUpdate{Floor: 1, Dir: "up", Status: "unassigned"}))
+	time.Sleep(1 * time.Second)
+	state2, _ := raft2.GetState()
+	assert.Contains(t, state2.HallUpButtons, "1")
+
+	// Plain HTTP is refused in the TLS handshake
+	res, err := newCommClient(nil, nil).get(raft1.CommAddr(), "/status", time.Second)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Contains(t, string(body), "HTTP request to an HTTPS server")
+	}
+
+	// So is TLS without a certificate from the cluster CA
+	noCert := tlsConfig("intruder")
+	noCert.Certificates = nil
+	_, err = newCommClient(nil, noCert).get(raft1.CommAddr(), "/status", time.Second)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tls: certificate required")
+	}
+}
+
+func Test_CommAddrReplicated(t *testing.T) {
+	config1 := Config{
+		RaftPort:           9042,
+		CommPort:           9050,
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft1 := FSM{}
+	if err := raft1.Init(config1); err != nil {
+		t.Fatalf("failed to initialize FSM: %v", err)
+	}
+	defer raft1.Shutdown()
+	assert.Equal(t, getOutboundIP()+":9050", raft1.CommAddr())
+
+	// The communication port of the second node is picked by the OS
+	config2 := Config{
+		RaftPort:           9044,
+		InitalPeer:         raft1.CommAddr(),
+		CostFunction:       func(s State, f int, d string) string { return "" },
+		Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+		DisableRaftLogging: true,
+	}
+	raft2 := FSM{}
+	if err := raft2.Init(config2); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	defer raft2.Shutdown()
+
+	state2, _ := raft2.GetState()
+	assert.Equal(t, raft1.CommAddr(), state2.Nodes[getOutboundIP()+":9042"].CommAddr)
+	assert.Equal(t, raft2.CommAddr(), state2.Nodes[getOutboundIP()+":9044"].CommAddr)
+
+	// Followers find the leader through the replicated address
+	assert.NoError(t, raft2.UpdateButtonStatus(ButtonStatusUpdate{Floor: 3, Dir: "down", Status: "unassigned"}))
+	time.Sleep(1 * time.Second)
+	state1, _ := raft1.GetState()
+	assert.Contains(t, state1.HallDownButtons, "3")
+}
+
+func Test_ShutdownLeavesRaft(t *testing.T) {
+	var nodes []*FSM
+	for i, port := range []int{9060, 9062, 9064} {
+		config := Config{
+			RaftPort:           port,
+			Floors:             4,
+			CostFunction:       func(s State, f int, d string) string { return "" },
+			Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+			DisableRaftLogging: true,
+		}
+		if i > 0 {
+			config.InitalPeer = nodes[0].CommAddr()
+		}
+		node := &FSM{}
+		if err := node.Init(config); err != nil {
+			t.Fatalf("failed to initialize FSM: %v", err)
+		}
+		defer func() {
+			if node.ready() {
+				node.Shutdown()
+			}
+		}()
+		nodes = append(nodes, node)
+	}
+	leader := nodes[0].wrapper.ownID
+	if !assert.Equal(t, leader, nodes[1].Leader()) {
+		return
+	}
+	assert.NoError(t, nodes[0].UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: BtnStateUnassigned}))
+	assert.NoError(t, nodes[0].UpdateButtonStatus(ButtonStatusUpdate{Floor: 2, Dir: "up", Status: BtnStateAssigned, AssignedTo: leader}))
+
+	// The leader leaves, its hall call is handed back, and the others elect a
+	// new leader among themselves without it ever joining again.
+	nodes[0].Shutdown()
+	var newLeader string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if newLeader = nodes[1].Leader(); newLeader != "" && newLeader != leader {
+			break
+		}
+	}
+	assert.NotEqual(t, "", newLeader)
+	assert.NotEqual(t, leader, newLeader)
+	peers, _ := nodes[1].wrapper.peers()
+	assert.NotContains(t, peers, leader)
+	state, _ := nodes[1].GetState()
+	assert.NotContains(t, state.Nodes, leader)
+	assert.Equal(t, BtnStateUnassigned, state.HallUpButtons["2"].LastStatus)
+
+	// The last one standing keeps the raft going on its own when the other
+	// follower leaves.
+	remaining, follower := nodes[1], nodes[2]
+	if newLeader == nodes[2].wrapper.ownID {
+		remaining, follower = nodes[2], nodes[1]
+	}
+	follower.Shutdown()
+	time.Sleep(1 * time.Second)
+	peers, _ = remaining.wrapper.peers()
+	assert.Equal(t, []string{remaining.wrapper.ownID}, peers)
+	assert.NoError(t, remaining.UpdateButtonStatus(ButtonStatusUpdate{Floor: 1, Dir: "down", Status: BtnStateUnassigned}))
+
+	// Only members may leave
+	assert.Error(t, remaining.wrapper.Leave(follower.wrapper.ownID))
+}
@@ -8,13 +8,21 @@ import (
 )
 
 type fsmSnapshot struct {
-	store State
+	store   State
+	history []HallCallRecord
+}
+
+// snapshotData is the encoding of a snapshot. The state is embedded, such that
+// snapshots holding nothing but the state can still be restored.
+type snapshotData struct {
+	State
+	History []HallCallRecord `json:",omitempty"`
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
 		// Encode data
-		b, err := json.Marshal(f.store)
+		b, err := json.Marshal(snapshotData{State: f.store, History: f.history})
 		if err != nil {
 			return err
 		}
@@ -2,14 +2,15 @@ package globalstate
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"os"
-	"strconv"
-	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
 )
 
 // Public facing data types and constants
@@ -26,19 +27,95 @@ const (
 
 // Config contain all configuration details and callbacks for the FSM.
 type Config struct {
-	// Port for raft RCP communication. The port above will also be binded, and is used for user-initiated communication over HTTP.
+	// Port for raft RCP communication.
 	RaftPort int
 
-	// If supplied the raft will attempt to connect to any cluster the supplied peer is connected to.
-	// If left blank the FSM instantiate a brand new raft and elect itself leader.
+	// CommPort is the port of the communication service, which is used for
+	// user-initiated communication over HTTP. If 0 any free port is used.
+	CommPort int
+
+	// CommAddr is the address other nodes should use to reach the communication
+	// service, which is advertised in the replicated state. Set it when the
+	// node is behind NAT or port mapping. Default is OwnIP and CommPort.
+	CommAddr string
+
+	// InitalPeer is the address of the communication service of a node, whose
+	// cluster the node attempts to join. A raft address is taken for the
+	// communication service at the raft port + 1, when the node answers there.
+	// If left blank, and no seeds are supplied, the FSM instantiate a brand new
+	// raft and elect itself leader.
 	InitalPeer string
 
+	// Seeds are the addresses of the communication services of nodes that may
+	// be part of an existing cluster, and raft addresses are taken the same way
+	// as for InitalPeer. They are tried in turn after InitalPeer until one of
+	// them admit the node. If none of them answers, the node with the lowest
+	// address among the seeds and itself bootstraps a new raft, and Init fails
+	// on the others.
+	Seeds []string
+
+	// JoinAttempts is the number of times all seeds are tried before giving up.
+	// Default is 3.
+	JoinAttempts int
+
+	// TLS enables mutual TLS for both raft and the communication service when
+	// set. It must hold the certificate of the node, and trust only the
+	// certificate authority of the cluster. See package clustertls.
+	TLS *tls.Config
+
+	// Secret is shared by all members of the cluster. When set, all requests
+	// between the nodes are signed with it, and unsigned requests, including
+	// attempts to join the raft, are rejected. Must be equal on all nodes.
+	Secret string
+
+	// DashboardToken lets browsers holding it read, but not change, the state
+	// through the dashboard when the cluster has a secret. See HandleDashboard.
+	// Under mutual TLS the browser must also present a certificate of the
+	// cluster. If empty, the dashboard only shows the state without a secret.
+	DashboardToken string
+
+	// MetricsAddr is the address of a plain HTTP listener serving nothing but
+	// /metrics, for Prometheus to scrape when the communication service needs
+	// signed requests or client certificates. The metrics name the nodes and
+	// their addresses, so bind it where only the scraper reaches it. If empty,
+	// the metrics are only served by the communication service, to requests
+	// authenticated like any other.
+	MetricsAddr string
+
 	// OwnIP may be manually be set. If not supplied it will be inferred by the package if needed.
 	OwnIP string
 
+	// Transport returns the raft transport of the node at the raft address,
+	// instead of a TCP transport bound to RaftPort. It is called every time
+	// raft is started, and lets tests run several nodes in one process over
+	// raft.InmemTransport. TLS is then left to the transport.
+	Transport func(addr string) (raft.Transport, error)
+
+	// Faults are injected into the raft RPCs and the requests sent to other
+	// nodes, and may be changed at runtime through /v1/faults. Meant for
+	// resilience tests. If nil no faults are injected, and /v1/faults is
+	// disabled.
+	Faults *faultnet.Faults
+
+	// DataDir is the directory where the raft log, stable store, snapshots and
+	// peer set are persisted. A node restarted with the same DataDir and RaftPort
+	// rejoins the cluster as itself and catches up on whatever it missed.
+	// If left blank a temporary directory is used, which is removed on Shutdown.
+	DataDir string
+
 	// Number of floors on the lifts in the cluster. Only used for calculating timeouts.
 	Floors int
 
+	// DeadNodeGracePeriod is how long the leader waits for a lift status update
+	// from a node before removing it from the raft. Default is 30 seconds.
+	DeadNodeGracePeriod time.Duration
+
+	// Clock returns the current time, which the lift statuses and button
+	// changes are stamped with, and the order timeouts and the grace period
+	// measured against. Default is time.Now. Lets tests decide when orders time
+	// out and nodes are taken for dead.
+	Clock func() time.Time
+
 	// Called once whenever the node win or loose the raft-leadership.
 	OnPromotion func()
 	OnDemotion  func()
@@ -49,8 +126,11 @@ type Config struct {
 	// Called once whenever the consensus is regained and a leader is elected.
 	OnLostConsensus func()
 
-	// Called once whenever the leader have assigned an order to the node.
-	OnIncomingCommand func(floor int, dir string)
+	// Called once whenever the leader have assigned an order to the node. The
+	// direction is "up" or "down" for hall orders, and "cab" for cab calls
+	// placed on the node through the API. The version is the one the hall
+	// button got when assigned, which the order should be reported done with.
+	OnIncomingCommand func(floor int, dir string, version uint64)
 
 	// Used by the leader to assign orders.
 	CostFunction func(s State, floor int, dir string) string
@@ -68,6 +148,8 @@ type LiftStatusUpdate struct {
 	CurrentDir   string
 	DstFloor     uint
 	DstBtnDir    string
+	DoorOpen     bool
+	CabCalls     []uint // Floors of the cab calls the lift has yet to serve
 }
 
 // ButtonStatusUpdate defines a message with which you intend to update the global store with.
@@ -76,6 +158,10 @@ type ButtonStatusUpdate struct {
 	Dir        string
 	Status     string
 	AssignedTo string
+
+	// Version of the button the update is based on. If set, the update is
+	// rejected with a StaleUpdateError if the button have changed since.
+	Version uint64
 }
 
 // Public facing functions
@@ -83,7 +169,7 @@ type ButtonStatusUpdate struct {
 
 // UpdateLiftStatus updates the globalstate with the provided liftStatus.
 func (f *FSM) UpdateLiftStatus(ls LiftStatusUpdate) error {
-	if !f.initDone {
+	if !f.ready() {
 		return fmt.Errorf("globalstate not yet initialized")
 	}
 	// Convert to liftStatus
@@ -93,6 +179,9 @@ func (f *FSM) UpdateLiftStatus(ls LiftStatusUpdate) error {
 		Direction:                  ls.CurrentDir,
 		DestinationFloor:           ls.DstFloor,
 		DestinationButtonDirection: ls.DstBtnDir,
+		CommAddr:                   f.wrapper.config.CommAddr,
+		DoorOpen:                   ls.DoorOpen,
+		CabCalls:                   ls.CabCalls,
 	}
 
 	b := new(bytes.Buffer)
@@ -104,19 +193,17 @@ func (f *FSM) UpdateLiftStatus(ls LiftStatusUpdate) error {
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s/update/lift", leader)
-	res, err := http.Post(url, "application/json; charset=utf-8", b)
+	res, err := f.wrapper.client.post(leader, "/update/lift", b.Bytes())
 	if err != nil {
 		return err
 	}
-	io.Copy(os.Stdout, res.Body)
-	return nil
+	return checkResponse(res)
 }
 
 // UpdateButtonStatus update the global store  with the supplied button update.
 // If unable to reach the raft-leader it will return an error.
 func (f *FSM) UpdateButtonStatus(bs ButtonStatusUpdate) error {
-	if !f.initDone {
+	if !f.ready() {
 		return fmt.Errorf("globalstate not yet initialized")
 	}
 	// Marshal for sending as json
@@ -134,24 +221,50 @@ func (f *FSM) UpdateButtonStatus(bs ButtonStatusUpdate) error {
 	}
 
 	// Post the update to the current raft-leader
-	url := fmt.Sprintf("http://%s/update/button", leader)
-	res, err := http.Post(url, "application/json; charset=utf-8", b)
+	res, err := f.wrapper.client.post(leader, "/update/button", b.Bytes())
 	if err != nil {
 		f.logger.Printf("[ERROR] Unable to send button status update to leader: %s\n", err.Error())
 		return err
 	}
-	io.Copy(os.Stdout, res.Body)
-	return nil
+	return checkResponse(res)
 }
 
 // GetState returns a copy of the current cluster state.
 func (f *FSM) GetState() (State, error) {
-	if !f.initDone {
+	if !f.ready() {
 		return State{}, fmt.Errorf("globalstate not yet initialized")
 	}
 	return f.wrapper.GetState(), nil
 }
 
+// Watch returns a channel of the changes to the state, as they are applied
+// on the node. The first event is always an EventReset holding the current
+// state, and each of the following is a change to it. Consumers that fall
+// behind may see some events twice, or a new EventReset, but never miss a
+// change. The channel is closed when the context is done, or the FSM is shut
+// down.
+func (f *FSM) Watch(ctx context.Context) (<-chan Event, error) {
+	if !f.ready() {
+		return nil, fmt.Errorf("globalstate not yet initialized")
+	}
+	return f.wrapper.watch(ctx.Done()), nil
+}
+
+// CommAddr returns the address of the communication service of the node, which
+// may be used as InitalPeer by other nodes.
+func (f *FSM) CommAddr() string {
+	return f.wrapper.config.CommAddr
+}
+
+// Leader returns the raft-address of the current leader, or an empty string
+// if there are no known leader.
+func (f *FSM) Leader() string {
+	if !f.ready() {
+		return ""
+	}
+	return f.wrapper.GetLeader()
+}
+
 // Helper functions
 // =============================================================================
 func (rw *raftwrapper) leaderComEndpoint() (string, error) {
@@ -159,7 +272,5 @@ func (rw *raftwrapper) leaderComEndpoint() (string, error) {
 	if leaderRaftAddr == "" {
 		return "", fmt.Errorf("Cannot send button status. No current leader")
 	}
-	parts := strings.Split(leaderRaftAddr, ":")
-	portStr, _ := strconv.Atoi(parts[1])
-	return fmt.Sprintf("%s:%d", parts[0], portStr+1), nil
+	return rw.commAddr(leaderRaftAddr)
 }
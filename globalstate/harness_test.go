@@ -0,0 +1,646 @@
+package globalstate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitLimit bounds every wait for the cluster to catch up. Orders only time
+// out and lifts are only taken for dead when a test advances the clock of the
+// cluster, so the limit is only reached by a cluster that is broken.
+const waitLimit = 30 * time.Second
+
+// testCluster runs a cluster of nodes within the test process. Raft runs over
+// in-memory transports, and the communication services on ephemeral ports, so
+// no fixed ports are needed, and the network between the nodes may be
+// partitioned and healed at will. Every node has fault injection enabled, the
+// same way as nodes started with -faults. The nodes share a clock, which only
+// moves when advanced by the test, and only the node chosen by the test may
+// stand for election. The lift of every node is simulated, and serves whatever
+// hall calls it is given, such that tests may check that every hall call is
+// served exactly once. Every hall call may therefore only be pressed once in a
+// cluster.
+type testCluster struct {
+	t         *testing.T
+	clock     *testClock
+	reports   sync.RWMutex // Read locked by the lifts while reporting, and write locked to silence them
+	mu        sync.Mutex
+	nodes     []*testNode
+	candidate string                          // Raft address of the only node allowed to stand for election
+	trans     map[string]*raft.InmemTransport // Transports of the running nodes, by raft address
+	comms     map[string]string               // Raft address of the nodes, by communication address
+	groups    map[string]int                  // Partition of every node. Nodes in different partitions are cut off
+	press     []btn                           // Hall calls pressed
+	served    map[btn][]string                // Lifts that have served every hall call
+}
+
+// testNode is a node of a testCluster.
+type testNode struct {
+	*FSM
+	id       string
+	config   Config
+	running  bool          // Only changed under the mutex of the cluster
+	commands chan btn      // Hall calls given to the lift
+	halt     chan struct{} // Stops the lift
+}
+
+// testClock is the clock of a testCluster.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the time on the clock. Used as Config.Clock of every node.
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward by d, and returns the new time.
+func (c *testClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// newTestCluster starts a cluster of n nodes, with the first one as the
+// initial leader, and the only one allowed to stand for election. It returns
+// once the lifts of all nodes have reported their status.
+func newTestCluster(t *testing.T, n int) *testCluster {
+	c := &testCluster{
+		t:         t,
+		clock:     &testClock{now: time.Now()},
+		candidate: "127.0.0.1:7000",
+		trans:     make(map[string]*raft.InmemTransport),
+		comms:     make(map[string]string),
+		groups:    make(map[string]int),
+		served:    make(map[btn][]string),
+	}
+	for i := 0; i < n; i++ {
+		dataDir, err := ioutil.TempDir("", "raft-cluster-test")
+		if err != nil {
+			t.Fatalf("unable to create data directory: %v", err)
+		}
+		node := &testNode{id: fmt.Sprintf("127.0.0.1:%d", 7000+i)}
+		node.config = Config{
+			RaftPort:           7000 + i,
+			OwnIP:              "127.0.0.1",
+			DataDir:            dataDir,
+			Floors:             4,
+			Transport:          c.transport,
+			Faults:             faultnet.New(node.id),
+			CostFunction:       c.cost,
+			Clock:              c.clock.Now,
+			OnIncomingCommand:  func(f int, d string, v uint64) { c.serve(node, btn{Floor: f, Dir: d}) },
+			Logger:             log.New(ioutil.Discard, "", log.Ltime|log.Lshortfile),
+			DisableRaftLogging: true,
+		}
+		if i > 0 {
+			node.config.InitalPeer = c.nodes[0].CommAddr()
+		}
+		c.nodes = append(c.nodes, node)
+		c.start(i)
+	}
+	var all []int
+	for i := range c.nodes {
+		all = append(all, i)
+	}
+	c.reported(c.clock.Now(), all...)
+	return c
+}
+
+// start starts the node, or restarts it on top of its own data directory. A
+// restarted node keeps its communication address.
+func (c *testCluster) start(i int) {
+	n := c.nodes[i]
+	n.commands = make(chan btn, 100)
+	n.halt = make(chan struct{})
+	n.FSM = &FSM{}
+	if err := n.Init(n.config); err != nil {
+		c.t.Fatalf("failed to start node %d: %v", i, err)
+	}
+	n.config.CommPort = n.comm.port
+	n.wrapper.client.transport = n.wrapper.withFaults(&testRoundTripper{cluster: c, from: n.id})
+	c.mu.Lock()
+	c.comms[n.CommAddr()] = n.id
+	n.running = true
+	c.mu.Unlock()
+	go c.runLift(n.id, n.FSM, n.commands, n.halt)
+}
+
+// kill crashes the node, without leaving the raft.
+func (c *testCluster) kill(i int) {
+	n := c.nodes[i]
+	c.mu.Lock()
+	n.running = false
+	c.mu.Unlock()
+	close(n.halt)
+	n.FSM.stop()
+}
+
+// restart restarts a killed node.
+func (c *testCluster) restart(i int) {
+	c.start(i)
+}
+
+// shutdown kills all nodes and removes their data.
+func (c *testCluster) shutdown() {
+	for i, n := range c.nodes {
+		if n.running {
+			c.kill(i)
+		}
+		os.RemoveAll(n.config.DataDir)
+	}
+}
+
+// partition cuts the groups of nodes off from each other. Nodes left out of
+// every group form a group of their own.
+func (c *testCluster) partition(groups ...[]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups = make(map[string]int)
+	for g, group := range groups {
+		for _, i := range group {
+			c.groups[c.nodes[i].id] = g + 1
+		}
+	}
+	c.connectLocked()
+}
+
+// heal lets all nodes reach each other again.
+func (c *testCluster) heal() {
+	c.partition()
+}
+
+// elect lets only the node stand for election from now on, such that it is
+// elected whenever the cluster is without a leader. A leader already elected
+// is left in place. The node is only eligible if no other node has log entries
+// it is missing, so the leader should be lost within quiet.
+func (c *testCluster) elect(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.candidate = c.nodes[i].id
+}
+
+// mayStand returns true if the node at the raft address may stand for
+// election.
+func (c *testCluster) mayStand(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return addr == c.candidate
+}
+
+// quiet runs f while the lifts report nothing, once all running nodes have the
+// whole log of the leader. Nodes cut off or killed by f then leave the others
+// with equal logs, such that the node chosen by elect is eligible.
+func (c *testCluster) quiet(f func()) {
+	c.reports.Lock()
+	defer c.reports.Unlock()
+	leader := c.leader()
+	if !c.wait(func() bool {
+		last := leader.wrapper.getRaft().LastIndex()
+		for _, n := range c.nodes {
+			if n.running && n.wrapper.getRaft().LastIndex() != last {
+				return false
+			}
+		}
+		return true
+	}) {
+		c.t.Fatalf("nodes never caught up on the log of %s", leader.id)
+	}
+	f()
+}
+
+// advance moves the clock of the cluster forward by d, and waits for the lifts
+// of the nodes given to report their status at the new time.
+func (c *testCluster) advance(d time.Duration, nodes ...int) {
+	c.reported(c.clock.advance(d), nodes...)
+}
+
+// expireOrders advances the clock just past the order timeout, such that every
+// hall call assigned is assigned again, and waits for the lifts of the nodes
+// given to report their status at the new time.
+func (c *testCluster) expireOrders(nodes ...int) {
+	c.advance(time.Duration(3*c.nodes[0].config.Floors+1)*time.Second, nodes...)
+}
+
+// retryLost expires the orders for as long as any hall call pressed is assigned
+// to a lift that never got it, such as when lost on the way, until all are
+// served. The orders are only expired once every call served is known as done
+// by the leader, so no call served is given to a lift again.
+func (c *testCluster) retryLost() {
+	var running []int
+	for i, n := range c.nodes {
+		if n.running {
+			running = append(running, i)
+		}
+	}
+	for !c.allServed() {
+		if !c.wait(c.settled) {
+			c.t.Fatalf("hall calls never settled")
+		}
+		if !c.allServed() {
+			c.expireOrders(running...)
+		}
+	}
+}
+
+// reported waits for the lifts of the nodes given to report their status to
+// the leader among them at the time given or later.
+func (c *testCluster) reported(now time.Time, nodes ...int) {
+	leader := c.leader(nodes...)
+	if !c.wait(func() bool {
+		state := leader.wrapper.GetState()
+		for _, i := range nodes {
+			if state.Nodes[c.nodes[i].id].LastUpdate.Before(now) {
+				return false
+			}
+		}
+		return true
+	}) {
+		c.t.Fatalf("lifts of nodes %v reported no status since %v", nodes, now)
+	}
+}
+
+// wait returns true once the condition holds, or false if it does not hold
+// within waitLimit.
+func (c *testCluster) wait(cond func() bool) bool {
+	for deadline := time.Now().Add(waitLimit); !cond(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return true
+}
+
+// transport returns an in-memory raft transport for the node at addr. Used as
+// Config.Transport of every node.
+func (c *testCluster) transport(addr string) (raft.Transport, error) {
+	_, trans := raft.NewInmemTransport(addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trans[addr] = trans
+	c.connectLocked()
+	return &testTransport{InmemTransport: trans, cluster: c}, nil
+}
+
+// connectLocked connects the transports of all nodes in the same partition,
+// and disconnects all others.
+func (c *testCluster) connectLocked() {
+	for a, ta := range c.trans {
+		for b, tb := range c.trans {
+			if c.groups[a] == c.groups[b] {
+				ta.Connect(b, tb)
+			} else {
+				ta.Disconnect(b)
+			}
+		}
+	}
+}
+
+// cut returns true if the node is cut off from the node with the
+// communication service at comm.
+func (c *testCluster) cut(from, comm string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	to, ok := c.comms[comm]
+	return ok && c.groups[from] != c.groups[to]
+}
+
+// testTransport disconnects the node from all others when closed, as a raft
+// that has shut down no longer consumes the requests sent to it. Votes are
+// only requested by the node chosen to stand for election.
+type testTransport struct {
+	*raft.InmemTransport
+	cluster *testCluster
+}
+
+func (t *testTransport) RequestVote(target string, args *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
+	if !t.cluster.mayStand(t.LocalAddr()) {
+		return fmt.Errorf("%s may not stand for election", t.LocalAddr())
+	}
+	if err := t.InmemTransport.RequestVote(target, args, resp); err != nil {
+		return err
+	}
+	// The other nodes still start elections, and vote for themselves, which
+	// may keep them a term ahead of the candidate. Refused for its term, the
+	// candidate goes two terms ahead of the voter, which raft's timeouts leave
+	// too little time to start two more elections before the candidate stands
+	// again.
+	if !resp.Granted && resp.Term >= args.Term {
+		resp.Term += 2
+	}
+	return nil
+}
+
+func (t *testTransport) Close() error {
+	c := t.cluster
+	addr := t.LocalAddr()
+	c.mu.Lock()
+	if c.trans[addr] == t.InmemTransport {
+		delete(c.trans, addr)
+	}
+	for _, other := range c.trans {
+		other.Disconnect(addr)
+	}
+	c.mu.Unlock()
+	return t.InmemTransport.Close()
+}
+
+// testRoundTripper refuses requests to the communication services of nodes
+// cut off from the node.
+type testRoundTripper struct {
+	cluster *testCluster
+	from    string
+}
+
+func (rt *testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.cluster.cut(rt.from, req.URL.Host) {
+		return nil, fmt.Errorf("%s is cut off from %s", rt.from, req.URL.Host)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// cost assigns hall calls to the live lift with the fewest hall calls assigned
+// to it, and the lowest id on ties, such that assignments are deterministic.
+func (c *testCluster) cost(s State, floor int, dir string) string {
+	load := map[string]int{}
+	for _, buttons := range []map[string]Status{s.HallUpButtons, s.HallDownButtons} {
+		for _, status := range buttons {
+			if status.LastStatus == BtnStateAssigned {
+				load[status.AssignedTo]++
+			}
+		}
+	}
+	var alive []string
+	for id, lift := range s.Nodes {
+		if c.clock.Now().Sub(lift.LastUpdate) < 2*time.Second {
+			alive = append(alive, id)
+		}
+	}
+	sort.Strings(alive)
+	best := ""
+	for _, id := range alive {
+		if best == "" || load[id] < load[best] {
+			best = id
+		}
+	}
+	return best
+}
+
+// serve has the lift of the node serve the hall call. The call is taken as
+// served as soon as the lift is given it, such that any call given to two
+// lifts shows at once. The lift of a killed node serves nothing, even if its
+// communication service is yet to drop the connections open to it.
+func (c *testCluster) serve(n *testNode, b btn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !n.running {
+		return
+	}
+	c.served[b] = append(c.served[b], n.id)
+	n.commands <- b
+}
+
+// runLift simulates the lift of the node until halted. It reports its status
+// like a lift standing still, and every hall call it serves as done, until the
+// cluster accepts them.
+func (c *testCluster) runLift(id string, f *FSM, commands <-chan btn, halt <-chan struct{}) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	floor := 0
+	var unreported []btn
+	for {
+		select {
+		case b := <-commands:
+			floor = b.Floor
+			unreported = append(unreported, b)
+		case <-ticker.C:
+		case <-halt:
+			return
+		}
+		c.reports.RLock()
+		f.UpdateLiftStatus(LiftStatusUpdate{CurrentFloor: uint(floor), CurrentDir: "stop"})
+		var left []btn
+		for _, b := range unreported {
+			if err := f.UpdateButtonStatus(ButtonStatusUpdate{Floor: uint(b.Floor), Dir: b.Dir, Status: BtnStateDone}); err != nil {
+				left = append(left, b)
+			}
+		}
+		unreported = left
+		c.reports.RUnlock()
+	}
+}
+
+// leader waits for the running nodes among the ones given, or all nodes if
+// none are given, to agree on a leader among themselves, and returns it.
+func (c *testCluster) leader(nodes ...int) *testNode {
+	if len(nodes) == 0 {
+		for i := range c.nodes {
+			nodes = append(nodes, i)
+		}
+	}
+	var leader *testNode
+	if !c.wait(func() bool {
+		leader = nil
+		agreed := true
+		for _, i := range nodes {
+			n := c.nodes[i]
+			if !n.running {
+				continue
+			}
+			if leader == nil {
+				for _, m := range nodes {
+					if c.nodes[m].running && c.nodes[m].id == n.Leader() {
+						leader = c.nodes[m]
+					}
+				}
+			}
+			agreed = agreed && leader != nil && n.Leader() == leader.id
+		}
+		return agreed && leader != nil
+	}) {
+		c.t.Fatalf("nodes %v agreed on no leader", nodes)
+	}
+	return leader
+}
+
+// pressHallCall presses the hall button at the node, retrying until the
+// cluster accepts it.
+func (c *testCluster) pressHallCall(i, floor int, dir string) {
+	c.mu.Lock()
+	c.press = append(c.press, btn{Floor: floor, Dir: dir})
+	c.mu.Unlock()
+	var err error
+	if !c.wait(func() bool {
+		err = c.nodes[i].UpdateButtonStatus(ButtonStatusUpdate{Floor: uint(floor), Dir: dir, Status: BtnStateUnassigned})
+		return err == nil
+	}) {
+		c.t.Fatalf("unable to press hall call %s at floor %d: %v", dir, floor, err)
+	}
+}
+
+// assertServedExactlyOnce waits for every hall call pressed to be served and
+// known as done by the leader, and asserts that none of them were served by
+// more than one lift. As the clock stands still, no call done is given to any
+// lift again, unless the cluster is at fault.
+func (c *testCluster) assertServedExactlyOnce() bool {
+	c.wait(c.allServed)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ok := true
+	for _, b := range c.press {
+		ok = assert.Len(c.t, c.served[b], 1, "hall call %s at floor %d served by %v", b.Dir, b.Floor, c.served[b]) && ok
+	}
+	return ok
+}
+
+// assigned returns the number of hall calls the leader has assigned to the
+// lift.
+func (c *testCluster) assigned(lift string) int {
+	state := c.leader().wrapper.GetState()
+	n := 0
+	for _, buttons := range []map[string]Status{state.HallUpButtons, state.HallDownButtons} {
+		for _, status := range buttons {
+			if status.LastStatus == BtnStateAssigned && status.AssignedTo == lift {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// servedCount returns the number of hall calls pressed that are served.
+func (c *testCluster) servedCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, b := range c.press {
+		if len(c.served[b]) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// settled returns true if every hall call pressed is either served and known
+// as done by the leader, or assigned by the leader to a lift that has yet to
+// serve it.
+func (c *testCluster) settled() bool {
+	state := c.leader().wrapper.GetState()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.press {
+		buttons := state.HallUpButtons
+		if b.Dir == "down" {
+			buttons = state.HallDownButtons
+		}
+		status := buttons[fmt.Sprint(b.Floor)].LastStatus
+		if len(c.served[b]) > 0 && status != BtnStateDone || len(c.served[b]) == 0 && status != BtnStateAssigned {
+			return false
+		}
+	}
+	return true
+}
+
+// allServed returns true if all hall calls pressed are served, and known as
+// done by the leader.
+func (c *testCluster) allServed() bool {
+	var state State
+	for _, n := range c.nodes {
+		if n.running && n.Leader() == n.id {
+			state = n.wrapper.GetState()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.press {
+		buttons := state.HallUpButtons
+		if b.Dir == "down" {
+			buttons = state.HallDownButtons
+		}
+		if len(c.served[b]) == 0 || buttons[fmt.Sprint(b.Floor)].LastStatus != BtnStateDone {
+			return false
+		}
+	}
+	return true
+}
+
+// Tests
+// =============================================================================
+
+func Test_ClusterServesHallCalls(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.leader()
+
+	c.pressHallCall(1, 0, "up")
+	c.pressHallCall(2, 1, "up")
+	c.pressHallCall(0, 2, "down")
+	c.pressHallCall(1, 3, "down")
+	c.assertServedExactlyOnce()
+}
+
+func Test_ClusterKillAndRestart(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.leader()
+
+	// The lift of the killed leader is not yet taken for dead, and has the
+	// lowest id, so the first call is assigned to it. The call is reassigned
+	// once it times out.
+	c.elect(1)
+	c.quiet(func() { c.kill(0) })
+	assert.Equal(t, c.nodes[1].id, c.leader().id)
+	c.pressHallCall(1, 1, "up")
+	c.pressHallCall(1, 2, "up")
+	c.pressHallCall(2, 3, "down")
+	if !c.wait(func() bool { return c.assigned(c.nodes[0].id) == 1 && c.servedCount() == 2 }) {
+		t.Fatalf("calls not assigned to the killed lift first")
+	}
+	c.expireOrders(1, 2)
+	c.assertServedExactlyOnce()
+
+	c.restart(0)
+	assert.Equal(t, c.nodes[1].id, c.leader().id)
+	c.pressHallCall(0, 0, "up")
+	c.pressHallCall(0, 2, "down")
+	c.assertServedExactlyOnce()
+}
+
+func Test_ClusterPartition(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	c.leader()
+
+	// The majority elects a new leader, and serves the calls on its own once
+	// the lift cut off is taken for dead.
+	c.elect(1)
+	c.quiet(func() { c.partition([]int{0}, []int{1, 2}) })
+	assert.Equal(t, c.nodes[1].id, c.leader(1, 2).id)
+	c.advance(3*time.Second, 1, 2)
+	c.pressHallCall(1, 1, "up")
+	c.pressHallCall(2, 2, "down")
+	c.assertServedExactlyOnce()
+
+	// The old leader joins the others as a follower once healed.
+	c.heal()
+	assert.Equal(t, c.nodes[1].id, c.leader().id)
+	c.pressHallCall(0, 3, "down")
+	c.pressHallCall(0, 0, "up")
+	c.assertServedExactlyOnce()
+}
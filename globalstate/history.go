@@ -0,0 +1,188 @@
+package globalstate
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+The buttons of the state only tell how each hall call is doing right now. To
+be able to tell how well the cluster serves its passengers, the lifecycle of
+every hall call is also recorded in a history, from the button is pressed,
+through every assignment, until a lift have served it.
+
+The history is kept beside the state rather than in it, such that copies of
+the state handed to API requests and subscribers stay small. It is still
+recorded as the raft log is applied, and snapshotted with the state. All
+times of the history are the ones stamped on the log entries by the leader,
+such that a waiting time is never the difference between the clocks of two
+lifts, and every node keep the exact same history. Buttons changed by the
+same log entry, like those of a lift leaving, are recorded in the order of
+sortedFloors for the same reason. Only the most recent historyLimit calls are
+kept.
+*/
+
+// historyLimit is the number of hall calls kept in the history.
+const historyLimit = 1000
+
+// HallCallRecord is the lifecycle of a single hall call.
+type HallCallRecord struct {
+	Floor       uint
+	Dir         string
+	Pressed     time.Time
+	Assignments []Assignment // In order, such that all but the first are reassignments
+	Done        time.Time    // Zero while the call is outstanding
+	ServedBy    string       // On the form "ip:port"
+}
+
+// Assignment is the assignment of a hall call to a lift.
+type Assignment struct {
+	Lift string // On the form "ip:port"
+	At   time.Time
+}
+
+// Reassignments returns the number of times the call was assigned to another
+// lift after the first.
+func (r HallCallRecord) Reassignments() int {
+	if len(r.Assignments) < 2 {
+		return 0
+	}
+	return len(r.Assignments) - 1
+}
+
+// WaitingTime returns the time from the button was pressed until the call was
+// served, or false if it is still outstanding.
+func (r HallCallRecord) WaitingTime() (time.Duration, bool) {
+	if r.Done.IsZero() {
+		return 0, false
+	}
+	return r.Done.Sub(r.Pressed), true
+}
+
+// DeepCopy safely return a copy of the record.
+func (r *HallCallRecord) DeepCopy() HallCallRecord {
+	c := *r
+	c.Assignments = append([]Assignment(nil), r.Assignments...)
+	return c
+}
+
+// callHistory is the bounded history of hall calls, in the order they were
+// pressed.
+type callHistory struct {
+	records []HallCallRecord
+}
+
+// add appends a new call to the history, forgetting the oldest calls beyond
+// historyLimit.
+func (h *callHistory) add(r HallCallRecord) {
+	h.records = append(h.records, r)
+	if over := len(h.records) - historyLimit; over > 0 {
+		h.records = append([]HallCallRecord(nil), h.records[over:]...)
+	}
+}
+
+// outstanding returns the outstanding call of the button, or nil if there is
+// none. It may be forgotten already if it have been outstanding for very long.
+func (h *callHistory) outstanding(floor uint, dir string) *HallCallRecord {
+	for i := len(h.records) - 1; i >= 0; i-- {
+		r := &h.records[i]
+		if r.Floor == floor && r.Dir == dir && r.Done.IsZero() {
+			return r
+		}
+	}
+	return nil
+}
+
+// copy safely returns a copy of the records.
+func (h *callHistory) copy() []HallCallRecord {
+	records := make([]HallCallRecord, 0, len(h.records))
+	for _, r := range h.records {
+		records = append(records, r.DeepCopy())
+	}
+	return records
+}
+
+// History returns a copy of the history of hall calls, in the order they were
+// pressed.
+func (rw *raftwrapper) History() []HallCallRecord {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.history.copy()
+}
+
+// recordButtonLocked records the change of a hall button in the history, at
+// the time stamped on the log entry being applied. The caller must hold the
+// mutex.
+func (rw *raftwrapper) recordButtonLocked(floor uint, dir string, from, to Status) {
+	at := rw.applied
+	if at.IsZero() {
+		// Entries appended before the leader stamped them
+		at = to.LastChange
+	}
+	if from.LastStatus == "" || from.LastStatus == BtnStateDone {
+		if to.LastStatus == BtnStateDone {
+			return
+		}
+		rw.history.add(HallCallRecord{Floor: floor, Dir: dir, Pressed: at})
+	}
+
+	record := rw.history.outstanding(floor, dir)
+	if record == nil {
+		return
+	}
+	switch to.LastStatus {
+	case BtnStateAssigned:
+		record.Assignments = append(record.Assignments, Assignment{Lift: to.AssignedTo, At: at})
+	case BtnStateDone:
+		record.Done = at
+		record.ServedBy = to.AssignedTo
+		if record.ServedBy == "" && len(record.Assignments) > 0 {
+			record.ServedBy = record.Assignments[len(record.Assignments)-1].Lift
+		}
+	}
+}
+
+// HistoryStats summarizes the hall calls of a history.
+type HistoryStats struct {
+	Calls         int // All calls, served or not
+	Served        int
+	Reassignments int           // Total number of reassignments
+	WaitingTime   []Percentile  // Of the served calls
+	MaxWaitTime   time.Duration // Of the served calls
+}
+
+// Percentile is the waiting time that P percent of the calls were served
+// within.
+type Percentile struct {
+	P    float64
+	Wait time.Duration
+}
+
+// waitingTimePercentiles are the percentiles reported by historyStats.
+var waitingTimePercentiles = []float64{50, 90, 95, 99}
+
+// historyStats returns the stats of the calls in the history. Percentiles are
+// by the nearest-rank method, and left out if no calls are served.
+func historyStats(history []HallCallRecord) HistoryStats {
+	var stats HistoryStats
+	var waits []time.Duration
+	for _, r := range history {
+		stats.Calls++
+		stats.Reassignments += r.Reassignments()
+		if w, ok := r.WaitingTime(); ok {
+			waits = append(waits, w)
+		}
+	}
+	stats.Served = len(waits)
+	if len(waits) == 0 {
+		return stats
+	}
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	for _, p := range waitingTimePercentiles {
+		rank := int(math.Ceil(p / 100 * float64(len(waits))))
+		stats.WaitingTime = append(stats.WaitingTime, Percentile{P: p, Wait: waits[rank-1]})
+	}
+	stats.MaxWaitTime = waits[len(waits)-1]
+	return stats
+}
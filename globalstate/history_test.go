@@ -0,0 +1,167 @@
+package globalstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CallHistory(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.logger = log.New(ioutil.Discard, "", 0)
+	t0 := time.Now()
+	at := func(s int) time.Time { return t0.Add(time.Duration(s) * time.Second) }
+	index := uint64(0)
+	// The updates are applied at the time stamped by the leader, whatever the
+	// clock of the lift reporting them.
+	update := func(s int, status Status) {
+		status.LastChange = at(s).Add(-time.Hour)
+		v, _ := json.Marshal(status)
+		b, _ := json.Marshal(command{Type: "btnUpUpdate", Key: "2", Value: v, Time: at(s)})
+		index++
+		assert.Nil(t, rw.Apply(&raft.Log{Index: index, Data: b}))
+	}
+
+	update(0, Status{LastStatus: BtnStateUnassigned})
+	update(1, Status{LastStatus: BtnStateUnassigned})
+	update(2, Status{LastStatus: BtnStateAssigned, AssignedTo: "lift1"})
+	update(3, Status{LastStatus: BtnStateAssigned, AssignedTo: "lift2"})
+	update(10, Status{LastStatus: BtnStateDone})
+	update(11, Status{LastStatus: BtnStateDone})
+	update(12, Status{LastStatus: BtnStateUnassigned})
+
+	history := rw.History()
+	if !assert.Len(t, history, 2) {
+		return
+	}
+	served := history[0]
+	assert.Equal(t, at(0).Unix(), served.Pressed.Unix())
+	assert.Equal(t, at(3).Unix(), served.Assignments[1].At.Unix())
+	assert.Equal(t, 1, served.Reassignments())
+	assert.Equal(t, "lift2", served.ServedBy)
+	wait, ok := served.WaitingTime()
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+	_, ok = history[1].WaitingTime()
+	assert.False(t, ok, "outstanding call has a waiting time")
+
+	// Only the most recent calls are kept
+	for i := 0; i < historyLimit; i++ {
+		update(20+2*i, Status{LastStatus: BtnStateDone, AssignedTo: "lift1"})
+		update(21+2*i, Status{LastStatus: BtnStateUnassigned})
+	}
+	history = rw.History()
+	assert.Len(t, history, historyLimit)
+	assert.Equal(t, "lift1", history[0].ServedBy)
+	assert.True(t, history[historyLimit-1].Done.IsZero())
+
+	// The history is restored from snapshots along with the state
+	snapshot, _ := rw.Snapshot()
+	b, _ := json.Marshal(snapshotData{State: snapshot.(*fsmSnapshot).store, History: snapshot.(*fsmSnapshot).history})
+	restored := newRaftWrapper("0", 4)
+	restored.logger = rw.logger
+	assert.Nil(t, restored.Restore(ioutil.NopCloser(bytes.NewReader(b))))
+	if assert.Len(t, restored.History(), historyLimit) {
+		assert.Equal(t, history[0].Done.Unix(), restored.History()[0].Done.Unix())
+	}
+}
+
+func Test_HistoryEqualOnAllNodes(t *testing.T) {
+	entries := mixedLog(time.Now())
+	replay := func() []HallCallRecord {
+		rw := newRaftWrapper("0", 4)
+		rw.logger = log.New(ioutil.Discard, "", 0)
+		for _, l := range entries {
+			assert.Nil(t, rw.Apply(l))
+		}
+		return rw.History()
+	}
+
+	first := replay()
+	if !assert.Len(t, first, 4) {
+		return
+	}
+	served := first[0]
+	assert.Equal(t, uint(2), served.Floor)
+	assert.Equal(t, "up", served.Dir)
+	assert.Equal(t, 1, served.Reassignments())
+	assert.Equal(t, "lift2", served.ServedBy)
+	for i := 0; i < 5; i++ {
+		if !assert.Equal(t, first, replay()) {
+			return
+		}
+	}
+}
+
+func Test_HistoryStats(t *testing.T) {
+	var history []HallCallRecord
+	t0 := time.Now()
+	for i := 1; i <= 20; i++ {
+		history = append(history, HallCallRecord{Pressed: t0, Done: t0.Add(time.Duration(i) * time.Second)})
+	}
+	history = append(history, HallCallRecord{Pressed: t0, Assignments: []Assignment{{Lift: "lift1"}, {Lift: "lift2"}}})
+
+	stats := historyStats(history)
+	assert.Equal(t, 21, stats.Calls)
+	assert.Equal(t, 20, stats.Served)
+	assert.Equal(t, 1, stats.Reassignments)
+	assert.Equal(t, []Percentile{
+		{P: 50, Wait: 10 * time.Second},
+		{P: 90, Wait: 18 * time.Second},
+		{P: 95, Wait: 19 * time.Second},
+		{P: 99, Wait: 20 * time.Second},
+	}, stats.WaitingTime)
+	assert.Equal(t, 20*time.Second, stats.MaxWaitTime)
+
+	assert.Empty(t, historyStats(nil).WaitingTime)
+}
+
+func Test_APIHistory(t *testing.T) {
+	t0 := time.Now().UTC().Truncate(time.Second)
+	rw := newRaftWrapper("0", 4)
+	rw.history.add(HallCallRecord{Floor: 1, Dir: "up", Pressed: t0, Done: t0.Add(4 * time.Second), ServedBy: "lift1",
+		Assignments: []Assignment{{Lift: "lift1", At: t0.Add(time.Second)}}})
+	rw.history.add(HallCallRecord{Floor: 2, Dir: "down", Pressed: t0.Add(time.Minute)})
+	srv := httptest.NewServer(newCommService("127.0.0.1:0", rw))
+	defer srv.Close()
+	get := func(path string, v interface{}) int {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		json.NewDecoder(res.Body).Decode(v)
+		return res.StatusCode
+	}
+
+	var records []HallCallRecordV1
+	assert.Equal(t, http.StatusOK, get("/v1/history", &records))
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "lift1", records[0].ServedBy)
+		assert.Equal(t, 4.0, *records[0].WaitingTime)
+		assert.Nil(t, records[1].Done)
+	}
+	get("/v1/history?direction=down", &records)
+	assert.Len(t, records, 1)
+	get("/v1/history?since="+t0.Add(time.Second).Format(time.RFC3339), &records)
+	assert.Len(t, records, 1)
+	get("/v1/history?limit=1", &records)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, uint(2), records[0].Floor)
+	}
+	assert.Equal(t, http.StatusBadRequest, get("/v1/history?floor=first", &records))
+
+	var stats HistoryStatsV1
+	assert.Equal(t, http.StatusOK, get("/v1/history/stats", &stats))
+	assert.Equal(t, 2, stats.Calls)
+	assert.Equal(t, 1, stats.Outstanding)
+	assert.Equal(t, map[string]float64{"p50": 4, "p90": 4, "p95": 4, "p99": 4, "max": 4}, stats.WaitingTime)
+}
@@ -0,0 +1,170 @@
+package globalstate
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+/*
+The communication service exposes metrics of the node at /metrics, in the text
+format read by Prometheus. They are authenticated like any other request, but
+may also be served on a plain listener of their own, see Config.MetricsAddr.
+The metrics are kept by the node itself, such that no external service is
+needed. Counters of what the node have seen itself, such as leader changes and
+consensus losses, count from the node was started. The trips and door cycles
+of the lifts are counted in the replicated state, and are the same on all
+nodes.
+*/
+
+// applyLatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// apply latency histogram.
+var applyLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// metrics holds the counters of the node. The counters are updated
+// atomically, and must be first in the struct to be aligned on all platforms.
+type metrics struct {
+	leaderChanges      uint64
+	consensusLost      uint64
+	consensusAcquired  uint64
+	assignments        uint64
+	assignmentTimeouts uint64
+
+	mu           sync.Mutex
+	applyBuckets []uint64 // Not cumulative
+	applyCount   uint64
+	applySum     float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{applyBuckets: make([]uint64, len(applyLatencyBuckets))}
+}
+
+func (m *metrics) inc(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// observeApply records the time it took to commit and apply a log entry.
+func (m *metrics) observeApply(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := d.Seconds()
+	m.applyCount++
+	m.applySum += s
+	if i := sort.SearchFloat64s(applyLatencyBuckets, s); i < len(applyLatencyBuckets) {
+		m.applyBuckets[i]++
+	}
+}
+
+// HandleMetrics responds with the metrics of the node in the Prometheus text
+// format.
+func (s *commService) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.store.writeMetrics(w)
+}
+
+func (rw *raftwrapper) writeMetrics(w io.Writer) {
+	m := rw.metrics
+	state := rw.GetState()
+
+	// Raft
+	if ra := rw.getRaft(); ra != nil {
+		stats := ra.Stats()
+		current := ra.State()
+		writeHeader(w, "lift_raft_state", "gauge", "Raft state of the node, 1 for the current state.")
+		for _, st := range []raft.RaftState{raft.Follower, raft.Candidate, raft.Leader, raft.Shutdown} {
+			v := 0.0
+			if st == current {
+				v = 1
+			}
+			writeSample(w, "lift_raft_state", v, "state", st.String())
+		}
+		term, _ := strconv.ParseFloat(stats["term"], 64)
+		writeHeader(w, "lift_raft_term", "gauge", "Current raft term.")
+		writeSample(w, "lift_raft_term", term)
+		peers, _ := strconv.ParseFloat(stats["num_peers"], 64)
+		writeHeader(w, "lift_raft_peers", "gauge", "Number of other members of the raft.")
+		writeSample(w, "lift_raft_peers", peers)
+	}
+	writeHeader(w, "lift_raft_applied_index", "gauge", "Raft index of the last log entry applied to the state.")
+	writeSample(w, "lift_raft_applied_index", float64(state.Index))
+	writeHeader(w, "lift_raft_leader_changes_total", "counter", "Changes of leader seen by the node.")
+	writeSample(w, "lift_raft_leader_changes_total", float64(atomic.LoadUint64(&m.leaderChanges)))
+
+	m.mu.Lock()
+	writeHeader(w, "lift_raft_apply_duration_seconds", "histogram", "Time from a log entry is proposed by the node until it is committed and applied.")
+	var cumulative uint64
+	for i, le := range applyLatencyBuckets {
+		cumulative += m.applyBuckets[i]
+		writeSample(w, "lift_raft_apply_duration_seconds_bucket", float64(cumulative), "le", strconv.FormatFloat(le, 'g', -1, 64))
+	}
+	writeSample(w, "lift_raft_apply_duration_seconds_bucket", float64(m.applyCount), "le", "+Inf")
+	writeSample(w, "lift_raft_apply_duration_seconds_sum", m.applySum)
+	writeSample(w, "lift_raft_apply_duration_seconds_count", float64(m.applyCount))
+	m.mu.Unlock()
+
+	// Consensus
+	writeHeader(w, "lift_consensus_lost_total", "counter", "Times the node have lost consensus.")
+	writeSample(w, "lift_consensus_lost_total", float64(atomic.LoadUint64(&m.consensusLost)))
+	writeHeader(w, "lift_consensus_acquired_total", "counter", "Times the node have acquired consensus.")
+	writeSample(w, "lift_consensus_acquired_total", float64(atomic.LoadUint64(&m.consensusAcquired)))
+
+	// Hall calls and assignments
+	outstanding := map[string]float64{BtnStateUnassigned: 0, BtnStateAssigned: 0}
+	for _, buttons := range []map[string]Status{state.HallUpButtons, state.HallDownButtons} {
+		for _, st := range buttons {
+			if _, ok := outstanding[st.LastStatus]; ok {
+				outstanding[st.LastStatus]++
+			}
+		}
+	}
+	writeHeader(w, "lift_hall_calls", "gauge", "Outstanding hall calls by state.")
+	writeSample(w, "lift_hall_calls", outstanding[BtnStateUnassigned], "state", BtnStateUnassigned)
+	writeSample(w, "lift_hall_calls", outstanding[BtnStateAssigned], "state", BtnStateAssigned)
+	writeHeader(w, "lift_assignments_total", "counter", "Hall calls assigned to a lift while the node was leader.")
+	writeSample(w, "lift_assignments_total", float64(atomic.LoadUint64(&m.assignments)))
+	writeHeader(w, "lift_assignment_timeouts_total", "counter", "Hall calls reassigned while the node was leader, as the lift assigned did not serve them in time.")
+	writeSample(w, "lift_assignment_timeouts_total", float64(atomic.LoadUint64(&m.assignmentTimeouts)))
+
+	// Lifts
+	var lifts []string
+	for id := range state.Nodes {
+		lifts = append(lifts, id)
+	}
+	sort.Strings(lifts)
+	writeHeader(w, "lift_trips_total", "counter", "Times the lift have started moving.")
+	for _, id := range lifts {
+		writeSample(w, "lift_trips_total", float64(state.Nodes[id].Trips), "lift", id)
+	}
+	writeHeader(w, "lift_door_cycles_total", "counter", "Times the lift have opened its doors.")
+	for _, id := range lifts {
+		writeSample(w, "lift_door_cycles_total", float64(state.Nodes[id].DoorCycles), "lift", id)
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a sample of the metric, with labels given as pairs of
+// names and values.
+func writeSample(w io.Writer, name string, v float64, labels ...string) {
+	var l []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		l = append(l, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	if len(l) > 0 {
+		name += "{" + strings.Join(l, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
@@ -0,0 +1,108 @@
+package globalstate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CountTrips(t *testing.T) {
+	lift := LiftStatus{}
+	for _, next := range []LiftStatus{
+		{Direction: "STOP", DoorOpen: true},
+		{Direction: "STOP"},
+		{Direction: "UP"},
+		{Direction: "UP"},
+		{Direction: "STOP"},
+		{Direction: "STOP", DoorOpen: true},
+		{Direction: "STOP", DoorOpen: true},
+		{Direction: "DOWN"},
+		{Direction: "stop"},
+	} {
+		countTrips(lift, &next)
+		lift = next
+	}
+	// Stopping without opening the doors, such as when the lift is taken out
+	// of service, is no door cycle.
+	assert.Equal(t, uint64(2), lift.Trips)
+	assert.Equal(t, uint64(1), lift.DoorCycles)
+}
+
+func Test_Metrics(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.auth = newAuthenticator("correct horse battery staple")
+	rw.state.Nodes["10.0.0.1:8000"] = LiftStatus{Trips: 3, DoorCycles: 2}
+	rw.state.HallUpButtons["1"] = Status{LastStatus: BtnStateAssigned}
+	rw.state.HallDownButtons["2"] = Status{LastStatus: BtnStateAssigned}
+	rw.state.HallDownButtons["3"] = Status{LastStatus: BtnStateDone}
+	rw.metrics.inc(&rw.metrics.consensusLost)
+	rw.metrics.observeApply(3 * time.Millisecond)
+	rw.metrics.observeApply(time.Minute)
+	srv := httptest.NewServer(newCommService("127.0.0.1:0", rw))
+	defer srv.Close()
+
+	// The metrics are signed like everything else
+	res, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = newCommClient(rw.auth, nil).get(srv.Listener.Addr().String(), "/metrics", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "version=0.0.4")
+
+	body := string(b)
+	for _, line := range []string{
+		"# TYPE lift_raft_apply_duration_seconds histogram\n",
+		`lift_raft_apply_duration_seconds_bucket{le="0.0025"} 0` + "\n",
+		`lift_raft_apply_duration_seconds_bucket{le="0.005"} 1` + "\n",
+		`lift_raft_apply_duration_seconds_bucket{le="5"} 1` + "\n",
+		`lift_raft_apply_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"lift_raft_apply_duration_seconds_count 2\n",
+		"lift_consensus_lost_total 1\n",
+		`lift_hall_calls{state="assigned"} 2` + "\n",
+		`lift_hall_calls{state="unassigned"} 0` + "\n",
+		`lift_trips_total{lift="10.0.0.1:8000"} 3` + "\n",
+		`lift_door_cycles_total{lift="10.0.0.1:8000"} 2` + "\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func Test_MetricsListener(t *testing.T) {
+	rw := newRaftWrapper("0", 4)
+	rw.auth = newAuthenticator("correct horse battery staple")
+	rw.config.MetricsAddr = "127.0.0.1:0"
+	s := newCommService("127.0.0.1:0", rw)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prometheus is unable to sign its requests, and gets nothing but the
+	// metrics from the listener of its own
+	get := func(path string) int {
+		res, err := http.Get("http://" + s.metricsLn.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get("/metrics"))
+	assert.Equal(t, http.StatusNotFound, get("/v1/state"))
+}
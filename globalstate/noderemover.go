@@ -0,0 +1,149 @@
+package globalstate
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// DeadNodeRemover removes nodes from the raft whenever they haven't published
+// a lift status within the grace period. Voters that never published any
+// status, such as nodes that died right after joining, are removed once they
+// have gone the grace period without. Only the leader does any removals.
+// Without it dead nodes remain voters, and the cluster will eventually be unable
+// to reach quorum even though a majority of the living nodes agree.
+func (rw *raftwrapper) DeadNodeRemover() {
+	shutdown := rw.done()
+	missing := make(map[string]time.Time) // Voters without any status, and since when
+	for {
+		select {
+		case <-time.After(1 * time.Second):
+		case <-shutdown:
+			return
+		}
+		if rw.getRaft().State() != raft.Leader {
+			missing = make(map[string]time.Time)
+			continue
+		}
+		peers, err := rw.peers()
+		if err != nil {
+			rw.logger.Printf("[ERROR] Unable to read raft peers: %s\n", err.Error())
+			continue
+		}
+
+		state := rw.GetState()
+		for _, id := range getDeadNodes(state, rw.ownID, rw.config.Clock(), rw.config.DeadNodeGracePeriod) {
+			rw.logger.Printf("[WARN] No status from %s in %v. Removing it from the raft.\n", id, rw.config.DeadNodeGracePeriod)
+			if err := rw.RemoveNode(id); err != nil {
+				rw.logger.Printf("[ERROR] Unable to remove dead node %s: %s\n", id, err.Error())
+			}
+		}
+		for _, id := range getMissingVoters(state, peers, rw.ownID, missing, rw.config.Clock(), rw.config.DeadNodeGracePeriod) {
+			rw.logger.Printf("[WARN] No status ever from %s in %v. Removing it from the raft.\n", id, rw.config.DeadNodeGracePeriod)
+			if err := rw.RemoveNode(id); err != nil {
+				rw.logger.Printf("[ERROR] Unable to remove dead node %s: %s\n", id, err.Error())
+			}
+		}
+	}
+}
+
+// getDeadNodes returns the id of all nodes, except the node itself, that have
+// not been updated within the grace period before now.
+func getDeadNodes(s State, ownID string, now time.Time, gracePeriod time.Duration) []string {
+	var dead []string
+	for id, lift := range s.Nodes {
+		if id != ownID && now.Sub(lift.LastUpdate) > gracePeriod {
+			dead = append(dead, id)
+		}
+	}
+	return dead
+}
+
+// getMissingVoters returns the raft peers, except the node itself, that have
+// been missing from the state for longer than the grace period. When each
+// peer was first found missing is kept in since, which is updated.
+func getMissingVoters(s State, peers []string, ownID string, since map[string]time.Time, now time.Time, gracePeriod time.Duration) []string {
+	var dead []string
+	for _, id := range peers {
+		if _, known := s.Nodes[id]; known || id == ownID {
+			delete(since, id)
+			continue
+		}
+		if first, ok := since[id]; !ok {
+			since[id] = now
+		} else if now.Sub(first) > gracePeriod {
+			dead = append(dead, id)
+		}
+	}
+	for id := range since {
+		if !stringInSlice(id, peers) {
+			delete(since, id)
+		}
+	}
+	return dead
+}
+
+// RemovalMonitor asks to be added to the raft again whenever the node finds
+// itself removed from it, such as when the leader took it for dead while it
+// was down or cut off. Raft keeps running on a removed node, which is then
+// left without a leader. Once the node has been without one for a while, it
+// asks the other nodes it knows of. If any of them have a leader known to the
+// node, and the node is no longer among their peers, the node joins the raft
+// through that leader again, and catches up on what it missed from its log.
+func (rw *raftwrapper) RemovalMonitor() {
+	const timeout = 5 * time.Second
+	shutdown := rw.done()
+	leaderSeen := time.Now()
+	for {
+		select {
+		case <-time.After(1 * time.Second):
+		case <-shutdown:
+			return
+		}
+		if rw.getRaft().Leader() != "" {
+			leaderSeen = time.Now()
+			continue
+		}
+		if time.Since(leaderSeen) < timeout {
+			continue
+		}
+
+		for _, comm := range rw.knownComms() {
+			cs, err := getClusterStatus(comm, rw.client)
+			if err != nil || cs.Leader == "" || cs.LeaderComm == "" || stringInSlice(rw.ownID, cs.Peers) {
+				continue
+			}
+			// Leave nodes of other clusters to be merged, as the log of the
+			// node is of no use to them.
+			if _, known := rw.GetState().Nodes[cs.Leader]; !known {
+				continue
+			}
+			rw.logger.Printf("[WARN] Removed from the raft led by %s. Asking to be added again.\n", cs.Leader)
+			if err := joinPeerToRaft(cs.LeaderComm, rw.RaftPort, rw.config.CommAddr, rw.client, rw.logger); err != nil {
+				rw.logger.Printf("[ERROR] Unable to join the raft again: %s\n", err.Error())
+				continue
+			}
+			leaderSeen = time.Now()
+			break
+		}
+	}
+}
+
+// knownComms returns the communication addresses of the other nodes in the
+// replicated state, followed by the initial peer and the seeds.
+func (rw *raftwrapper) knownComms() []string {
+	var comms []string
+	rw.mu.Lock()
+	for id, ls := range rw.state.Nodes {
+		if id != rw.ownID && ls.CommAddr != "" {
+			comms = append(comms, ls.CommAddr)
+		}
+	}
+	rw.mu.Unlock()
+	for _, seed := range append([]string{rw.config.InitalPeer}, rw.config.Seeds...) {
+		if seed != "" && seed != rw.config.CommAddr && !stringInSlice(seed, comms) {
+			comms = append(comms, seed)
+		}
+	}
+	return comms
+}
@@ -0,0 +1,90 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_GetDeadNodes(t *testing.T) {
+	s := NewState(4)
+	s.Nodes["10.0.0.1:8000"] = LiftStatus{ID: "10.0.0.1:8000", LastUpdate: time.Now().Add(-time.Minute)}
+	s.Nodes["10.0.0.2:8000"] = LiftStatus{ID: "10.0.0.2:8000", LastUpdate: time.Now()}
+	s.Nodes["10.0.0.3:8000"] = LiftStatus{ID: "10.0.0.3:8000", LastUpdate: time.Now().Add(-time.Minute)}
+
+	// The node itself should never be considered dead
+	got := getDeadNodes(*s, "10.0.0.3:8000", time.Now(), 30*time.Second)
+	if len(got) != 1 || got[0] != "10.0.0.1:8000" {
+		t.Errorf("getDeadNodes() = %v, want [10.0.0.1:8000]", got)
+	}
+}
+
+func Test_ApplyNodeRemove(t *testing.T) {
+	rw := newRaftWrapper("8000", 4)
+	rw.state.Nodes["10.0.0.1:8000"] = LiftStatus{ID: "10.0.0.1:8000"}
+	rw.state.HallUpButtons["1"] = Status{AssignedTo: "10.0.0.1:8000", LastStatus: BtnStateAssigned}
+	rw.state.HallDownButtons["2"] = Status{AssignedTo: "10.0.0.2:8000", LastStatus: BtnStateAssigned}
+
+	v, _ := json.Marshal(time.Now())
+	if err := rw.applyNodeRemove("10.0.0.1:8000", v); err != nil {
+		t.Fatalf("applyNodeRemove() = %v", err)
+	}
+	if _, ok := rw.state.Nodes["10.0.0.1:8000"]; ok {
+		t.Errorf("removed node still present in state")
+	}
+	if rw.state.HallUpButtons["1"].LastStatus != BtnStateUnassigned {
+		t.Errorf("order assigned to removed node not handed back")
+	}
+	if rw.state.HallDownButtons["2"].LastStatus != BtnStateAssigned {
+		t.Errorf("order assigned to other node was changed")
+	}
+}
+
+func Test_GetMissingVoters(t *testing.T) {
+	s := NewState(4)
+	s.Nodes["10.0.0.1:8000"] = LiftStatus{ID: "10.0.0.1:8000", LastUpdate: time.Now()}
+	peers := []string{"10.0.0.1:8000", "10.0.0.2:8000", "10.0.0.3:8000"}
+	since := make(map[string]time.Time)
+	start := time.Now()
+
+	// Voters are given the grace period from when they are first found missing.
+	if got := getMissingVoters(*s, peers, "10.0.0.3:8000", since, start, 30*time.Second); len(got) != 0 {
+		t.Errorf("getMissingVoters() = %v, want none", got)
+	}
+	got := getMissingVoters(*s, peers, "10.0.0.3:8000", since, start.Add(time.Minute), 30*time.Second)
+	if len(got) != 1 || got[0] != "10.0.0.2:8000" {
+		t.Errorf("getMissingVoters() = %v, want [10.0.0.2:8000]", got)
+	}
+
+	// Voters that publish their status are forgotten.
+	s.Nodes["10.0.0.2:8000"] = LiftStatus{ID: "10.0.0.2:8000", LastUpdate: time.Now()}
+	getMissingVoters(*s, peers, "10.0.0.3:8000", since, start.Add(time.Minute), 30*time.Second)
+	if len(since) != 0 {
+		t.Errorf("voters with a status still considered missing: %v", since)
+	}
+}
+
+func Test_ClusterAddsRemovedNodeAgain(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.shutdown()
+	leader := c.leader()
+	follower := 1
+
+	// Remove the follower while it is down, as if found dead.
+	c.kill(follower)
+	if err := leader.wrapper.RemoveNode(c.nodes[follower].id); err != nil {
+		t.Fatalf("RemoveNode() = %v", err)
+	}
+	c.restart(follower)
+
+	var peers []string
+	if !c.wait(func() bool {
+		peers, _ = c.leader().wrapper.peers()
+		return stringInSlice(c.nodes[follower].id, peers)
+	}) {
+		t.Fatalf("removed node not added to the raft again. Peers: %v", peers)
+	}
+	c.leader()
+	c.pressHallCall(follower, 1, "up")
+	c.assertServedExactlyOnce()
+}
@@ -0,0 +1,458 @@
+package globalstate
+
+// openAPIv1 is the OpenAPI document describing the /v1 API. It is served at
+// /v1/openapi.json, and must be kept in sync with apiv1.go.
+const openAPIv1 = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "TTK4145-Lift communication service",
+    "version": "1.0.0",
+    "description": "Read the replicated state of a lift cluster and manage its membership. Every node in the cluster serves the API. Requests that only the raft leader can serve are redirected to it with 307 Temporary Redirect. If the cluster is configured with a secret, every request must be signed with the headers X-Lift-Timestamp, X-Lift-Nonce and X-Lift-Signature, where the signature is the hex encoded HMAC-SHA256 of method, request URI, timestamp and nonce, each followed by a newline, and then the body."
+  },
+  "paths": {
+    "/v1/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "The OpenAPI document", "content": {"application/json": {}}}
+        }
+      }
+    },
+    "/v1/state": {
+      "get": {
+        "summary": "The full replicated state of the cluster",
+        "responses": {
+          "200": {"description": "Cluster state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/nodes": {
+      "get": {
+        "summary": "All lifts known to the cluster, ordered by id",
+        "responses": {
+          "200": {"description": "Lifts", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Node"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/nodes/{id}": {
+      "get": {
+        "summary": "A single lift",
+        "parameters": [{"$ref": "#/components/parameters/NodeID"}],
+        "responses": {
+          "200": {"description": "Lift", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Node"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/nodes/{id}/mode": {
+      "put": {
+        "summary": "Take a lift out of service, or put it back in",
+        "description": "A drained lift is assigned no hall calls, and those already assigned to it are handed back for assignment to the other lifts. It still serves its cab calls.",
+        "parameters": [{"$ref": "#/components/parameters/NodeID"}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceMode"}}}
+        },
+        "responses": {
+          "200": {"description": "The lift", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Node"}}}},
+          "307": {"$ref": "#/components/responses/Redirect"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/hall-calls": {
+      "get": {
+        "summary": "All outstanding hall calls, ordered by floor",
+        "responses": {
+          "200": {"description": "Hall calls", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HallCall"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/hall-calls/{floor}/{direction}/reassign": {
+      "post": {
+        "summary": "Hand an assigned hall call back for assignment",
+        "description": "Meant for calls stuck with a lift. The call is assigned again to whichever lift is the cheapest, which may be the same one. Refused with 409 Conflict unless the call is assigned.",
+        "parameters": [
+          {"name": "floor", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 0}},
+          {"name": "direction", "in": "path", "required": true, "schema": {"type": "string", "enum": ["up", "down"]}}
+        ],
+        "responses": {
+          "204": {"description": "The call is handed back"},
+          "307": {"$ref": "#/components/responses/Redirect"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/membership": {
+      "get": {
+        "summary": "The members of the raft, as seen by the node serving the request",
+        "responses": {
+          "200": {"description": "Membership", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Membership"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/membership/{id}": {
+      "delete": {
+        "summary": "Remove a node from the raft",
+        "description": "Refused with 409 Conflict if the raft would be left without quorum among the living nodes, or if the node is the leader itself.",
+        "parameters": [{"$ref": "#/components/parameters/NodeID"}],
+        "responses": {
+          "204": {"description": "The node is removed"},
+          "307": {"$ref": "#/components/responses/Redirect"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/leadership/transfer": {
+      "post": {
+        "summary": "Hand the leadership over to another node",
+        "description": "The leader leaves the raft, waits for the others to elect a new leader, and joins again as a follower. Which node becomes leader is up to the election. Refused with 409 Conflict unless at least two other members are alive.",
+        "responses": {
+          "200": {"description": "The new leader", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Leader"}}}},
+          "307": {"$ref": "#/components/responses/Redirect"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/snapshot": {
+      "post": {
+        "summary": "Take a snapshot of the raft on the node serving the request",
+        "description": "Compacts the raft log of the node. Refused with 409 Conflict if nothing is applied since the last snapshot.",
+        "responses": {
+          "200": {"description": "The snapshot", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Snapshot"}}}},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/faults": {
+      "get": {
+        "summary": "Network faults injected into the traffic of the node serving the request",
+        "description": "Refused with 501 Not Implemented unless the node is started with fault injection enabled.",
+        "responses": {
+          "200": {"description": "Faults", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Faults"}}}},
+          "501": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Replace the network faults injected into the traffic of the node serving the request",
+        "description": "Faults only apply to raft RPCs, requests and discovery beacons the node sends, so a partition is only complete once it is set on every node. Nodes in different partitions are cut off from each other, and nodes left out of every partition only reach each other. Put an empty object to clear all faults.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Faults"}}}
+        },
+        "responses": {
+          "200": {"description": "Faults now injected", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Faults"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/calls": {
+      "get": {
+        "summary": "All calls placed through the API, ordered by creation",
+        "description": "Served and cancelled calls are kept for an hour.",
+        "responses": {
+          "200": {"description": "Calls", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Call"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Place a hall or cab call",
+        "description": "Hall calls need a direction, and cab calls the lift to place them on. Only allowed in clusters with a secret or mutual TLS.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewCall"}}}
+        },
+        "responses": {
+          "201": {
+            "description": "The call is placed",
+            "headers": {"Location": {"description": "Path of the call", "schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Call"}}}
+          },
+          "307": {"$ref": "#/components/responses/Redirect"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/events": {
+      "get": {
+        "summary": "Stream of state changes as Server-Sent Events",
+        "description": "The event type is one of reset (State), button (HallCall, status may be done), lift (Node), membership (Member), leader (Leader) and call (Call). The id of every event is <index>.<position>, the raft index it stems from and its position among the events of that index, which is the same on all nodes. Resume with the Last-Event-ID header or the since parameter. A bare index resumes after all events of the index. The stream starts with a reset event unless resuming, or when the events since are forgotten, and always tells the current leader.",
+        "parameters": [
+          {"name": "since", "in": "query", "required": false, "description": "Resume after this event id or raft index. Takes precedence over Last-Event-ID", "schema": {"type": "string"}},
+          {"name": "Last-Event-ID", "in": "header", "required": false, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "Event stream", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/history": {
+      "get": {
+        "summary": "The lifecycle of the most recent hall calls, in the order they were pressed",
+        "description": "The history is part of the replicated state, and is the same on all nodes. Only the most recent 1000 calls are kept.",
+        "parameters": [
+          {"$ref": "#/components/parameters/HistoryFloor"},
+          {"$ref": "#/components/parameters/HistoryDirection"},
+          {"$ref": "#/components/parameters/HistorySince"},
+          {"name": "limit", "in": "query", "required": false, "description": "Only the most recent of the calls", "schema": {"type": "integer", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {"description": "Hall calls", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HallCallRecord"}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/history/stats": {
+      "get": {
+        "summary": "Number of hall calls and percentiles of their waiting times",
+        "parameters": [
+          {"$ref": "#/components/parameters/HistoryFloor"},
+          {"$ref": "#/components/parameters/HistoryDirection"},
+          {"$ref": "#/components/parameters/HistorySince"}
+        ],
+        "responses": {
+          "200": {"description": "Stats", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HistoryStats"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/calls/{id}": {
+      "get": {
+        "summary": "A single call",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "wait", "in": "query", "required": false, "description": "Hold the response back until the status of the call change, or the duration, such as 30s, has passed. At most one minute.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "Call", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Call"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Cancel a call",
+        "description": "The hall button is turned off if no lift is dispatched to it yet. Lifts already on their way are not stopped.",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The cancelled call", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Call"}}}},
+          "307": {"$ref": "#/components/responses/Redirect"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "NodeID": {
+        "name": "id",
+        "in": "path",
+        "required": true,
+        "description": "Raft address of the node, on the form ip:port",
+        "schema": {"type": "string"}
+      },
+      "HistoryFloor": {"name": "floor", "in": "query", "required": false, "description": "Only calls at the floor", "schema": {"type": "integer", "minimum": 0}},
+      "HistoryDirection": {"name": "direction", "in": "query", "required": false, "description": "Only calls in the direction", "schema": {"type": "string", "enum": ["up", "down"]}},
+      "HistorySince": {"name": "since", "in": "query", "required": false, "description": "Only calls pressed at or after the time", "schema": {"type": "string", "format": "date-time"}}
+    },
+    "responses": {
+      "Error": {
+        "description": "Error",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "Redirect": {
+        "description": "The request must be served by the leader",
+        "headers": {
+          "Location": {"description": "The same request at the leader", "schema": {"type": "string"}},
+          "X-Raft-Leader": {"description": "Communication address of the leader", "schema": {"type": "string"}}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {"type": "integer", "description": "HTTP status code"},
+              "message": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Node": {
+        "type": "object",
+        "required": ["id", "commAddr", "lastFloor", "direction", "destinationFloor", "destinationButtonDirection", "lastUpdate", "doorOpen", "cabCalls", "mode"],
+        "properties": {
+          "id": {"type": "string", "description": "Raft address of the node"},
+          "commAddr": {"type": "string", "description": "Address of the communication service of the node"},
+          "lastFloor": {"type": "integer", "minimum": 0},
+          "direction": {"type": "string"},
+          "destinationFloor": {"type": "integer", "minimum": 0},
+          "destinationButtonDirection": {"type": "string"},
+          "lastUpdate": {"type": "string", "format": "date-time"},
+          "doorOpen": {"type": "boolean"},
+          "cabCalls": {"type": "array", "items": {"type": "integer"}, "description": "Floors of the cab calls the lift has yet to serve"},
+          "mode": {"type": "string", "enum": ["normal", "drain"], "description": "Service mode. Drained lifts are assigned no hall calls"}
+        }
+      },
+      "ServiceMode": {
+        "type": "object",
+        "required": ["mode"],
+        "properties": {
+          "mode": {"type": "string", "enum": ["normal", "drain"]}
+        }
+      },
+      "Snapshot": {
+        "type": "object",
+        "required": ["index"],
+        "properties": {
+          "index": {"type": "integer", "description": "Raft index of the last log entry in the snapshot"}
+        }
+      },
+      "Faults": {
+        "type": "object",
+        "properties": {
+          "dropRate": {"type": "number", "minimum": 0, "maximum": 1, "description": "Share of packets and requests dropped"},
+          "latencyMs": {"type": "integer", "minimum": 0, "description": "Latency added to every packet and request"},
+          "jitterMs": {"type": "integer", "minimum": 0, "description": "Random variation of the latency, in either direction"},
+          "partitions": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}, "description": "Raft addresses of the nodes in every partition, by name"}
+        }
+      },
+      "HallCall": {
+        "type": "object",
+        "required": ["floor", "direction", "status", "lastChange", "version"],
+        "properties": {
+          "floor": {"type": "integer", "minimum": 0},
+          "direction": {"type": "string", "enum": ["up", "down"]},
+          "status": {"type": "string", "enum": ["unassigned", "assigned", "done"], "description": "Only button events are ever done"},
+          "assignedTo": {"type": "string", "description": "Raft address of the lift serving the call"},
+          "lastChange": {"type": "string", "format": "date-time"},
+          "version": {"type": "integer", "description": "Incremented on every change of the button"}
+        }
+      },
+      "State": {
+        "type": "object",
+        "required": ["index", "floors", "nodes", "hallCalls"],
+        "properties": {
+          "index": {"type": "integer", "description": "Raft index of the last log entry applied to the state"},
+          "floors": {"type": "integer", "minimum": 0},
+          "nodes": {"type": "array", "items": {"$ref": "#/components/schemas/Node"}},
+          "hallCalls": {"type": "array", "items": {"$ref": "#/components/schemas/HallCall"}}
+        }
+      },
+      "NewCall": {
+        "type": "object",
+        "required": ["type", "floor"],
+        "properties": {
+          "type": {"type": "string", "enum": ["hall", "cab"]},
+          "floor": {"type": "integer", "minimum": 0},
+          "direction": {"type": "string", "enum": ["up", "down"], "description": "Required for hall calls"},
+          "lift": {"type": "string", "description": "Raft address of the lift. Required for cab calls"}
+        }
+      },
+      "Call": {
+        "type": "object",
+        "required": ["id", "type", "floor", "status", "created", "lastChange"],
+        "properties": {
+          "id": {"type": "string"},
+          "type": {"type": "string", "enum": ["hall", "cab"]},
+          "floor": {"type": "integer", "minimum": 0},
+          "direction": {"type": "string", "enum": ["up", "down"]},
+          "lift": {"type": "string", "description": "The lift of a cab call, or the lift dispatched to a hall call"},
+          "status": {"type": "string", "enum": ["pending", "assigned", "served", "cancelled"]},
+          "created": {"type": "string", "format": "date-time"},
+          "lastChange": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Member": {
+        "type": "object",
+        "required": ["id", "joined"],
+        "properties": {
+          "id": {"type": "string", "description": "Raft address of the node"},
+          "joined": {"type": "boolean", "description": "False if the node left"}
+        }
+      },
+      "Leader": {
+        "type": "object",
+        "required": ["leader", "leaderCommAddr"],
+        "properties": {
+          "leader": {"type": "string", "description": "Raft address of the leader, empty if unknown"},
+          "leaderCommAddr": {"type": "string"}
+        }
+      },
+      "HallCallRecord": {
+        "type": "object",
+        "required": ["floor", "direction", "pressed", "assignments", "reassignments"],
+        "properties": {
+          "floor": {"type": "integer", "minimum": 0},
+          "direction": {"type": "string", "enum": ["up", "down"]},
+          "pressed": {"type": "string", "format": "date-time"},
+          "assignments": {"type": "array", "items": {"$ref": "#/components/schemas/Assignment"}, "description": "In order, such that all but the first are reassignments"},
+          "reassignments": {"type": "integer"},
+          "done": {"type": "string", "format": "date-time", "description": "Left out while the call is outstanding"},
+          "servedBy": {"type": "string", "description": "Raft address of the lift that served the call"},
+          "waitingTime": {"type": "number", "description": "Seconds from the button was pressed until the call was served"}
+        }
+      },
+      "Assignment": {
+        "type": "object",
+        "required": ["lift", "at"],
+        "properties": {
+          "lift": {"type": "string", "description": "Raft address of the lift"},
+          "at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "HistoryStats": {
+        "type": "object",
+        "required": ["calls", "served", "outstanding", "reassignments", "waitingTime"],
+        "properties": {
+          "calls": {"type": "integer"},
+          "served": {"type": "integer"},
+          "outstanding": {"type": "integer"},
+          "reassignments": {"type": "integer"},
+          "waitingTime": {"type": "object", "description": "Waiting times of the served calls in seconds, by the keys p50, p90, p95, p99 and max. Empty if no calls are served.", "additionalProperties": {"type": "number"}}
+        }
+      },
+      "Membership": {
+        "type": "object",
+        "required": ["self", "leader", "leaderCommAddr", "peers"],
+        "properties": {
+          "self": {"type": "string", "description": "Raft address of the node serving the request"},
+          "leader": {"type": "string", "description": "Raft address of the leader, empty if unknown"},
+          "leaderCommAddr": {"type": "string", "description": "Communication address of the leader, empty if unknown"},
+          "peers": {"type": "array", "items": {"type": "string"}, "description": "Raft addresses of all members"}
+        }
+      }
+    }
+  }
+}
+`
@@ -1,29 +1,30 @@
 package globalstate
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/hashicorp/raft"
 )
 
+// ConsensusOrderAssigner assigns orders to lifts while the node is the leader.
+// New orders are assigned as soon as they are applied, while orders that have
+// timed out are looked for every scanInterval.
 func (rw *raftwrapper) ConsensusOrderAssigner(updateBtnStatus func(bs ButtonStatusUpdate) error) {
 	// Set intervals. Timeout determined linearly based on number of floors.
-	scanInterval := 500 * time.Millisecond
+	scanInterval := 1 * time.Second
 	orderTimeout := time.Duration(3*rw.config.Floors) * time.Second
 
-	leaderCh := rw.raft.LeaderCh()
-	isLeader := rw.raft.State() == raft.Leader
+	shutdown := rw.done()
+	leaderCh := rw.getRaft().LeaderCh()
+	events := rw.watch(nil)
+	isLeader := rw.getRaft().State() == raft.Leader
+	lastScan := time.Now()
 
 	// Check initial role and invoke corresponding callback
 	if isLeader {
+		rw.registerSelf()
 		rw.config.OnPromotion()
 	} else {
 		rw.config.OnDemotion()
@@ -32,11 +33,16 @@ func (rw *raftwrapper) ConsensusOrderAssigner(updateBtnStatus func(bs ButtonStat
 	for {
 		if !isLeader {
 			// Blocks until assuming leadership
-			isLeader = <-leaderCh
+			select {
+			case isLeader = <-leaderCh:
+			case <-shutdown:
+				return
+			}
+			rw.registerSelf()
 			rw.config.OnPromotion()
 		}
 
-		// Wait for either loosing leadership or a interval
+		// Wait for either loosing leadership, new orders or a interval
 		select {
 		case l := <-leaderCh:
 			isLeader = l
@@ -45,19 +51,30 @@ func (rw *raftwrapper) ConsensusOrderAssigner(updateBtnStatus func(bs ButtonStat
 				rw.config.OnDemotion()
 			}
 
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			// Events keep coming while lifts report more often than the
+			// interval, so they may only be skipped until a scan is due.
+			if !needsAssignment(e) && time.Since(lastScan) < scanInterval {
+				continue
+			}
 		case <-time.After(scanInterval):
-		case <-rw.shutdown:
+		case <-shutdown:
 			return
 		}
 
-		// Retrieve a working copy of the state
+		lastScan = time.Now()
+
+		// Retrieve a working copy of the state, without the lifts out of service
 		rw.mu.Lock()
-		state := rw.state.DeepCopy()
+		state := inService(rw.state.DeepCopy())
 		rw.mu.Unlock()
 
 		// Inspect unassigned or orders that have timed out
 		unassignedBtns := getUnassignedOrders(state)
-		expiredBtns := getTimedOutOrders(state, orderTimeout)
+		expiredBtns := getTimedOutOrders(state, rw.config.Clock(), orderTimeout)
 		var assignees []string
 
 		// Assign to lifts based on cost
@@ -66,10 +83,17 @@ func (rw *raftwrapper) ConsensusOrderAssigner(updateBtnStatus func(bs ButtonStat
 			if lowestCostPeer == "" || stringInSlice(lowestCostPeer, assignees) {
 				continue
 			}
-			updateToAssigned(b, lowestCostPeer, updateBtnStatus)
+			version, err := updateToAssigned(b, state, lowestCostPeer, updateBtnStatus)
+			if err != nil {
+				// Most likely the button changed since the scan.
+				rw.logger.Printf("[WARN] Unable to assign %s %d to %s: %s\n", b.Dir, b.Floor, lowestCostPeer, err.Error())
+				continue
+			}
+			rw.metrics.inc(&rw.metrics.assignments)
+			rw.metrics.inc(&rw.metrics.assignmentTimeouts)
 			assignees = append(assignees, lowestCostPeer)
 			time.Sleep(100 * time.Millisecond)
-			sendCmd(b, lowestCostPeer)
+			rw.sendCmd(b, version, lowestCostPeer)
 
 		}
 		for _, b := range unassignedBtns {
@@ -77,19 +101,43 @@ func (rw *raftwrapper) ConsensusOrderAssigner(updateBtnStatus func(bs ButtonStat
 			if lowestCostPeer == "" || stringInSlice(lowestCostPeer, assignees) {
 				continue
 			}
-			updateToAssigned(b, lowestCostPeer, updateBtnStatus)
+			version, err := updateToAssigned(b, state, lowestCostPeer, updateBtnStatus)
+			if err != nil {
+				// Most likely the button changed since the scan.
+				rw.logger.Printf("[WARN] Unable to assign %s %d to %s: %s\n", b.Dir, b.Floor, lowestCostPeer, err.Error())
+				continue
+			}
+			rw.metrics.inc(&rw.metrics.assignments)
 			assignees = append(assignees, lowestCostPeer)
 			time.Sleep(100 * time.Millisecond)
-			sendCmd(b, lowestCostPeer)
+			rw.sendCmd(b, version, lowestCostPeer)
 		}
 	}
 }
 
+// needsAssignment returns true if the event may leave any orders unassigned.
+func needsAssignment(e Event) bool {
+	switch e.Type {
+	case EventReset, EventMembership:
+		return true
+	case EventButton:
+		return e.Button.LastStatus == BtnStateUnassigned
+	}
+	return false
+}
+
 type btn struct {
 	Floor int
 	Dir   string
 }
 
+// order is a command to serve a button, as sent to the node given it.
+type order struct {
+	Floor   int
+	Dir     string
+	Version uint64
+}
+
 func getUnassignedOrders(s State) []btn {
 	var btns []btn
 	// Scan down buttons
@@ -111,13 +159,13 @@ func getUnassignedOrders(s State) []btn {
 	return btns
 }
 
-func getTimedOutOrders(s State, timeout time.Duration) []btn {
+func getTimedOutOrders(s State, now time.Time, timeout time.Duration) []btn {
 	var btns []btn
 
 	// Scan down buttons
 	for k, v := range s.HallDownButtons {
 		if v.LastStatus == BtnStateAssigned &&
-			time.Since(v.LastChange) > timeout {
+			now.Sub(v.LastChange) > timeout {
 			f, _ := strconv.Atoi(k)
 			btns = append(btns, btn{Floor: f, Dir: "down"})
 		}
@@ -126,7 +174,7 @@ func getTimedOutOrders(s State, timeout time.Duration) []btn {
 	// Scan up buttons
 	for k, v := range s.HallUpButtons {
 		if v.LastStatus == BtnStateAssigned &&
-			time.Since(v.LastChange) > timeout {
+			now.Sub(v.LastChange) > timeout {
 			f, _ := strconv.Atoi(k)
 			btns = append(btns, btn{Floor: f, Dir: "up"})
 		}
@@ -134,39 +182,46 @@ func getTimedOutOrders(s State, timeout time.Duration) []btn {
 	return btns
 }
 
-func sendCmd(b btn, dstNode string) error {
-	// Infer address from id (communication endpoint in port above raft-port)
-	if strings.Contains(dstNode, ":") == false {
-		return fmt.Errorf("bad destination node")
-	}
-	parts := strings.Split(dstNode, ":")
-	raftPort, err := strconv.Atoi(parts[1])
+// sendCmd orders the node to serve the button. The version is the one the
+// hall button got when it was assigned to the node, and 0 for cab calls.
+func (rw *raftwrapper) sendCmd(b btn, version uint64, dstNode string) error {
+	// Look up the communication endpoint of the node
+	addr, err := rw.commAddr(dstNode)
 	if err != nil {
-		return fmt.Errorf("bad destination node: %s", err.Error())
+		return err
 	}
-	addr := fmt.Sprintf("%s:%d", parts[0], raftPort+1)
 
 	// Marshal to json
-	buf := new(bytes.Buffer)
-	json.NewEncoder(buf).Encode(b)
-	res, err := http.Post(fmt.Sprintf("http://%s/cmd", addr), "application/json; charset=utf-8", buf)
+	buf, _ := json.Marshal(order{Floor: b.Floor, Dir: b.Dir, Version: version})
+	res, err := rw.client.post(addr, "/cmd", buf)
 	if err != nil {
 		return err
 	}
-	io.Copy(os.Stdout, res.Body)
-	return nil
+	return checkResponse(res)
 }
 
+// updateToAssigned assigns the button to the node, and returns the version of
+// the button assigned. The update is based on the version of the button in the
+// state scanned, and is rejected if the button have changed since.
 func updateToAssigned(b btn,
+	s State,
 	dstNode string,
-	updateBtnStatus func(bs ButtonStatusUpdate) error) error {
+	updateBtnStatus func(bs ButtonStatusUpdate) error) (uint64, error) {
+	buttons := s.HallUpButtons
+	if b.Dir == "down" {
+		buttons = s.HallDownButtons
+	}
 	bsu := ButtonStatusUpdate{
 		Floor:      uint(b.Floor),
 		Dir:        b.Dir,
 		Status:     BtnStateAssigned,
 		AssignedTo: dstNode,
+		Version:    buttons[strconv.Itoa(b.Floor)].Version,
+	}
+	if err := updateBtnStatus(bsu); err != nil {
+		return 0, err
 	}
-	return updateBtnStatus(bsu)
+	return bsu.Version + 1, nil
 }
 
 func stringInSlice(a string, list []string) bool {
@@ -8,12 +8,14 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/hdhauk/TTK4145-Lift/peerdiscovery"
 )
 
 // raftwrapper is the data structure that hold pretty much everything interesting in
@@ -25,15 +27,31 @@ import (
 //    * raftwrapper.Snapshot()(FSMSnapshot, error)
 //    * raftwrapper.Restore(io.ReadCloser) error
 type raftwrapper struct {
-	RaftDir  string
-	RaftPort string
-	mu       sync.Mutex
-	state    State
-	raft     *raft.Raft
-	logger   *log.Logger
-	ownID    string
-	config   Config
-	shutdown chan interface{}
+	RaftDir   string
+	RaftPort  string
+	ephemeral bool // RaftDir is a temporary folder, and is removed on shutdown
+	mu        sync.Mutex
+	state     State
+	logger    *log.Logger
+	ownID     string
+	config    Config
+	auth      *authenticator
+	client    *commClient
+	events    *eventBus
+	lastEvent eventID     // Id of the last event emitted. Guarded by mu
+	history   callHistory // Hall calls recorded as the log is applied. Guarded by mu
+	applied   time.Time   // Time stamped on the log entry being applied. Guarded by mu
+	metrics   *metrics
+
+	// The raft of the node is replaced whenever it is restarted, and is
+	// accessed through getRaft, peers and done.
+	raftMu    sync.RWMutex
+	running   bool
+	raft      *raft.Raft
+	store     *raftboltdb.BoltStore
+	trans     raft.Transport
+	peerStore raft.PeerStore
+	shutdown  chan interface{}
 }
 
 // newRaftWrapper return a new raft-enabled finite state machine.
@@ -43,12 +61,16 @@ func newRaftWrapper(rPortStr string, floors int) *raftwrapper {
 		Nodes:           make(map[string]LiftStatus),
 		HallUpButtons:   make(map[string]Status),
 		HallDownButtons: make(map[string]Status),
+		Calls:           make(map[string]Call),
 	}
 	return &raftwrapper{
 		RaftPort: rPortStr,
+		config:   Config{Clock: time.Now}, // Replaced by the validated config on Init
 		state:    s,
 		logger:   log.New(os.Stderr, "[globalstate] ", log.Ltime|log.Lshortfile),
 		shutdown: make(chan interface{}),
+		events:   newEventBus(),
+		metrics:  newMetrics(),
 	}
 }
 
@@ -61,18 +83,19 @@ func (rw *raftwrapper) Start(enableSingle bool) error {
 		raftCfg.Logger = log.New(os.Stderr, "[raft] ", log.Ltime|log.Lshortfile)
 	}
 
+	// A node removed from the raft is left as a follower without any peers,
+	// and asks to be added again once it finds out. See RemovalMonitor. A
+	// node added again also finds its own removal in the log as it catches
+	// up, and raft must keep running past it.
+	raftCfg.ShutdownOnRemove = false
+
 	// Set up Raft communication.
-	rSocket := ":" + rw.RaftPort
-	localIP := getOutboundIP()
-	addr, err := net.ResolveTCPAddr("tcp", localIP+rSocket)
+	trans, err := rw.newTransport()
 	if err != nil {
-		rw.logger.Printf("[ERROR] Unable to resolve TCP raft-endpoint: %s\n", err.Error())
 		return err
 	}
-	trans, err := raft.NewTCPTransportWithLogger(rSocket, addr, 3, 5*time.Second, rw.logger)
-	if err != nil {
-		rw.logger.Printf("[ERROR] Unable to set up Raft TCP Transport: %v\n", err.Error())
-		return err
+	if rw.config.Faults != nil {
+		trans = &faultTransport{Transport: trans, faults: rw.config.Faults}
 	}
 
 	// Create peer storage
@@ -90,25 +113,141 @@ func (rw *raftwrapper) Start(enableSingle bool) error {
 	snapshots, err := raft.NewFileSnapshotStoreWithLogger(rw.RaftDir, 2, rw.logger)
 	if err != nil {
 		rw.logger.Printf("[ERROR] Unable to create Snapshot store: %v\n", err.Error())
+		rw.closeTransport(trans)
 		return fmt.Errorf("file snapshot store: %s", err)
 	}
 
-	// Create log store and stable store. These only exist in memory, as our
-	// database is useless for old information anyway.
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
+	// Create log store and stable store. Both are kept on disk in the same
+	// database, so that a restarted node remember its term, vote and log.
+	store, err := raftboltdb.NewBoltStore(filepath.Join(rw.RaftDir, "raft.db"))
+	if err != nil {
+		rw.logger.Printf("[ERROR] Unable to create log store: %v\n", err.Error())
+		rw.closeTransport(trans)
+		return fmt.Errorf("bolt store: %s", err)
+	}
 
 	// Instantiate Raft
-	ra, err := raft.NewRaft(raftCfg, rw, logStore, stableStore, snapshots, peerStore, trans)
+	ra, err := raft.NewRaft(raftCfg, rw, store, store, snapshots, peerStore, trans)
 	if err != nil {
 		rw.logger.Printf("[ERROR] Unable to instansiate raft: %v\n", err.Error())
+		rw.closeTransport(trans)
+		store.Close()
 		return fmt.Errorf("new raft: %s", err)
 	}
-	rw.raft = ra
+
+	rw.raftMu.Lock()
+	rw.raft, rw.store, rw.trans, rw.peerStore = ra, store, trans, peerStore
+	rw.shutdown = make(chan interface{})
+	rw.running = true
+	rw.raftMu.Unlock()
 	rw.logger.Println("[INFO] Successfully initialized Raft")
 	return nil
 }
 
+// newTransport returns the transport given by the config, if any, and
+// otherwise binds a TCP transport to the raft port, over TLS if enabled.
+func (rw *raftwrapper) newTransport() (raft.Transport, error) {
+	if rw.config.Transport != nil {
+		trans, err := rw.config.Transport(rw.ownID)
+		if err != nil {
+			rw.logger.Printf("[ERROR] Unable to set up Raft Transport: %v\n", err.Error())
+		}
+		return trans, err
+	}
+
+	rSocket := ":" + rw.RaftPort
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(rw.config.OwnIP, rw.RaftPort))
+	if err != nil {
+		rw.logger.Printf("[ERROR] Unable to resolve TCP raft-endpoint: %s\n", err.Error())
+		return nil, err
+	}
+	if rw.config.TLS != nil {
+		stream, err := newTLSStreamLayer(rSocket, addr, rw.config.TLS)
+		if err != nil {
+			rw.logger.Printf("[ERROR] Unable to set up Raft TLS Transport: %v\n", err.Error())
+			return nil, err
+		}
+		return raft.NewNetworkTransportWithLogger(stream, 3, 5*time.Second, rw.logger), nil
+	}
+	trans, err := raft.NewTCPTransportWithLogger(rSocket, addr, 3, 5*time.Second, rw.logger)
+	if err != nil {
+		rw.logger.Printf("[ERROR] Unable to set up Raft TCP Transport: %v\n", err.Error())
+		return nil, err
+	}
+	return trans, nil
+}
+
+// Stop stops all workers and shuts down raft, releasing both the raft port and
+// the persistent storage. The raftwrapper may be started again afterwards.
+// Stopping a stopped raftwrapper does nothing.
+func (rw *raftwrapper) Stop() error {
+	rw.raftMu.Lock()
+	if !rw.running {
+		rw.raftMu.Unlock()
+		return nil
+	}
+	rw.running = false
+	rw.stopWorkersLocked()
+	ra, store, trans := rw.raft, rw.store, rw.trans
+	rw.raftMu.Unlock()
+
+	if err := ra.Shutdown().Error(); err != nil {
+		return err
+	}
+	rw.closeTransport(trans)
+	if err := store.Close(); err != nil {
+		rw.logger.Printf("[ERROR] Failed to close raft store: %v\n", err.Error())
+	}
+	return nil
+}
+
+// closeTransport releases the port of the transport, if it has one.
+func (rw *raftwrapper) closeTransport(trans raft.Transport) {
+	if t, ok := trans.(raft.WithClose); ok {
+		if err := t.Close(); err != nil {
+			rw.logger.Printf("[ERROR] Failed to close raft transport: %v\n", err.Error())
+		}
+	}
+}
+
+// stopWorkers stops all workers of the node, unless already stopped. Raft
+// itself is left running.
+func (rw *raftwrapper) stopWorkers() {
+	rw.raftMu.Lock()
+	defer rw.raftMu.Unlock()
+	rw.stopWorkersLocked()
+}
+
+func (rw *raftwrapper) stopWorkersLocked() {
+	select {
+	case <-rw.shutdown:
+	default:
+		close(rw.shutdown)
+	}
+}
+
+// getRaft returns the current raft of the node.
+func (rw *raftwrapper) getRaft() *raft.Raft {
+	rw.raftMu.RLock()
+	defer rw.raftMu.RUnlock()
+	return rw.raft
+}
+
+// peers returns the members of the current raft of the node.
+func (rw *raftwrapper) peers() ([]string, error) {
+	rw.raftMu.RLock()
+	peerStore := rw.peerStore
+	rw.raftMu.RUnlock()
+	return peerStore.Peers()
+}
+
+// done returns a channel closed once the workers of the node are to stop.
+func (rw *raftwrapper) done() <-chan interface{} {
+	rw.raftMu.RLock()
+	defer rw.raftMu.RUnlock()
+	return rw.shutdown
+}
+
 // raft-interface functions
 // =============================================================================
 
@@ -121,6 +260,10 @@ func (rw *raftwrapper) Apply(l *raft.Log) interface{} {
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		rw.logger.Fatalf(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
+	rw.mu.Lock()
+	rw.state.Index = l.Index
+	rw.applied = c.Time
+	rw.mu.Unlock()
 
 	switch c.Type {
 	case "updateFloor":
@@ -131,6 +274,16 @@ func (rw *raftwrapper) Apply(l *raft.Log) interface{} {
 		return rw.applyBtnUpUpdate(c.Key, c.Value)
 	case "btnDownUpdate":
 		return rw.applyBtnDownUpdate(c.Key, c.Value)
+	case "nodeRemove":
+		return rw.applyNodeRemove(c.Key, c.Value)
+	case "callPlace":
+		return rw.applyCallPlace(c.Key, c.Value)
+	case "callCancel":
+		return rw.applyCallCancel(c.Key, c.Value)
+	case "nodeMode":
+		return rw.applyNodeMode(c.Key, c.Value)
+	case "btnRelease":
+		return rw.applyBtnRelease(c.Key, c.Value)
 	default:
 		rw.logger.Printf(fmt.Sprintf("Unrecognized command: %s", c.Type))
 		return nil
@@ -146,49 +299,192 @@ func (rw *raftwrapper) Apply(l *raft.Log) interface{} {
 func (rw *raftwrapper) Snapshot() (raft.FSMSnapshot, error) {
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
-	return &fsmSnapshot{store: rw.state.DeepCopy()}, nil
+	return &fsmSnapshot{store: rw.state.DeepCopy(), history: rw.history.copy()}, nil
 }
 
 // Restore is used to restore an FSM from a snapshot. It is not called
 // concurrently with any other command. The FSM must discard all previous
 // state.
 func (rw *raftwrapper) Restore(rc io.ReadCloser) error {
-	newState := State{}
-	if err := json.NewDecoder(rc).Decode(&newState); err != nil {
+	var snapshot snapshotData
+	if err := json.NewDecoder(rc).Decode(&snapshot); err != nil {
 		rw.logger.Printf("Failed to decode FSM from snapshot: %v\n", err)
 		return err
 	}
-	// No need to lock the mutex as this command isn't run concurrently with any
-	// other command (according to Hashicorp docs)
+	newState := snapshot.State
+	// Restore isn't run concurrently with any other command (according to
+	// Hashicorp docs), but the state may still be read by the API.
+	if newState.Calls == nil {
+		newState.Calls = make(map[string]Call)
+	}
+	rw.mu.Lock()
 	rw.state = newState
+	rw.history = callHistory{records: snapshot.History}
+	rw.emitLocked(Event{Type: EventReset, State: newState.DeepCopy()})
+	rw.mu.Unlock()
 	return nil
 }
 
+// resetState discards the state, such that a log may be replayed onto it from
+// the beginning. Subscribers start over from the blank state.
+func (rw *raftwrapper) resetState() {
+	rw.mu.Lock()
+	rw.state = *NewState(uint(rw.config.Floors))
+	rw.history = callHistory{}
+	rw.emitLocked(Event{Type: EventReset, State: rw.state.DeepCopy()})
+	rw.mu.Unlock()
+}
+
 // Functions for general usage and update of the raft-fsm
 // =============================================================================
 
 // Getstatus returns the current raft-status (leader, candidate or follower)
 func (rw *raftwrapper) GetStatus() uint32 {
-	return uint32(rw.raft.State())
+	return uint32(rw.getRaft().State())
 }
 
 // GetLeader returns the ip:port of the current leader
 func (rw *raftwrapper) GetLeader() string {
-	return rw.raft.Leader()
+	return rw.getRaft().Leader()
 }
 
 // Join joins a node, located at addr, to this store. The node must be ready to
-// respond to Raft communications at that address.
-func (rw *raftwrapper) Join(addr string) error {
-	future := rw.raft.AddPeer(addr)
-	if future.Error() != nil {
+// respond to Raft communications at that address. Nodes that already are
+// members are admitted as they are.
+func (rw *raftwrapper) Join(addr, commAddr string) error {
+	future := rw.getRaft().AddPeer(addr)
+	if future.Error() != nil && future.Error() != raft.ErrKnownPeer {
 		rw.logger.Printf("[WARN] Unable to add peer: %v\n", future.Error())
 		return future.Error()
 	}
 	rw.logger.Printf("[INFO] Successfully joined node %s to the raft.\n", addr)
+	if commAddr == "" {
+		return nil
+	}
+	return rw.registerNode(addr, commAddr)
+}
+
+// registerNode stores the address of the communication service of the node
+// in the replicated state. Anything else known about the node is kept.
+func (rw *raftwrapper) registerNode(id, commAddr string) error {
+	rw.mu.Lock()
+	ls, known := rw.state.Nodes[id]
+	rw.mu.Unlock()
+	if known && ls.CommAddr == commAddr {
+		return nil
+	}
+	ls.ID = id
+	ls.CommAddr = commAddr
+	return rw.UpdateLiftStatus(ls)
+}
+
+// registerSelf makes sure the leader itself is reachable by the other nodes.
+func (rw *raftwrapper) registerSelf() {
+	if err := rw.registerNode(rw.ownID, rw.config.CommAddr); err != nil {
+		rw.logger.Printf("[ERROR] Unable to register own communication address: %s\n", err.Error())
+	}
+}
+
+// commAddr returns the address of the communication service of the node with
+// the provided id, as advertised in the replicated state.
+func (rw *raftwrapper) commAddr(id string) (string, error) {
+	if id == rw.ownID {
+		return rw.config.CommAddr, nil
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if ls, ok := rw.state.Nodes[id]; ok && ls.CommAddr != "" {
+		return ls.CommAddr, nil
+	}
+	return "", fmt.Errorf("no known communication address for %s", id)
+}
+
+// RemoveNode removes the node, located at addr, from the raft and the state.
+// Any hall calls assigned to it are handed back as unassigned.
+func (rw *raftwrapper) RemoveNode(addr string) error {
+	if rw.getRaft().State() != raft.Leader {
+		return fmt.Errorf("not leader")
+	}
+	future := rw.getRaft().RemovePeer(addr)
+	if err := future.Error(); err != nil && err != raft.ErrUnknownPeer {
+		return err
+	}
+
+	v, _ := json.Marshal(rw.config.Clock())
+	if err := rw.applyCommand("nodeRemove", addr, v); err != nil {
+		return err
+	}
+	rw.logger.Printf("[INFO] Successfully removed node %s from the raft.\n", addr)
 	return nil
 }
 
+// Kick removes the node, located at addr, from the raft if it is safe to do so.
+// The leader cannot kick itself, and a node is not kicked if the remaining live
+// nodes would be unable to form a quorum afterwards.
+func (rw *raftwrapper) Kick(addr string) error {
+	if addr == rw.ownID {
+		return fmt.Errorf("leader cannot kick itself")
+	}
+	peers, err := rw.peers()
+	if err != nil {
+		return err
+	}
+	if !stringInSlice(addr, peers) {
+		return fmt.Errorf("%s is not a member of the raft", addr)
+	}
+
+	// Count the nodes that will still be alive after the removal. Nodes that
+	// never have published any status are considered dead.
+	alive := rw.countAlive(peers, addr)
+	if remaining := len(peers) - 1; alive <= remaining/2 {
+		return fmt.Errorf("only %d of %d remaining nodes alive. Kicking %s would leave the raft without quorum", alive, remaining, addr)
+	}
+	return rw.RemoveNode(addr)
+}
+
+// Leave removes the node with the id from the raft at its own request, and may
+// be used by the leader to remove itself. Unlike RemoveNode, the node is
+// removed from the state first, which hands its hall calls back, such that
+// they are handed back even if the removal from the raft fails. Unlike Kick,
+// the removal is never refused for the sake of quorum, as the node is going
+// away regardless.
+func (rw *raftwrapper) Leave(id string) error {
+	if rw.getRaft().State() != raft.Leader {
+		return fmt.Errorf("not leader")
+	}
+	peers, err := rw.peers()
+	if err != nil {
+		return err
+	}
+	if !stringInSlice(id, peers) {
+		return fmt.Errorf("%s is not a member of the raft", id)
+	}
+
+	v, _ := json.Marshal(rw.config.Clock())
+	if err := rw.applyCommand("nodeRemove", id, v); err != nil {
+		return err
+	}
+	future := rw.getRaft().RemovePeer(id)
+	if err := future.Error(); err != nil && err != raft.ErrUnknownPeer {
+		return err
+	}
+	rw.logger.Printf("[INFO] Node %s left the raft.\n", id)
+	return nil
+}
+
+// hasExistingState returns true if the node have been part of a raft before,
+// ie. there are either logs or known peers in the persistent storage.
+func (rw *raftwrapper) hasExistingState() bool {
+	rw.raftMu.RLock()
+	store := rw.store
+	rw.raftMu.RUnlock()
+	if lastIdx, err := store.LastIndex(); err == nil && lastIdx > 0 {
+		return true
+	}
+	peers, err := rw.peers()
+	return err == nil && len(peers) > 0
+}
+
 // GetState returns a copy of the full state as it currently stands.
 func (rw *raftwrapper) GetState() State {
 	rw.mu.Lock()
@@ -198,36 +494,21 @@ func (rw *raftwrapper) GetState() State {
 
 func (rw *raftwrapper) UpdateLiftStatus(ls LiftStatus) error {
 	// Make sure the node currently hold leadership.
-	if rw.raft.State() != raft.Leader {
+	if rw.getRaft().State() != raft.Leader {
 		rw.logger.Printf("[WARN] Unable to update lift status. Not currently leader.\n")
 		return fmt.Errorf("not leader")
 	}
 
-	ls.LastUpdate = time.Now()
+	ls.LastUpdate = rw.config.Clock()
 	v, _ := json.Marshal(ls)
 
-	// Create log entry for raft.
-	cmd := &command{
-		Type:  "nodeUpdate",
-		Key:   ls.ID,
-		Value: v,
-	}
-
-	// Encode to json
-	b, err := json.Marshal(cmd)
-	if err != nil {
-		rw.logger.Printf("[ERROR] Failed to encode json: %s\n", err.Error())
-		return err
-	}
-
 	// Apply command to raft
-	future := rw.raft.Apply(b, 5*time.Second)
-	return future.Error()
+	return rw.applyCommand("nodeUpdate", ls.ID, v)
 }
 
 func (rw *raftwrapper) UpdateButtonStatus(bsu ButtonStatusUpdate) error {
 	// Make sure the node currently hold leadership.
-	if rw.raft.State() != raft.Leader {
+	if rw.getRaft().State() != raft.Leader {
 		rw.logger.Printf("[WARN] Unable to update button status. Not currently leader.\n")
 		return fmt.Errorf("not leader")
 	}
@@ -240,14 +521,15 @@ func (rw *raftwrapper) UpdateButtonStatus(bsu ButtonStatusUpdate) error {
 		t = "btnDownUpdate"
 	} else {
 		rw.logger.Printf("[ERROR] Unable to parse direction in button update: %s\n", bsu.Dir)
-		return fmt.Errorf("unable to parse direction: %s", bsu.Dir)
+		return &InvalidButtonError{Floor: strconv.Itoa(int(bsu.Floor)), Dir: bsu.Dir, Reason: "direction must be up or down"}
 	}
 
-	// Create status
+	// Create status. The version is the one the update is based on.
 	status := Status{
 		AssignedTo: bsu.AssignedTo,
 		LastStatus: bsu.Status,
-		LastChange: time.Now(),
+		LastChange: rw.config.Clock(),
+		Version:    bsu.Version,
 	}
 
 	// Marshal payload to bytes. No need for error check, as it it just recently
@@ -258,24 +540,9 @@ func (rw *raftwrapper) UpdateButtonStatus(bsu ButtonStatusUpdate) error {
 		return err
 	}
 
-	// Create log entry command for raft.
-	cmd := &command{
-		Type:  t,
-		Key:   strconv.Itoa(int(bsu.Floor)),
-		Value: v,
-	}
-
-	// Marshal command to json
-	b, err := json.Marshal(cmd)
-	if err != nil {
-		rw.logger.Printf("[ERROR] Failed to marshal raft log command: %s\n", err.Error())
-		return err
-	}
-
-	// Apply command to raft
-	future := rw.raft.Apply(b, 5*time.Second)
-	return future.Error()
-
+	// Apply command to raft. Updates rejected by the lifecycle of the button
+	// are returned as errors.
+	return rw.applyCommand(t, strconv.Itoa(int(bsu.Floor)), v)
 }
 
 // Internal fsm-function
@@ -291,12 +558,18 @@ type command struct {
 		Types:
 		- "updateFloor": key=<Don't Care>   Value=<floors int>
 		- "nodeUpdate":  key=<ip:raftport>  Value=<struct{ID string, LastFloor, Destination uint}>
-		- "btnUpUpdate": key=<floor>        Value=<struct{AssignedTo, LastStatus string, LastChange time.Time}>
-		- "btnDownUpdate": key=<floor>      Value=<struct{AssignedTo, LastStatus string, LastChange time.Time}>
+		- "btnUpUpdate": key=<floor>        Value=<Status>, Version is the one the update is based on
+		- "btnDownUpdate": key=<floor>      Value=<Status>, Version is the one the update is based on
+		- "nodeRemove":  key=<ip:raftport>  Value=<time.Time>
+		- "callPlace":   key=<call id>      Value=<Call>
+		- "callCancel":  key=<call id>      Value=<time.Time>
+		- "nodeMode":    key=<ip:raftport>  Value=<serviceMode>
+		- "btnRelease":  key=<floor>        Value=<buttonRelease>
 	*/
-	Type  string `json:"type,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value []byte `json:"value,omitempty"`
+	Type  string    `json:"type,omitempty"`
+	Key   string    `json:"key,omitempty"`
+	Value []byte    `json:"value,omitempty"`
+	Time  time.Time `json:"time,omitempty"` // Stamped by the leader when appending the command
 }
 
 func (rw *raftwrapper) applyUpdateFloor(floor interface{}) interface{} {
@@ -316,63 +589,100 @@ func (rw *raftwrapper) applyNodeUpdate(nodeID string, e []byte) interface{} {
 		return fmt.Errorf("unable to unmarshal liftstats")
 	}
 
-	// Update the actual data store entry
+	// Update the actual data store entry. Updates without a communication
+	// address keep the one already known. The service mode is only changed by
+	// SetServiceMode.
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
+	known, joined := rw.state.Nodes[nodeID]
+	if lift.CommAddr == "" {
+		lift.CommAddr = known.CommAddr
+	}
+	lift.Mode = known.Mode
+	countTrips(known, &lift)
+	if !joined {
+		rw.emitLocked(Event{Type: EventMembership, Node: nodeID, Joined: true})
+	}
 	rw.state.Nodes[nodeID] = lift
+	rw.emitLocked(Event{Type: EventLift, Lift: lift})
+	rw.serveCabCalls(lift, lift.LastUpdate)
 	return nil
 }
 
-func (rw *raftwrapper) applyBtnUpUpdate(floor string, b []byte) interface{} {
-	// Unmarshal ButtonStatusUpdate
-	var status Status
-	err := json.Unmarshal(b, &status)
-	if err != nil {
-		rw.logger.Printf("[ERROR] Unable to unmarshal status: %s\n", err.Error())
-		return fmt.Errorf("unable to unmarshal ButtonUpStatusUpdate: %s", err.Error())
+func (rw *raftwrapper) applyNodeRemove(nodeID string, b []byte) interface{} {
+	var removed time.Time
+	if err := json.Unmarshal(b, &removed); err != nil {
+		rw.logger.Printf("[ERROR] Unable to unmarshal removal time: %s\n", err.Error())
+		return fmt.Errorf("unable to unmarshal removal time: %s", err.Error())
 	}
 
-	// Update the actual data store entry
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
-	// Discard any transitions from "done" --> "assigned"
-	if rw.state.HallUpButtons[floor].LastStatus == BtnStateDone && status.LastStatus == BtnStateAssigned {
-		return nil
+	if _, ok := rw.state.Nodes[nodeID]; ok {
+		delete(rw.state.Nodes, nodeID)
+		rw.emitLocked(Event{Type: EventMembership, Node: nodeID, Joined: false})
 	}
-	rw.state.HallUpButtons[floor] = status
+
+	// Hand any orders assigned to the removed node back for reassignment.
+	rw.releaseHallButtonsLocked(nodeID, removed)
+	rw.releaseCalls(nodeID, removed)
 	return nil
 }
 
+func (rw *raftwrapper) applyBtnUpUpdate(floor string, b []byte) interface{} {
+	return rw.applyBtnUpdate(floor, "up", b)
+}
+
 func (rw *raftwrapper) applyBtnDownUpdate(floor string, b []byte) interface{} {
+	return rw.applyBtnUpdate(floor, "down", b)
+}
+
+// applyBtnUpdate applies an update of a hall button, unless it is rejected by
+// the lifecycle of buttons. Rejections are returned as errors.
+func (rw *raftwrapper) applyBtnUpdate(floor, dir string, b []byte) interface{} {
 	// Unmarshal ButtonStatusUpdate
 	var status Status
 	err := json.Unmarshal(b, &status)
 	if err != nil {
 		rw.logger.Printf("[ERROR] Unable to unmarshal status: %s\n", err.Error())
-		return fmt.Errorf("unable to unmarshal ButtonDownStatusUpdate: %s", err.Error())
+		return fmt.Errorf("unable to unmarshal button status update: %s", err.Error())
 	}
 
 	// Update the actual data store entry
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
-
-	// Discard any transitions from "done" --> "assigned"
-	if rw.state.HallDownButtons[floor].LastStatus == BtnStateDone && status.LastStatus == BtnStateAssigned {
-		return nil
+	if err := validateButton(floor, dir, rw.state.Floors); err != nil {
+		return err
+	}
+	change, err := transition(floor, dir, rw.hallButtons(dir)[floor], status)
+	if err != nil {
+		return err
+	}
+	if change {
+		rw.setButtonLocked(floor, dir, status)
 	}
-	rw.state.HallDownButtons[floor] = status
 	return nil
 }
 
+// setButtonLocked stores the status of the hall button as its next version,
+// records it in the history, and brings any calls waiting for it up to date.
+func (rw *raftwrapper) setButtonLocked(floor, dir string, status Status) {
+	previous := rw.hallButtons(dir)[floor]
+	status.Version = previous.Version + 1
+	rw.hallButtons(dir)[floor] = status
+	f, _ := strconv.Atoi(floor)
+	rw.recordButtonLocked(uint(f), dir, previous, status)
+	rw.emitLocked(Event{Type: EventButton, Floor: uint(f), Dir: dir, Button: status})
+	rw.updateHallCalls(floor, dir, status)
+}
+
+// getOutboundIP returns the local IP-address, falling back to the loopback
+// address if unable to find any other.
 func getOutboundIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	ip, err := peerdiscovery.GetLocalIP()
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("[WARN] Unable to resolve local IP. Using loopback: %s\n", err.Error())
+		return "127.0.0.1"
 	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().String()
-	idx := strings.LastIndex(localAddr, ":")
-
-	return localAddr[0:idx]
+	return ip
 }
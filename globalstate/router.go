@@ -0,0 +1,109 @@
+package globalstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests on method and path. Path patterns consist of
+// literal segments and parameters on the form {name}, such as
+// /v1/nodes/{id}, which are passed on to the handler.
+type router struct {
+	routes []route
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+// handle registers the handler for the method and path pattern.
+func (rt *router) handle(method, pattern string, h func(w http.ResponseWriter, r *http.Request, params map[string]string)) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+// handleFunc registers a handler without any use of path parameters.
+func (rt *router) handleFunc(method, pattern string, h http.HandlerFunc) {
+	rt.handle(method, pattern, func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		h(w, r)
+	})
+}
+
+// ServeHTTP calls the handler matching the request. Requests for known paths
+// with another method are answered with 405 Method Not Allowed, and anything
+// else with 404 Not Found.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	var allowed []string
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method == r.Method {
+			route.handler(w, r, params)
+			return
+		}
+		allowed = append(allowed, route.method)
+	}
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+		return
+	}
+	writeError(w, http.StatusNotFound, "no such resource: %s", r.URL.Path)
+}
+
+func (rt route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeError responds with the status code and a JSON error body.
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	var e apiError
+	e.Error.Code = code
+	e.Error.Message = fmt.Sprintf(format, args...)
+	writeJSON(w, code, e)
+}
+
+// writeJSON responds with the status code and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
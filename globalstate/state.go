@@ -1,9 +1,14 @@
 package globalstate
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // State defines the centralized state managed by the raft-cluster
 type State struct {
+	// Index of the last raft log entry applied to the state.
+	Index uint64
 	// Number of floors for all lifts.
 	Floors uint
 	// Nodes is the IP:port of all nodes in the system
@@ -11,6 +16,8 @@ type State struct {
 	// HallUpButtons, true of they are lit. Equivalent with an order there
 	HallUpButtons   map[string]Status
 	HallDownButtons map[string]Status
+	// Calls placed through the API of the communication service, by call id.
+	Calls map[string]Call
 }
 
 // NewState returns a new state
@@ -20,6 +27,7 @@ func NewState(floors uint) *State {
 		Nodes:           make(map[string]LiftStatus),
 		HallUpButtons:   make(map[string]Status),
 		HallDownButtons: make(map[string]Status),
+		Calls:           make(map[string]Call),
 	}
 	return &s
 }
@@ -39,11 +47,17 @@ func (s *State) DeepCopy() State {
 	for k, v := range s.HallDownButtons {
 		hallDown[k] = v.DeepCopy()
 	}
+	calls := make(map[string]Call)
+	for k, v := range s.Calls {
+		calls[k] = v
+	}
 	return State{
+		Index:           s.Index,
 		Floors:          s.Floors,
 		Nodes:           nodes,
 		HallUpButtons:   hallUp,
 		HallDownButtons: hallDown,
+		Calls:           calls,
 	}
 }
 
@@ -56,6 +70,7 @@ type Status struct {
 	AssignedTo string    // on the form "ip:port"
 	LastStatus string    // "UNASSIGNED", "ASSIGNED", "DONE"
 	LastChange time.Time // Automatically set by the sender when publishing a statusupdate.
+	Version    uint64    // Incremented on every change of the button
 }
 
 // DeepCopy safely return a copy of the Status
@@ -64,6 +79,7 @@ func (s *Status) DeepCopy() Status {
 		AssignedTo: s.AssignedTo,
 		LastStatus: s.LastStatus,
 		LastChange: s.LastChange,
+		Version:    s.Version,
 	}
 }
 
@@ -75,6 +91,12 @@ type LiftStatus struct {
 	DestinationFloor           uint
 	DestinationButtonDirection string
 	LastUpdate                 time.Time
+	CommAddr                   string // Address of the communication service of the node
+	DoorOpen                   bool
+	CabCalls                   []uint // Floors of the cab calls the lift has yet to serve
+	Trips                      uint64 // Times the lift have started moving. Counted by the FSM
+	DoorCycles                 uint64 // Times the lift have opened its doors. Counted by the FSM
+	Mode                       string // ServiceModeNormal or ServiceModeDrain. Empty until changed by SetServiceMode
 }
 
 // DeepCopy safely return a copy of the lift.
@@ -86,5 +108,45 @@ func (e *LiftStatus) DeepCopy() LiftStatus {
 		DestinationFloor:           e.DestinationFloor,
 		DestinationButtonDirection: e.DestinationButtonDirection,
 		LastUpdate:                 e.LastUpdate,
+		CommAddr:                   e.CommAddr,
+		DoorOpen:                   e.DoorOpen,
+		CabCalls:                   append([]uint(nil), e.CabCalls...),
+		Trips:                      e.Trips,
+		DoorCycles:                 e.DoorCycles,
+		Mode:                       e.Mode,
+	}
+}
+
+// countTrips carries the trips and door cycles of the lift over to its next
+// status, counting the trip started or the doors opened in between. Nothing is
+// counted until the lift have reported once.
+func countTrips(prev LiftStatus, next *LiftStatus) {
+	next.Trips, next.DoorCycles = prev.Trips, prev.DoorCycles
+	if prev.Direction == "" || next.Direction == "" {
+		return
+	}
+	if strings.EqualFold(prev.Direction, "stop") && !strings.EqualFold(next.Direction, "stop") {
+		next.Trips++
 	}
+	if !prev.DoorOpen && next.DoorOpen {
+		next.DoorCycles++
+	}
+}
+
+// Call is a hall or cab call placed by an external system, such as an access
+// control system or a visitor kiosk, rather than by a physical button.
+type Call struct {
+	ID         string
+	Type       string // CallTypeHall or CallTypeCab
+	Floor      uint
+	Dir        string // "up" or "down" for hall calls
+	Lift       string // The lift of a cab call, or the lift serving a hall call. On the form "ip:port"
+	Status     string // CallPending, CallAssigned, CallServed or CallCancelled
+	Created    time.Time
+	LastChange time.Time
+}
+
+// Open returns true until the call is either served or cancelled.
+func (c Call) Open() bool {
+	return c.Status == CallPending || c.Status == CallAssigned
 }
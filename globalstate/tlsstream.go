@@ -0,0 +1,34 @@
+package globalstate
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsStreamLayer implements raft.StreamLayer, such that all raft traffic is
+// sent over mutual TLS.
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+// newTLSStreamLayer listens for raft connections on bindAddr.
+func newTLSStreamLayer(bindAddr string, advertise net.Addr, config *tls.Config) (*tlsStreamLayer, error) {
+	l, err := tls.Listen("tcp", bindAddr, config)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsStreamLayer{Listener: l, advertise: advertise, config: config}, nil
+}
+
+// Dial connects to the raft at address.
+func (t *tlsStreamLayer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, t.config)
+}
+
+// Addr returns the address other nodes should use to reach this node.
+func (t *tlsStreamLayer) Addr() net.Addr {
+	return t.advertise
+}
@@ -2,27 +2,53 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/dimiro1/banner"
+	"github.com/hdhauk/TTK4145-Lift/clustertls"
 	"github.com/hdhauk/TTK4145-Lift/driver"
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
 	"github.com/hdhauk/TTK4145-Lift/globalstate"
 	"github.com/hdhauk/TTK4145-Lift/peerdiscovery"
 	"github.com/hdhauk/TTK4145-Lift/statetools"
 )
 
+// version is the software version advertised to other peers. Set at build time with:
+//	go build -ldflags "-X main.version=<version>"
+var version = "dev"
+
 // Command line parameters
 var nick string
+var clusterID string
 var simPort string
 var floors int
+var dataDir string
+var bindIface string
+var bindAddr string
+var mcastGroup string
+var mcastTTL int
+var peerList string
+var peerFile string
+var secretFile string
+var dashboardTokenFile string
+var tlsCA, tlsCert, tlsKey string
+var commPort int
+var commAddr string
+var metricsAddr string
+var injectFaults bool
 
-// Pick ports randomly
+// Pick ports randomly. A node with a data directory keeps the port it was
+// first given, see persistRaftPort.
 var raftPort = 1024 + rand.Intn(64510)
 
 // Both the global and local state are thread safe and for convenience thus
@@ -30,6 +56,9 @@ var raftPort = 1024 + rand.Intn(64510)
 var stateGlobal globalstate.FSM
 var stateLocal *statetools.LocalState
 
+// Peers found by peer discovery.
+var discoveredPeers peerdiscovery.PeerTable
+
 // Set up looging. All packages have their own logger with prefix: [package name]
 var mainlogger = log.New(os.Stderr, "[main] ", log.Ltime|log.Lshortfile)
 
@@ -44,26 +73,146 @@ func main() {
 	banner.Init(os.Stdout, true, true, bytes.NewBufferString(bannerTxt))
 	// Parse command line argument flags
 	flag.StringVar(&nick, "nick", strconv.Itoa(os.Getpid()), "Nickname of this peer. Default is the process id (PID)")
+	flag.StringVar(&clusterID, "cluster", "ttk4145", "Cluster id. Only peers with the same cluster id are discovered")
 	flag.StringVar(&simPort, "sim", "", "Listening port of the simulator")
-	flag.IntVar(&raftPort, "raft", raftPort, "Communication port for raft")
+	flag.IntVar(&raftPort, "raft", raftPort, "Communication port for raft. Default is the port stored in the -data directory, if any, otherwise a random one")
 	flag.IntVar(&floors, "floors", 4, "Number of floors on the lift.")
+	flag.StringVar(&dataDir, "data", "", "Directory for persistent raft state. If omitted the state is lost on exit")
+	flag.StringVar(&bindIface, "iface", "", "Network interface to use. Default is the most suitable one available")
+	flag.StringVar(&bindAddr, "ip", "", "Local IP-address to use. Use 127.0.0.1 to run several nodes on one machine")
+	flag.StringVar(&mcastGroup, "mcast", "", "IPv4 or IPv6 multicast group used for peer discovery instead of broadcast")
+	flag.IntVar(&mcastTTL, "mcast-ttl", 1, "TTL (hop limit) of multicast discovery beacons")
+	flag.StringVar(&peerList, "peers", "", "Comma separated communication addresses (ip:port) of peers to join, in addition to discovered ones")
+	flag.StringVar(&peerFile, "peers-file", "", "File listing communication addresses (ip:port) of peers to join, one per line")
+	flag.StringVar(&secretFile, "secret-file", "", "File holding the secret shared by the cluster. If omitted any host may join")
+	flag.StringVar(&dashboardTokenFile, "dashboard-token-file", "", "File holding the token letting browsers read the state through the dashboard when the cluster has a secret")
+	flag.StringVar(&tlsCA, "tls-ca", "", "Certificate of the cluster CA. Enables mutual TLS together with -tls-cert and -tls-key")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate of this node, signed by the cluster CA")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key of this node")
+	flag.IntVar(&commPort, "comm", 0, "Port of the communication service. Default is the raft port + 1 if free, otherwise any free port")
+	flag.StringVar(&commAddr, "comm-addr", "", "Address (ip:port) other peers should use to reach the communication service, if different from the local one")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address (ip:port) of a plain HTTP listener serving /metrics unauthenticated, for Prometheus")
+	flag.BoolVar(&injectFaults, "faults", false, "Enable injection of network faults through the API, for resilience tests")
 	flag.Parse()
-	mainlogger.Printf("[INFO] Raft port: %d, Nickname: %s, Simulator port: %s, Floors: %d\n", raftPort, nick, simPort, floors)
 
-	// Initialize peer discovery. Any discovered are only used for initializing
-	// the global store.
-	peers := make(map[string]peerdiscovery.Peer)
+	// Keep the raft port, and thereby the id of the node, across restarts.
+	if dataDir != "" {
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "raft" })
+		port, err := persistRaftPort(dataDir, raftPort, explicit)
+		if err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to keep the raft port in the data directory: %v", err)
+		}
+		raftPort = port
+	}
+	mainlogger.Printf("[INFO] Raft port: %d, Nickname: %s, Cluster: %s, Simulator port: %s, Floors: %d, Data directory: %q\n", raftPort, nick, clusterID, simPort, floors, dataDir)
+
+	// Collect statically configured peers.
+	seeds, err := parseSeeds(peerList)
+	if err != nil {
+		mainlogger.Fatalf("[ERROR] %v", err)
+	}
+	if peerFile != "" {
+		fileSeeds, err := readSeedFile(peerFile)
+		if err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to read peer file: %v", err)
+		}
+		seeds = append(seeds, fileSeeds...)
+	}
+	staticPeers = seeds
+
+	// Read the cluster secret used to sign all communication.
+	var secret string
+	if secretFile != "" {
+		if secret, err = readSecretFile(secretFile); err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to read secret: %v", err)
+		}
+	}
+
+	// Read the token granting browsers read-only access to the dashboard.
+	var dashboardToken string
+	if dashboardTokenFile != "" {
+		if dashboardToken, err = readSecretFile(dashboardTokenFile); err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to read dashboard token: %v", err)
+		}
+	}
+
+	// Load certificates for mutual TLS.
+	var tlsConfig *tls.Config
+	if tlsCA != "" || tlsCert != "" || tlsKey != "" {
+		if tlsCA == "" || tlsCert == "" || tlsKey == "" {
+			mainlogger.Fatalf("[ERROR] TLS requires all of -tls-ca, -tls-cert and -tls-key")
+		}
+		if tlsConfig, err = clustertls.LoadConfig(tlsCA, tlsCert, tlsKey); err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to load TLS certificates: %v", err)
+		}
+		mainlogger.Println("[INFO] Mutual TLS enabled")
+	}
+
+	// Determine which local IP-address to use. Peers discovered through an IPv6
+	// multicast group are reached over IPv6.
+	if group := net.ParseIP(mcastGroup); group != nil && group.To4() == nil {
+		peerdiscovery.UseIPv6()
+	}
+	if bindIface != "" {
+		if err := peerdiscovery.BindInterface(bindIface); err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to bind to interface %s: %v", bindIface, err)
+		}
+	}
+	if bindAddr != "" {
+		if err := peerdiscovery.BindAddress(bindAddr); err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to bind to address %s: %v", bindAddr, err)
+		}
+	}
+	ip, err := peerdiscovery.GetLocalIP()
+	if err != nil {
+		mainlogger.Fatalf("[ERROR] Unable to resolve local IP-address: %v", err)
+	}
+	mainlogger.Printf("[INFO] Using local IP-address %s\n", ip)
+
+	// Pick the port of the communication service, such that it can be advertised.
+	// Earlier versions always used the raft port + 1, which is kept whenever
+	// free, such that peer lists written for them only need their ports bumped.
+	if commPort == 0 && portFree(raftPort+1) {
+		commPort = raftPort + 1
+	}
+	if commPort == 0 {
+		if commPort, err = freePort(); err != nil {
+			mainlogger.Fatalf("[ERROR] Unable to find a free port for the communication service: %v", err)
+		}
+	}
+
+	// Faults are injected into all traffic of the node, once set through the API.
+	var faults *faultnet.Faults
+	if injectFaults {
+		faults = faultnet.New(net.JoinHostPort(ip, strconv.Itoa(raftPort)))
+		mainlogger.Println("[WARN] Fault injection enabled")
+	}
+
+	// Initialize peer discovery. Discovered peers are used for initializing the
+	// global store, and later for merging with any other clusters that show up.
 	discoveryConfig := peerdiscovery.Config{
 		Nick:              nick,
+		ClusterID:         clusterID,
 		RaftPort:          raftPort,
+		CommPort:          commPort,
+		CommAddr:          commAddr,
 		BroadcastPort:     33324,
-		OnNewPeer:         func(p peerdiscovery.Peer) { peers[p.Nick+":"+p.IP] = p },
+		MulticastGroup:    mcastGroup,
+		MulticastTTL:      mcastTTL,
+		Interface:         bindIface,
+		Version:           version,
+		Secret:            secret,
+		Faults:            faults,
+		Peers:             &discoveredPeers,
+		Leader:            stateGlobal.Leader,
+		OnNewPeer:         onNewPeer,
 		OnLostPeer:        onLostPeer,
 		BroadcastInterval: 15 * time.Millisecond,
-		Timeout:           50 * time.Millisecond,
+		Timeout:           1 * time.Second,
 		Logger:            log.New(os.Stderr, "[peerdiscovery] ", log.Ltime|log.Lshortfile),
 	}
-	go peerdiscovery.Start(discoveryConfig)
+	go peerdiscovery.Start(context.Background(), discoveryConfig)
 	time.Sleep(2 * discoveryConfig.BroadcastInterval) // Allow for detection of any remote peers
 
 	// Initialize driver
@@ -81,17 +230,25 @@ func main() {
 	// Start driver and wait for it to complete initialization.
 	driverInitDone := make(chan error)
 	go driver.Init(driverConfig, driverInitDone)
-	err := <-driverInitDone
+	err = <-driverInitDone
 	if err != nil {
 		mainlogger.Fatalf("[ERROR] Failed to initialize driver: %v", err)
 	}
 	mainlogger.Println("[INFO] Driver successfully initialized")
 
 	// Initialize globalstate
-	ip, _ := peerdiscovery.GetLocalIP()
 	globalstateConfig := globalstate.Config{
 		RaftPort:           raftPort,
+		CommPort:           commPort,
+		CommAddr:           commAddr,
+		MetricsAddr:        metricsAddr,
 		OwnIP:              ip,
+		DataDir:            dataDir,
+		Seeds:              seeds,
+		Secret:             secret,
+		DashboardToken:     dashboardToken,
+		TLS:                tlsConfig,
+		Faults:             faults,
 		Floors:             floors,
 		OnAquiredConsensus: onAquiredConsensus,
 		OnLostConsensus:    onLostConsensus,
@@ -100,37 +257,62 @@ func main() {
 		Logger:             log.New(os.Stderr, "[globalstate] ", log.Ltime|log.Lshortfile),
 		DisableRaftLogging: true,
 	}
-	// Attempt to connect to any known peers.
-	if len(peers) > 0 {
-		for _, anyPeer := range peers {
-			globalstateConfig.InitalPeer = anyPeer.IP + ":" + anyPeer.RaftPort
+	// The node is of no use to the others until it is part of a cluster, so
+	// keep trying until it is. Any peers known are attempted first.
+	for {
+		globalstateConfig.InitalPeer = ""
+		if known := discoveredPeers.Peers(); len(known) > 0 {
+			globalstateConfig.InitalPeer = known[0].CommAddr
 			mainlogger.Printf("[INFO] Other peers known. Attempting to connect to %s\n", globalstateConfig.InitalPeer)
+		}
+		if err = stateGlobal.Init(globalstateConfig); err == nil {
 			break
 		}
-	}
-	stateGlobal = globalstate.FSM{}
-	err = stateGlobal.Init(globalstateConfig)
-	if err != nil {
-		mainlogger.Printf("[ERROR] Failed to initialize globalstore: %s", err.Error())
+		mainlogger.Printf("[ERROR] Failed to initialize globalstore: %s. Retrying in 5 seconds.\n", err.Error())
+		time.Sleep(5 * time.Second)
 	}
 
 	// Set up local state in case network connection is lost.
 	stateLocal = statetools.NewLocalState()
 
 	// Start workers for coordination
-	go syncBtnLEDs()         // Only active when consensus is achieved.
+	go syncBtnLEDs()         // Driven by changes to the global state.
 	go orderQueuer()         // Always active.
 	go noConsensusAssigner() // Only active when consensus is missing.
+	go clusterMerger()       // Always active.
 
-	// Capture Ctrl+C in order to stop the lift if it is moving.
+	// Capture Ctrl+C in order to stop the lift if it is moving, and leave the
+	// cluster before exiting.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		mainlogger.Printf("[WARN] Interrupt detected. Stopping lift, leaving the cluster and exiting.\n")
 		driver.Stop()
-		mainlogger.Fatalf("[WARN] Interrupt detected. Stopping lift and exiting.\n")
+		stateGlobal.Shutdown()
+		os.Exit(0)
 	}()
 
 	// Block forever
 	select {}
 }
+
+// portFree returns whether the TCP port is currently not in use.
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// freePort returns a TCP port that is currently not in use.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,97 @@
+package peerdiscovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// maxBeaconAge is the oldest signed beacon accepted. Signed beacons are only
+// accepted from peers with clocks reasonably in sync with our own.
+const maxBeaconAge = 30 * time.Second
+
+// beaconVersion is bumped whenever the beacon format change in a way older
+// versions cannot understand. Beacons of any other version are ignored.
+const beaconVersion = 1
+
+// beacon is the message broadcasted by every peer.
+type beacon struct {
+	Version   int    `json:"v"`
+	ClusterID string `json:"cluster"`
+	NodeID    string `json:"node"`
+	IP        string `json:"ip"`
+	RaftPort  int    `json:"raft"`
+	CommPort  int    `json:"comm"`
+	CommAddr  string `json:"comm_addr,omitempty"` // Overrides IP and CommPort when set
+	Leader    string `json:"leader,omitempty"`
+	Software  string `json:"sw,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`  // Unix time in nanoseconds. Only set in signed beacons
+	Signature string `json:"sig,omitempty"` // HMAC-SHA256 of the rest of the beacon
+}
+
+func (b *beacon) marshal() []byte {
+	buf, _ := json.Marshal(b)
+	return buf
+}
+
+// sign timestamps the beacon and signs it with the secret.
+func (b *beacon) sign(secret []byte) {
+	b.Timestamp = time.Now().UnixNano()
+	b.Signature = b.mac(secret)
+}
+
+// verify checks that the beacon is signed with the secret and recent.
+func (b *beacon) verify(secret []byte) error {
+	if b.Signature == "" {
+		return fmt.Errorf("beacon not signed")
+	}
+	if !hmac.Equal([]byte(b.Signature), []byte(b.mac(secret))) {
+		return fmt.Errorf("bad beacon signature")
+	}
+	if age := time.Since(time.Unix(0, b.Timestamp)); age > maxBeaconAge || age < -maxBeaconAge {
+		return fmt.Errorf("beacon timestamp off by %v", age)
+	}
+	return nil
+}
+
+// mac returns the HMAC of the beacon with the signature left out.
+func (b beacon) mac(secret []byte) string {
+	b.Signature = ""
+	m := hmac.New(sha256.New, secret)
+	m.Write(b.marshal())
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// parseBeacon decodes and validates a received beacon.
+func parseBeacon(buf []byte) (beacon, error) {
+	var b beacon
+	if err := json.Unmarshal(buf, &b); err != nil {
+		return beacon{}, fmt.Errorf("malformed beacon: %s", err.Error())
+	}
+	if b.Version != beaconVersion {
+		return beacon{}, fmt.Errorf("unsupported beacon version %d", b.Version)
+	}
+	if b.ClusterID == "" || b.NodeID == "" {
+		return beacon{}, fmt.Errorf("beacon without cluster or node id")
+	}
+	if net.ParseIP(b.IP) == nil {
+		return beacon{}, fmt.Errorf("bad ip-address in beacon: %q", b.IP)
+	}
+	if !validPort(b.RaftPort) || !validPort(b.CommPort) {
+		return beacon{}, fmt.Errorf("bad ports in beacon: raft=%d comm=%d", b.RaftPort, b.CommPort)
+	}
+	if b.CommAddr != "" {
+		if _, _, err := net.SplitHostPort(b.CommAddr); err != nil {
+			return beacon{}, fmt.Errorf("bad comm address in beacon: %q", b.CommAddr)
+		}
+	}
+	return b, nil
+}
+
+func validPort(p int) bool {
+	return p > 0 && p < 65536
+}
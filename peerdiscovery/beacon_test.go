@@ -0,0 +1,88 @@
+package peerdiscovery
+
+import "testing"
+
+func TestParseBeacon(t *testing.T) {
+	valid := beacon{
+		Version:   beaconVersion,
+		ClusterID: "lab-group-1",
+		NodeID:    "sim53566",
+		IP:        "10.0.0.1",
+		RaftPort:  8000,
+		CommPort:  8001,
+	}
+	if got, err := parseBeacon(valid.marshal()); err != nil || got != valid {
+		t.Errorf("parseBeacon(%+v) = %+v, %v", valid, got, err)
+	}
+
+	natted := valid
+	natted.CommAddr = "192.168.1.10:18001"
+	if got, err := parseBeacon(natted.marshal()); err != nil || got != natted {
+		t.Errorf("parseBeacon(%+v) = %+v, %v", natted, got, err)
+	}
+
+	badVersion, noCluster, badIP, badPort, badCommAddr := valid, valid, valid, valid, valid
+	badVersion.Version = beaconVersion + 1
+	noCluster.ClusterID = ""
+	badIP.IP = "10.0.0"
+	badPort.CommPort = 70000
+	badCommAddr.CommAddr = "192.168.1.10"
+
+	var tests = [][]byte{
+		[]byte("sim53566@10.0.0.1:8000"),
+		[]byte("{\"v\":1"),
+		badVersion.marshal(),
+		noCluster.marshal(),
+		badIP.marshal(),
+		badPort.marshal(),
+		badCommAddr.marshal(),
+	}
+	for _, test := range tests {
+		if _, err := parseBeacon(test); err == nil {
+			t.Errorf("parseBeacon(%s) accepted invalid beacon", test)
+		}
+	}
+}
+
+func TestSignedBeacon(t *testing.T) {
+	b := beacon{
+		Version:   beaconVersion,
+		ClusterID: "lab-group-1",
+		NodeID:    "sim53566",
+		IP:        "10.0.0.1",
+		RaftPort:  8000,
+		CommPort:  8001,
+	}
+	secret := []byte("correct horse battery staple")
+	b.sign(secret)
+
+	got, err := parseBeacon(b.marshal())
+	if err != nil {
+		t.Fatalf("parseBeacon() = %v", err)
+	}
+	if err := got.verify(secret); err != nil {
+		t.Errorf("verify() rejected a correctly signed beacon: %v", err)
+	}
+	if err := got.verify([]byte("wrong secret")); err == nil {
+		t.Errorf("verify() accepted a beacon signed with another secret")
+	}
+
+	tampered := got
+	tampered.RaftPort = 9000
+	if err := tampered.verify(secret); err == nil {
+		t.Errorf("verify() accepted a tampered beacon")
+	}
+
+	stale := got
+	stale.Timestamp -= int64(2 * maxBeaconAge)
+	stale.Signature = stale.mac(secret)
+	if err := stale.verify(secret); err == nil {
+		t.Errorf("verify() accepted a stale beacon")
+	}
+
+	unsigned := got
+	unsigned.Signature = ""
+	if err := unsigned.verify(secret); err == nil {
+		t.Errorf("verify() accepted an unsigned beacon")
+	}
+}
@@ -1,27 +1,164 @@
 package peerdiscovery
 
 import (
+	"fmt"
 	"net"
-	"strings"
 	"sync"
 )
 
 var mu sync.Mutex
 var localIP string
+var ipv6 bool // Pick IPv6 addresses rather than IPv4 ones. See UseIPv6
 
-// GetLocalIP return the IP-address of the local client. It does this by
-// dialing the Google DNS service, hence it will fail if it is unable to reach
-// the internet.
+// GetLocalIP return the IP-address of the local client. Unless an address or
+// interface is bound with BindAddress or BindInterface, the address is picked
+// from the network interfaces in the following order of preference:
+//	1. Private IPv4 addresses (10.0.0.0/8, 172.16.0.0/12 and 192.168.0.0/16)
+//	2. Any other global unicast IPv4 addresses
+//	3. Link-local IPv4 addresses
+//	4. The loopback address
+// IPv6 addresses are ranked the same way, with unique local addresses
+// (fc00::/7) as the private ones, and are only picked when there are no IPv4
+// addresses, unless UseIPv6 is called. No network connectivity is required.
 func GetLocalIP() (string, error) {
 	mu.Lock()
 	defer mu.Unlock()
 	if localIP == "" {
-		conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: []byte{8, 8, 8, 8}, Port: 53})
+		ifaces, err := net.Interfaces()
 		if err != nil {
 			return "", err
 		}
-		defer conn.Close()
-		localIP = strings.Split(conn.LocalAddr().String(), ":")[0]
+		ip, err := preferredIP(ifaces, ipv6)
+		if err != nil {
+			return "", err
+		}
+		localIP = ip
 	}
 	return localIP, nil
 }
+
+// UseIPv6 makes GetLocalIP and BindInterface prefer IPv6 addresses over IPv4
+// ones, such as when peers are discovered through an IPv6 multicast group, and
+// thereby reach each other over IPv6. Call it before either of them.
+func UseIPv6() {
+	mu.Lock()
+	ipv6 = true
+	mu.Unlock()
+}
+
+// BindAddress fixes the local IP-address to the provided one, which must belong
+// to one of the local network interfaces. Use "127.0.0.1" in order to run
+// several nodes on the same machine without any network.
+func BindAddress(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid ip-address: %q", addr)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			mu.Lock()
+			localIP = ip.String()
+			mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an address of any local interface", addr)
+}
+
+// BindInterface fixes the local IP-address to the most preferred address of
+// the network interface with the provided name, in the same order as
+// GetLocalIP.
+func BindInterface(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	v6 := ipv6
+	mu.Unlock()
+	ip, err := preferredIP([]net.Interface{*iface}, v6)
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", name, err.Error())
+	}
+	mu.Lock()
+	localIP = ip
+	mu.Unlock()
+	return nil
+}
+
+// preferredIP returns the most preferred address among the interfaces that
+// are up. Addresses of the preferred family are picked over any of the other.
+func preferredIP(ifaces []net.Interface, preferIPv6 bool) (string, error) {
+	var addrs []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaceAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				addrs = append(addrs, ipNet.IP)
+			}
+		}
+	}
+	return pickIP(addrs, preferIPv6)
+}
+
+// pickIP returns the most preferred of the addresses.
+func pickIP(addrs []net.IP, preferIPv6 bool) (string, error) {
+	var best net.IP
+	bestRank := 0
+	for _, ip := range addrs {
+		r := rankIP(ip)
+		if r == 0 {
+			continue
+		}
+		// Addresses of the preferred family outrank all of the other
+		if (ip.To4() == nil) == preferIPv6 {
+			r += 10
+		}
+		if r > bestRank {
+			best, bestRank = ip, r
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no usable IP address found")
+	}
+	return best.String(), nil
+}
+
+// rankIP rank IP-addresses after preference. Higher is better.
+func rankIP(ip net.IP) int {
+	switch {
+	case isPrivateIPv4(ip) || isUniqueLocalIPv6(ip):
+		return 4
+	case ip.IsGlobalUnicast():
+		return 3
+	case ip.IsLinkLocalUnicast():
+		return 2
+	case ip.IsLoopback():
+		return 1
+	}
+	return 0
+}
+
+func isUniqueLocalIPv6(ip net.IP) bool {
+	return ip.To4() == nil && len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+func isPrivateIPv4(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	return ip4[0] == 10 ||
+		(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+		(ip4[0] == 192 && ip4[1] == 168)
+}
@@ -0,0 +1,69 @@
+package peerdiscovery
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRankIP(t *testing.T) {
+	var tests = []struct {
+		ip   string
+		want int
+	}{
+		{"10.100.23.11", 4},
+		{"172.20.0.1", 4},
+		{"192.168.0.4", 4},
+		{"172.32.0.1", 3},
+		{"129.241.187.3", 3},
+		{"169.254.10.1", 2},
+		{"127.0.0.1", 1},
+		{"0.0.0.0", 0},
+		{"fd12:3456::1", 4},
+		{"2001:db8::1", 3},
+		{"fe80::1", 2},
+		{"::1", 1},
+		{"ff02::4145", 0},
+	}
+	for _, test := range tests {
+		if got := rankIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("rankIP(%s) = %d, want %d", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestPickIP(t *testing.T) {
+	var tests = []struct {
+		addrs      []string
+		preferIPv6 bool
+		want       string
+	}{
+		{[]string{"127.0.0.1", "fe80::1", "192.168.0.4", "2001:db8::1"}, false, "192.168.0.4"},
+		{[]string{"127.0.0.1", "fe80::1", "192.168.0.4", "2001:db8::1"}, true, "2001:db8::1"},
+		{[]string{"127.0.0.1", "fe80::1", "fd12:3456::1", "2001:db8::1"}, true, "fd12:3456::1"},
+		{[]string{"::1", "fe80::1", "2001:db8::1"}, false, "2001:db8::1"}, // IPv6 only
+		{[]string{"127.0.0.1", "10.100.23.11"}, true, "10.100.23.11"},     // IPv4 only
+		{[]string{"ff02::4145"}, true, ""},
+	}
+	for _, test := range tests {
+		var addrs []net.IP
+		for _, a := range test.addrs {
+			addrs = append(addrs, net.ParseIP(a))
+		}
+		got, err := pickIP(addrs, test.preferIPv6)
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("pickIP(%v, %v) = %s, %v, want %s", test.addrs, test.preferIPv6, got, err, test.want)
+		}
+	}
+}
+
+func TestBindLoopback(t *testing.T) {
+	if err := BindAddress("127.0.0.1"); err != nil {
+		t.Fatalf("BindAddress(127.0.0.1) = %v", err)
+	}
+	if ip, err := GetLocalIP(); err != nil || ip != "127.0.0.1" {
+		t.Errorf("GetLocalIP() = %s, %v after binding to loopback", ip, err)
+	}
+	if err := BindAddress("203.0.113.99"); err == nil {
+		t.Errorf("BindAddress() accepted an address not belonging to any interface")
+	}
+}
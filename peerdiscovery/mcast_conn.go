@@ -0,0 +1,103 @@
+// +build !windows
+
+package peerdiscovery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+/*
+For the same reasons as for the broadcast socket (see bcast_conn.go) the
+multicast socket is created through the `syscall` functions. This allows
+several peers on the same host to bind the same port, while also giving us
+control over the TTL (hop limit for IPv6) and outgoing interface.
+Multicast loopback is left enabled, such that peers on the same host hear
+each other.
+*/
+
+func dialMulticastUDP(group net.IP, port int, iface *net.Interface, ttl int) (net.PacketConn, error) {
+	if group4 := group.To4(); group4 != nil {
+		return dialMulticastUDP4(group4, port, iface, ttl)
+	}
+	return dialMulticastUDP6(group, port, iface, ttl)
+}
+
+func dialMulticastUDP4(group net.IP, port int, iface *net.Interface, ttl int) (net.PacketConn, error) {
+	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group)
+	if iface != nil {
+		ifaceIP, err := interfaceIPv4(iface)
+		if err != nil {
+			syscall.Close(s)
+			return nil, err
+		}
+		copy(mreq.Interface[:], ifaceIP)
+		syscall.SetsockoptInet4Addr(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq.Interface)
+	}
+	if err := syscall.SetsockoptIPMreq(s, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq); err != nil {
+		syscall.Close(s)
+		return nil, fmt.Errorf("unable to join multicast group %s: %s", group, err.Error())
+	}
+	if err := syscall.Bind(s, &syscall.SockaddrInet4{Port: port}); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+	return filePacketConn(s)
+}
+
+func dialMulticastUDP6(group net.IP, port int, iface *net.Interface, ttl int) (net.PacketConn, error) {
+	s, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+	syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, 1)
+
+	mreq := &syscall.IPv6Mreq{}
+	copy(mreq.Multiaddr[:], group.To16())
+	if iface != nil {
+		mreq.Interface = uint32(iface.Index)
+		syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+	}
+	if err := syscall.SetsockoptIPv6Mreq(s, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+		syscall.Close(s)
+		return nil, fmt.Errorf("unable to join multicast group %s: %s", group, err.Error())
+	}
+	if err := syscall.Bind(s, &syscall.SockaddrInet6{Port: port}); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+	return filePacketConn(s)
+}
+
+func filePacketConn(s int) (net.PacketConn, error) {
+	f := os.NewFile(uintptr(s), "")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	return conn, err
+}
+
+func interfaceIPv4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s have no IPv4 address", iface.Name)
+}
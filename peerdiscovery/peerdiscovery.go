@@ -1,120 +1,341 @@
 /*
 Package peerdiscovery provides automatic detection of other peers in the same subnet.
-It does this by utilizing broadcastmessages over UDP. The package is in part based on
-https://github.com/TTK4145/Network-go
+It does this by utilizing broadcastmessages over UDP, or optionally IPv4 or IPv6
+multicast. The package is in part based on https://github.com/TTK4145/Network-go
 */
 package peerdiscovery
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"strings"
+	"os"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/hdhauk/TTK4145-Lift/faultnet"
 )
 
 // Peer holds information of address, ports and when it was detected.
 type Peer struct {
 	IP        string
 	Nick      string
-	JoinPort  string
+	ClusterID string
+	CommPort  string
+	CommAddr  string // Address of the communication service of the peer
 	RaftPort  string
-	firstSeen time.Time
-	lastSeen  time.Time
+	Leader    string // Raft-address of the leader the peer last reported
+	Version   string // Software version of the peer
+	FirstSeen time.Time
+	LastSeen  time.Time
+	stamp     int64 // Timestamp of the last signed beacon
 }
 
 // DeepCopy safely returns a copy of the peer.
 func (p *Peer) DeepCopy() Peer {
 	new := Peer{
-		IP:       p.IP,
-		Nick:     p.Nick,
-		JoinPort: p.JoinPort,
-		RaftPort: p.RaftPort,
+		IP:        p.IP,
+		Nick:      p.Nick,
+		ClusterID: p.ClusterID,
+		CommPort:  p.CommPort,
+		CommAddr:  p.CommAddr,
+		RaftPort:  p.RaftPort,
+		Leader:    p.Leader,
+		Version:   p.Version,
+		FirstSeen: p.FirstSeen,
+		LastSeen:  p.LastSeen,
 	}
 	return new
 }
 
 // Config defines configuration for the package, including callbacks.
 type Config struct {
-	Nick              string
-	RaftPort          int
-	BroadcastPort     int
-	OnNewPeer         func(Peer)
+	// Nick is the id of the node, and must be unique within the cluster.
+	Nick string
+	// ClusterID is broadcasted along with every beacon. Beacons from any other
+	// clusters are ignored, so several clusters may share the same subnet.
+	ClusterID     string
+	RaftPort      int
+	CommPort      int
+	BroadcastPort int
+	// CommAddr is advertised as the address of the communication service when
+	// set, for peers behind NAT or port mapping. Default is the local IP-address
+	// and CommPort.
+	CommAddr string
+	// MulticastGroup switches from broadcast to multicast when set. Both IPv4
+	// (eg. 239.255.41.45) and IPv6 (eg. ff02::4145) groups are supported.
+	MulticastGroup string
+	// MulticastTTL is the TTL (hop limit for IPv6) of multicast beacons.
+	// Default is 1, which keep the beacons within the local subnet.
+	MulticastTTL int
+	// Interface is the name of the network interface used for multicast.
+	// If left blank the operating system decides.
+	Interface string
+	// Version is the software version advertised to other peers.
+	Version string
+	// Secret is shared by all members of the cluster. When set, beacons are
+	// signed with it, and beacons that are unsigned, wrongly signed or replayed
+	// are discarded.
+	Secret string
+	// Faults are injected into the beacons sent, and beacons from peers cut
+	// off by a partition are ignored. If nil no faults are injected.
+	Faults *faultnet.Faults
+	// Peers, if set, is kept up to date with the peers currently known, and
+	// emptied when Start returns. Every call to Start has its own peers.
+	Peers *PeerTable
+	// Leader should return the raft-address of the current leader, or an empty
+	// string if unknown. It is called before every broadcast.
+	Leader func() string
+	// OnNewPeer is called whenever a peer is discovered, including peers that
+	// are rediscovered after being lost.
+	OnNewPeer func(Peer)
+	// OnLostPeer is called whenever nothing is heard from a peer within Timeout.
 	OnLostPeer        func(Peer)
 	BroadcastInterval time.Duration
 	Timeout           time.Duration
 	Logger            *log.Logger
 }
 
-func broadcastHeartBeats(c Config) {
-	conn := dialBroadcastUDP(c.BroadcastPort)
-	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", c.BroadcastPort))
+// PeerTable holds the peers known to a running Start. The zero value is an
+// empty table ready for use.
+type PeerTable struct {
+	mu    sync.Mutex
+	peers map[string]*Peer // Keyed by "nick@ip:raftport"
+}
+
+// Peers returns a snapshot of all currently known peers.
+func (t *PeerTable) Peers() []Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var snapshot []Peer
+	for _, p := range t.peers {
+		snapshot = append(snapshot, p.DeepCopy())
+	}
+	return snapshot
+}
+
+// dialDiscoveryUDP binds a socket for either broadcast or multicast beacons,
+// and returns it along with the address beacons should be sent to.
+func dialDiscoveryUDP(c Config) (net.PacketConn, net.Addr, error) {
+	if c.MulticastGroup == "" {
+		// Nodes bound to the loopback address are only able to reach each other
+		// through the broadcast address of the loopback interface.
+		bcastIP := "255.255.255.255"
+		if ip, _ := GetLocalIP(); net.ParseIP(ip) != nil && net.ParseIP(ip).IsLoopback() {
+			bcastIP = "127.255.255.255"
+		}
+		addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", bcastIP, c.BroadcastPort))
+		if err != nil {
+			return nil, nil, err
+		}
+		return dialBroadcastUDP(c.BroadcastPort), addr, nil
+	}
+
+	group := net.ParseIP(c.MulticastGroup)
+	if group == nil || !group.IsMulticast() {
+		return nil, nil, fmt.Errorf("%q is not a multicast group", c.MulticastGroup)
+	}
+	var iface *net.Interface
+	if c.Interface != "" {
+		var err error
+		if iface, err = net.InterfaceByName(c.Interface); err != nil {
+			return nil, nil, err
+		}
+	}
+	ttl := c.MulticastTTL
+	if ttl == 0 {
+		ttl = 1
+	}
+	conn, err := dialMulticastUDP(group, c.BroadcastPort, iface, ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := &net.UDPAddr{IP: group, Port: c.BroadcastPort}
+	if iface != nil && group.To4() == nil {
+		addr.Zone = iface.Name
+	}
+	return conn, addr, nil
+}
+
+func broadcastHeartBeats(ctx context.Context, c Config) {
+	conn, addr, err := dialDiscoveryUDP(c)
+	if err != nil {
+		c.Logger.Printf("[ERROR] Unable to set up socket for sending beacons: %s\n", err.Error())
+		return
+	}
+	defer conn.Close()
+	if c.Faults != nil {
+		conn = faultnet.PacketConn(conn, c.Faults)
+	}
 
 	// Resolve own IP-address
 	ip, err := GetLocalIP()
 	if err != nil {
-		c.Logger.Printf("[ERROR] Unable to resolve own IP. Check internet connection")
+		c.Logger.Printf("[ERROR] Unable to resolve own IP. Check network interfaces")
 	}
 
-	// Create broadcast message: "nick"@"ip-address":"raft-port"
-	id := fmt.Sprintf("%s@%s:%d", c.Nick, ip, c.RaftPort)
+	b := beacon{
+		Version:   beaconVersion,
+		ClusterID: c.ClusterID,
+		NodeID:    c.Nick,
+		IP:        ip,
+		RaftPort:  c.RaftPort,
+		CommPort:  c.CommPort,
+		CommAddr:  c.CommAddr,
+		Software:  c.Version,
+	}
 
 	for {
 		select {
 		case <-time.After(c.BroadcastInterval):
+		case <-ctx.Done():
+			return
+		}
+		if c.Leader != nil {
+			b.Leader = c.Leader()
 		}
-		conn.WriteTo([]byte(id), addr)
+		if c.Secret != "" {
+			b.sign([]byte(c.Secret))
+		}
+		conn.WriteTo(b.marshal(), addr)
 	}
 }
 
 // Start initiate listening for other peers while also start broadcasting
-// to others. The `id`-field in the callbacks have the form:
-//	"nick"@"ip-address":"raft-port"
-// where the latter part is the IPv4 address of the peer.
-func Start(c Config) {
-	// Set up storage for peers we discover
-	peers := make(map[string]*Peer)
+// to others. Peers are identified by their nick and raft-address, and only
+// peers with the same cluster id are reported. Start blocks until the context
+// is cancelled, and all known peers are forgotten when it returns.
+func Start(ctx context.Context, c Config) {
+	if c.OnNewPeer == nil {
+		c.OnNewPeer = func(Peer) {}
+	}
+	if c.OnLostPeer == nil {
+		c.OnLostPeer = func(Peer) {}
+	}
+	if c.Logger == nil {
+		c.Logger = log.New(os.Stderr, "[peerdiscovery] ", log.Ltime|log.Lshortfile)
+	}
+	table := c.Peers
+	if table == nil {
+		table = &PeerTable{}
+	}
 
 	// Bind the socket
-	conn := dialBroadcastUDP(c.BroadcastPort)
+	conn, _, err := dialDiscoveryUDP(c)
+	if err != nil {
+		c.Logger.Printf("[ERROR] Unable to set up socket for receiving beacons: %s\n", err.Error())
+		return
+	}
+	defer conn.Close()
+	defer func() {
+		table.mu.Lock()
+		table.peers = nil
+		table.mu.Unlock()
+	}()
 
 	// Start broadcasting
-	go broadcastHeartBeats(c)
+	go broadcastHeartBeats(ctx, c)
 
 	// Start listening for others broadcasts
+	ownIP, _ := GetLocalIP()
 	var buf [1024]byte
 	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
 		conn.SetReadDeadline(time.Now().Add(c.BroadcastInterval))
 
 		// Although it is considered BAD go-code to throw away the error as we do
 		// here the ReadFrom function will constantly yield non-nil error value
-		// whenever nothing is read. Therefore we instead check to see if the string
-		// n is empty further down.
+		// whenever nothing is read. Therefore we instead check to see if n is zero.
 		n, _, _ := conn.ReadFrom(buf[0:])
+		expirePeers(c, table)
+		if n == 0 {
+			continue
+		}
 
-		id := string(buf[:n]) // Either "" or on the form: nick"@"ip-address":"raft-port"
+		b, err := parseBeacon(buf[:n])
+		if err != nil {
+			c.Logger.Printf("[WARN] Discarding beacon: %s\n", err.Error())
+			continue
+		}
 
-		// Avoid triggering on own heartbeats.
-		if strings.Contains(id, c.Nick) {
+		// Avoid triggering on own heartbeats and other clusters.
+		if b.ClusterID != c.ClusterID ||
+			(b.NodeID == c.Nick && b.IP == ownIP && b.RaftPort == c.RaftPort) {
+			continue
+		}
+		if c.Secret != "" {
+			if err := b.verify([]byte(c.Secret)); err != nil {
+				c.Logger.Printf("[WARN] Discarding beacon from %s: %s\n", b.IP, err.Error())
+				continue
+			}
+		}
+		if c.Faults != nil && c.Faults.Cut(net.JoinHostPort(b.IP, strconv.Itoa(b.RaftPort))) {
 			continue
 		}
 
 		// Adding new connection
-		if id != "" {
-			if _, idExists := peers[id]; !idExists {
-				// Previusly unknown host
-				parts := strings.Split(id, "@")
-				ipv4parts := strings.Split(parts[1], ":")
-				peers[id] = &Peer{
-					IP:        ipv4parts[0],
-					Nick:      parts[0],
-					RaftPort:  ipv4parts[1],
-					firstSeen: time.Now(),
-					lastSeen:  time.Now(),
-				}
-				c.OnNewPeer(peers[id].DeepCopy())
+		id := fmt.Sprintf("%s@%s:%d", b.NodeID, b.IP, b.RaftPort)
+		table.mu.Lock()
+		if table.peers == nil {
+			table.peers = make(map[string]*Peer)
+		}
+		p, idExists := table.peers[id]
+		if !idExists {
+			// Previusly unknown host
+			commAddr := b.CommAddr
+			if commAddr == "" {
+				commAddr = net.JoinHostPort(b.IP, strconv.Itoa(b.CommPort))
 			}
-			peers[id].lastSeen = time.Now()
+			p = &Peer{
+				IP:        b.IP,
+				Nick:      b.NodeID,
+				ClusterID: b.ClusterID,
+				CommPort:  strconv.Itoa(b.CommPort),
+				CommAddr:  commAddr,
+				RaftPort:  strconv.Itoa(b.RaftPort),
+				Version:   b.Software,
+				FirstSeen: time.Now(),
+			}
+			table.peers[id] = p
+		}
+		if c.Secret != "" {
+			// Replayed beacons would keep dead peers alive.
+			if b.Timestamp <= p.stamp {
+				table.mu.Unlock()
+				continue
+			}
+			p.stamp = b.Timestamp
+		}
+		p.Leader = b.Leader
+		p.LastSeen = time.Now()
+		newPeer := p.DeepCopy()
+		table.mu.Unlock()
+
+		if !idExists {
+			c.OnNewPeer(newPeer)
 		}
 	}
 }
+
+// expirePeers forgets all peers not heard from within the timeout.
+func expirePeers(c Config, table *PeerTable) {
+	var lost []Peer
+	table.mu.Lock()
+	for id, p := range table.peers {
+		if time.Since(p.LastSeen) > c.Timeout {
+			lost = append(lost, p.DeepCopy())
+			delete(table.peers, id)
+		}
+	}
+	table.mu.Unlock()
+
+	for _, p := range lost {
+		c.OnLostPeer(p)
+	}
+}
@@ -0,0 +1,114 @@
+package peerdiscovery
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLostAndRediscoveredPeer(t *testing.T) {
+	newPeer := make(chan Peer, 10)
+	lostPeer := make(chan Peer, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peers := &PeerTable{}
+	go Start(ctx, Config{
+		Nick:              "self",
+		ClusterID:         "test",
+		RaftPort:          9100,
+		CommPort:          9101,
+		BroadcastPort:     33390,
+		Peers:             peers,
+		OnNewPeer:         func(p Peer) { newPeer <- p },
+		OnLostPeer:        func(p Peer) { lostPeer <- p },
+		BroadcastInterval: 10 * time.Millisecond,
+		Timeout:           100 * time.Millisecond,
+		Logger:            log.New(ioutil.Discard, "", 0),
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// Pose as another peer by broadcasting beacons ourself.
+	conn := dialBroadcastUDP(33390)
+	defer conn.Close()
+	addr, _ := net.ResolveUDPAddr("udp4", "255.255.255.255:33390")
+	other := beacon{Version: beaconVersion, ClusterID: "test", NodeID: "other", IP: "10.0.0.2", RaftPort: 8000, CommPort: 8001}
+	foreign := other
+	foreign.ClusterID = "another-lab-group"
+	foreign.NodeID = "foreign"
+
+	for round := 0; round < 2; round++ {
+		conn.WriteTo(foreign.marshal(), addr)
+		conn.WriteTo(other.marshal(), addr)
+		select {
+		case p := <-newPeer:
+			if p.Nick != "other" || p.RaftPort != "8000" || p.CommPort != "8001" {
+				t.Errorf("unexpected peer discovered: %+v", p)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("peer not discovered in round %d", round)
+		}
+		if got := peers.Peers(); len(got) != 1 || got[0].FirstSeen.IsZero() || got[0].LastSeen.IsZero() {
+			t.Errorf("Peers() = %+v, want exactly one peer with first and last seen set", got)
+		}
+
+		select {
+		case <-lostPeer:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("peer not lost in round %d", round)
+		}
+		if got := peers.Peers(); len(got) != 0 {
+			t.Errorf("Peers() = %+v after the peer was lost", got)
+		}
+	}
+}
+
+func TestMulticastDiscovery(t *testing.T) {
+	for _, group := range []string{"239.255.41.45", "ff02::4145"} {
+		found := make(chan Peer, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		config := Config{
+			Nick:              "mcast1",
+			ClusterID:         "test",
+			RaftPort:          9200,
+			CommPort:          9201,
+			BroadcastPort:     33391,
+			MulticastGroup:    group,
+			OnNewPeer:         func(p Peer) { found <- p },
+			BroadcastInterval: 10 * time.Millisecond,
+			Timeout:           100 * time.Millisecond,
+			Logger:            log.New(ioutil.Discard, "", 0),
+		}
+		// Multicast on link-local IPv6 needs a specified interface
+		if ifaces, err := net.Interfaces(); err == nil {
+			for _, iface := range ifaces {
+				if iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagUp != 0 {
+					config.Interface = iface.Name
+					break
+				}
+			}
+		}
+		if config.Interface == "" {
+			cancel()
+			t.Skip("no multicast capable interface available")
+		}
+		go Start(ctx, config)
+		other := config
+		other.Nick = "mcast2"
+		other.RaftPort = 9202
+		go broadcastHeartBeats(ctx, other)
+
+		select {
+		case p := <-found:
+			if p.Nick != "mcast2" {
+				t.Errorf("unexpected peer discovered over %s: %+v", group, p)
+			}
+		case <-time.After(1 * time.Second):
+			t.Errorf("no peer discovered over multicast group %s", group)
+		}
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// raftPortFile is the file in the data directory holding the raft port of the
+// node. The id of the node in the raft is its address, so a node restarted on
+// another port would come back as a stranger, and leave its old self behind
+// as a dead voter.
+const raftPortFile = "raft-port"
+
+// persistRaftPort returns the raft port stored in the data directory, if any,
+// and otherwise stores the provided one there. A port given explicitly must
+// match the stored one, as the raft state in the directory belongs to the node
+// with that port.
+func persistRaftPort(dir string, port int, explicit bool) (int, error) {
+	path := filepath.Join(dir, raftPortFile)
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		stored, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return 0, fmt.Errorf("invalid raft port in %s: %v", path, err)
+		}
+		if explicit && stored != port {
+			return 0, fmt.Errorf("%s belongs to the node with raft port %d, not %d. Remove %s to change the port", dir, stored, port, path)
+		}
+		return stored, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	return port, ioutil.WriteFile(path, []byte(strconv.Itoa(port)+"\n"), 0644)
+}
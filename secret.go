@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+
+	"github.com/hdhauk/TTK4145-Lift/globalstate"
+)
+
+// readSecretFile returns the cluster secret stored in the file at path, and
+// warns if others than the owner may read it. See globalstate.ReadSecretFile.
+func readSecretFile(path string) (string, error) {
+	secret, err := globalstate.ReadSecretFile(path)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+		mainlogger.Printf("[WARN] Secret file %s is readable by other users\n", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// parseSeeds returns the communication addresses (ip:port) in a comma separated list.
+func parseSeeds(list string) ([]string, error) {
+	var seeds []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %s", s, err.Error())
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, nil
+}
+
+// readSeedFile returns the communication addresses in a seed file. The file lists one
+// address (ip:port) per line. Empty lines and lines starting with # are ignored.
+func readSeedFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var seeds []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid peer address %q", path, n, line)
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, scanner.Err()
+}
@@ -1,5 +1,7 @@
 #!/bin/bash
 MAIN=$(xdotool getwindowfocus)
+# Communication ports of the controllers, used for injecting network faults.
+COMMS="9000 9001 9002 9003"
 while :
 do
     clear
@@ -14,8 +16,8 @@ do
   Send elevator 1 upward                                   (2)
   Hold HallUp 1st floor for 2 sec in elevator 1            (3)
   Rebuild and restart controllers                          (4)
-  Emulate packet loss on network adapter                   (5)
-  Remove emulated packet loss                              (6)
+  Emulate packet loss and latency between controllers      (5)
+  Remove emulated packet loss and latency                  (6)
   Spawn 4x terminals for the simulators                    (7)
   Quit                                                     (Q)
 --------------------------------------------------------------
@@ -43,13 +45,13 @@ EOF
 
         read -p "Press any key to continue when simulators are ready... " -n1 -s
 
-        gnome-terminal -e './TTK4145-Lift -sim 53566 -nick sim53566 -raft 8000' --geometry 90x10+680+100 --title="controller53566"
+        gnome-terminal -e './TTK4145-Lift -sim 53566 -nick sim53566 -raft 8000 -comm 9000 -faults' --geometry 90x10+680+100 --title="controller53566"
         sleep 5
-        gnome-terminal -e './TTK4145-Lift -sim 53567 -nick sim53567 -raft 8002' --geometry 90x10+680+320 --title="controller53567"
+        gnome-terminal -e './TTK4145-Lift -sim 53567 -nick sim53567 -raft 8002 -comm 9001 -faults' --geometry 90x10+680+320 --title="controller53567"
         sleep 5
-        gnome-terminal -e './TTK4145-Lift -sim 53568 -nick sim53568 -raft 8004' --geometry 90x10+680+540 --title="controller53568"
+        gnome-terminal -e './TTK4145-Lift -sim 53568 -nick sim53568 -raft 8004 -comm 9002 -faults' --geometry 90x10+680+540 --title="controller53568"
         sleep 5
-        gnome-terminal -e './TTK4145-Lift -sim 53569 -nick sim53569 -raft 8006' --geometry 90x10+680+760 --title="controller53569"
+        gnome-terminal -e './TTK4145-Lift -sim 53569 -nick sim53569 -raft 8006 -comm 9003 -faults' --geometry 90x10+680+760 --title="controller53569"
 
         echo "Select simulators"
         SIM1=$(xdotool search --name sim53566)
@@ -90,10 +92,10 @@ EOF
         echo "Building..."
         go build .
         echo "Build complete!"
-        gnome-terminal -e './TTK4145-Lift -sim 53566 -nick sim53566' --geometry 90x10+680+100 --title="controller53566"
-        gnome-terminal -e './TTK4145-Lift -sim 53567 -nick sim53567' --geometry 90x10+680+320 --title="controller53567"
-        gnome-terminal -e './TTK4145-Lift -sim 53568 -nick sim53568' --geometry 90x10+680+540 --title="controller53568"
-        gnome-terminal -e './TTK4145-Lift -sim 53569 -nick sim53569' --geometry 90x10+680+760 --title="controller53569"
+        gnome-terminal -e './TTK4145-Lift -sim 53566 -nick sim53566 -comm 9000 -faults' --geometry 90x10+680+100 --title="controller53566"
+        gnome-terminal -e './TTK4145-Lift -sim 53567 -nick sim53567 -comm 9001 -faults' --geometry 90x10+680+320 --title="controller53567"
+        gnome-terminal -e './TTK4145-Lift -sim 53568 -nick sim53568 -comm 9002 -faults' --geometry 90x10+680+540 --title="controller53568"
+        gnome-terminal -e './TTK4145-Lift -sim 53569 -nick sim53569 -comm 9003 -faults' --geometry 90x10+680+760 --title="controller53569"
         sleep .2
         CTRL1=$(xdotool search --name controller53566)
         CTRL2=$(xdotool search --name controller53567)
@@ -103,15 +105,39 @@ EOF
         xdotool windowactivate --sync $MAIN
         ;;
     "5")
-        echo "Enter name of network adapter: "
-        read adapter
         echo "Select percentage of packets to drop: "
         read percentage
-        sudo tc qdisc add dev $adapter root netem loss $percentage% && echo "Packet loss set to $percentage %"
+        echo "Select latency in milliseconds: "
+        read latency
+        rate=$(awk "BEGIN { print ${percentage:-0} / 100 }")
+        if ! go build ./cmd/liftctl; then
+            echo "Unable to build liftctl"
+        else
+            failed=""
+            for comm in $COMMS; do
+                ./liftctl -addr 127.0.0.1:$comm faults set -drop $rate -latency ${latency:-0}ms > /dev/null || failed="$failed $comm"
+            done
+            if [ -z "$failed" ]; then
+                echo "Packet loss set to $percentage %, latency to $latency ms"
+            else
+                echo "Unable to set packet loss and latency on the controllers at ports$failed"
+            fi
+        fi
         ;;
     "6")
-        sudo tc qdisc del dev $adapter root netem loss $percentage%
-        echo "Emulated packet loss reset"
+        if ! go build ./cmd/liftctl; then
+            echo "Unable to build liftctl"
+        else
+            failed=""
+            for comm in $COMMS; do
+                ./liftctl -addr 127.0.0.1:$comm faults clear > /dev/null || failed="$failed $comm"
+            done
+            if [ -z "$failed" ]; then
+                echo "Emulated packet loss and latency reset"
+            else
+                echo "Unable to reset packet loss and latency on the controllers at ports$failed"
+            fi
+        fi
         ;;
     "7")
         echo "Launching 4 simulators"